@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	socket := flag.String("socket", "webircgateway.sock", "Control socket location, as set in control_socket")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-socket path] <command> [args]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Commands:")
+		fmt.Fprintln(flag.CommandLine.Output(), "  reload                                     Reload the config file, log files and TLS certificates")
+		fmt.Fprintln(flag.CommandLine.Output(), "  status                                     Show the connected clients by state, upstream and listener")
+		fmt.Fprintln(flag.CommandLine.Output(), "  kick <client id|nick!user@host> [reason]   Disconnect clients")
+		fmt.Fprintln(flag.CommandLine.Output(), "  loglevel [1-3]                             Show or change the log level until the next reload")
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	conn, err := net.DialTimeout("unix", *socket, time.Second*5)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to the gateway: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 30))
+
+	fmt.Fprintln(conn, strings.Join(flag.Args(), " "))
+
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading from the gateway: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if strings.HasPrefix(status, "ERR ") {
+		fmt.Fprintln(os.Stderr, strings.TrimSpace(strings.TrimPrefix(status, "ERR ")))
+		os.Exit(1)
+	}
+
+	io.Copy(os.Stdout, reader)
+}
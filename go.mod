@@ -1,22 +1,46 @@
 module github.com/kiwiirc/webircgateway
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/OneOfOne/xxhash v1.2.4
-	github.com/cespare/xxhash v1.1.0 // indirect
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/go-asn1-ber/asn1-ber v1.3.1
+	github.com/go-ldap/ldap/v3 v3.1.10
 	github.com/gobwas/glob v0.2.3
-	github.com/gopherjs/gopherjs v0.0.0-20181103185306-d547d1d9531e // indirect
-	github.com/gorilla/websocket v1.4.0 // indirect
+	github.com/gorilla/websocket v1.4.2
 	github.com/igm/sockjs-go v0.0.0-20191119074118-cd6986df5bcc
-	github.com/jtolds/gls v4.2.1+incompatible // indirect
 	github.com/orcaman/concurrent-map v0.0.0-20190107190726-7ed82d9cb717
+	github.com/oschwald/maxminddb-golang v1.6.0
+	github.com/quic-go/quic-go v0.43.1
+	github.com/quic-go/webtransport-go v0.8.0
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+	golang.org/x/sys v0.15.0
+	golang.org/x/time v0.5.0
+	google.golang.org/grpc v1.58.3
+	google.golang.org/protobuf v1.31.0
+	gopkg.in/ini.v1 v1.42.0
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/cespare/xxhash v1.1.0 // indirect
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/google/pprof v0.0.0-20230821062121-407c9e7a662f // indirect
+	github.com/gopherjs/gopherjs v0.0.0-20181103185306-d547d1d9531e // indirect
+	github.com/jtolds/gls v4.2.1+incompatible // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/onsi/ginkgo/v2 v2.12.0 // indirect
+	github.com/quic-go/qpack v0.4.0 // indirect
 	github.com/smartystreets/assertions v0.0.0-20190215210624-980c5ac6f3ac // indirect
 	github.com/smartystreets/goconvey v0.0.0-20181108003508-044398e4856c // indirect
-	golang.org/x/crypto v0.0.0-20200208060501-ecb85df21340
-	golang.org/x/net v0.0.0-20190503192946-f4e77d36d62c
-	golang.org/x/text v0.3.1-0.20180807135948-17ff2d5776d2 // indirect
-	golang.org/x/time v0.0.0-20181108054448-85acf8d2951c
-	gopkg.in/ini.v1 v1.42.0
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/exp v0.0.0-20230817173708-d852ddb80c63 // indirect
+	golang.org/x/mod v0.12.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	golang.org/x/tools v0.12.1-0.20230815132531-74c255bcf846 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
 )
 
-go 1.13
+go 1.21
@@ -24,7 +24,13 @@ func init() {
 func main() {
 	printVersion := flag.Bool("version", false, "Print the version")
 	configFile := flag.String("config", "config.conf", "Config file location")
+	configFormat := flag.String("config-format", "", "Config file format (ini, yaml or toml). Detected from the file extension by default")
+	configAuth := flag.String("config-auth", os.Getenv("WEBIRCGATEWAY_CONFIG_AUTH"), "Authorization header sent when the config location is a http(s) URL, eg. \"Bearer <token>\". Defaults to $WEBIRCGATEWAY_CONFIG_AUTH")
 	startSection := flag.String("run", "gateway", "What type of server to run")
+	logLevel := flag.String("loglevel", "", "Override the config log level (1-3)")
+	bind := flag.String("bind", "", "Override the address of the first server (host:port)")
+	upstream := flag.String("upstream", "", "Override the address of the first upstream (host:port)")
+	checkConfig := flag.Bool("check-config", false, "Check the config file for problems and exit, without starting any servers")
 	flag.Parse()
 
 	if *printVersion {
@@ -39,11 +45,50 @@ func main() {
 		os.Exit(1)
 	}
 
-	runGateway(*configFile, *startSection)
+	overrides := map[string]string{}
+	if *logLevel != "" {
+		overrides["LOG_LEVEL"] = *logLevel
+	}
+	if *bind != "" {
+		overrides["BIND"] = *bind
+	}
+	if *upstream != "" {
+		overrides["UPSTREAM"] = *upstream
+	}
+
+	if *checkConfig {
+		os.Exit(runConfigCheck(*configFile, *configFormat, *configAuth, *startSection, overrides))
+	}
+
+	runGateway(*configFile, *configFormat, *configAuth, *startSection, overrides)
+}
+
+// runConfigCheck - Print any problems found in the config, returning the exit code
+func runConfigCheck(configFile string, configFormat string, configAuth string, function string, overrides map[string]string) int {
+	gateway := webircgateway.NewGateway(function)
+	gateway.Config.Overrides = overrides
+	gateway.Config.ConfigFormat = configFormat
+	gateway.Config.ConfigAuth = configAuth
+	gateway.Config.SetConfigFile(configFile)
+
+	problems := gateway.CheckConfig()
+	if len(problems) == 0 {
+		fmt.Printf("Config %s is OK\n", gateway.Config.CurrentConfigFile())
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "Config %s has problems:\n", gateway.Config.CurrentConfigFile())
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "  %s\n", problem)
+	}
+	return 1
 }
 
-func runGateway(configFile string, function string) {
+func runGateway(configFile string, configFormat string, configAuth string, function string, overrides map[string]string) {
 	gateway := webircgateway.NewGateway(function)
+	gateway.Config.Overrides = overrides
+	gateway.Config.ConfigFormat = configFormat
+	gateway.Config.ConfigAuth = configAuth
 
 	log.SetFlags(log.Flags() | log.Lmicroseconds)
 
@@ -73,24 +118,63 @@ func runGateway(configFile string, function string) {
 
 func watchForSignals(gateway *webircgateway.Gateway) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	// Notify() with no signals would relay every signal
+	if len(logReopenSignals) > 0 {
+		signal.Notify(c, logReopenSignals...)
+	}
+	if len(upgradeSignals) > 0 {
+		signal.Notify(c, upgradeSignals...)
+	}
 
 	for {
 		switch sig := <-c; sig {
-		case syscall.SIGINT:
-			fmt.Println("Received SIGINT, shutting down webircgateway")
-			gateway.Close()
+		case syscall.SIGINT, syscall.SIGTERM:
+			if gateway.IsClosing() {
+				fmt.Printf("Received %s again, disconnecting the remaining clients\n", sig)
+			} else {
+				fmt.Printf("Received %s, shutting down webircgateway\n", sig)
+			}
+			// Closing drains clients so keep listening for a second signal to stop waiting
+			go gateway.Close()
 		case syscall.SIGHUP:
 			fmt.Println("Recieved SIGHUP, reloading config file")
-			gateway.Config.Load()
+			if err := gateway.Reload(); err != nil {
+				log.Printf("Config file error: %s", err.Error())
+			}
+		default:
+			if isSignalIn(sig, upgradeSignals) {
+				fmt.Printf("Received %s, upgrading to a new webircgateway process\n", sig)
+				if err := gateway.Upgrade(); err != nil {
+					log.Printf("Upgrade failed: %s", err.Error())
+				}
+			} else {
+				fmt.Printf("Received %s, reopening log files\n", sig)
+				gateway.ReopenLogFiles()
+			}
 		}
 	}
 }
 
+func isSignalIn(sig os.Signal, signals []os.Signal) bool {
+	for _, s := range signals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
 func printLogOutput(gateway *webircgateway.Gateway) {
 	for {
-		line, _ := <-gateway.LogOutput
-		log.Println(line)
+		entry, _ := <-gateway.LogOutput
+		if !gateway.Config.LogStdout {
+			continue
+		} else if gateway.Config.LogFormat == "json" {
+			fmt.Fprintln(log.Writer(), string(entry.JSON()))
+		} else {
+			log.Println(entry.String())
+		}
 	}
 }
 
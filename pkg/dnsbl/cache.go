@@ -0,0 +1,117 @@
+package dnsbl
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Cache remembers lookup results so that reconnecting clients don't query the DNSBLs each time.
+Listed and unlisted results are kept for their own TTLs, and results that had an error are not
+kept at all. A nil Cache remembers nothing
+*/
+type Cache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	// positiveTTL / negativeTTL are how long listed and unlisted results are kept
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	// maxEntries is the number of results kept before the soonest to expire are forgotten. 0 = no
+	// limit
+	maxEntries int
+}
+
+type cacheEntry struct {
+	result  Result
+	expires time.Time
+}
+
+func NewCache() *Cache {
+	return &Cache{
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+/*
+SetOptions changes the TTLs and size of the cache. Results already cached keep the TTL they were
+added with
+*/
+func (c *Cache) SetOptions(positiveTTL time.Duration, negativeTTL time.Duration, maxEntries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.positiveTTL = positiveTTL
+	c.negativeTTL = negativeTTL
+	c.maxEntries = maxEntries
+}
+
+// get fills in r from the cache if its Blacklist and Address have an unexpired result
+func (c *Cache) get(r *Result) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := r.Blacklist + " " + r.Address
+	entry, exists := c.entries[key]
+	if !exists {
+		return false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return false
+	}
+
+	*r = entry.result
+	return true
+}
+
+func (c *Cache) put(r *Result) {
+	if c == nil || r.Error {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ttl := c.negativeTTL
+	if r.Listed {
+		ttl = c.positiveTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	if c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		c.evictLocked()
+	}
+
+	c.entries[r.Blacklist+" "+r.Address] = cacheEntry{
+		result:  *r,
+		expires: time.Now().Add(ttl),
+	}
+}
+
+// evictLocked removes expired results, or the one expiring soonest if none have. c.mu must be held
+func (c *Cache) evictLocked() {
+	now := time.Now()
+	soonestKey := ""
+	var soonest time.Time
+
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		if soonestKey == "" || entry.expires.Before(soonest) {
+			soonestKey = key
+			soonest = entry.expires
+		}
+	}
+
+	if len(c.entries) >= c.maxEntries && soonestKey != "" {
+		delete(c.entries, soonestKey)
+	}
+}
@@ -1,10 +1,13 @@
 package dnsbl
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
 type ResultList struct {
@@ -74,19 +77,30 @@ func expandIPv6(ip net.IP) string {
 		string(dst[28:])
 }
 
-func query(rbl string, host string, r *Result) {
+func query(rbl string, host string, timeout time.Duration, r *Result) {
 	r.Listed = false
 
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	lookup := fmt.Sprintf("%s.%s", host, rbl)
-	res, err := net.LookupHost(lookup)
+	res, err := net.DefaultResolver.LookupHost(ctx, lookup)
 
 	if len(res) > 0 {
 		r.Listed = true
-		txt, _ := net.LookupTXT(lookup)
+		txt, _ := net.DefaultResolver.LookupTXT(ctx, lookup)
 		if len(txt) > 0 {
 			r.Text = txt[0]
 		}
 	}
+	// Not being listed is answered with NXDOMAIN and isn't an error
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		err = nil
+	}
 	if err != nil {
 		r.Error = true
 		r.ErrorType = err
@@ -95,7 +109,25 @@ func query(rbl string, host string, r *Result) {
 	return
 }
 
+/*
+Options for a lookup
+*/
+type Options struct {
+	// Timeout is how long each query may take. 0 = no limit
+	Timeout time.Duration
+	// Cache keeps results for the next lookup of the same address, if set
+	Cache *Cache
+}
+
 func Lookup(dnsblList []string, targetHost string) (r ResultList) {
+	return LookupWithOptions(dnsblList, targetHost, Options{})
+}
+
+/*
+LookupWithOptions queries every DNSBL for each address of targetHost at the same time, answering
+from the cache where it can
+*/
+func LookupWithOptions(dnsblList []string, targetHost string, opts Options) (r ResultList) {
 	ip, err := net.LookupIP(targetHost)
 	if err != nil {
 		return
@@ -106,14 +138,29 @@ func Lookup(dnsblList []string, targetHost string) (r ResultList) {
 			res := Result{}
 			res.Blacklist = dnsbl
 			res.Address = addr.String()
-
-			addr := toDnsBlHostname(addr)
-			query(dnsbl, addr, &res)
 			r.Results = append(r.Results, res)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for i := range r.Results {
+		res := &r.Results[i]
+		if opts.Cache.get(res) {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			query(res.Blacklist, toDnsBlHostname(net.ParseIP(res.Address)), opts.Timeout, res)
+			opts.Cache.put(res)
+		}()
+	}
+	wg.Wait()
 
-			if res.Listed {
-				r.Listed = true
-			}
+	for _, res := range r.Results {
+		if res.Listed {
+			r.Listed = true
 		}
 	}
 
@@ -34,9 +34,15 @@ func (i *Server) RemoveIdent(localPort, remotePort int, iface string) {
 	i.EntriesLock.Unlock()
 }
 
-// Run - Start listening for ident lookups
+// Run - Start listening for ident lookups on port 113 of all addresses
 func (i *Server) Run() error {
-	serv, err := net.Listen("tcp", ":113")
+	return i.Listen("tcp", ":113")
+}
+
+// Listen - Start listening for ident lookups on a specific address. network may be tcp4 or tcp6
+// to only listen on one IP version
+func (i *Server) Listen(network string, address string) error {
+	serv, err := net.Listen(network, address)
 	if err != nil {
 		return err
 	}
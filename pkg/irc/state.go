@@ -50,6 +50,17 @@ func (m *State) RemoveChannel(name string) {
 	m.channelMutex.Unlock()
 }
 
+// ChannelNames - The names of all channels in the state
+func (m *State) ChannelNames() []string {
+	m.channelMutex.Lock()
+	names := make([]string, 0, len(m.Channels))
+	for _, channel := range m.Channels {
+		names = append(names, channel.Name)
+	}
+	m.channelMutex.Unlock()
+	return names
+}
+
 func (m *State) ClearChannels() {
 	m.channelMutex.Lock()
 	for i := range m.Channels {
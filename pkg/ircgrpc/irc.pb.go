@@ -0,0 +1,151 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.31.0
+// 	protoc        (unknown)
+// source: irc.proto
+
+package ircgrpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// IrcLine - A single IRC line without its trailing \r\n
+type IrcLine struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Line string `protobuf:"bytes,1,opt,name=line,proto3" json:"line,omitempty"`
+}
+
+func (x *IrcLine) Reset() {
+	*x = IrcLine{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_irc_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *IrcLine) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IrcLine) ProtoMessage() {}
+
+func (x *IrcLine) ProtoReflect() protoreflect.Message {
+	mi := &file_irc_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IrcLine.ProtoReflect.Descriptor instead.
+func (*IrcLine) Descriptor() ([]byte, []int) {
+	return file_irc_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *IrcLine) GetLine() string {
+	if x != nil {
+		return x.Line
+	}
+	return ""
+}
+
+var File_irc_proto protoreflect.FileDescriptor
+
+var file_irc_proto_rawDesc = []byte{
+	0x0a, 0x09, 0x69, 0x72, 0x63, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0d, 0x77, 0x65, 0x62,
+	0x69, 0x72, 0x63, 0x67, 0x61, 0x74, 0x65, 0x77, 0x61, 0x79, 0x22, 0x1d, 0x0a, 0x07, 0x49, 0x72,
+	0x63, 0x4c, 0x69, 0x6e, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x6c, 0x69, 0x6e, 0x65, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x04, 0x6c, 0x69, 0x6e, 0x65, 0x32, 0x48, 0x0a, 0x07, 0x47, 0x61, 0x74,
+	0x65, 0x77, 0x61, 0x79, 0x12, 0x3d, 0x0a, 0x07, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x12,
+	0x16, 0x2e, 0x77, 0x65, 0x62, 0x69, 0x72, 0x63, 0x67, 0x61, 0x74, 0x65, 0x77, 0x61, 0x79, 0x2e,
+	0x49, 0x72, 0x63, 0x4c, 0x69, 0x6e, 0x65, 0x1a, 0x16, 0x2e, 0x77, 0x65, 0x62, 0x69, 0x72, 0x63,
+	0x67, 0x61, 0x74, 0x65, 0x77, 0x61, 0x79, 0x2e, 0x49, 0x72, 0x63, 0x4c, 0x69, 0x6e, 0x65, 0x28,
+	0x01, 0x30, 0x01, 0x42, 0x2e, 0x5a, 0x2c, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f,
+	0x6d, 0x2f, 0x6b, 0x69, 0x77, 0x69, 0x69, 0x72, 0x63, 0x2f, 0x77, 0x65, 0x62, 0x69, 0x72, 0x63,
+	0x67, 0x61, 0x74, 0x65, 0x77, 0x61, 0x79, 0x2f, 0x70, 0x6b, 0x67, 0x2f, 0x69, 0x72, 0x63, 0x67,
+	0x72, 0x70, 0x63, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_irc_proto_rawDescOnce sync.Once
+	file_irc_proto_rawDescData = file_irc_proto_rawDesc
+)
+
+func file_irc_proto_rawDescGZIP() []byte {
+	file_irc_proto_rawDescOnce.Do(func() {
+		file_irc_proto_rawDescData = protoimpl.X.CompressGZIP(file_irc_proto_rawDescData)
+	})
+	return file_irc_proto_rawDescData
+}
+
+var file_irc_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_irc_proto_goTypes = []interface{}{
+	(*IrcLine)(nil), // 0: webircgateway.IrcLine
+}
+var file_irc_proto_depIdxs = []int32{
+	0, // 0: webircgateway.Gateway.Connect:input_type -> webircgateway.IrcLine
+	0, // 1: webircgateway.Gateway.Connect:output_type -> webircgateway.IrcLine
+	1, // [1:2] is the sub-list for method output_type
+	0, // [0:1] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_irc_proto_init() }
+func file_irc_proto_init() {
+	if File_irc_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_irc_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*IrcLine); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_irc_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_irc_proto_goTypes,
+		DependencyIndexes: file_irc_proto_depIdxs,
+		MessageInfos:      file_irc_proto_msgTypes,
+	}.Build()
+	File_irc_proto = out.File
+	file_irc_proto_rawDesc = nil
+	file_irc_proto_goTypes = nil
+	file_irc_proto_depIdxs = nil
+}
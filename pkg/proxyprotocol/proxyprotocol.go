@@ -0,0 +1,296 @@
+// Package proxyprotocol reads HAProxy PROXY protocol v1 and v2 headers from connections
+// https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var v1Prefix = []byte("PROXY ")
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrInvalidHeader - The connection did not start with a valid PROXY header
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+// Listener - Wraps a net.Listener so that connections from trusted sources must start with a
+// PROXY protocol header. Connections from other sources are passed through untouched.
+type Listener struct {
+	net.Listener
+	// Trusted - Whether a connection from this IP should be sending a PROXY header
+	Trusted func(ip net.IP) bool
+	// Timeout - How long to wait for the PROXY header
+	Timeout time.Duration
+}
+
+// Accept - Accept a connection. The PROXY header is read on the first Read() or RemoteAddr() call
+// so that a slow connection does not block other connections from being accepted.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tcpAddr, isTCP := conn.RemoteAddr().(*net.TCPAddr)
+	if !isTCP || l.Trusted == nil || !l.Trusted(tcpAddr.IP) {
+		return conn, nil
+	}
+
+	return &Conn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: l.Timeout,
+	}, nil
+}
+
+// Conn - A connection that starts with a PROXY header
+type Conn struct {
+	net.Conn
+	reader     *bufio.Reader
+	timeout    time.Duration
+	once       sync.Once
+	headerErr  error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+
+		c.remoteAddr, c.localAddr, c.headerErr = ReadHeader(c.reader)
+
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Time{})
+		}
+
+		// A malformed header means we can't trust anything else on this connection
+		if c.headerErr != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+// HeaderError - Any error that occurred while reading the PROXY header
+func (c *Conn) HeaderError() error {
+	c.readHeader()
+	return c.headerErr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+
+	return c.reader.Read(b)
+}
+
+// RemoteAddr - The source address given in the PROXY header
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+
+	return c.remoteAddr
+}
+
+// LocalAddr - The destination address given in the PROXY header
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.localAddr == nil {
+		return c.Conn.LocalAddr()
+	}
+
+	return c.localAddr
+}
+
+// ReadHeader - Read a v1 or v2 PROXY header. The returned addresses are nil if the header does
+// not carry any (UNKNOWN or LOCAL connections) in which case the real connection addresses apply.
+func ReadHeader(r *bufio.Reader) (src net.Addr, dst net.Addr, err error) {
+	peeked, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	if bytes.Equal(peeked, v1Prefix) {
+		return readV1Header(r)
+	}
+
+	peeked, err = r.Peek(len(v2Signature))
+	if err == nil && bytes.Equal(peeked, v2Signature) {
+		return readV2Header(r)
+	}
+
+	return nil, nil, ErrInvalidHeader
+}
+
+func readV1Header(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// v1 headers are at most 107 bytes including the CRLF
+	line := make([]byte, 0, 107)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, ErrInvalidHeader
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= 107 {
+			return nil, nil, ErrInvalidHeader
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	srcIP := net.ParseIP(parts[2])
+	dstIP := net.ParseIP(parts[3])
+	srcPort, srcPortErr := strconv.ParseUint(parts[4], 10, 16)
+	dstPort, dstPortErr := strconv.ParseUint(parts[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcPortErr != nil || dstPortErr != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	src := &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	dst := &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return src, dst, nil
+}
+
+func readV2Header(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	version := header[12] >> 4
+	command := header[12] & 0x0f
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if version != 2 || command > 1 {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	// LOCAL connections are health checks from the proxy itself
+	if command == 0 {
+		return nil, nil, nil
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, nil, ErrInvalidHeader
+		}
+		src := &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		dst := &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+		return src, dst, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, nil, ErrInvalidHeader
+		}
+		src := &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		dst := &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+		return src, dst, nil
+	}
+
+	// Unsupported families such as UDP or unix sockets carry no usable TCP addresses
+	return nil, nil, nil
+}
+
+// v2 header TLV types, https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt section 2.2
+const (
+	tlvTypeSSL           = 0x20
+	tlvSubtypeSSLVersion = 0x21
+	tlvSubtypeSSLCipher  = 0x23
+	// PP2_CLIENT_SSL - The client connected over TLS
+	sslClientSSL = 0x01
+)
+
+// SSLInfo - Details of the clients TLS connection, sent in the PP2_TYPE_SSL TLV
+type SSLInfo struct {
+	// Version - eg. TLS1.3
+	Version string
+	// Cipher - eg. TLS_AES_128_GCM_SHA256
+	Cipher string
+}
+
+// WriteV2Header - Write a v2 PROXY header for a TCP connection from src to dst. A nil src sends
+// a LOCAL header so that the receiver uses the real connection addresses. ssl adds the
+// PP2_TYPE_SSL TLV for clients that connected over TLS
+func WriteV2Header(w io.Writer, src *net.TCPAddr, dst *net.TCPAddr, ssl *SSLInfo) error {
+	header := bytes.NewBuffer(nil)
+	header.Write(v2Signature)
+
+	payload := bytes.NewBuffer(nil)
+	if src == nil || dst == nil {
+		// Version 2, LOCAL, UNSPEC
+		header.Write([]byte{0x20, 0x00})
+	} else if src.IP.To4() != nil && dst.IP.To4() != nil {
+		// Version 2, PROXY, TCP over IPv4
+		header.Write([]byte{0x21, 0x11})
+		payload.Write(src.IP.To4())
+		payload.Write(dst.IP.To4())
+	} else {
+		// Version 2, PROXY, TCP over IPv6. IPv4 addresses are mapped if the families differ
+		header.Write([]byte{0x21, 0x21})
+		payload.Write(src.IP.To16())
+		payload.Write(dst.IP.To16())
+	}
+
+	if src != nil && dst != nil {
+		binary.Write(payload, binary.BigEndian, uint16(src.Port))
+		binary.Write(payload, binary.BigEndian, uint16(dst.Port))
+	}
+
+	if ssl != nil {
+		// The verify field is non-zero as no client certificate was verified
+		sslValue := bytes.NewBuffer([]byte{sslClientSSL, 0, 0, 0, 1})
+		if ssl.Version != "" {
+			writeTLV(sslValue, tlvSubtypeSSLVersion, []byte(ssl.Version))
+		}
+		if ssl.Cipher != "" {
+			writeTLV(sslValue, tlvSubtypeSSLCipher, []byte(ssl.Cipher))
+		}
+		writeTLV(payload, tlvTypeSSL, sslValue.Bytes())
+	}
+
+	binary.Write(header, binary.BigEndian, uint16(payload.Len()))
+	header.Write(payload.Bytes())
+
+	_, err := w.Write(header.Bytes())
+	return err
+}
+
+func writeTLV(buf *bytes.Buffer, tlvType byte, value []byte) {
+	buf.WriteByte(tlvType)
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.Write(value)
+}
@@ -1,4 +1,5 @@
 // Google re-captcha package tweaked from http://github.com/haisum/recaptcha
+// hCaptcha and Cloudflare Turnstile use the same verification API
 
 package recaptcha
 
@@ -13,44 +14,59 @@ import (
 // R type represents an object of Recaptcha and has public property Secret,
 // which is secret obtained from google recaptcha tool admin interface
 type R struct {
-	URL       string
-	Secret    string
+	URL    string
+	Secret string
+	// RemoteIP - The user's IP address, sent to the provider if set
+	RemoteIP  string
 	lastError []string
 }
 
-// Struct for parsing json in google's response
-type googleResponse struct {
-	Success    bool
-	ErrorCodes []string `json:"error-codes"`
+// Result is the provider's response to verifying a captcha response. Hostname, Action and
+// CData are only sent by some providers
+type Result struct {
+	Success     bool
+	ErrorCodes  []string `json:"error-codes"`
+	ChallengeTS string   `json:"challenge_ts"`
+	Hostname    string   `json:"hostname"`
+	Action      string   `json:"action"`
+	CData       string   `json:"cdata"`
 }
 
 // VerifyResponse is a method similar to `Verify`; but doesn't parse the form for you.  Useful if
 // you're receiving the data as a JSON object from a javascript app or similar.
 func (r *R) VerifyResponse(response string) bool {
-	r.lastError = make([]string, 1)
+	return r.Verify(response).Success
+}
+
+// Verify checks a captcha response with the provider, returning its full result
+func (r *R) Verify(response string) Result {
+	r.lastError = []string{}
 	client := &http.Client{Timeout: 20 * time.Second}
-	resp, err := client.PostForm(r.URL,
-		url.Values{"secret": {r.Secret}, "response": {response}})
+	form := url.Values{"secret": {r.Secret}, "response": {response}}
+	if r.RemoteIP != "" {
+		form.Set("remoteip", r.RemoteIP)
+	}
+	resp, err := client.PostForm(r.URL, form)
 	if err != nil {
 		r.lastError = append(r.lastError, err.Error())
-		return false
+		return Result{}
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		r.lastError = append(r.lastError, err.Error())
-		return false
+		return Result{}
 	}
-	gr := new(googleResponse)
-	err = json.Unmarshal(body, gr)
+	gr := Result{}
+	err = json.Unmarshal(body, &gr)
 	if err != nil {
 		r.lastError = append(r.lastError, err.Error())
-		return false
+		return Result{}
 	}
 	if !gr.Success {
 		r.lastError = append(r.lastError, gr.ErrorCodes...)
 	}
-	return gr.Success
+	return gr
 }
 
 // LastError returns errors occurred in last re-captcha validation attempt
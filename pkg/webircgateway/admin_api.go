@@ -0,0 +1,213 @@
+package webircgateway
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// ClientDetail - The full state of a single client as given by the admin API
+type ClientDetail struct {
+	ClientInfo
+	RealName   string            `json:"realname"`
+	Account    string            `json:"account"`
+	Channels   []string          `json:"channels"`
+	Listener   string            `json:"listener"`
+	OriginHost string            `json:"origin_host"`
+	Tags       map[string]string `json:"tags"`
+	Verified   bool              `json:"verified"`
+	Encoding   string            `json:"encoding"`
+}
+
+func (s *Gateway) clientDetail(c *Client) ClientDetail {
+	// Marshalled after this returns, so not the clients own map
+	tags := make(map[string]string, len(c.Tags))
+	for key, val := range c.Tags {
+		tags[key] = val
+	}
+
+	detail := ClientDetail{
+		ClientInfo: ClientInfo{
+			Id:             c.Id,
+			Nick:           c.IrcState.Nick,
+			Username:       c.IrcState.Username,
+			Upstream:       upstreamAddrKey(*c.UpstreamConfig),
+			State:          c.State,
+			RemoteAddr:     c.RemoteAddr,
+			RemoteHostname: c.RemoteHostname,
+			TLSVersion:     c.TLSVersion,
+			TLSCipher:      c.TLSCipher,
+			Stats:          c.Stats.Snapshot(),
+		},
+		RealName:   c.IrcState.RealName,
+		Account:    c.IrcState.Account,
+		Channels:   c.IrcState.ChannelNames(),
+		Listener:   c.Listener,
+		OriginHost: c.OriginHost,
+		Tags:       tags,
+		Verified:   c.Verified,
+		Encoding:   c.Encoding,
+	}
+
+	sort.Strings(detail.Channels)
+
+	return detail
+}
+
+// Disconnect - Close the client on behalf of the gateway admin, quitting the upstream with reason
+func (c *Client) Disconnect(reason string) {
+	c.Log(2, "Disconnected by admin: %s", reason)
+	c.disconnect(reason, "admin_disconnect")
+}
+
+// disconnect - Close the client, quitting the upstream and sending an ERROR with message
+func (c *Client) disconnect(message string, closeReason string) {
+	// An admin given reason must not be able to add lines of its own
+	message = stripLineBreaks(message)
+
+	// Queued before shutting down so that it is written before the upstream is closed. Dropped by
+	// SendUpstream if there is no upstream connection
+	c.SendUpstream("QUIT :" + message)
+
+	c.SendIrcError(message)
+	c.SendClientSignal("state", "closed", closeReason)
+	c.StartShutdown(closeReason)
+}
+
+// clientsMatchingMask - Clients whose nick!username@host matches a glob mask. The host may be the
+// clients hostname or IP
+func (s *Gateway) clientsMatchingMask(mask string) ([]ClientInfo, error) {
+	match, err := glob.Compile(strings.ToLower(mask))
+	if err != nil {
+		return nil, err
+	}
+
+	clients := []ClientInfo{}
+	for _, info := range s.SnapshotClients() {
+		prefix := strings.ToLower(info.Nick + "!" + info.Username + "@")
+		if match.Match(prefix+strings.ToLower(info.RemoteHostname)) || match.Match(prefix+info.RemoteAddr) {
+			clients = append(clients, info)
+		}
+	}
+
+	return clients, nil
+}
+
+// isAdminRequest - If the request has the admin token set in [admin]. Responds with an error if
+// not, or as if the route did not exist if the admin API is disabled
+func (s *Gateway) isAdminRequest(w http.ResponseWriter, r *http.Request) bool {
+	token := s.Config.AdminToken
+	if token == "" {
+		s.serveNotFound(w, r)
+		return false
+	}
+
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAdminJSON(w, 401, map[string]interface{}{"error": "unauthorized"})
+		return false
+	}
+
+	return true
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, body interface{}) {
+	out, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// initAdminRoutes - An API for admin tooling to list, inspect and disconnect clients. Requests
+// must give the token set in [admin] as a bearer token:
+//
+//	GET  /webirc/admin/clients[?mask=nick!user@host]
+//	GET  /webirc/admin/clients/<id>
+//	POST /webirc/admin/disconnect with id=<id> or mask=<mask>, and optionally reason=<reason>
+func (s *Gateway) initAdminRoutes() {
+	s.HttpRouter.HandleFunc("/webirc/admin/clients", func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAdminRequest(w, r) {
+			return
+		}
+
+		mask := r.URL.Query().Get("mask")
+		if mask == "" {
+			writeAdminJSON(w, 200, s.SnapshotClients())
+			return
+		}
+
+		clients, err := s.clientsMatchingMask(mask)
+		if err != nil {
+			writeAdminJSON(w, 400, map[string]interface{}{"error": "invalid_mask"})
+			return
+		}
+
+		writeAdminJSON(w, 200, clients)
+	})
+
+	s.HttpRouter.HandleFunc("/webirc/admin/clients/", func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAdminRequest(w, r) {
+			return
+		}
+
+		id, _ := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/webirc/admin/clients/"), 10, 64)
+		c, ok := s.Clients.Get(id)
+		if !ok {
+			writeAdminJSON(w, 404, map[string]interface{}{"error": "no_such_client"})
+			return
+		}
+
+		writeAdminJSON(w, 200, s.clientDetail(c))
+	})
+
+	s.HttpRouter.HandleFunc("/webirc/admin/disconnect", func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAdminRequest(w, r) {
+			return
+		}
+
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			writeAdminJSON(w, 405, map[string]interface{}{"error": "method_not_allowed"})
+			return
+		}
+
+		reason := r.FormValue("reason")
+		if reason == "" {
+			reason = "Disconnected by the gateway administrator"
+		}
+
+		clients := []*Client{}
+		if id := r.FormValue("id"); id != "" {
+			clientID, _ := strconv.ParseUint(id, 10, 64)
+			if c, ok := s.Clients.Get(clientID); ok {
+				clients = append(clients, c)
+			}
+		} else if mask := r.FormValue("mask"); mask != "" {
+			matched, err := s.clientsMatchingMask(mask)
+			if err != nil {
+				writeAdminJSON(w, 400, map[string]interface{}{"error": "invalid_mask"})
+				return
+			}
+			for _, info := range matched {
+				clients = append(clients, info.client)
+			}
+		} else {
+			writeAdminJSON(w, 400, map[string]interface{}{"error": "missing_id_or_mask"})
+			return
+		}
+
+		disconnected := []uint64{}
+		for _, c := range clients {
+			c.Disconnect(reason)
+			disconnected = append(disconnected, c.Id)
+		}
+
+		writeAdminJSON(w, 200, map[string]interface{}{"disconnected": disconnected})
+	})
+}
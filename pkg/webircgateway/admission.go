@@ -0,0 +1,118 @@
+package webircgateway
+
+import (
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdmissionControl - A last resort global guard that refuses new clients once the gateway
+// has reached its configured client count or memory ceiling
+type AdmissionControl struct {
+	gateway *Gateway
+	mu      sync.Mutex
+	// Reading memory stats stops the world so only sample it periodically
+	memSampled time.Time
+	memUsage   uint64
+	tripped    bool
+}
+
+func NewAdmissionControl(gateway *Gateway) *AdmissionControl {
+	return &AdmissionControl{gateway: gateway}
+}
+
+// Check - Returns an empty string if a new client may be admitted, otherwise the reason it may not
+func (a *AdmissionControl) Check() string {
+	// The client being checked has already been added to the clients map
+	return a.check(0)
+}
+
+// CheckNew - The same as Check, but for a connection that has not created its client yet
+func (a *AdmissionControl) CheckNew() string {
+	return a.check(1)
+}
+
+func (a *AdmissionControl) check(newClients int) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	reason := ""
+	cfg := a.gateway.Config
+
+	if cfg.MaxClients > 0 && a.gateway.Clients.Count()+newClients > cfg.MaxClients {
+		reason = "max_clients"
+	}
+
+	if reason == "" && cfg.MaxMemory > 0 && a.memoryUsage() > cfg.MaxMemory*1024*1024 {
+		reason = "max_memory"
+	}
+
+	if reason != "" && !a.tripped {
+		a.tripped = true
+		a.gateway.LogEvent(3, "admission.tripped", "ADMISSION CONTROL TRIPPED (%s). Refusing new clients. clients=%d memory=%dMB",
+			reason,
+			a.gateway.Clients.Count(),
+			a.memUsage/1024/1024,
+		)
+	} else if reason == "" && a.tripped {
+		a.tripped = false
+		a.gateway.Log(3, "Admission control recovered. Accepting new clients")
+	}
+
+	return reason
+}
+
+func (a *AdmissionControl) memoryUsage() uint64 {
+	if time.Since(a.memSampled) < time.Second {
+		return a.memUsage
+	}
+
+	mem := &runtime.MemStats{}
+	runtime.ReadMemStats(mem)
+	// Memory obtained from the OS minus what has been given back approximates the process size
+	a.memUsage = mem.Sys - mem.HeapReleased
+	a.memSampled = time.Now()
+
+	return a.memUsage
+}
+
+// RejectHandshake - Respond with a 503 and Retry-After if a new connection may not be admitted,
+// so that well behaved clients back off instead of reconnecting immediately. Returns true if the
+// request has been rejected
+func (a *AdmissionControl) RejectHandshake(w http.ResponseWriter) bool {
+	if a.CheckNew() == "" {
+		return false
+	}
+
+	if a.gateway.Config.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(a.gateway.Config.RetryAfter))
+	}
+	http.Error(w, "Server is full, please try again later", http.StatusServiceUnavailable)
+	return true
+}
+
+// SockjsHandler - Reject new SockJS sessions while over capacity. Only the requests that start a
+// session are rejected so that existing sessions may continue polling
+func (a *AdmissionControl) SockjsHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isHandshake := strings.HasSuffix(r.URL.Path, "/info") || strings.HasSuffix(r.URL.Path, "/websocket")
+		if isHandshake && a.RejectHandshake(w) {
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// CloseReason - The reason given to a transport when closing a client. Clients refused for being
+// over capacity are also told how long to wait before reconnecting
+func (a *AdmissionControl) CloseReason(reason string) string {
+	if reason == "server_full" && a.gateway.Config.RetryAfter > 0 {
+		return reason + " retry_after=" + strconv.Itoa(a.gateway.Config.RetryAfter)
+	}
+
+	return reason
+}
@@ -0,0 +1,80 @@
+package webircgateway
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// authenticateTransport - The claims of a transport request passing each enabled [auth_jwt],
+// [auth_oidc], [auth_ldap] and [auth_token] check, in that order. The claims of the first of them
+// are used
+func (s *Gateway) authenticateTransport(req *http.Request) (map[string]interface{}, error) {
+	jwtClaims, err := s.jwtAuth.Authenticate(req)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT: %s", err.Error())
+	}
+
+	oidcClaims, err := s.oidcAuth.Authenticate(req)
+	if err != nil {
+		return nil, fmt.Errorf("no OIDC session: %s", err.Error())
+	}
+
+	ldapClaims, err := s.ldapAuth.Authenticate(req)
+	if err != nil {
+		return nil, fmt.Errorf("LDAP login failed: %s", err.Error())
+	}
+
+	tokenClaims, err := s.tokenAuth.Authenticate(req)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection token: %s", err.Error())
+	}
+
+	for _, claims := range []map[string]interface{}{jwtClaims, oidcClaims, ldapClaims, tokenClaims} {
+		if claims != nil {
+			return claims, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// transportAuthEnabled - If any of [auth_jwt], [auth_oidc], [auth_ldap] or [auth_token] is
+// enabled, so that transports without a request to authenticate must refuse clients
+func (s *Gateway) transportAuthEnabled() bool {
+	cfg := s.Config
+	return cfg.JwtAuth || cfg.OidcAuth || cfg.LdapAuth || cfg.TokenAuth
+}
+
+// rejectUnauthenticated - Respond with a 401 if a transport request fails authentication. Returns
+// the request's claims, and true if the request has been rejected
+func (s *Gateway) rejectUnauthenticated(w http.ResponseWriter, req *http.Request) (map[string]interface{}, bool) {
+	claims, err := s.authenticateTransport(req)
+	if err == nil {
+		return claims, false
+	}
+
+	remoteAddr := s.GetRemoteAddressFromRequest(req).String()
+	s.LogEvent(2, "client.auth_failed", "Connection from %s refused, %s", remoteAddr, err.Error())
+	s.logRejection(remoteAddr, "auth_failed")
+	if s.Config.LdapAuth {
+		w.Header().Set("WWW-Authenticate", `Basic realm="webircgateway"`)
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return nil, true
+}
+
+// authSockjsHandler - Reject SockJS handshakes failing authentication, before a session is
+// started. The session's first request is checked again when it starts
+func (s *Gateway) authSockjsHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isHandshake := strings.HasSuffix(r.URL.Path, "/info") || strings.HasSuffix(r.URL.Path, "/websocket")
+		if isHandshake {
+			if _, rejected := s.rejectUnauthenticated(w, r); rejected {
+				return
+			}
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,321 @@
+package webircgateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// How long keys fetched from a JWKS URL are used before fetching them again. A token signed by an
+// unknown key ID fetches them again sooner, at most once every jwksMinRefresh
+const (
+	jwksRefresh    = time.Hour
+	jwksMinRefresh = time.Minute
+)
+
+// JwtAuth - Requires websocket, sockjs and kiwiirc connections to carry a signed JWT, either as a
+// query parameter or an "Authorization: Bearer" header. The token's claims are kept on the client
+// for hooks and the username / realname options
+type JwtAuth struct {
+	gateway *Gateway
+	jwks    *jwksCache
+}
+
+func NewJwtAuth(gateway *Gateway) *JwtAuth {
+	return &JwtAuth{
+		gateway: gateway,
+		jwks:    newJwksCache(gateway),
+	}
+}
+
+// Authenticate - Validate the token sent with a request, returning its claims. Returns nil claims
+// and no error when JWT authentication is disabled
+func (a *JwtAuth) Authenticate(req *http.Request) (jwt.MapClaims, error) {
+	cfg := a.gateway.Config
+	if !cfg.JwtAuth {
+		return nil, nil
+	}
+
+	tokenString := req.URL.Query().Get(cfg.JwtQueryParam)
+	if tokenString == "" {
+		auth := req.Header.Get("Authorization")
+		if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+			tokenString = strings.TrimSpace(auth[7:])
+		}
+	}
+	if tokenString == "" {
+		return nil, errors.New("no token")
+	}
+
+	claims := jwt.MapClaims{}
+	// Expiry and not-before times are checked while parsing, but only when the token has them
+	_, err := jwt.ParseWithClaims(tokenString, claims, a.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	// A token without an expiry would be accepted forever
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("token has no expiry")
+	}
+
+	if cfg.JwtIssuer != "" && !claims.VerifyIssuer(cfg.JwtIssuer, true) {
+		return nil, errors.New("token has the wrong issuer")
+	}
+	if cfg.JwtAudience != "" && !jwtHasAudience(claims, cfg.JwtAudience) {
+		return nil, errors.New("token has the wrong audience")
+	}
+
+	return claims, nil
+}
+
+// keyFunc - The key a token must be signed with. Only the algorithms matching the configured
+// keys are accepted so that, eg. a public key can't be used as a HMAC secret
+func (a *JwtAuth) keyFunc(token *jwt.Token) (interface{}, error) {
+	cfg := a.gateway.Config
+
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if cfg.JwtSecret == "" {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return []byte(cfg.JwtSecret), nil
+
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		if cfg.JwtJwksURL != "" {
+			kid, _ := token.Header["kid"].(string)
+			key, err := a.jwks.Key(cfg.JwtJwksURL, kid)
+			if err != nil {
+				return nil, err
+			}
+			return jwtCheckKeyType(token, key)
+		}
+		if cfg.JwtPublicKey != nil {
+			return jwtCheckKeyType(token, cfg.JwtPublicKey)
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+}
+
+func jwtCheckKeyType(token *jwt.Token, key interface{}) (interface{}, error) {
+	_, isRSAMethod := token.Method.(*jwt.SigningMethodRSA)
+	_, isRSAKey := key.(*rsa.PublicKey)
+	if isRSAMethod != isRSAKey {
+		return nil, fmt.Errorf("signing method %s does not match the key", token.Method.Alg())
+	}
+
+	return key, nil
+}
+
+// jwksCache - The public keys published at a JWKS URL
+type jwksCache struct {
+	gateway    *Gateway
+	mu         sync.Mutex
+	url        string
+	keys       map[string]interface{}
+	fetched    time.Time
+	tried      time.Time
+	httpClient *http.Client
+}
+
+func newJwksCache(gateway *Gateway) *jwksCache {
+	return &jwksCache{
+		gateway:    gateway,
+		httpClient: &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+// Key - The public key with the given key ID from a JWKS URL. Without a key ID the only key
+// is used
+func (j *jwksCache) Key(jwksURL string, kid string) (interface{}, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	findKey := func() (interface{}, bool) {
+		if kid == "" && len(j.keys) == 1 {
+			for _, key := range j.keys {
+				return key, true
+			}
+		}
+		key, exists := j.keys[kid]
+		return key, exists
+	}
+
+	stale := j.url != jwksURL || time.Since(j.fetched) > jwksRefresh
+	if key, exists := findKey(); exists && !stale {
+		return key, nil
+	}
+
+	// Keys are rotated by publishing a new key ID, but don't let unknown IDs flood the JWKS URL
+	if stale || time.Since(j.tried) > jwksMinRefresh {
+		j.tried = time.Now()
+		keys, err := j.fetch(jwksURL)
+		if err != nil {
+			j.gateway.Log(3, "Error fetching JWKS keys from %s: %s", jwksURL, err.Error())
+		} else {
+			j.url = jwksURL
+			j.keys = keys
+			j.fetched = time.Now()
+		}
+	}
+
+	if key, exists := findKey(); exists {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown key ID '%s'", kid)
+}
+
+func (j *jwksCache) fetch(jwksURL string) (map[string]interface{}, error) {
+	resp, err := j.httpClient.Get(jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseJwks(body)
+}
+
+// parseJwks - The RSA and EC public keys in a JSON Web Key Set, keyed by key ID. Keys of other
+// types or for other uses are skipped
+func parseJwks(data []byte) (map[string]interface{}, error) {
+	set := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	decode := func(s string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		if err != nil || len(b) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(b)
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		switch k.Kty {
+		case "RSA":
+			n, e := decode(k.N), decode(k.E)
+			if n == nil || e == nil || !e.IsInt64() {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, y := decode(k.X), decode(k.Y)
+			if x == nil || y == nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no usable keys")
+	}
+
+	return keys, nil
+}
+
+// jwtHasAudience - The aud claim may be a single string or a list of them
+func jwtHasAudience(claims jwt.MapClaims, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// jwtClaimReplacement - %{name} in the username / realname options, replaced by the claim name
+var jwtClaimReplacement = regexp.MustCompile(`%\{([^}]+)\}`)
+
+// makeClaimReplacements - Replace %{name} with the client's JWT claim name, or nothing if the
+// client has no such claim
+func makeClaimReplacements(format string, client *Client) string {
+	return jwtClaimReplacement.ReplaceAllStringFunc(format, func(ref string) string {
+		claim, exists := client.AuthClaims[ref[2:len(ref)-1]]
+		if !exists || claim == nil {
+			return ""
+		}
+		if s, isString := claim.(string); isString {
+			return stripLineBreaks(s)
+		}
+		return stripLineBreaks(fmt.Sprint(claim))
+	})
+}
+
+// loadJwtPublicKey - Read a PEM encoded RSA or EC public key, logging why if it can't be used
+func (c *Config) loadJwtPublicKey(path string) interface{} {
+	pemData, err := ioutil.ReadFile(path)
+	if err != nil {
+		c.gateway.Log(3, "Config section auth_jwt public_key could not be read: %s", err.Error())
+		return nil
+	}
+
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(pemData); err == nil {
+		return key
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(pemData); err == nil {
+		return key
+	}
+
+	c.gateway.Log(3, "Config section auth_jwt public_key %s is not a PEM encoded RSA or EC public key", path)
+	return nil
+}
@@ -0,0 +1,33 @@
+package webircgateway
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestJwtAuthRequiresExpiry(t *testing.T) {
+	gateway := newTestGateway(t, "[auth_jwt]\nenabled = true\nsecret = \"testsecret\"\n")
+	auth := NewJwtAuth(gateway)
+
+	authenticate := func(claims jwt.MapClaims) error {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("testsecret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = auth.Authenticate(httptest.NewRequest("GET", "/webirc/websocket/?token="+token, nil))
+		return err
+	}
+
+	if err := authenticate(jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}); err != nil {
+		t.Errorf("token with an expiry was refused: %s", err.Error())
+	}
+	if err := authenticate(jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()}); err == nil {
+		t.Error("expired token was accepted")
+	}
+	if err := authenticate(jwt.MapClaims{"sub": "alice"}); err == nil {
+		t.Error("token without an expiry was accepted")
+	}
+}
@@ -0,0 +1,320 @@
+package webircgateway
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// How long a successful login is remembered, so that the several requests starting a SockJS
+// session don't each bind to the LDAP server
+const ldapLoginCacheTTL = time.Minute
+
+// LdapAuth - Requires websocket, sockjs and kiwiirc connections to send a username and password,
+// as HTTP basic auth, that can bind to an LDAP / Active Directory server. Users are either bound
+// directly by a DN built from their username, or found by a search first. Idle connections to the
+// server are kept in a pool for the next login
+type LdapAuth struct {
+	gateway *Gateway
+	mu      sync.Mutex
+	// idle - Connections waiting for the next login, dialed with the options in poolKey
+	idle    []*ldap.Conn
+	poolKey string
+	logins  map[string]*ldapLogin
+}
+
+type ldapLogin struct {
+	claims  map[string]interface{}
+	expires time.Time
+}
+
+func NewLdapAuth(gateway *Gateway) *LdapAuth {
+	return &LdapAuth{
+		gateway: gateway,
+		logins:  make(map[string]*ldapLogin),
+	}
+}
+
+// Authenticate - Check the request's basic auth username and password against the LDAP server,
+// returning the user's claims: sub (the username), dn and the configured attributes. Returns nil
+// claims and no error when LDAP authentication is disabled
+func (a *LdapAuth) Authenticate(req *http.Request) (map[string]interface{}, error) {
+	cfg := a.gateway.Config
+	if !cfg.LdapAuth {
+		return nil, nil
+	}
+
+	username, password, ok := req.BasicAuth()
+	// An empty password would be an unauthenticated bind, which always succeeds
+	if !ok || username == "" || password == "" {
+		return nil, errors.New("no username or password")
+	}
+
+	cacheKey := a.loginCacheKey(username, password)
+	a.mu.Lock()
+	login, exists := a.logins[cacheKey]
+	a.mu.Unlock()
+	if exists && time.Now().Before(login.expires) {
+		return login.claims, nil
+	}
+
+	claims, err := a.login(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	for key, login := range a.logins {
+		if time.Now().After(login.expires) {
+			delete(a.logins, key)
+		}
+	}
+	a.logins[cacheKey] = &ldapLogin{claims: claims, expires: time.Now().Add(ldapLoginCacheTTL)}
+	a.mu.Unlock()
+
+	return claims, nil
+}
+
+// loginCacheKey - Logins are remembered by a hash of their credentials and the server they were
+// checked against, so that changing the server or a password takes effect
+func (a *LdapAuth) loginCacheKey(username string, password string) string {
+	cfg := a.gateway.Config
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		cfg.LdapURL, cfg.LdapBindDN, cfg.LdapSearchBase, cfg.LdapSearchFilter, username, password,
+	}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *LdapAuth) login(username string, password string) (map[string]interface{}, error) {
+	cfg := a.gateway.Config
+
+	conn, err := a.getConn()
+	if err != nil {
+		a.gateway.Log(3, "Error connecting to LDAP server %s: %s", cfg.LdapURL, err.Error())
+		return nil, errors.New("LDAP server unavailable")
+	}
+
+	claims, err := a.bindUser(conn, username, password)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) && err != errLdapNoSuchUser {
+		// The connection may be broken so don't reuse it
+		conn.Close()
+		a.gateway.Log(3, "LDAP error logging in %s: %s", username, err.Error())
+		return nil, errors.New("LDAP server error")
+	}
+
+	a.putConn(conn)
+	if err != nil {
+		return nil, errors.New("invalid username or password")
+	}
+
+	return claims, nil
+}
+
+var errLdapNoSuchUser = errors.New("no such user")
+
+// bindUser - Bind as the user, finding their DN with a search first if no bind_dn is configured
+func (a *LdapAuth) bindUser(conn *ldap.Conn, username string, password string) (map[string]interface{}, error) {
+	cfg := a.gateway.Config
+	claims := map[string]interface{}{"sub": username}
+	var entry *ldap.Entry
+	var userDN string
+
+	if cfg.LdapBindDN != "" {
+		userDN = strings.Replace(cfg.LdapBindDN, "%u", ldapEscapeDN(username), -1)
+	} else {
+		// Pooled connections are still bound as the last user to log in
+		var err error
+		if cfg.LdapSearchBindDN != "" {
+			err = conn.Bind(cfg.LdapSearchBindDN, cfg.LdapSearchBindPassword)
+		} else {
+			err = conn.UnauthenticatedBind("")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("search bind: %s", err.Error())
+		}
+
+		filter := strings.Replace(cfg.LdapSearchFilter, "%u", ldap.EscapeFilter(username), -1)
+		entry, err = a.searchOne(conn, cfg.LdapSearchBase, ldap.ScopeWholeSubtree, filter)
+		if err != nil {
+			return nil, err
+		}
+		userDN = entry.DN
+	}
+
+	if err := conn.Bind(userDN, password); err != nil {
+		return nil, err
+	}
+
+	// A directly bound user's attributes are read from their own entry
+	if entry == nil && len(cfg.LdapAttributes) > 0 {
+		var err error
+		entry, err = a.searchOne(conn, userDN, ldap.ScopeBaseObject, "(objectClass=*)")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	claims["dn"] = userDN
+	if entry != nil {
+		for _, attribute := range cfg.LdapAttributes {
+			if val := entry.GetAttributeValue(attribute); val != "" {
+				claims[attribute] = val
+			}
+		}
+	}
+
+	return claims, nil
+}
+
+// searchOne - The only entry matching the search. Finding no entries, or more than one, is
+// errLdapNoSuchUser
+func (a *LdapAuth) searchOne(conn *ldap.Conn, baseDN string, scope int, filter string) (*ldap.Entry, error) {
+	cfg := a.gateway.Config
+	search := ldap.NewSearchRequest(
+		baseDN, scope, ldap.NeverDerefAliases, 2, cfg.LdapTimeout, false, filter,
+		append([]string{"dn"}, cfg.LdapAttributes...), nil,
+	)
+
+	result, err := conn.Search(search)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, errLdapNoSuchUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		return nil, errLdapNoSuchUser
+	}
+
+	return result.Entries[0], nil
+}
+
+// getConn - An idle connection from the pool, or a new one
+func (a *LdapAuth) getConn() (*ldap.Conn, error) {
+	key := a.connKey()
+
+	a.mu.Lock()
+	// The server or its TLS options changed in a reload
+	if key != a.poolKey {
+		for _, conn := range a.idle {
+			conn.Close()
+		}
+		a.idle = nil
+		a.poolKey = key
+	}
+	for len(a.idle) > 0 {
+		conn := a.idle[len(a.idle)-1]
+		a.idle = a.idle[:len(a.idle)-1]
+		if !conn.IsClosing() {
+			a.mu.Unlock()
+			return conn, nil
+		}
+	}
+	a.mu.Unlock()
+
+	return a.dial()
+}
+
+// putConn - Keep a connection for the next login if the pool isn't full
+func (a *LdapAuth) putConn(conn *ldap.Conn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if conn.IsClosing() || len(a.idle) >= a.gateway.Config.LdapPoolSize || a.poolKey != a.connKey() {
+		conn.Close()
+		return
+	}
+
+	a.idle = append(a.idle, conn)
+}
+
+func (a *LdapAuth) connKey() string {
+	cfg := a.gateway.Config
+	return fmt.Sprintf("%s %t %t %p", cfg.LdapURL, cfg.LdapStartTLS, cfg.LdapTLSVerify, cfg.LdapRootCAs)
+}
+
+func (a *LdapAuth) dial() (*ldap.Conn, error) {
+	cfg := a.gateway.Config
+	timeout := time.Second * time.Duration(cfg.LdapTimeout)
+
+	serverURL, err := url.Parse(cfg.LdapURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         serverURL.Hostname(),
+		InsecureSkipVerify: !cfg.LdapTLSVerify,
+		RootCAs:            cfg.LdapRootCAs,
+	}
+
+	conn, err := ldap.DialURL(
+		cfg.LdapURL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+		ldap.DialWithTLSConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+
+	if cfg.LdapStartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// ldapEscapeDN - Escape a value for use in a DN, as described in RFC 4514
+func ldapEscapeDN(val string) string {
+	escaped := strings.Builder{}
+	for i := 0; i < len(val); i++ {
+		c := val[i]
+		switch {
+		case c == 0:
+			escaped.WriteString(`\00`)
+		case strings.IndexByte(`,+"\<>;=`, c) != -1:
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+		case (c == ' ' || c == '#') && i == 0, c == ' ' && i == len(val)-1:
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+
+	return escaped.String()
+}
+
+// loadLdapCA - Read the PEM encoded certificates trusted for the LDAP server's TLS
+func (c *Config) loadLdapCA(path string) *x509.CertPool {
+	pemData, err := ioutil.ReadFile(path)
+	if err != nil {
+		c.gateway.Log(3, "Config section auth_ldap ca_file could not be read: %s", err.Error())
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		c.gateway.Log(3, "Config section auth_ldap ca_file %s has no PEM encoded certificates", path)
+		return nil
+	}
+
+	return pool
+}
@@ -0,0 +1,469 @@
+package webircgateway
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	oidcSessionCookie = "webircgateway_session"
+	oidcStateCookie   = "webircgateway_oidc_state"
+	// How long a browser has to log in at the identity provider and return to the callback
+	oidcLoginTimeout = time.Minute * 10
+	// Logins started but not yet returned to the callback. Further logins are refused until some
+	// complete or time out
+	oidcMaxPendingLogins = 10000
+)
+
+// OidcAuth - Requires browsers to log in at an OpenID Connect identity provider before their
+// websocket, sockjs and kiwiirc connections are accepted. A successful login starts a session,
+// kept in a cookie, whose ID token claims are kept on each client connecting with it
+type OidcAuth struct {
+	gateway    *Gateway
+	jwks       *jwksCache
+	httpClient *http.Client
+	mu         sync.Mutex
+	// discovery - The provider metadata of discoveryIssuer, fetched on the first login
+	discovery       *oidcDiscovery
+	discoveryIssuer string
+	// pending - Logins waiting for the provider to redirect back, keyed by their state
+	pending map[string]*oidcPendingLogin
+	// sessions - Logged in browsers, keyed by the session cookie value
+	sessions map[string]*oidcSession
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type oidcPendingLogin struct {
+	nonce       string
+	redirectURL string
+	returnTo    string
+	expires     time.Time
+}
+
+type oidcSession struct {
+	claims  jwt.MapClaims
+	expires time.Time
+}
+
+func NewOidcAuth(gateway *Gateway) *OidcAuth {
+	return &OidcAuth{
+		gateway:    gateway,
+		jwks:       newJwksCache(gateway),
+		httpClient: &http.Client{Timeout: time.Second * 10},
+		pending:    make(map[string]*oidcPendingLogin),
+		sessions:   make(map[string]*oidcSession),
+	}
+}
+
+// Authenticate - The ID token claims of the session the request belongs to. Returns nil claims
+// and no error when OIDC authentication is disabled
+func (o *OidcAuth) Authenticate(req *http.Request) (jwt.MapClaims, error) {
+	if !o.gateway.Config.OidcAuth {
+		return nil, nil
+	}
+
+	cookie, err := req.Cookie(oidcSessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil, errors.New("not logged in")
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	session, exists := o.sessions[cookie.Value]
+	if !exists {
+		return nil, errors.New("unknown session")
+	}
+	if time.Now().After(session.expires) {
+		delete(o.sessions, cookie.Value)
+		return nil, errors.New("session expired")
+	}
+
+	return session.claims, nil
+}
+
+// RequireLogin - Redirect browsers without a session to the identity provider, returning them to
+// the page they requested once logged in. Returns true if the request may continue
+func (o *OidcAuth) RequireLogin(w http.ResponseWriter, req *http.Request) bool {
+	if _, err := o.Authenticate(req); err == nil {
+		return true
+	}
+
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	loginURL := "/webirc/oidc/login?return=" + url.QueryEscape(req.URL.RequestURI())
+	http.Redirect(w, req, loginURL, http.StatusFound)
+	return false
+}
+
+// initOidcRoutes - The endpoints browsers are sent to while logging in:
+//
+//	GET /webirc/oidc/login[?return=<url>]    Start a login at the identity provider
+//	GET /webirc/oidc/callback                Where the identity provider redirects back to
+//	GET /webirc/oidc/logout[?return=<url>]   End the session
+func (s *Gateway) initOidcRoutes() {
+	s.HttpRouter.HandleFunc("/webirc/oidc/login", s.oidcAuth.loginHandler)
+	s.HttpRouter.HandleFunc("/webirc/oidc/callback", s.oidcAuth.callbackHandler)
+	s.HttpRouter.HandleFunc("/webirc/oidc/logout", s.oidcAuth.logoutHandler)
+}
+
+func (o *OidcAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := o.gateway.Config
+	if !cfg.OidcAuth {
+		o.gateway.serveNotFound(w, r)
+		return
+	}
+
+	discovery, err := o.discover()
+	if err != nil {
+		o.gateway.Log(3, "Error fetching the OIDC provider configuration of %s: %s", cfg.OidcIssuer, err.Error())
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	login := &oidcPendingLogin{
+		nonce:       randomToken(),
+		redirectURL: o.redirectURL(r),
+		returnTo:    o.returnTo(r),
+		expires:     time.Now().Add(oidcLoginTimeout),
+	}
+	state := randomToken()
+
+	o.mu.Lock()
+	o.pruneLocked()
+	if len(o.pending) >= oidcMaxPendingLogins {
+		o.mu.Unlock()
+		http.Error(w, "Too many logins in progress, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	o.pending[state] = login
+	o.mu.Unlock()
+
+	// The state is also kept in a cookie so that a login can only be completed by the browser
+	// that started it
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/webirc/oidc/",
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   o.gateway.isRequestSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", cfg.OidcClientID)
+	params.Set("redirect_uri", login.redirectURL)
+	params.Set("scope", cfg.OidcScopes)
+	params.Set("state", state)
+	params.Set("nonce", login.nonce)
+
+	authURL := discovery.AuthorizationEndpoint
+	if strings.Contains(authURL, "?") {
+		authURL += "&" + params.Encode()
+	} else {
+		authURL += "?" + params.Encode()
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (o *OidcAuth) callbackHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := o.gateway.Config
+	if !cfg.OidcAuth {
+		o.gateway.serveNotFound(w, r)
+		return
+	}
+
+	remoteAddr := o.gateway.GetRemoteAddressFromRequest(r).String()
+	query := r.URL.Query()
+
+	if errCode := query.Get("error"); errCode != "" {
+		o.gateway.Log(2, "OIDC login from %s failed at the identity provider: %s %s", remoteAddr, errCode, query.Get("error_description"))
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	stateCookie, err := r.Cookie(oidcStateCookie)
+	if state == "" || err != nil || stateCookie.Value != state {
+		http.Error(w, "Login failed, please try again", http.StatusBadRequest)
+		return
+	}
+
+	o.mu.Lock()
+	login, exists := o.pending[state]
+	delete(o.pending, state)
+	o.mu.Unlock()
+
+	if !exists || time.Now().After(login.expires) {
+		http.Error(w, "Login timed out, please try again", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := o.exchangeCode(query.Get("code"), login)
+	if err != nil {
+		o.gateway.Log(2, "OIDC login from %s failed: %s", remoteAddr, err.Error())
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	sessionID := randomToken()
+	ttl := time.Second * time.Duration(cfg.OidcSessionTTL)
+
+	o.mu.Lock()
+	o.sessions[sessionID] = &oidcSession{claims: claims, expires: time.Now().Add(ttl)}
+	o.mu.Unlock()
+
+	sub, _ := claims["sub"].(string)
+	o.gateway.Log(2, "OIDC login from %s as %s", remoteAddr, sub)
+
+	secure := o.gateway.isRequestSecure(r)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/webirc/oidc/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secure,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcSessionCookie,
+		Value:    sessionID,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, login.returnTo, http.StatusFound)
+}
+
+func (o *OidcAuth) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if !o.gateway.Config.OidcAuth {
+		o.gateway.serveNotFound(w, r)
+		return
+	}
+
+	if cookie, err := r.Cookie(oidcSessionCookie); err == nil {
+		o.mu.Lock()
+		delete(o.sessions, cookie.Value)
+		o.mu.Unlock()
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcSessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   o.gateway.isRequestSecure(r),
+	})
+
+	http.Redirect(w, r, o.returnTo(r), http.StatusFound)
+}
+
+// exchangeCode - Swap the authorization code for the ID token at the token endpoint, returning its
+// claims once validated
+func (o *OidcAuth) exchangeCode(code string, login *oidcPendingLogin) (jwt.MapClaims, error) {
+	cfg := o.gateway.Config
+	if code == "" {
+		return nil, errors.New("no authorization code")
+	}
+
+	discovery, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", login.redirectURL)
+
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(cfg.OidcClientID), url.QueryEscape(cfg.OidcClientSecret))
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint responded %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	tokens := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token endpoint did not return an id_token")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokens.IDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			return []byte(cfg.OidcClientSecret), nil
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+			kid, _ := token.Header["kid"].(string)
+			key, err := o.jwks.Key(discovery.JwksURI, kid)
+			if err != nil {
+				return nil, err
+			}
+			return jwtCheckKeyType(token, key)
+		}
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("id_token has no expiry")
+	}
+	if !claims.VerifyIssuer(discovery.Issuer, true) {
+		return nil, errors.New("id_token has the wrong issuer")
+	}
+	if !jwtHasAudience(claims, cfg.OidcClientID) {
+		return nil, errors.New("id_token has the wrong audience")
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != login.nonce {
+		return nil, errors.New("id_token has the wrong nonce")
+	}
+
+	return claims, nil
+}
+
+// discover - The provider metadata published at the issuer's /.well-known/openid-configuration
+func (o *OidcAuth) discover() (*oidcDiscovery, error) {
+	issuer := o.gateway.Config.OidcIssuer
+
+	o.mu.Lock()
+	if o.discovery != nil && o.discoveryIssuer == issuer {
+		discovery := o.discovery
+		o.mu.Unlock()
+		return discovery, nil
+	}
+	o.mu.Unlock()
+
+	resp, err := o.httpClient.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery := &oidcDiscovery{}
+	if err := json.Unmarshal(body, discovery); err != nil {
+		return nil, err
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksURI == "" {
+		return nil, errors.New("missing authorization_endpoint, token_endpoint or jwks_uri")
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("provider issuer %s does not match the configured issuer", discovery.Issuer)
+	}
+
+	o.mu.Lock()
+	o.discovery = discovery
+	o.discoveryIssuer = issuer
+	o.mu.Unlock()
+
+	return discovery, nil
+}
+
+// redirectURL - Where the identity provider sends the browser back to, the configured
+// redirect_url or this gateway's own callback
+func (o *OidcAuth) redirectURL(r *http.Request) string {
+	if o.gateway.Config.OidcRedirectURL != "" {
+		return o.gateway.Config.OidcRedirectURL
+	}
+
+	scheme := "http"
+	if o.gateway.isRequestSecure(r) {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host + "/webirc/oidc/callback"
+}
+
+// returnTo - Where to send the browser after logging in or out. Only paths on this gateway, or
+// pages on one of the [allowed_origins] are allowed so that it can't be used as an open redirect
+func (o *OidcAuth) returnTo(r *http.Request) string {
+	target := r.URL.Query().Get("return")
+	if strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") && !strings.HasPrefix(target, "/\\") {
+		return target
+	}
+
+	u, err := url.Parse(target)
+	if err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" &&
+		len(o.gateway.Config.RemoteOrigins) > 0 && o.gateway.IsClientOriginAllowed(u.Scheme+"://"+u.Host) {
+		return target
+	}
+
+	return "/"
+}
+
+// pruneLocked - Forget expired logins and sessions. o.mu must be held
+func (o *OidcAuth) pruneLocked() {
+	now := time.Now()
+	for state, login := range o.pending {
+		if now.After(login.expires) {
+			delete(o.pending, state)
+		}
+	}
+	for id, session := range o.sessions {
+		if now.After(session.expires) {
+			delete(o.sessions, id)
+		}
+	}
+}
+
+// randomToken - A random hex string for session IDs and login states
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,110 @@
+package webircgateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TokenAuth - Requires websocket, sockjs and kiwiirc connections to carry a short lived token
+// signed by the website with a shared secret, so that the gateway can't be used from other sites.
+// A token is <payload>.<signature>, both base64url encoded without padding, where the payload is
+// JSON such as {"ip": "192.0.2.1", "exp": 1600000000, "account": "bob"} and the signature is the
+// HMAC-SHA256 of the encoded payload
+type TokenAuth struct {
+	gateway *Gateway
+}
+
+type connectionToken struct {
+	IP      string `json:"ip"`
+	Expires int64  `json:"exp"`
+	Account string `json:"account"`
+}
+
+func NewTokenAuth(gateway *Gateway) *TokenAuth {
+	return &TokenAuth{gateway: gateway}
+}
+
+// Authenticate - Validate the token sent with a request, returning its claims: ip, exp and the
+// account as sub if it has one. Returns nil claims and no error when token authentication is
+// disabled
+func (a *TokenAuth) Authenticate(req *http.Request) (map[string]interface{}, error) {
+	cfg := a.gateway.Config
+	if !cfg.TokenAuth {
+		return nil, nil
+	}
+
+	tokenString := req.URL.Query().Get(cfg.TokenQueryParam)
+	if tokenString == "" {
+		return nil, errors.New("no token")
+	}
+
+	token, err := a.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	if token.Expires <= now {
+		return nil, errors.New("token has expired")
+	}
+	if cfg.TokenMaxTTL > 0 && token.Expires > now+int64(cfg.TokenMaxTTL) {
+		return nil, errors.New("token expires too far in the future")
+	}
+
+	if cfg.TokenBindIP && !a.gateway.GetRemoteAddressFromRequest(req).Equal(net.ParseIP(token.IP)) {
+		return nil, errors.New("token was issued for another address")
+	}
+
+	claims := map[string]interface{}{
+		"ip":  token.IP,
+		"exp": token.Expires,
+	}
+	if token.Account != "" {
+		claims["sub"] = token.Account
+		claims["account"] = token.Account
+	}
+
+	return claims, nil
+}
+
+func (a *TokenAuth) parse(tokenString string) (*connectionToken, error) {
+	// Anybody could sign tokens without a secret
+	if a.gateway.Config.TokenSecret == "" {
+		return nil, errors.New("no secret is configured")
+	}
+
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed token")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	mac := hmac.New(sha256.New, []byte(a.gateway.Config.TokenSecret))
+	mac.Write([]byte(parts[0]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+
+	token := &connectionToken{}
+	if err := json.Unmarshal(payload, token); err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+
+	return token, nil
+}
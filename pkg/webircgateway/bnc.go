@@ -0,0 +1,557 @@
+package webircgateway
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// How long a relaying client waits for room in a sessions event queue before it is closed
+const bncEventTimeout = time.Second * 5
+
+// BncSessions - Registered clients of authenticated users that may be attached to again by a later
+// connection of the same user, by session key
+type BncSessions struct {
+	gateway  *Gateway
+	mu       sync.Mutex
+	sessions map[string]*Client
+}
+
+func NewBncSessions(gateway *Gateway) *BncSessions {
+	return &BncSessions{
+		gateway:  gateway,
+		sessions: make(map[string]*Client),
+	}
+}
+
+// Add - Register a clients session. Returns false if another client already has the key
+func (b *BncSessions) Add(key string, client *Client) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if existing, exists := b.sessions[key]; exists && existing != client {
+		return false
+	}
+
+	b.sessions[key] = client
+	return true
+}
+
+// Remove - Unregister a clients session, if it is still the one with the key
+func (b *BncSessions) Remove(key string, client *Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.sessions[key] == client {
+		delete(b.sessions, key)
+	}
+}
+
+func (b *BncSessions) Get(key string) *Client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.sessions[key]
+}
+
+// bncSession - A client whose upstream connection is kept open once its own transport has closed.
+// Later connections of the same user relay through it instead of connecting upstream themselves
+type bncSession struct {
+	key string
+	// detached / relay / buffer / caps - Guarded by the clients shuttingDownLock as other
+	// goroutines use them. detached is set once its own transport has gone, relay is the client
+	// attached to it since, and buffer keeps lines while nothing is attached
+	detached bool
+	relay    *Client
+	buffer   []bncBufferedLine
+	// bufferSize / bufferMaxAge - Set when the session starts so that a config reload doesn't
+	// change a buffer in use. bufferMaxAge is in seconds, 0 = no limit
+	bufferSize   int
+	bufferMaxAge int
+	// caps - The capabilities enabled on the upstream, lowercased
+	caps map[string]bool
+	// welcome - The registration burst from 001 to the end of the MOTD, replayed on attaching
+	welcome     []string
+	welcomeDone bool
+	away        bool
+	expire      *time.Timer
+	events      chan bncEvent
+}
+
+// bncBufferedLine - A line kept for the client and when it was received, sent as its server-time
+// when replayed
+type bncBufferedLine struct {
+	line string
+	at   time.Time
+}
+
+// bncEvent - A relaying client attaching, detaching or sending a line. Handled by the sessions
+// own goroutine so that it is the only one using its upstream
+type bncEvent struct {
+	kind   string
+	client *Client
+	line   string
+}
+
+// bncRelay - A client attached to another clients session
+type bncRelay struct {
+	session *Client
+	caps    []string
+	// serverTime - The client enabled server-time so replayed lines are tagged with their time
+	serverTime bool
+	sawNick    bool
+	sawUser    bool
+	// capNegotiating - The client started CAP negotiation so attaching waits for its CAP END
+	capNegotiating bool
+	attached       bool
+}
+
+// Events - Lines and attachments from relaying clients. A nil session has none
+func (b *bncSession) Events() <-chan bncEvent {
+	if b == nil {
+		return nil
+	}
+
+	return b.events
+}
+
+// Expired - Fires once the session has been detached for too long. A nil session never expires
+func (b *bncSession) Expired() <-chan time.Time {
+	if b == nil || b.expire == nil {
+		return nil
+	}
+
+	return b.expire.C
+}
+
+// bncKey - The session key of the client for an upstream, empty if it can't have a session. Only
+// clients with verified claims have one so that nobody can attach to another users session
+func (c *Client) bncKey(upstream ConfigUpstream) string {
+	cfg := c.Gateway.Config
+	if !cfg.BncEnabled || c.AuthClaims == nil {
+		return ""
+	}
+
+	identity := makeClaimReplacements("%{"+cfg.BncIdentityClaim+"}", c)
+	if identity == "" {
+		return ""
+	}
+
+	return identity + " " + upstreamAddrKey(upstream)
+}
+
+// maybeStartBnc - Start keeping what is needed to attach to the client later, if it can have a
+// session. Called before connecting upstream so that the capabilities it enables are seen
+func (c *Client) maybeStartBnc() {
+	key := c.bncKey(*c.UpstreamConfig)
+	if key == "" {
+		return
+	}
+
+	c.shuttingDownLock.Lock()
+	c.bnc = &bncSession{
+		key:          key,
+		bufferSize:   c.Gateway.Config.BncBuffer,
+		bufferMaxAge: c.Gateway.Config.BncBufferMaxAge,
+		caps:         make(map[string]bool),
+		events:       make(chan bncEvent, 50),
+	}
+	c.shuttingDownLock.Unlock()
+}
+
+// registerBnc - Make the session available to attach to once the client has registered
+func (c *Client) registerBnc() {
+	if c.bnc == nil || c.Gateway.bncSessions.Add(c.bnc.key, c) {
+		return
+	}
+
+	c.Log(2, "The user already has a session on this upstream, not keeping this one")
+	c.shuttingDownLock.Lock()
+	c.bnc = nil
+	c.shuttingDownLock.Unlock()
+}
+
+// keepBncSignal - Pass a signal on to the attached client, or keep it until one attaches. Called
+// with the shuttingDownLock held
+func (b *bncSession) keepBncSignal(signal ClientSignal) {
+	if b.relay != nil {
+		b.relay.sendSignal(signal)
+		return
+	}
+	if signal[0] != "data" {
+		return
+	}
+
+	b.buffer = append(b.buffer, bncBufferedLine{line: signal[1], at: time.Now()})
+	b.pruneBuffer()
+}
+
+// pruneBuffer - Drop the oldest kept lines beyond the buffer size, and those older than its max age
+func (b *bncSession) pruneBuffer() {
+	if over := len(b.buffer) - b.bufferSize; over > 0 {
+		b.buffer = b.buffer[over:]
+	}
+	if b.bufferMaxAge <= 0 {
+		return
+	}
+
+	oldest := time.Now().Add(-time.Second * time.Duration(b.bufferMaxAge))
+	for len(b.buffer) > 0 && b.buffer[0].at.Before(oldest) {
+		b.buffer = b.buffer[1:]
+	}
+}
+
+// withServerTime - A kept line tagged with the time it was received, unless the upstream already
+// tagged it
+func (l bncBufferedLine) withServerTime() string {
+	if m, err := irc.ParseLine(l.line); err == nil && m.Tags["time"] != "" {
+		return l.line
+	}
+
+	tag := "time=" + l.at.UTC().Format("2006-01-02T15:04:05.000Z")
+	if strings.HasPrefix(l.line, "@") {
+		return "@" + tag + ";" + l.line[1:]
+	}
+
+	return "@" + tag + " " + l.line
+}
+
+// recordBncLine - Keep what a client attaching later needs from a line sent to the client
+func (c *Client) recordBncLine(line string) {
+	b := c.bnc
+	if b == nil {
+		return
+	}
+
+	m, err := irc.ParseLine(line)
+	if err != nil {
+		return
+	}
+
+	if subcommand := m.GetParamU(1, ""); m.Command == "CAP" && (subcommand == "ACK" || subcommand == "DEL") {
+		c.shuttingDownLock.Lock()
+		for _, capability := range strings.Fields(strings.ToLower(m.GetParam(2, ""))) {
+			if subcommand == "DEL" || strings.HasPrefix(capability, "-") {
+				delete(b.caps, strings.TrimPrefix(capability, "-"))
+			} else {
+				b.caps[capability] = true
+			}
+		}
+		c.shuttingDownLock.Unlock()
+	}
+
+	if !b.welcomeDone && (m.Command == "001" || len(b.welcome) > 0) {
+		b.welcome = append(b.welcome, line)
+		if m.Command == "376" || m.Command == "422" || len(b.welcome) >= 500 {
+			b.welcomeDone = true
+		}
+	}
+}
+
+// answerBncPing - Answer the upstreams PINGs while nothing is attached to answer them. Returns
+// true if answered
+func (c *Client) answerBncPing(m *irc.Message) bool {
+	b := c.bnc
+	if b == nil || !b.detached || b.relay != nil || m.Command != "PING" {
+		return false
+	}
+
+	c.SendUpstream("PONG :" + m.GetParam(0, ""))
+	return true
+}
+
+// detachBnc - Keep the upstream connection open after the clients own transport has closed.
+// Returns false if the client should be closed as usual
+func (c *Client) detachBnc() bool {
+	b := c.bnc
+	if b == nil || c.SeenQuit || c.IsShuttingDown() || c.Gateway.bncSessions.Get(b.key) != c {
+		return false
+	}
+	if c.State != ClientStateConnected && c.reconnect == nil {
+		return false
+	}
+
+	c.shuttingDownLock.Lock()
+	b.detached = true
+	// Ends the transports writer, signals are kept from now on
+	close(c.Signals)
+	c.shuttingDownLock.Unlock()
+
+	c.bncAway()
+	return true
+}
+
+// bncAway - Mark the user as away and start the timer to close the session if nothing attaches
+func (c *Client) bncAway() {
+	cfg := c.Gateway.Config
+	b := c.bnc
+
+	if cfg.BncAwayMessage != "" && !b.away {
+		c.processLineToUpstream("AWAY :" + cfg.BncAwayMessage)
+		b.away = true
+	}
+
+	b.expire = time.NewTimer(time.Second * time.Duration(cfg.BncTimeout))
+	c.LogEvent(2, "bnc.detached", "Client detached, keeping its upstream connection for %d seconds", cfg.BncTimeout)
+}
+
+// handleBncEvent - Handle a relaying client attaching, detaching or sending a line
+func (c *Client) handleBncEvent(event bncEvent) {
+	b := c.bnc
+
+	switch event.kind {
+	case "attach":
+		c.attachBncRelay(event.client)
+
+	case "detach":
+		if b.relay != event.client {
+			return
+		}
+		c.shuttingDownLock.Lock()
+		b.relay = nil
+		c.shuttingDownLock.Unlock()
+		c.bncAway()
+
+	case "line":
+		// Lines from a client that has since been replaced are dropped
+		if b.relay == event.client {
+			c.processLineToUpstream(event.line)
+		}
+	}
+}
+
+// attachBncRelay - Send the relaying client everything it needs to carry on from where the
+// session is, then pass everything for the client on to it
+func (c *Client) attachBncRelay(relay *Client) {
+	b := c.bnc
+	if b.expire != nil {
+		b.expire.Stop()
+		b.expire = nil
+	}
+	if b.away {
+		c.processLineToUpstream("AWAY")
+		b.away = false
+	}
+
+	lines := c.bncWelcomeLines()
+
+	c.shuttingDownLock.Lock()
+	previous := b.relay
+	if !b.detached {
+		// The users previous connection is still open, eg. a phone that changed networks
+		// before the old connection timed out
+		c.Signals <- ClientSignal{"data", "ERROR :Attached from another connection"}
+		c.Signals <- ClientSignal{"state", "closed", "bnc_replaced"}
+		close(c.Signals)
+		b.detached = true
+	}
+	b.relay = relay
+	relay.sendSignal(ClientSignal{"state", "connected"})
+	for _, line := range lines {
+		relay.sendSignal(ClientSignal{"data", line})
+	}
+	b.pruneBuffer()
+	for _, buffered := range b.buffer {
+		line := buffered.line
+		if relay.bncRelay.serverTime {
+			line = buffered.withServerTime()
+		}
+		relay.sendSignal(ClientSignal{"data", line})
+	}
+	b.buffer = nil
+	c.shuttingDownLock.Unlock()
+
+	if previous != nil {
+		previous.SendIrcError("Attached from another connection")
+		previous.SendClientSignal("state", "closed", "bnc_replaced")
+		previous.StartShutdown("bnc_replaced")
+	}
+
+	c.LogEvent(2, "bnc.attached", "Client %d attached from %s", relay.Id, relay.RemoteAddr)
+
+	// The upstream sends the topic and names of each channel for the client to fill them in
+	if c.State == ClientStateConnected {
+		for _, name := range c.IrcState.ChannelNames() {
+			c.processLineToUpstream("TOPIC " + name)
+			c.processLineToUpstream("NAMES " + name)
+		}
+	}
+}
+
+// bncWelcomeLines - The registration burst with the current nick and the channels the client is in
+func (c *Client) bncWelcomeLines() []string {
+	nick := c.IrcState.Nick
+	lines := []string{}
+
+	for _, line := range c.bnc.welcome {
+		m, err := irc.ParseLine(line)
+		if err == nil && len(m.Params) > 0 && isNumericCommand(m.Command) {
+			m.Params[0] = nick
+			line = m.ToLine()
+		}
+		lines = append(lines, line)
+	}
+
+	if c.State == ClientStateConnected {
+		for _, name := range c.IrcState.ChannelNames() {
+			join := irc.NewMessage()
+			join.Prefix = &irc.Mask{Nick: nick}
+			join.Command = "JOIN"
+			join.Params = []string{name}
+			lines = append(lines, join.ToLine())
+		}
+	}
+
+	return lines
+}
+
+func isNumericCommand(command string) bool {
+	if len(command) != 3 {
+		return false
+	}
+	for _, r := range command {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bncExpired - Close a session that has been detached for too long
+func (c *Client) bncExpired() {
+	c.LogEvent(2, "bnc.expired", "Nothing attached for %d seconds, closing the session", c.Gateway.Config.BncTimeout)
+	c.processLineToUpstream("QUIT :" + c.Gateway.Config.BncQuitMessage)
+	c.StartShutdown("bnc_expired")
+}
+
+// sendBncEvent - Queue an event for the sessions goroutine. A relaying client missing a line or
+// its attach would be out of step with the session, so it is closed if the queue stays full
+func (c *Client) sendBncEvent(event bncEvent) {
+	select {
+	case c.bnc.events <- event:
+		return
+	default:
+	}
+
+	if event.kind != "line" && event.kind != "attach" {
+		c.Log(3, "Session event queue full. Dropping %s", event.kind)
+		return
+	}
+
+	timeout := time.NewTimer(bncEventTimeout)
+	defer timeout.Stop()
+	select {
+	case c.bnc.events <- event:
+	case <-timeout.C:
+		c.Log(3, "Session event queue full. Closing the relaying client %d", event.client.Id)
+		event.client.SendIrcError("Your session is not responding")
+		event.client.SendClientSignal("state", "closed", "bnc_overloaded")
+		event.client.StartShutdown("bnc_overloaded")
+	}
+}
+
+// attachBnc - Relay through the users session if it has one rather than connecting upstream.
+// Returns true if attaching
+func (c *Client) attachBnc() bool {
+	key := c.bncKey(*c.UpstreamConfig)
+	if key == "" {
+		return false
+	}
+
+	session := c.Gateway.bncSessions.Get(key)
+	if session == nil || session.IsShuttingDown() {
+		return false
+	}
+
+	relay := &bncRelay{session: session}
+	session.shuttingDownLock.Lock()
+	for capability := range session.bnc.caps {
+		relay.caps = append(relay.caps, capability)
+	}
+	session.shuttingDownLock.Unlock()
+	// Offered even if the upstream doesn't have it so that kept lines can be replayed with times
+	if !stringInSlice("server-time", relay.caps) {
+		relay.caps = append(relay.caps, "server-time")
+	}
+	sort.Strings(relay.caps)
+
+	c.bncRelay = relay
+	c.serverName = session.serverName
+	c.State = ClientStateConnected
+	c.LogEvent(2, "bnc.attaching", "Attaching to the session of client %d", session.Id)
+	return true
+}
+
+// relayToBnc - Pass a line from a relaying client on to its session. Its registration and CAP
+// negotiation are answered here as the session has already registered. Returns true if relaying
+func (c *Client) relayToBnc(line string) bool {
+	r := c.bncRelay
+	if r == nil {
+		return false
+	}
+
+	command := ""
+	m, err := irc.ParseLine(line)
+	if err == nil {
+		command = strings.ToUpper(m.Command)
+	}
+
+	if command == "CAP" {
+		c.answerBncCap(m)
+	} else if !r.attached {
+		switch command {
+		case "NICK":
+			r.sawNick = true
+		case "USER":
+			r.sawUser = true
+		}
+	} else {
+		r.session.sendBncEvent(bncEvent{kind: "line", client: c, line: line})
+	}
+
+	if !r.attached && r.sawNick && r.sawUser && !r.capNegotiating {
+		r.attached = true
+		r.session.sendBncEvent(bncEvent{kind: "attach", client: c})
+	}
+
+	return true
+}
+
+// answerBncCap - Answer CAP commands from a relaying client with the capabilities the session has
+func (c *Client) answerBncCap(m *irc.Message) {
+	r := c.bncRelay
+	target := "*"
+	if r.attached {
+		target = r.session.IrcState.Nick
+	}
+	caps := strings.Join(r.caps, " ")
+
+	switch m.GetParamU(0, "") {
+	case "LS":
+		r.capNegotiating = !r.attached
+		c.Reply("CAP " + target + " LS :" + caps)
+	case "LIST":
+		c.Reply("CAP " + target + " LIST :" + caps)
+	case "REQ":
+		r.capNegotiating = !r.attached
+		requested := m.GetParam(1, "")
+		reply := "ACK"
+		for _, capability := range strings.Fields(strings.ToLower(requested)) {
+			// Capabilities can't be changed as the session is shared
+			if !stringInSlice(capability, r.caps) {
+				reply = "NAK"
+				break
+			}
+		}
+		if reply == "ACK" && stringInSlice("server-time", strings.Fields(strings.ToLower(requested))) {
+			r.serverTime = true
+		}
+		c.Reply("CAP " + target + " " + reply + " :" + requested)
+	case "END":
+		r.capNegotiating = false
+	}
+}
@@ -0,0 +1,81 @@
+package webircgateway
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// lineBufferPool - Buffers for IRC lines and websocket messages on their way through the
+// transports, so busy clients don't allocate a buffer for each one
+var lineBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// lineBufferMaxSize - Larger buffers, eg. from a client sending huge messages, aren't kept to be
+// reused so that they don't hold on to the memory
+const lineBufferMaxSize = 64 * 1024
+
+// websocketWriteBufferPool - Shared by the websocket upgraders so that a connection only holds a
+// write buffer while it is writing, instead of one for each idle client
+var websocketWriteBufferPool = &sync.Pool{}
+
+func getLineBuffer() *bytes.Buffer {
+	buf := lineBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putLineBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > lineBufferMaxSize {
+		return
+	}
+	lineBufferPool.Put(buf)
+}
+
+// writeLine - Write line followed by end to w in a single write, without allocating a copy of
+// each line
+func writeLine(w io.Writer, line string, end string) (int, error) {
+	buf := getLineBuffer()
+	defer putLineBuffer(buf)
+
+	buf.WriteString(line)
+	buf.WriteString(end)
+	return w.Write(buf.Bytes())
+}
+
+// readWebsocketMessage - The next message from ws, read into a pooled buffer instead of one
+// grown for each message
+func readWebsocketMessage(ws *websocket.Conn) (string, error) {
+	_, r, err := ws.NextReader()
+	if err != nil {
+		return "", err
+	}
+
+	buf := getLineBuffer()
+	defer putLineBuffer(buf)
+
+	_, err = buf.ReadFrom(r)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// writeWebsocketMessage - Send message to ws without allocating a copy of it
+func writeWebsocketMessage(ws *websocket.Conn, messageType int, message string) error {
+	w, err := ws.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.WriteString(w, message); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,152 @@
+package webircgateway
+
+import (
+	"strings"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// hasCapPolicy - If the upstream limits which capabilities clients may use
+func (upstream *ConfigUpstream) hasCapPolicy() bool {
+	return len(upstream.CapAllow) > 0 || len(upstream.CapDeny) > 0
+}
+
+// capAllowed - If clients may see and request a capability. Values (sasl=PLAIN) and the removal
+// prefix (-batch) are ignored. The deny list takes priority over the allow list
+func (upstream *ConfigUpstream) capAllowed(capability string) bool {
+	name := strings.ToLower(strings.TrimPrefix(capability, "-"))
+	if pos := strings.Index(name, "="); pos > -1 {
+		name = name[:pos]
+	}
+
+	for _, denied := range upstream.CapDeny {
+		if denied == name {
+			return false
+		}
+	}
+
+	if len(upstream.CapAllow) == 0 {
+		return true
+	}
+	for _, allowed := range upstream.CapAllow {
+		if allowed == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterUpstreamCaps - Remove capabilities the clients may not use from a CAP LS or CAP NEW
+// listing sent by the upstream. Returns true if the message was modified
+func (c *Client) filterUpstreamCaps(m *irc.Message) bool {
+	subCommand := m.GetParamU(1, "")
+	if strings.ToUpper(m.Command) != "CAP" || (subCommand != "LS" && subCommand != "NEW") {
+		return false
+	}
+	if len(m.Params) < 3 || !c.UpstreamConfig.hasCapPolicy() {
+		return false
+	}
+
+	// The caps are always the last param, after the * of a multiline listing
+	capsParam := len(m.Params) - 1
+	caps := []string{}
+	for _, capability := range strings.Fields(m.Params[capsParam]) {
+		if c.UpstreamConfig.capAllowed(capability) {
+			caps = append(caps, capability)
+		}
+	}
+
+	m.Params[capsParam] = strings.Join(caps, " ")
+	return true
+}
+
+// requestForcedCaps - Request the cap_force capabilities from the upstream once its CAP LS
+// listing has ended, if it offered any of them
+func (c *Client) requestForcedCaps(m *irc.Message) {
+	if len(c.UpstreamConfig.CapForce) == 0 || c.State == ClientStateConnected {
+		return
+	}
+	if strings.ToUpper(m.Command) != "CAP" || m.GetParamU(1, "") != "LS" || len(m.Params) < 3 {
+		return
+	}
+
+	for _, capability := range strings.Fields(strings.ToLower(m.Params[len(m.Params)-1])) {
+		if pos := strings.Index(capability, "="); pos > -1 {
+			capability = capability[:pos]
+		}
+		if stringInSlice(capability, c.UpstreamConfig.CapForce) && !stringInSlice(capability, c.capForceOffered) {
+			c.capForceOffered = append(c.capForceOffered, capability)
+		}
+	}
+
+	// More of the listing follows a *
+	if m.Params[2] == "*" || len(c.capForceOffered) == 0 || c.capForceRequested != "" {
+		return
+	}
+
+	c.capForceRequested = strings.Join(c.capForceOffered, " ")
+	c.SendUpstream("CAP REQ :" + c.capForceRequested)
+}
+
+// handleForcedCapReply - The upstreams reply to requesting the cap_force capabilities. Returns true
+// if the line should not be passed on to the client, which didn't ask for them
+func (c *Client) handleForcedCapReply(m *irc.Message) bool {
+	if c.capForceRequested == "" || strings.ToUpper(m.Command) != "CAP" {
+		return false
+	}
+
+	subCommand := m.GetParamU(1, "")
+	caps := strings.Join(strings.Fields(strings.ToLower(m.GetParam(2, ""))), " ")
+	if (subCommand != "ACK" && subCommand != "NAK") || caps != c.capForceRequested {
+		return false
+	}
+
+	if subCommand == "NAK" {
+		c.Log(2, "Upstream refused the forced capabilities %s", caps)
+	}
+	c.capForceRequested = ""
+	return true
+}
+
+// rejectDeniedCapReq - Reply with a NAK if a CAP REQ from the client includes any capability the
+// client may not use. The whole request is refused as the IRCd would. Returns true if rejected
+func (c *Client) rejectDeniedCapReq(m *irc.Message) bool {
+	if m == nil || strings.ToUpper(m.Command) != "CAP" || m.GetParamU(0, "") != "REQ" {
+		return false
+	}
+	if !c.UpstreamConfig.hasCapPolicy() {
+		return false
+	}
+
+	requested := m.GetParam(1, "")
+	// message-tags may have already been removed from the request to be handled by the gateway
+	if c.RequestedMessageTagsCap != "" {
+		requested = strings.TrimSpace(requested + " " + c.RequestedMessageTagsCap)
+	}
+
+	denied := ""
+	for _, capability := range strings.Fields(requested) {
+		if !c.UpstreamConfig.capAllowed(capability) {
+			denied = capability
+			break
+		}
+	}
+	if denied == "" {
+		return false
+	}
+
+	c.Log(2, "Refusing CAP REQ for %s, denied by the upstream CAP policy", denied)
+	c.RequestedMessageTagsCap = ""
+
+	nick := c.IrcState.Nick
+	if nick == "" || c.State != ClientStateConnected {
+		nick = "*"
+	}
+
+	nak := irc.NewMessage()
+	nak.Command = "CAP"
+	nak.Params = []string{nick, "NAK", requested}
+	c.SendClientSignal("data", nak.ToLine())
+	return true
+}
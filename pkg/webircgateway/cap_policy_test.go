@@ -0,0 +1,123 @@
+package webircgateway
+
+import (
+	"testing"
+)
+
+func TestCapAllowed(t *testing.T) {
+	upstream := &ConfigUpstream{
+		CapAllow: []string{"multi-prefix", "sasl", "batch"},
+		CapDeny:  []string{"batch"},
+	}
+
+	tests := map[string]bool{
+		"multi-prefix":   true,
+		"Multi-Prefix":   true,
+		"sasl=PLAIN":     true,
+		"-multi-prefix":  true,
+		"batch":          false,
+		"away-notify":    false,
+		"-away-notify":   false,
+		"server-time=ab": false,
+	}
+	for capability, want := range tests {
+		if got := upstream.capAllowed(capability); got != want {
+			t.Errorf("capAllowed(%q) = %t, want %t", capability, got, want)
+		}
+	}
+}
+
+func TestCapReqDeniedNak(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	gateway := newTestGateway(t, upstream.config("cap_deny = batch"))
+
+	client := newTestClient(t, gateway)
+	testClientSend(client, "CAP LS 302", "NICK alice", "USER alice 0 * :Alice")
+
+	upstream.accept()
+	upstream.expect("CAP LS 302")
+	upstream.send(":irc.example.net CAP * LS :multi-prefix batch server-time")
+
+	// Denied caps are never listed. message-tags is added by the gateway
+	if line := testClientExpect(t, client, ":irc.example.net CAP * LS "); line != ":irc.example.net CAP * LS :multi-prefix server-time message-tags" {
+		t.Errorf("CAP LS = %q", line)
+	}
+
+	// The whole request is refused without reaching the upstream
+	testClientSend(client, "CAP REQ :multi-prefix batch", "CAP REQ :server-time")
+	if line := testClientExpect(t, client, "CAP "); line != "CAP * NAK :multi-prefix batch" {
+		t.Errorf("reply = %q, want %q", line, "CAP * NAK :multi-prefix batch")
+	}
+	if line := upstream.expect("CAP REQ"); line != "CAP REQ :server-time" {
+		t.Errorf("the upstream received %q, want %q", line, "CAP REQ :server-time")
+	}
+}
+
+func TestCapReqAllowListNak(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	gateway := newTestGateway(t, upstream.config("cap_allow = multi-prefix"))
+
+	client := newTestClient(t, gateway)
+	testClientSend(client, "CAP LS 302", "NICK alice", "USER alice 0 * :Alice")
+
+	upstream.accept()
+	upstream.expect("CAP LS 302")
+	upstream.send(":irc.example.net CAP * LS :multi-prefix away-notify")
+	testClientExpect(t, client, ":irc.example.net CAP * LS ")
+
+	testClientSend(client, "CAP REQ :away-notify")
+	if line := testClientExpect(t, client, "CAP "); line != "CAP * NAK away-notify" {
+		t.Errorf("reply = %q, want %q", line, "CAP * NAK away-notify")
+	}
+}
+
+func TestCapForce(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	gateway := newTestGateway(t, upstream.config("cap_force = server-time"))
+
+	client := newTestClient(t, gateway)
+	testClientSend(client, "CAP LS 302", "NICK alice", "USER alice 0 * :Alice")
+
+	upstream.accept()
+	upstream.expect("CAP LS 302")
+	upstream.send(
+		":irc.example.net CAP * LS * :multi-prefix",
+		":irc.example.net CAP * LS :server-time away-notify",
+	)
+
+	// Requested once the whole listing has been seen
+	if line := upstream.expect("CAP REQ"); line != "CAP REQ :server-time" {
+		t.Errorf("the upstream received %q, want %q", line, "CAP REQ :server-time")
+	}
+	testClientExpect(t, client, ":irc.example.net CAP * LS :server-time away-notify")
+
+	testClientSend(client, "CAP REQ :multi-prefix")
+	upstream.expect("CAP REQ :multi-prefix")
+
+	// The reply to the forced request is not for the client
+	upstream.send(
+		":irc.example.net CAP * ACK :server-time",
+		":irc.example.net CAP * ACK :multi-prefix",
+	)
+	if line := testClientExpect(t, client, ":irc.example.net CAP "); line != ":irc.example.net CAP * ACK :multi-prefix" {
+		t.Errorf("the client received %q", line)
+	}
+}
+
+func TestCapForceNotOffered(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	gateway := newTestGateway(t, upstream.config("cap_force = server-time"))
+
+	client := newTestClient(t, gateway)
+	testClientSend(client, "CAP LS 302", "NICK alice", "USER alice 0 * :Alice")
+
+	upstream.accept()
+	upstream.expect("CAP LS 302")
+	upstream.send(":irc.example.net CAP * LS :multi-prefix")
+	testClientExpect(t, client, ":irc.example.net CAP * LS ")
+
+	testClientSend(client, "CAP END")
+	if line := upstream.expect("CAP "); line != "CAP END" {
+		t.Errorf("the upstream received %q, want CAP END", line)
+	}
+}
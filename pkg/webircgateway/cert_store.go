@@ -0,0 +1,97 @@
+package webircgateway
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for changes while handshaking
+const certStoreCheckInterval = time.Second * 30
+
+// CertStore - A TLS certificate loaded from a cert and key file, read again when the files
+// change or the config is reloaded so that renewed certificates are used without a restart
+type CertStore struct {
+	gateway   *Gateway
+	certFile  string
+	keyFile   string
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func NewCertStore(gateway *Gateway, certFile string, keyFile string) *CertStore {
+	return &CertStore{gateway: gateway, certFile: certFile, keyFile: keyFile}
+}
+
+// Load - Read the certificate files. The previous certificate is kept if they can't be read
+func (c *CertStore) Load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.load()
+}
+
+func (c *CertStore) load() error {
+	modTime := c.filesModTime()
+	c.lastCheck = time.Now()
+
+	keyPair, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if c.cert != nil {
+		c.gateway.Log(2, "Loaded new TLS certificate from %s", c.certFile)
+	}
+	c.cert = &keyPair
+	c.modTime = modTime
+
+	return nil
+}
+
+// filesModTime - The latest modification time of the cert and key files
+func (c *CertStore) filesModTime() time.Time {
+	latest := time.Time{}
+	for _, file := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest
+}
+
+// GetCertificate - Used as tls.Config.GetCertificate. The files are read again if they have
+// changed since last checked
+func (c *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.lastCheck) >= certStoreCheckInterval {
+		c.lastCheck = time.Now()
+		if !c.filesModTime().Equal(c.modTime) {
+			if err := c.load(); err != nil {
+				c.gateway.Log(3, "Error loading TLS certificate %s, using the previous certificate: %s", c.certFile, err.Error())
+			}
+		}
+	}
+
+	return c.cert, nil
+}
+
+// ReloadCertificates - Read the certificate files of all TLS servers and upstreams again
+func (s *Gateway) ReloadCertificates() {
+	s.upstreamCerts.Reset()
+
+	s.httpSrvsMu.Lock()
+	stores := append([]*CertStore{}, s.certStores...)
+	s.httpSrvsMu.Unlock()
+
+	for _, store := range stores {
+		if err := store.Load(); err != nil {
+			s.Log(3, "Error loading TLS certificate %s, using the previous certificate: %s", store.certFile, err.Error())
+		}
+	}
+}
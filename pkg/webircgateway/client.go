@@ -2,25 +2,31 @@ package webircgateway
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"golang.org/x/time/rate"
 
 	"sync"
 
-	"github.com/kiwiirc/webircgateway/pkg/dnsbl"
 	"github.com/kiwiirc/webircgateway/pkg/irc"
 	"github.com/kiwiirc/webircgateway/pkg/proxy"
+	"github.com/kiwiirc/webircgateway/pkg/proxyprotocol"
 )
 
 const (
@@ -62,6 +68,9 @@ type Client struct {
 	DestTLS          bool
 	IrcState         *irc.State
 	Encoding         string
+	// RawBytes - The transport carries the bytes of lines as they are, so lines are not converted
+	// between Encoding and UTF-8
+	RawBytes bool
 	// Tags get passed upstream via the WEBIRC command
 	Tags map[string]string
 	// Captchas may be needed to verify a client
@@ -77,6 +86,106 @@ type Client struct {
 	}
 	// The specific message-tags CAP that the client has requested if we are wrapping it
 	RequestedMessageTagsCap string
+	// capForceOffered / capForceRequested - The [upstream] cap_force capabilities the upstream
+	// listed in CAP LS, and those asked for on the clients behalf while waiting for the reply
+	capForceOffered   []string
+	capForceRequested string
+	// The reason given to the transport when the upstream closes, if known
+	upstreamCloseReason string
+	// Byte counts of data passed over the transport
+	Stats TransportStats
+	// Clients with the same AffinityKey are sent to the same upstream. Plugins may set this
+	// before the upstream connection is made, otherwise it depends on the affinity config
+	AffinityKey string
+	// The reconnect token the client sent with its request, for [upstream_affinity] key = token
+	affinityToken string
+	// TLS details of the clients connection to us. Empty if the client did not connect over TLS
+	// to the gateway itself
+	TLSVersion string
+	TLSCipher  string
+	// TLSCertFP - The SHA-256 fingerprint of the certificate the client presented, if any
+	TLSCertFP string
+	// The websocket close code and reason given when the client closed its transport. 0 if the
+	// transport doesn't support close codes
+	TransportCloseCode   int
+	TransportCloseReason string
+	// Nick changes the client asked for that the upstream hasn't answered yet, oldest first.
+	// Guarded by requestedNicksLock
+	requestedNicks     []string
+	requestedNicksLock sync.Mutex
+	// The upstreams NICKLEN, which requested nicks may have been truncated to. 0 if unknown
+	nickLen int
+	// Set when the client is to be disconnected after being killed or having its nick forced
+	forcedDisconnect       string
+	forcedDisconnectReason string
+	// WEBIRC passwords left to try for the upstream, the one in use first
+	webircPasswords []string
+	// Set when the upstream rejected the WEBIRC password and the next will be tried once closed
+	webircRetry bool
+	// Lines sent upstream during registration, replayed when trying the next WEBIRC password
+	registrationLines []string
+	// Failover hosts of the upstream left to try, and the upstream before a host was picked
+	failoverHosts []string
+	upstreamBlock *ConfigUpstream
+	// Reconnecting to the upstream after it dropped the registered client
+	reconnect      *upstreamReconnect
+	reconnectLines []string
+	// Keys of the channels the client joined, by lowercased name
+	channelKeys map[string]string
+	// Credentials from the HTTP request for [sasl], and the login in progress
+	saslAccount  string
+	saslPassword string
+	sasl         *saslSession
+	idle         *clientIdle
+	// All writes to upstream go through this queue. Guarded by upstreamWriteLock
+	upstreamWriteQueue chan upstreamWrite
+	upstreamWriteLock  sync.Mutex
+	upstreamWriterDone chan struct{}
+	// Whether this clients traffic is being written to the debug capture file. Set with atomics
+	// while holding the gateways DebugCapture lock so that Record can skip the lock when off
+	debugCapture int32
+	// Guarded by the gateways DebugCapture
+	debugCapturePending []string
+	// Channels the client has sent a JOIN for, lowercased
+	clientJoined map[string]bool
+	autoJoined   bool
+	// The hostname of the page the client connected from, if given
+	OriginHost string
+	// Origin - The lowercased Origin header the client connected with, if given
+	Origin string
+	// Limits the CTCP queries passed on to the client, if configured
+	ctcpLimiter *rate.Limiter
+	// The config section name of the server the client connected through, eg. server.1
+	Listener string
+	// Set once the upstreams isupport_set tokens have been sent to the client
+	isupportSet bool
+	// 1 when the client was disconnected for not reading what was written to its transport. Set by
+	// the transports writer so read with atomics
+	slowClient int32
+	// The name the IRC server gave itself when registering the client
+	serverName string
+	// The root span of the clients trace and the span timing its registration. nil if not traced
+	traceSpan        *Span
+	registrationSpan *Span
+	// registrationTimer - Fires if the upstream hasn't registered the client within its
+	// registration_timeout. nil when not registering
+	registrationTimer *time.Timer
+	// AuthClaims - The claims of the JWT the client connected with, if [auth_jwt] is enabled
+	AuthClaims map[string]interface{}
+	// RequestHeaders - Headers of the HTTP request the client connected with. nil for TCP clients
+	RequestHeaders http.Header
+	// Country / ASN / ASOrg - Where the client connected from, if [geoip] databases are configured.
+	// Empty or 0 when not known
+	Country string
+	ASN     uint
+	ASOrg   string
+	// Limits the lines passed upstream once registered, if [limits] flood_rate is set
+	flood *floodControl
+	// ipLimitKey - The address group the client counts towards for [limits] max_clients_per_ip
+	ipLimitKey string
+	// The clients [bnc] session, or the session it is attached to instead of an upstream
+	bnc      *bncSession
+	bncRelay *bncRelay
 }
 
 var nextClientID uint64 = 1
@@ -99,7 +208,12 @@ func NewClient(gateway *Gateway) *Client {
 		Tags:           make(map[string]string),
 		IrcState:       irc.NewState(),
 		UpstreamConfig: &ConfigUpstream{},
+		clientJoined:   make(map[string]bool),
+		channelKeys:    make(map[string]string),
+		traceSpan:      gateway.tracer.StartTrace("client"),
+		idle:           newClientIdle(gateway.Config),
 	}
+	c.traceSpan.SetAttribute("client.id", strconv.FormatUint(thisID, 10))
 
 	// Auto enable some features by default. They may be disabled later on
 	c.Features.ExtJwt = true
@@ -115,10 +229,15 @@ func NewClient(gateway *Gateway) *Client {
 	// Add to the clients maps and wait until everything has been marked
 	// as completed (several routines add themselves to EndWG so that we can catch
 	// when they are all completed)
-	gateway.Clients.Set(strconv.FormatUint(c.Id, 10), c)
+	gateway.Clients.Add(c)
 	go func() {
 		c.EndWG.Wait()
-		gateway.Clients.Remove(strconv.FormatUint(c.Id, 10))
+		gateway.Clients.Remove(c)
+		if c.Listener != "" {
+			gateway.listenerLimits.Remove(c.Listener)
+		}
+		gateway.ipLimits.Remove(c)
+		c.endTrace()
 
 		hook := &HookClientState{
 			Client:    c,
@@ -131,15 +250,51 @@ func NewClient(gateway *Gateway) *Client {
 		Client:    c,
 		Connected: true,
 	}
+	hookSpan := c.traceHook("client.state")
 	hook.Dispatch("client.state")
+	hookSpan.End()
 
 	return c
 }
 
-// Log - Log a line of text with context of this client
-func (c *Client) Log(level int, format string, args ...interface{}) {
-	prefix := fmt.Sprintf("client:%d ", c.Id)
-	c.Gateway.Log(level, prefix+format, args...)
+// SetOrigin - Record the page the client connected from, given the Origin header
+func (c *Client) SetOrigin(originHeader string) {
+	if originHeader == "" {
+		return
+	}
+
+	c.Origin = strings.ToLower(originHeader)
+	origin, err := url.Parse(originHeader)
+	if err == nil {
+		c.OriginHost = origin.Hostname()
+	}
+}
+
+// SetListener - Record the listener the client connected through so that it counts towards
+// that listeners max_clients
+func (c *Client) SetListener(listener string) {
+	if listener == "" || c.Listener != "" {
+		return
+	}
+
+	c.Listener = listener
+	c.Gateway.listenerLimits.Add(listener)
+}
+
+// SetTLSState - Record the TLS details of the clients connection to the gateway
+func (c *Client) SetTLSState(state *tls.ConnectionState) {
+	c.TLSVersion, c.TLSCipher = tlsStateNames(state)
+
+	if c.Gateway.Config.WebircTLSInfo && state != nil {
+		c.Tags["tls-version"] = c.TLSVersion
+		c.Tags["tls-cipher"] = c.TLSCipher
+	}
+
+	if state != nil && len(state.PeerCertificates) > 0 {
+		fingerprint := sha256.Sum256(state.PeerCertificates[0].Raw)
+		c.TLSCertFP = hex.EncodeToString(fingerprint[:])
+		c.Tags["certfp-sha-256"] = c.TLSCertFP
+	}
 }
 
 // TrafficLog - Log out raw IRC traffic
@@ -154,15 +309,53 @@ func (c *Client) TrafficLog(isUpstream bool, toGateway bool, traffic string) {
 	} else if !isUpstream && !toGateway {
 		label = "->Client"
 	}
-	c.Log(1, fmt.Sprintf("Traffic (%s) %s", label, traffic))
+	c.LogEvent(1, "traffic", "Traffic (%s) %s", label, traffic)
+	c.Gateway.debugCapture.Record(c, label, traffic)
 }
 
 func (c *Client) Ready() {
-	dnsblAction := c.Gateway.Config.DnsblAction
-	validAction := dnsblAction == "verify" || dnsblAction == "deny"
-	dnsblTookAction := ""
+	if !c.Gateway.ipAccess.Allowed(net.ParseIP(c.RemoteAddr)) {
+		c.SendIrcError("You are not allowed to connect")
+		c.SendClientSignal("state", "closed", "ip_denied")
+		c.StartShutdown("ip_denied")
+		return
+	}
+
+	if !c.checkGeoIP() {
+		c.SendIrcError("You are not allowed to connect")
+		c.SendClientSignal("state", "closed", "geoip_denied")
+		c.StartShutdown("geoip_denied")
+		return
+	}
+
+	if allowed, reason := c.Gateway.reputation.Check(c.RemoteAddr, c.RequestHeaders); !allowed {
+		c.LogEvent(2, "client.reputation_rejected", "Connection from %s refused by the reputation service: %s", c.RemoteAddr, reason)
+		c.SendIrcError("You are not allowed to connect")
+		c.SendClientSignal("state", "closed", "reputation_rejected")
+		c.StartShutdown("reputation_rejected")
+		return
+	}
+
+	if admissionErr := c.Gateway.admission.Check(); admissionErr != "" {
+		c.SendIrcError("Server is full, please try again later")
+		c.SendClientSignal("state", "closed", "server_full")
+		c.StartShutdown("server_full")
+		return
+	}
 
-	if len(c.Gateway.Config.DnsblServers) > 0 && c.RemoteAddr != "" && !c.Verified && validAction {
+	if !c.Gateway.ipLimits.Add(c) {
+		c.LogEvent(2, "client.ip_limited", "Connection from %s refused, too many clients from the address", c.RemoteAddr)
+		c.Gateway.logRejection(c.RemoteAddr, "ip_limited")
+		c.SendIrcError("Too many connections from your address")
+		c.SendClientSignal("state", "closed", "ip_limited")
+		c.StartShutdown("ip_limited")
+		return
+	}
+
+	c.Gateway.debugCapture.Select(c)
+
+	dnsblTookAction := ""
+	if len(c.Gateway.Config.DnsblServers) > 0 && c.RemoteAddr != "" {
 		dnsblTookAction = c.checkDnsBl()
 	}
 
@@ -171,14 +364,61 @@ func (c *Client) Ready() {
 	}
 }
 
+// checkDnsBl - Look the client up on each DNSBL and take the actions of those it is listed on.
+// Returns "deny" or "verify" if the client was denied or now needs a captcha
 func (c *Client) checkDnsBl() (tookAction string) {
-	dnsResult := dnsbl.Lookup(c.Gateway.Config.DnsblServers, c.RemoteAddr)
-	if dnsResult.Listed && c.Gateway.Config.DnsblAction == "deny" {
+	cfg := c.Gateway.Config
+
+	servers := []string{}
+	for _, server := range cfg.DnsblServers {
+		action := cfg.dnsblServerAction(server)
+		// Verified clients have already passed a captcha
+		if !isDnsblAction(action) || (c.Verified && (action == "deny" || action == "verify")) {
+			continue
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		return
+	}
+
+	dnsResult := c.Gateway.dnsblLookup(servers, c.RemoteAddr)
+
+	listedOn := make(map[string]bool)
+	tagged := []string{}
+	deny := false
+	verify := false
+	for _, res := range dnsResult.Results {
+		if res.Error {
+			c.Log(2, "DNSBL lookup of %s on %s failed: %s", res.Address, res.Blacklist, res.ErrorType.Error())
+		}
+		if !res.Listed || listedOn[res.Blacklist] {
+			continue
+		}
+		listedOn[res.Blacklist] = true
+
+		action := cfg.dnsblServerAction(res.Blacklist)
+		c.LogEvent(2, "client.dnsbl_listed", "%s is listed on %s, action %s %s", res.Address, res.Blacklist, action, res.Text)
+		switch action {
+		case "deny":
+			deny = true
+		case "verify":
+			verify = true
+		case "tag":
+			tagged = append(tagged, res.Blacklist)
+		}
+	}
+
+	if len(tagged) > 0 {
+		c.Tags["dnsbl"] = strings.Join(tagged, ",")
+	}
+
+	if deny {
 		c.SendIrcError("Blocked by DNSBL")
 		c.SendClientSignal("state", "closed", "dnsbl_listed")
 		c.StartShutdown("dnsbl")
 		tookAction = "deny"
-	} else if dnsResult.Listed && c.Gateway.Config.DnsblAction == "verify" {
+	} else if verify {
 		c.RequiresVerification = true
 		c.SendClientSignal("data", "CAPTCHA NEEDED")
 		tookAction = "verify"
@@ -200,45 +440,141 @@ func (c *Client) StartShutdown(reason string) {
 	c.Log(1, "StartShutdown(%s) ShuttingDown=%t", reason, c.shuttingDown)
 	if !c.shuttingDown {
 		c.shuttingDown = true
+		c.traceSpan.SetAttribute("close.reason", reason)
 		c.State = ClientStateEnding
 
+		if rejectReason, isRejection := clientRejectionReasons[reason]; isRejection {
+			c.Gateway.logRejection(c.RemoteAddr, rejectReason)
+		}
+
 		switch reason {
 		case "upstream_closed":
-			c.Log(2, "Upstream closed the connection")
+			c.LogEvent(2, "client.closed", "Upstream closed the connection")
 		case "err_connecting_upstream":
 		case "err_no_upstream":
 			// Error has been logged already
 		case "client_closed":
-			c.Log(2, "Client disconnected")
+			c.LogEvent(2, "client.closed", "Client disconnected")
 		default:
-			c.Log(2, "Closed: %s", reason)
+			c.LogEvent(2, "client.closed", "Closed: %s", reason)
 		}
 
-		close(c.Signals)
+		if c.bnc != nil {
+			c.Gateway.bncSessions.Remove(c.bnc.key, c)
+			if c.bnc.relay != nil {
+				c.bnc.relay.StartShutdown(reason)
+			}
+		}
+		// A detached sessions signals were closed along with its transport
+		if c.bnc == nil || !c.bnc.detached {
+			close(c.Signals)
+		}
 		c.EndWG.Done()
 	}
 }
 
+// clientCloseQuitMessage - The QUIT message sent upstream on behalf of a client that closed its
+// transport, including its websocket close reason if it gave one
+func (c *Client) clientCloseQuitMessage() string {
+	if atomic.LoadInt32(&c.slowClient) == 1 {
+		return "Slow client"
+	}
+
+	message := c.Gateway.Config.SendQuitOnClientClose
+
+	switch c.TransportCloseCode {
+	case 0:
+	case websocket.CloseNormalClosure, websocket.CloseGoingAway:
+		if c.TransportCloseReason != "" && c.Gateway.Config.QuitOnCloseReason != "" {
+			message = c.Gateway.Config.QuitOnCloseReason
+		}
+	default:
+		if c.Gateway.Config.QuitOnAbnormalClose != "" {
+			message = c.Gateway.Config.QuitOnAbnormalClose
+		}
+	}
+
+	// The close reason comes from the client so it must not be able to inject extra IRC lines
+	reason := stripLineBreaks(c.TransportCloseReason)
+
+	message = strings.Replace(message, "%c", strconv.Itoa(c.TransportCloseCode), -1)
+	message = strings.Replace(message, "%r", reason, -1)
+	return message
+}
+
+// transportWriteDeadline - The deadline for a write to the clients transport that is about to be
+// made. A zero time if writes have no timeout
+func (c *Client) transportWriteDeadline() time.Time {
+	if c.Gateway.Config.ClientWriteTimeout <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(time.Second * time.Duration(c.Gateway.Config.ClientWriteTimeout))
+}
+
+// transportWriteFailed - Called by transports when a write to the client fails, before they close
+// the connection
+func (c *Client) transportWriteFailed(err error) {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		c.LogEvent(2, "client.slow", "Disconnecting slow client, a write took longer than %d seconds", c.Gateway.Config.ClientWriteTimeout)
+		atomic.StoreInt32(&c.slowClient, 1)
+		return
+	}
+
+	c.Log(1, "Error writing to the client: %s", err.Error())
+}
+
 func (c *Client) SendClientSignal(signal string, args ...string) {
+	switch len(args) {
+	case 0:
+		c.sendSignal(ClientSignal{signal})
+	case 1:
+		c.sendSignal(ClientSignal{signal, args[0]})
+	case 2:
+		c.sendSignal(ClientSignal{signal, args[0], args[1]})
+	}
+}
+
+func (c *Client) sendSignal(signal ClientSignal) {
 	c.shuttingDownLock.Lock()
 	defer c.shuttingDownLock.Unlock()
 
-	if !c.shuttingDown {
-		switch len(args) {
-		case 0:
-			c.Signals <- ClientSignal{signal}
-		case 1:
-			c.Signals <- ClientSignal{signal, args[0]}
-		case 2:
-			c.Signals <- ClientSignal{signal, args[0], args[1]}
-		}
+	if c.shuttingDown {
+		return
+	}
+
+	// Once detached the signals go to whichever client is attached to the session
+	if c.bnc != nil && c.bnc.detached {
+		c.bnc.keepBncSignal(signal)
+		return
 	}
+
+	c.Signals <- signal
 }
 
 func (c *Client) SendIrcError(message string) {
 	c.SendClientSignal("data", "ERROR :"+message)
 }
 
+// Reply - Send the client a line as if it came from the IRC server, eg. when a plugin answers a
+// command itself. Lines without a prefix are given the servers name
+func (c *Client) Reply(line string) {
+	line = stripLineBreaks(line)
+	if line == "" {
+		return
+	}
+
+	if line[0] != ':' && line[0] != '@' {
+		serverName := c.serverName
+		if serverName == "" {
+			serverName = "webircgateway"
+		}
+		line = ":" + serverName + " " + line
+	}
+
+	c.SendClientSignal("data", line)
+}
+
 func (c *Client) connectUpstream() {
 	client := c
 
@@ -249,7 +585,7 @@ func (c *Client) connectUpstream() {
 	if client.DestHost == "" {
 		client.Log(2, "Using configured upstream")
 		var err error
-		upstreamConfig, err = c.Gateway.findUpstream()
+		upstreamConfig, err = c.Gateway.findUpstream(c)
 		if err != nil {
 			client.Log(3, "No upstreams available")
 			client.SendIrcError("The server has not been configured")
@@ -270,19 +606,28 @@ func (c *Client) connectUpstream() {
 	}
 
 	c.UpstreamConfig = &upstreamConfig
+	c.Gateway.Clients.indexUpstreamHost(c)
 
 	hook := &HookIrcConnectionPre{
 		Client:         client,
 		UpstreamConfig: &upstreamConfig,
 	}
+	hookSpan := c.traceHook("irc.connection.pre")
 	hook.Dispatch("irc.connection.pre")
+	hookSpan.End()
 	if hook.Halt {
 		client.SendClientSignal("state", "closed", "err_forbidden")
 		client.StartShutdown("err_connecting_upstream")
 		return
 	}
 
+	if client.attachBnc() {
+		return
+	}
+	client.maybeStartBnc()
+
 	client.State = ClientStateConnecting
+	client.startFailover()
 
 	upstream, upstreamErr := client.makeUpstreamConnection()
 	if upstreamErr != nil {
@@ -291,11 +636,22 @@ func (c *Client) connectUpstream() {
 	}
 
 	client.State = ClientStateRegistering
+	client.registrationSpan = c.traceSpan.StartChild("irc.registration")
+
+	client.webircPasswords = c.Gateway.webircPasswords.Candidates(*client.UpstreamConfig)
+	if len(client.webircPasswords) > 0 {
+		client.UpstreamConfig.WebircPassword = client.webircPasswords[0]
+	}
 
 	client.upstream = upstream
+	client.startRegistrationTimeout()
+	client.startUpstreamWriter(upstream)
 	client.readUpstream()
-	client.writeWebircLines(upstream)
-	client.maybeSendPass(upstream)
+	webircSpan := c.traceSpan.StartChild("upstream.webirc")
+	client.writeWebircLines()
+	client.maybeSendPass()
+	client.maybeStartSasl()
+	client.afterUpstreamWrites(webircSpan.End)
 	client.SendClientSignal("state", "connected")
 }
 
@@ -303,6 +659,52 @@ func (c *Client) makeUpstreamConnection() (io.ReadWriteCloser, error) {
 	client := c
 	upstreamConfig := c.UpstreamConfig
 
+	connection, errString, err := client.dialUpstreamHosts()
+
+	// Try the standby upstream if the primary could not be reached at all
+	if err != nil && upstreamConfig.Fallback != nil {
+		fallback := *upstreamConfig.Fallback
+		client.Log(3, "Upstream %s is unreachable, trying fallback upstream %s", upstreamAddrKey(*upstreamConfig), upstreamAddrKey(fallback))
+
+		connection, errString, err = client.dialUpstreamWithRetries(&fallback)
+		if err == nil {
+			// The client stays on the fallback for the rest of its session
+			client.UpstreamConfig = &fallback
+			notice := irc.NewMessage()
+			notice.Command = "NOTICE"
+			notice.Params = []string{"*", "The IRC server is unreachable, you have been connected to a standby server"}
+			client.SendClientSignal("data", notice.ToLine())
+		}
+	}
+
+	if err != nil {
+		client.SendClientSignal("state", "closed", errString)
+		client.StartShutdown("err_connecting_upstream")
+		return nil, errors.New("error connecting upstream")
+	}
+
+	client.LogEvent(2, "upstream.connected", "Connected to upstream %s", upstreamAddrKey(*client.UpstreamConfig))
+	client.Gateway.Clients.indexUpstreamHost(client)
+	return connection, nil
+}
+
+// dialUpstreamWithRetries - Connect to an upstream, retrying as many times as it is configured to
+func (c *Client) dialUpstreamWithRetries(upstreamConfig *ConfigUpstream) (io.ReadWriteCloser, string, error) {
+	connection, errString, err := c.tracedDialUpstream(upstreamConfig, 0)
+	for attempt := 0; err != nil && attempt < upstreamConfig.Retries && !c.IsShuttingDown(); attempt++ {
+		time.Sleep(time.Second)
+		c.Log(2, "Retrying connection to upstream %s", upstreamAddrKey(*upstreamConfig))
+		connection, errString, err = c.tracedDialUpstream(upstreamConfig, attempt+1)
+	}
+
+	return connection, errString, err
+}
+
+// dialUpstream - Make a single connection attempt to an upstream. On failure the returned string
+// is the reason to give the client
+func (c *Client) dialUpstream(upstreamConfig *ConfigUpstream) (io.ReadWriteCloser, string, error) {
+	client := c
+
 	var connection io.ReadWriteCloser
 
 	if upstreamConfig.Proxy == nil {
@@ -310,24 +712,31 @@ func (c *Client) makeUpstreamConnection() (io.ReadWriteCloser, error) {
 		dialer := net.Dialer{}
 		dialer.Timeout = time.Second * time.Duration(upstreamConfig.Timeout)
 
-		var conn net.Conn
+		// A preconnected connection has already completed any TLS handshake
+		conn, pooled := c.Gateway.upstreamPool.Take(*upstreamConfig)
 		var connErr error
-		if upstreamConfig.Network == "unix" {
-			conn, connErr = dialer.Dial("unix", upstreamConfig.Hostname)
+		if pooled {
+			client.Log(1, "Using a preconnected upstream connection")
 		} else {
-			upstreamStr := fmt.Sprintf("%s:%d", upstreamConfig.Hostname, upstreamConfig.Port)
-			conn, connErr = dialer.Dial("tcp", upstreamStr)
+			conn, connErr = dialUpstreamConn(c.Gateway.dnsResolver, *upstreamConfig, &dialer)
 		}
 
 		if connErr != nil {
-			client.Log(3, "Error connecting to the upstream IRCd. %s", connErr.Error())
+			client.LogEvent(3, "upstream.error", "Error connecting to the upstream IRCd. %s", connErr.Error())
 			errString := ""
 			if errString = typeOfErr(connErr); errString != "" {
 				errString = "err_" + errString
 			}
-			client.SendClientSignal("state", "closed", errString)
-			client.StartShutdown("err_connecting_upstream")
-			return nil, errors.New("error connecting upstream")
+			return nil, errString, connErr
+		}
+
+		// The PROXY header comes before anything else on the connection, including the TLS handshake
+		if upstreamConfig.ProxyProtocol {
+			if err := c.writeProxyProtocolHeader(conn); err != nil {
+				client.LogEvent(3, "upstream.error", "Error sending the PROXY protocol header to the upstream IRCd. %s", err.Error())
+				conn.Close()
+				return nil, "", err
+			}
 		}
 
 		// Add the ports into the identd before possible TLS handshaking. If we do it after then
@@ -342,15 +751,28 @@ func (c *Client) makeUpstreamConnection() (io.ReadWriteCloser, error) {
 			c.Gateway.identdServ.AddIdent(client.IrcState.LocalPort, client.IrcState.RemotePort, client.IrcState.Username, "")
 		}
 
-		if upstreamConfig.TLS {
-			tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if upstreamConfig.TLS && !pooled {
+			tlsConfig := upstreamTLSConfig(*upstreamConfig)
+			clientCert, certErr := c.upstreamClientCertificate(upstreamConfig)
+			if certErr != nil {
+				client.LogEvent(3, "upstream.error", "Error loading the client certificate for the upstream IRCd. %s", certErr.Error())
+				conn.Close()
+				return nil, "err_tls", certErr
+			}
+			if clientCert != nil {
+				tlsConfig.Certificates = []tls.Certificate{*clientCert}
+			}
+
+			if upstreamConfig.TLSTimeout > 0 {
+				conn.SetDeadline(time.Now().Add(time.Second * time.Duration(upstreamConfig.TLSTimeout)))
+			}
 			tlsConn := tls.Client(conn, tlsConfig)
 			err := tlsConn.Handshake()
+			conn.SetDeadline(time.Time{})
 			if err != nil {
-				client.Log(3, "Error connecting to the upstream IRCd. %s", err.Error())
-				client.SendClientSignal("state", "closed", "err_tls")
-				client.StartShutdown("err_connecting_upstream")
-				return nil, errors.New("error connecting upstream")
+				client.LogEvent(3, "upstream.error", "Error connecting to the upstream IRCd. %s", err.Error())
+				conn.Close()
+				return nil, "err_tls", err
 			}
 
 			conn = net.Conn(tlsConn)
@@ -388,18 +810,16 @@ func (c *Client) makeUpstreamConnection() (io.ReadWriteCloser, error) {
 				dialErr.Error(),
 			)
 
-			client.SendClientSignal("state", "closed", errString)
-			client.StartShutdown("err_connecting_upstream")
-			return nil, errors.New("error connecting upstream")
+			return nil, errString, dialErr
 		}
 
 		connection = conn
 	}
 
-	return connection, nil
+	return connection, "", nil
 }
 
-func (c *Client) writeWebircLines(upstream io.ReadWriteCloser) {
+func (c *Client) writeWebircLines() {
 	// Send any WEBIRC lines
 	if c.UpstreamConfig.WebircPassword == "" {
 		c.Log(1, "No webirc to send")
@@ -414,12 +834,29 @@ func (c *Client) writeWebircLines(upstream io.ReadWriteCloser) {
 		gatewayName = c.UpstreamConfig.GatewayName
 	}
 
-	webircTags := c.buildWebircTags()
+	// Plugins may add their own flags
+	hook := &HookIrcWebirc{
+		Client:         c,
+		UpstreamConfig: c.UpstreamConfig,
+		Tags:           make(map[string]string),
+	}
+	for key, val := range c.Tags {
+		hook.Tags[key] = val
+	}
+	hookSpan := c.traceHook("irc.webirc")
+	hook.Dispatch("irc.webirc")
+	hookSpan.End()
+
+	webircTags := c.buildWebircTags(hook.Tags)
 	if strings.Contains(webircTags, " ") {
 		webircTags = ":" + webircTags
 	}
 
 	clientHostname := c.RemoteHostname
+	if c.UpstreamConfig.Onion {
+		// The hostname was looked up outside of Tor and means nothing to an onion network
+		clientHostname = c.RemoteAddr
+	}
 	if c.Gateway.Config.ClientHostname != "" {
 		clientHostname = makeClientReplacements(c.Gateway.Config.ClientHostname, c)
 	}
@@ -432,39 +869,167 @@ func (c *Client) writeWebircLines(upstream io.ReadWriteCloser) {
 	}
 
 	webircLine := fmt.Sprintf(
-		"WEBIRC %s %s %s %s %s\n",
+		"WEBIRC %s %s %s %s %s",
 		c.UpstreamConfig.WebircPassword,
 		gatewayName,
 		clientHostname,
 		remoteAddr,
 		webircTags,
 	)
-	c.Log(1, "->upstream: %s", webircLine)
-	upstream.Write([]byte(webircLine))
+	c.Log(1, "WEBIRC sent to %s: %s", upstreamAddrKey(*c.UpstreamConfig), redactSecret(webircLine, c.UpstreamConfig.WebircPassword))
+	c.SendUpstream(webircLine)
 }
 
-func (c *Client) maybeSendPass(upstream io.ReadWriteCloser) {
+// writeProxyProtocolHeader - Send a PROXY protocol v2 header with the clients address and the
+// details of its TLS connection to the gateway, if it used one
+func (c *Client) writeProxyProtocolHeader(conn net.Conn) error {
+	var src *net.TCPAddr
+	if ip := net.ParseIP(c.RemoteAddr); ip != nil {
+		port, _ := strconv.Atoi(c.Tags["remote-port"])
+		src = &net.TCPAddr{IP: ip, Port: port}
+	}
+	dst, _ := conn.RemoteAddr().(*net.TCPAddr)
+
+	var ssl *proxyprotocol.SSLInfo
+	if c.TLSVersion != "" {
+		ssl = &proxyprotocol.SSLInfo{Version: c.TLSVersion, Cipher: c.TLSCipher}
+	}
+
+	c.Log(1, "Sending PROXY protocol header to %s for %s", upstreamAddrKey(*c.UpstreamConfig), c.RemoteAddr)
+	return proxyprotocol.WriteV2Header(conn, src, dst, ssl)
+}
+
+func (c *Client) maybeSendPass() {
 	if c.UpstreamConfig.ServerPassword == "" {
 		return
 	}
 	c.SentPass = true
 	passLine := fmt.Sprintf(
-		"PASS %s\n",
+		"PASS %s",
 		c.UpstreamConfig.ServerPassword,
 	)
-	c.Log(1, "->upstream: %s", passLine)
-	upstream.Write([]byte(passLine))
+	c.Log(1, "->upstream: %s", redactSecret(passLine, c.UpstreamConfig.ServerPassword))
+	c.SendUpstream(passLine)
+}
+
+// SendUpstream - Send a raw line to the IRCd. Lines from all callers are written one at a time,
+// in the order they were sent, so they never interleave on the connection. Unlike lines sent
+// from the client, these are not passed through any hooks or encoding.
+func (c *Client) SendUpstream(line string) {
+	c.upstreamWriteLock.Lock()
+	defer c.upstreamWriteLock.Unlock()
+
+	if c.upstreamWriteQueue == nil {
+		c.Log(2, "Tried sending data upstream before connected")
+		return
+	}
+
+	c.upstreamWriteQueue <- upstreamWrite{line: strings.TrimRight(line, "\r\n")}
+}
+
+// afterUpstreamWrites - Call fn from the upstream writer once the lines sent before it have been
+// written, or straight away if there is no upstream connection
+func (c *Client) afterUpstreamWrites(fn func()) {
+	c.upstreamWriteLock.Lock()
+	defer c.upstreamWriteLock.Unlock()
+
+	if c.upstreamWriteQueue == nil {
+		fn()
+		return
+	}
+
+	c.upstreamWriteQueue <- upstreamWrite{written: fn}
+}
+
+// upstreamWrite - A line queued to be written upstream, or a function to call once the lines
+// queued before it have been written
+type upstreamWrite struct {
+	line    string
+	written func()
+}
+
+func (c *Client) startUpstreamWriter(upstream io.Writer) {
+	c.upstreamWriteLock.Lock()
+	c.upstreamWriteQueue = make(chan upstreamWrite, 50)
+	c.upstreamWriterDone = make(chan struct{})
+	queue := c.upstreamWriteQueue
+	done := c.upstreamWriterDone
+	c.upstreamWriteLock.Unlock()
+
+	go func() {
+		defer close(done)
+
+		var writeErr error
+		for write := range queue {
+			if write.written != nil {
+				write.written()
+				continue
+			}
+
+			// Keep draining the queue after an error so that senders never block
+			if writeErr != nil {
+				continue
+			}
+
+			_, writeErr = writeLine(upstream, write.line, "\r\n")
+			if writeErr != nil {
+				c.Log(1, "Error writing upstream: %s", writeErr.Error())
+			}
+		}
+	}()
+}
+
+// stopUpstreamWriter - Stop accepting new upstream lines and wait a short time for the queued
+// lines to be written
+func (c *Client) stopUpstreamWriter() {
+	c.upstreamWriteLock.Lock()
+	done := c.upstreamWriterDone
+	if c.upstreamWriteQueue != nil {
+		close(c.upstreamWriteQueue)
+		c.upstreamWriteQueue = nil
+	}
+	c.upstreamWriteLock.Unlock()
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-time.After(time.Second * 2):
+		}
+	}
 }
 
 func (c *Client) processLineToUpstream(data string) {
 	client := c
 	upstreamConfig := c.UpstreamConfig
 
+	if c.relayToBnc(data) {
+		return
+	}
+
+	if c.dropForReconnect(data) {
+		return
+	}
+
+	c.recordRegistrationLine(data)
+
+	if c.holdForSasl(data) {
+		return
+	}
+
 	if strings.HasPrefix(data, "PASS ") && c.SentPass {
 		// Hijack the PASS command if we already sent a pass command
 		return
 	} else if strings.HasPrefix(data, "USER ") {
-		// Hijack the USER command as we may have some overrides
+		// Hijack the USER command as we may have some overrides. The upstream may have its own
+		// so that networks can identify gateway connections
+		if upstreamConfig.ClientUsername != "" {
+			username := makeClientReplacements(upstreamConfig.ClientUsername, client)
+			client.IrcState.Username = strings.Replace(stripLineBreaks(username), " ", "", -1)
+		}
+		if upstreamConfig.ClientRealname != "" {
+			client.IrcState.RealName = stripLineBreaks(makeClientReplacements(upstreamConfig.ClientRealname, client))
+		}
+
 		data = fmt.Sprintf(
 			"USER %s 0 * :%s",
 			client.IrcState.Username,
@@ -476,6 +1041,11 @@ func (c *Client) processLineToUpstream(data string) {
 
 	message, _ := irc.ParseLine(data)
 
+	// Checked here rather than as the client sends it so that the final upstream is known
+	if client.rejectDeniedCapReq(message) {
+		return
+	}
+
 	hook := &HookIrcLine{
 		Client:         client,
 		UpstreamConfig: upstreamConfig,
@@ -491,18 +1061,21 @@ func (c *Client) processLineToUpstream(data string) {
 	// Plugins may have modified the data
 	data = hook.Line
 
-	c.TrafficLog(true, false, data)
-	data = utf8ToOther(data, client.Encoding)
-	if data == "" {
-		client.Log(1, "Failed to encode into '%s'. Dropping data", c.Encoding)
+	data, drop := c.transformLine(data, true)
+	if drop {
 		return
 	}
 
-	if client.upstream != nil {
-		client.upstream.Write([]byte(data + "\r\n"))
-	} else {
-		client.Log(2, "Tried sending data upstream before connected")
+	c.TrafficLog(true, false, data)
+	if !client.RawBytes {
+		data = utf8ToOther(data, client.Encoding)
+		if data == "" {
+			client.Log(1, "Failed to encode into '%s'. Dropping data", c.Encoding)
+			return
+		}
 	}
+
+	client.SendUpstream(data)
 }
 
 func (c *Client) handleLineFromUpstream(data string) {
@@ -530,10 +1103,12 @@ func (c *Client) handleLineFromUpstream(data string) {
 		return
 	}
 
-	data = ensureUtf8(data, client.Encoding)
-	if data == "" {
-		client.Log(1, "Failed to decode as 'UTF-8'. Dropping data")
-		return
+	if !client.RawBytes {
+		data = ensureUtf8(data, client.Encoding)
+		if data == "" {
+			client.Log(1, "Failed to decode as 'UTF-8'. Dropping data")
+			return
+		}
 	}
 
 	data = client.ProcessLineFromUpstream(data)
@@ -541,7 +1116,32 @@ func (c *Client) handleLineFromUpstream(data string) {
 		return
 	}
 
-	client.SendClientSignal("data", data)
+	data, drop := client.transformLine(data, false)
+	if drop {
+		return
+	}
+
+	clientHook := &HookMessageToClient{
+		Client: client,
+		Line:   data,
+	}
+	clientHook.Dispatch("irc.line.client")
+
+	// Injected lines use the same signal queue as the line itself so that ordering is kept
+	if !clientHook.Halt && clientHook.Line != "" {
+		client.recordBncLine(clientHook.Line)
+		client.SendClientSignal("data", clientHook.Line)
+	}
+	for _, line := range clientHook.Inject {
+		client.SendClientSignal("data", line)
+	}
+
+	if client.forcedDisconnect != "" {
+		message := strings.Replace(client.Gateway.Config.ForcedDisconnectMessage, "%r", client.forcedDisconnectReason, -1)
+		client.SendIrcError(makeClientReplacements(message, client))
+		client.SendClientSignal("state", "closed", "forced_"+client.forcedDisconnect)
+		client.StartShutdown("forced_" + client.forcedDisconnect)
+	}
 }
 
 func typeOfErr(err error) string {
@@ -600,13 +1200,16 @@ func (c *Client) readUpstream() {
 			client.UpstreamRecv <- data
 		}
 
-		close(client.UpstreamRecv)
+		client.stopUpstreamWriter()
 		client.upstream.Close()
 		client.upstream = nil
 
 		if client.IrcState.RemotePort > 0 {
 			c.Gateway.identdServ.RemoveIdent(client.IrcState.LocalPort, client.IrcState.RemotePort, "")
 		}
+
+		// Closed last so that a new upstream connection may be made once it is seen
+		close(client.UpstreamRecv)
 	}()
 }
 
@@ -620,9 +1223,19 @@ func (c *Client) clientLineWorker() {
 
 	}
 
+	c.idle.stop()
+	c.stopRegistrationTimeout()
 	c.Log(1, "leaving clientLineWorker")
 }
 
+// sendLineFromClient - Process a line from the client and queue anything left of it for upstream
+func (c *Client) sendLineFromClient(line string) {
+	clientLine, err := c.ProcessLineFromClient(line)
+	if err == nil && clientLine != "" {
+		c.UpstreamSend <- clientLine
+	}
+}
+
 func (c *Client) handleDataLine() (shouldQuit bool, hadErr bool) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -634,23 +1247,40 @@ func (c *Client) handleDataLine() (shouldQuit bool, hadErr bool) {
 		}
 	}()
 
-	// We only want to send data upstream if we have an upstream connection
+	// We only want to send data upstream if we have an upstream connection, or a session to
+	// relay it to
 	upstreamSend := c.UpstreamSend
-	if c.upstream == nil {
+	if c.upstream == nil && c.bncRelay == nil {
 		upstreamSend = nil
 	}
 
+	// A detached session has no transport of its own
+	clientRecv := c.ThrottledRecv.Output
+	if c.bnc != nil && c.bnc.detached {
+		clientRecv = nil
+	}
+
 	select {
-	case clientData, ok := <-c.ThrottledRecv.Output:
+	case clientData, ok := <-clientRecv:
 		if !ok {
 			c.Log(1, "client.Recv closed")
-			if !c.SeenQuit && c.Gateway.Config.SendQuitOnClientClose != "" && c.State == ClientStateEnding {
-				c.processLineToUpstream("QUIT :" + c.Gateway.Config.SendQuitOnClientClose)
+			if c.bncRelay != nil {
+				c.bncRelay.session.sendBncEvent(bncEvent{kind: "detach", client: c})
+				c.StartShutdown("client_closed")
+				return true, false
+			}
+			if c.detachBnc() {
+				return false, false
+			}
+			if !c.SeenQuit && c.Gateway.Config.SendQuitOnClientClose != "" && c.State != ClientStateEnding {
+				c.processLineToUpstream("QUIT :" + c.clientCloseQuitMessage())
 			}
 
 			c.StartShutdown("client_closed")
 
 			if c.upstream != nil {
+				// Let any queued lines such as the QUIT be written before closing
+				c.stopUpstreamWriter()
 				c.upstream.Close()
 			}
 			return true, false
@@ -658,9 +1288,42 @@ func (c *Client) handleDataLine() (shouldQuit bool, hadErr bool) {
 		c.Log(1, "in c.ThrottledRecv.Output")
 		c.TrafficLog(false, true, clientData)
 
-		clientLine, err := c.ProcessLineFromClient(clientData)
-		if err == nil && clientLine != "" {
-			c.UpstreamSend <- clientLine
+		if c.idle.active(clientData) {
+			// The answer to the idle PING isn't for the upstream
+			return false, false
+		}
+
+		if c.floodCheck(clientData) {
+			c.sendLineFromClient(clientData)
+		}
+
+	case <-c.flood.Ready():
+		c.floodSendQueued()
+
+	case <-c.sasl.Timeout():
+		c.saslTimedOut()
+
+	case <-c.idle.Timeout():
+		c.clientIdleTimedOut()
+
+	case <-c.registrationTimeout():
+		c.upstreamRegistrationTimedOut()
+
+	case event := <-c.bnc.Events():
+		c.handleBncEvent(event)
+
+	case <-c.bnc.Expired():
+		c.bncExpired()
+		if c.upstream != nil {
+			c.stopUpstreamWriter()
+			c.upstream.Close()
+		}
+		return true, false
+
+	case <-c.reconnect.Ready():
+		if !c.reconnectNow() {
+			c.closeForUpstream()
+			return true, false
 		}
 
 	case line, ok := <-upstreamSend:
@@ -674,8 +1337,22 @@ func (c *Client) handleDataLine() (shouldQuit bool, hadErr bool) {
 	case upstreamData, ok := <-c.UpstreamRecv:
 		if !ok {
 			c.Log(1, "client.UpstreamRecv closed")
-			c.SendClientSignal("state", "closed")
-			c.StartShutdown("upstream_closed")
+			if c.webircRetry {
+				c.webircRetry = false
+				if c.retryWebirc() {
+					return false, false
+				}
+			} else if c.State == ClientStateRegistering && c.upstreamCloseReason == "" && !c.SeenQuit {
+				// Closed during registration without saying why, the host is probably failing
+				c.upstreamHostFailed()
+				if c.nextFailoverHost() && c.reconnectUpstream() {
+					return false, false
+				}
+			}
+			if c.maybeScheduleReconnect() {
+				return false, false
+			}
+			c.closeForUpstream()
 			return true, false
 		}
 		c.Log(1, "in .UpstreamRecv")
@@ -687,6 +1364,16 @@ func (c *Client) handleDataLine() (shouldQuit bool, hadErr bool) {
 	return false, false
 }
 
+// closeForUpstream - Close the client once its upstream connection has closed
+func (c *Client) closeForUpstream() {
+	if c.upstreamCloseReason != "" {
+		c.SendClientSignal("state", "closed", c.upstreamCloseReason)
+	} else {
+		c.SendClientSignal("state", "closed")
+	}
+	c.StartShutdown("upstream_closed")
+}
+
 // configureUpstream - Generate an upstream configuration from the information set on the client instance
 func (c *Client) configureUpstream() ConfigUpstream {
 	upstreamConfig := ConfigUpstream{}
@@ -694,15 +1381,34 @@ func (c *Client) configureUpstream() ConfigUpstream {
 	upstreamConfig.Port = c.DestPort
 	upstreamConfig.TLS = c.DestTLS
 	upstreamConfig.Timeout = c.Gateway.Config.GatewayTimeout
+	upstreamConfig.TLSTimeout = c.Gateway.Config.GatewayTimeout
 	upstreamConfig.Throttle = c.Gateway.Config.GatewayThrottle
 	upstreamConfig.WebircPassword = c.Gateway.findWebircPassword(c.DestHost)
+	if isOnionHostname(c.DestHost) {
+		upstreamConfig.Onion = true
+		upstreamConfig.Socks5Address = c.Gateway.Config.TorSocksAddress
+	}
 
 	return upstreamConfig
 }
 
-func (c *Client) buildWebircTags() string {
+// buildWebircTags - The flags parameter of the WEBIRC line, as space separated key=value pairs
+// in key order. Flags that would break the line are left out
+func (c *Client) buildWebircTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
 	str := ""
-	for key, val := range c.Tags {
+	for _, key := range keys {
+		val := tags[key]
+		if key == "" || strings.ContainsAny(key, " =\r\n\x00") || strings.ContainsAny(val, " \r\n\x00") {
+			c.Log(2, "Not sending invalid WEBIRC flag %q=%q", key, val)
+			continue
+		}
+
 		if str != "" {
 			str += " "
 		}
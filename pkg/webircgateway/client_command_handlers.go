@@ -8,7 +8,6 @@ import (
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/kiwiirc/webircgateway/pkg/irc"
-	"github.com/kiwiirc/webircgateway/pkg/recaptcha"
 	"golang.org/x/net/html/charset"
 	"golang.org/x/time/rate"
 )
@@ -27,17 +26,69 @@ func (c *Client) ProcessLineFromUpstream(data string) string {
 
 	pLen := len(m.Params)
 
-	if pLen > 0 && m.Command == "NICK" && m.Prefix.Nick == c.IrcState.Nick {
+	if client.handleCtcpFromUpstream(m) {
+		return ""
+	}
+
+	if client.handleSaslFromUpstream(m) {
+		return ""
+	}
+
+	if client.handleForcedCapReply(m) {
+		return ""
+	}
+
+	if client.answerBncPing(m) {
+		return ""
+	}
+
+	if pLen > 0 && m.Command == "NICK" && strings.EqualFold(m.Prefix.Nick, c.IrcState.Nick) {
+		// A nick change we didn't ask for after registration has been forced on us by the network
+		requested := client.takeRequestedNick(m.Params[0])
+		if client.State == ClientStateConnected && !requested {
+			client.handleForcedChange("nick", "Nick changed to "+m.Params[0])
+		}
+
 		client.IrcState.Nick = m.Params[0]
 	}
+	// ERR_ERRONEUSNICKNAME, ERR_NICKNAMEINUSE, ERR_NICKCOLLISION, ERR_UNAVAILRESOURCE. The nick
+	// change asked for won't happen
+	if pLen > 1 && (m.Command == "432" || m.Command == "433" || m.Command == "436" || m.Command == "437") {
+		client.takeRequestedNick(m.Params[1])
+	}
+	// :killer!k@host KILL ournick :Reason
+	if pLen > 0 && m.Command == "KILL" && strings.EqualFold(m.Params[0], c.IrcState.Nick) {
+		client.handleForcedChange("kill", m.GetParam(1, ""))
+	}
 	if pLen > 0 && m.Command == "001" {
 		client.IrcState.Nick = m.Params[0]
+		client.serverName = m.Prefix.Mask
 		client.State = ClientStateConnected
+		client.stopRegistrationTimeout()
+		client.registrationSpan.End()
+		client.Gateway.webircPasswords.Accepted(*client.UpstreamConfig, client.UpstreamConfig.WebircPassword)
+		if client.UpstreamConfig.ReconnectAttempts > 0 {
+			client.reconnectLines = client.registrationLines
+		}
+		client.registrationLines = nil
+		client.Gateway.upstreamHosts.Succeeded(upstreamAddrKey(*client.UpstreamConfig))
+		client.registerBnc()
 
 		// Throttle writes if configured, but only after registration is complete. Typical IRCd
 		// behavior is to not throttle registration commands.
 		client.ThrottledRecv.Limiter = rate.NewLimiter(rate.Limit(client.UpstreamConfig.Throttle), 1)
 	}
+	// End of MOTD or no MOTD. Registration is complete
+	if m.Command == "376" || m.Command == "422" {
+		client.maybeAutoJoin()
+	}
+	if m.Command == "ERROR" && client.State == ClientStateRegistering {
+		if client.handleRegistrationError(m.GetParam(0, "")) {
+			return ""
+		}
+	}
+	// Registering again after the upstream dropped the client is hidden from it
+	hideReconnect := client.handleReconnectFromUpstream(m)
 	if pLen > 0 && m.Command == "005" {
 		// If EXTJWT is supported by the IRC server, disable it here
 		foundExtJwt := false
@@ -46,11 +97,22 @@ func (c *Client) ProcessLineFromUpstream(data string) string {
 				c.Log(1, "Upstream already supports EXTJWT, disabling feature")
 				foundExtJwt = true
 			}
+			if strings.HasPrefix(param, "NICKLEN=") {
+				c.nickLen, _ = strconv.Atoi(param[len("NICKLEN="):])
+			}
 		}
 
 		if foundExtJwt {
 			c.Features.ExtJwt = false
 		}
+
+		upstream := c.UpstreamConfig
+		if len(upstream.ISupportSet) > 0 || len(upstream.ISupportRemove) > 0 {
+			if !c.rewriteISupport(m) {
+				return ""
+			}
+			data = m.ToLine()
+		}
 	}
 	if pLen > 0 && m.Command == "JOIN" && m.Prefix.Nick == c.IrcState.Nick {
 		channel := irc.NewStateChannel(m.GetParam(0, ""))
@@ -130,6 +192,10 @@ func (c *Client) ProcessLineFromUpstream(data string) string {
 			data = m.ToLine()
 		}
 	}
+	client.requestForcedCaps(m)
+	if client.filterUpstreamCaps(m) {
+		data = m.ToLine()
+	}
 
 	// If we requested message-tags, make sure to include it in the ACK when
 	// the IRCd sends the ACK through
@@ -158,9 +224,166 @@ func (c *Client) ProcessLineFromUpstream(data string) string {
 		}
 	}
 
+	if hideReconnect {
+		return ""
+	}
+
 	return data
 }
 
+// maybeAutoJoin - Join the upstreams autojoin channels that the client hasn't already joined.
+// Only done once per client as the MOTD may be requested again later.
+func (c *Client) maybeAutoJoin() {
+	if c.autoJoined || len(c.UpstreamConfig.AutoJoin) == 0 {
+		return
+	}
+	c.autoJoined = true
+
+	hook := &HookIrcAutoJoin{
+		Client:   c,
+		Channels: c.UpstreamConfig.AutoJoin,
+	}
+	hookSpan := c.traceHook("irc.autojoin")
+	hook.Dispatch("irc.autojoin")
+	hookSpan.End()
+	if hook.Halt {
+		return
+	}
+
+	channels := []ConfigChannel{}
+	names := []string{}
+	for _, channel := range hook.Channels {
+		lowerName := strings.ToLower(channel.Name)
+		if !c.IrcState.HasChannel(channel.Name) && !c.clientJoined[lowerName] {
+			channels = append(channels, channel)
+			names = append(names, channel.Name)
+		}
+	}
+
+	if len(channels) == 0 {
+		return
+	}
+
+	c.Log(1, "Auto joining %s", strings.Join(names, ","))
+	c.processLineToUpstream(joinLine(channels))
+}
+
+// joinLine - A JOIN for several channels. Keyed channels must come first as keys are matched to
+// channels in order
+func joinLine(channels []ConfigChannel) string {
+	names := []string{}
+	keys := []string{}
+	unkeyed := []string{}
+	for _, channel := range channels {
+		if channel.Key != "" {
+			names = append(names, channel.Name)
+			keys = append(keys, channel.Key)
+		} else {
+			unkeyed = append(unkeyed, channel.Name)
+		}
+	}
+	names = append(names, unkeyed...)
+
+	line := "JOIN " + strings.Join(names, ",")
+	if len(keys) > 0 {
+		line += " " + strings.Join(keys, ",")
+	}
+
+	return line
+}
+
+// Most nick changes the client may have waiting for an answer from the upstream. Older ones are
+// forgotten
+const maxRequestedNicks = 5
+
+// addRequestedNick - Remember a nick change the client asked for so that we know when the network
+// forces one on us instead
+func (c *Client) addRequestedNick(nick string) {
+	c.requestedNicksLock.Lock()
+	defer c.requestedNicksLock.Unlock()
+
+	c.requestedNicks = append(c.requestedNicks, nick)
+	if len(c.requestedNicks) > maxRequestedNicks {
+		c.requestedNicks = c.requestedNicks[len(c.requestedNicks)-maxRequestedNicks:]
+	}
+}
+
+// takeRequestedNick - Whether the client asked for nick, possibly before the upstream truncated it
+// to NICKLEN. The upstream answers in order, so it is forgotten along with any asked for before it
+func (c *Client) takeRequestedNick(nick string) bool {
+	c.requestedNicksLock.Lock()
+	defer c.requestedNicksLock.Unlock()
+
+	for i, requested := range c.requestedNicks {
+		if c.nickLen > 0 && len(requested) > c.nickLen {
+			requested = requested[:c.nickLen]
+		}
+		if strings.EqualFold(requested, nick) {
+			c.requestedNicks = c.requestedNicks[i+1:]
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleForcedChange - The network has killed us or changed our nick without us asking for it.
+// Depending on the config or plugins, disconnect the client once this line has been sent to it
+func (c *Client) handleForcedChange(kind string, reason string) {
+	action := c.Gateway.Config.KillAction
+	if kind == "nick" {
+		action = c.Gateway.Config.ForcedNickAction
+	}
+
+	hook := &HookIrcForcedChange{
+		Client:     c,
+		Kind:       kind,
+		Reason:     reason,
+		Disconnect: action == "disconnect",
+	}
+	hook.Dispatch("irc.forced")
+
+	c.Log(2, "Forced %s by upstream (%s). Disconnecting=%t", kind, reason, hook.Disconnect)
+	if hook.Disconnect {
+		c.forcedDisconnect = kind
+		c.forcedDisconnectReason = hook.Reason
+	}
+}
+
+// handleRegistrationError - The upstream rejected us before registration completed. Typically
+// a ban on the gateway or a rejected WEBIRC. Returns true if the next WEBIRC password will be
+// tried, in which case the client isn't told of the error
+func (c *Client) handleRegistrationError(errText string) bool {
+	isWebircErr := c.UpstreamConfig.WebircPassword != "" &&
+		containsOneOf(strings.ToLower(errText), []string{"webirc", "cgi:irc", "cgiirc"})
+
+	c.registrationSpan.EndWithError(errText)
+
+	if isWebircErr && len(c.webircPasswords) > 1 {
+		c.webircRetry = true
+		c.LogEvent(3, "upstream.rejected", "Upstream %s rejected WEBIRC before registration, trying the next password: %s", c.UpstreamConfig.Hostname, errText)
+		return true
+	}
+
+	if isWebircErr {
+		c.upstreamCloseReason = "err_webirc"
+		c.LogEvent(3, "upstream.rejected", "Upstream %s rejected WEBIRC before registration: %s", c.UpstreamConfig.Hostname, errText)
+	} else {
+		c.upstreamCloseReason = "err_upstream_rejected"
+		c.LogEvent(3, "upstream.rejected", "Upstream %s closed the connection before registration: %s", c.UpstreamConfig.Hostname, errText)
+		c.Gateway.logRejection(c.RemoteAddr, "upstream_rejected")
+	}
+
+	if c.Gateway.Config.RelayRegistrationErrors && errText != "" {
+		notice := irc.NewMessage()
+		notice.Command = "NOTICE"
+		notice.Params = []string{"*", "The IRC server closed the connection: " + errText}
+		c.SendClientSignal("data", notice.ToLine())
+	}
+
+	return false
+}
+
 /*
  * ProcessLineFromClient
  * Processes and makes any changes to a line of data sent from a client
@@ -172,6 +395,16 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 		return line, nil
 	}
 
+	commandHook := &HookIrcCommand{
+		Client:  c,
+		Line:    line,
+		Message: message,
+	}
+	commandHook.Dispatch("irc.command")
+	if commandHook.Halt {
+		return "", nil
+	}
+
 	maybeConnectUpstream := func() {
 		verified := false
 		if c.RequiresVerification && !c.Verified {
@@ -188,12 +421,7 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 	if !c.Verified && strings.ToUpper(message.Command) == "CAPTCHA" {
 		verified := false
 		if len(message.Params) >= 1 {
-			captcha := recaptcha.R{
-				URL:    c.Gateway.Config.ReCaptchaURL,
-				Secret: c.Gateway.Config.ReCaptchaSecret,
-			}
-
-			verified = captcha.VerifyResponse(message.Params[0])
+			verified, _ = c.Gateway.verifyCaptcha(c, c.RemoteAddr, message.Params[0])
 		}
 
 		if !verified {
@@ -208,6 +436,23 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 		return "", nil
 	}
 
+	// Remember channels the client joins itself so that the gateway doesn't auto join them again
+	if strings.ToUpper(message.Command) == "JOIN" && len(message.Params) > 0 {
+		keys := strings.Split(message.GetParam(1, ""), ",")
+		for i, channel := range strings.Split(message.Params[0], ",") {
+			c.clientJoined[strings.ToLower(channel)] = true
+			// Kept for joining again after reconnecting to the upstream
+			if i < len(keys) && keys[i] != "" {
+				c.channelKeys[strings.ToLower(channel)] = keys[i]
+			}
+		}
+	}
+
+	// Remember nick changes we ask for so that we know when the network forces one on us
+	if strings.ToUpper(message.Command) == "NICK" && c.UpstreamStarted && len(message.Params) > 0 {
+		c.addRequestedNick(message.Params[0])
+	}
+
 	// NICK <nickname>
 	if strings.ToUpper(message.Command) == "NICK" && !c.UpstreamStarted {
 		if len(message.Params) > 0 {
@@ -225,11 +470,13 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 			return line, errors.New("Invalid USER line")
 		}
 
+		// JWT claims used in the replacements are not limited to what a client could send
 		if c.Gateway.Config.ClientUsername != "" {
-			message.Params[0] = makeClientReplacements(c.Gateway.Config.ClientUsername, c)
+			username := makeClientReplacements(c.Gateway.Config.ClientUsername, c)
+			message.Params[0] = strings.Replace(stripLineBreaks(username), " ", "", -1)
 		}
 		if c.Gateway.Config.ClientRealname != "" {
-			message.Params[3] = makeClientReplacements(c.Gateway.Config.ClientRealname, c)
+			message.Params[3] = stripLineBreaks(makeClientReplacements(c.Gateway.Config.ClientRealname, c))
 		}
 
 		line = message.ToLine()
@@ -345,15 +592,8 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 		message.Prefix.Hostname = ""
 		message.Prefix.Username = ""
 
-		thisHost := strings.ToLower(c.UpstreamConfig.Hostname)
 		target := message.Params[0]
-		for val := range c.Gateway.Clients.Iter() {
-			curClient := val.Val.(*Client)
-			sameHost := strings.ToLower(curClient.UpstreamConfig.Hostname) == thisHost
-			if !sameHost {
-				continue
-			}
-
+		for _, curClient := range c.Gateway.Clients.ByUpstreamHost(c.UpstreamConfig.Hostname) {
 			// Only send the message on to either the target nick, or the clients in a set channel
 			curNick := strings.ToLower(curClient.IrcState.Nick)
 			if target != curNick && !curClient.IrcState.HasChannel(target) {
@@ -0,0 +1,216 @@
+package webircgateway
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistrationErrorsRelayed(t *testing.T) {
+	tests := []struct {
+		name        string
+		webirc      string
+		errorLine   string
+		notice      string
+		closeReason string
+	}{
+		{
+			name:        "kline",
+			errorLine:   "ERROR :Closing Link: 127.0.0.1 (K-Lined: No web clients)",
+			notice:      "NOTICE * :The IRC server closed the connection: Closing Link: 127.0.0.1 (K-Lined: No web clients)",
+			closeReason: "err_upstream_rejected",
+		},
+		{
+			name:        "no colon",
+			errorLine:   "ERROR Throttled",
+			notice:      "NOTICE * :The IRC server closed the connection: Throttled",
+			closeReason: "err_upstream_rejected",
+		},
+		{
+			name:        "webirc",
+			webirc:      "secret",
+			errorLine:   "ERROR :Closing Link: 127.0.0.1 (Invalid WEBIRC password)",
+			notice:      "NOTICE * :The IRC server closed the connection: Closing Link: 127.0.0.1 (Invalid WEBIRC password)",
+			closeReason: "err_webirc",
+		},
+		{
+			name:        "cgiirc",
+			webirc:      "secret",
+			errorLine:   "ERROR :CGI:IRC host/IP spoofing denied",
+			notice:      "NOTICE * :The IRC server closed the connection: CGI:IRC host/IP spoofing denied",
+			closeReason: "err_webirc",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstream := newFakeUpstream(t)
+			extra := ""
+			if test.webirc != "" {
+				extra = "webirc = \"" + test.webirc + "\""
+			}
+			gateway := newTestGateway(t, upstream.config(extra))
+
+			client := newTestClient(t, gateway)
+			testClientSend(client, "NICK alice", "USER alice 0 * :Alice")
+
+			upstream.accept()
+			if test.webirc != "" {
+				upstream.expect("WEBIRC " + test.webirc + " ")
+			}
+			upstream.expect("USER ")
+			upstream.send(test.errorLine)
+			upstream.conn.Close()
+
+			if line := testClientExpect(t, client, "NOTICE"); line != test.notice {
+				t.Errorf("notice = %q, want %q", line, test.notice)
+			}
+			if reason := testClientExpectClosed(t, client); reason != test.closeReason {
+				t.Errorf("close reason = %q, want %q", reason, test.closeReason)
+			}
+		})
+	}
+}
+
+func TestRegistrationErrorsNotRelayed(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	gateway := newTestGateway(t, "relay_registration_errors = false\n"+upstream.config(""))
+
+	client := newTestClient(t, gateway)
+	testClientSend(client, "NICK alice", "USER alice 0 * :Alice")
+
+	upstream.accept()
+	upstream.expect("USER ")
+	upstream.send("ERROR :Closing Link: 127.0.0.1 (Banned)")
+	upstream.conn.Close()
+
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case signal, ok := <-client.Signals:
+			if !ok {
+				t.Fatal("the client signals closed without a closed state")
+			}
+			if signal[0] == "data" && strings.HasPrefix(signal[1], "NOTICE") {
+				t.Errorf("the error was relayed: %q", signal[1])
+			}
+			if signal[0] == "state" && signal[1] == "closed" {
+				if signal[2] != "err_upstream_rejected" {
+					t.Errorf("close reason = %q, want err_upstream_rejected", signal[2])
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("the client was not closed")
+		}
+	}
+}
+
+func TestKillOfSelfDisconnects(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	gateway := newTestGateway(t, "[clients]\non_kill = disconnect\nforced_disconnect_message = \"Killed: %r\"\n"+upstream.config(""))
+
+	client := newTestClient(t, gateway)
+	testClientSend(client, "NICK alice", "USER alice 0 * :Alice")
+	upstream.register("alice")
+	testClientExpect(t, client, ":irc.example.net 376 ")
+
+	upstream.send(":oper!o@example.net KILL Alice :Spamming")
+
+	// The KILL is passed on before the client is closed
+	testClientExpect(t, client, ":oper!o@example.net KILL Alice ")
+	if line := testClientExpect(t, client, "ERROR"); line != "ERROR :Killed: Spamming" {
+		t.Errorf("error = %q, want %q", line, "ERROR :Killed: Spamming")
+	}
+	if reason := testClientExpectClosed(t, client); reason != "forced_kill" {
+		t.Errorf("close reason = %q, want forced_kill", reason)
+	}
+}
+
+func TestKillOfSelfPassedOn(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	gateway := newTestGateway(t, upstream.config(""))
+
+	client := newTestClient(t, gateway)
+	testClientSend(client, "NICK alice", "USER alice 0 * :Alice")
+	upstream.register("alice")
+	testClientExpect(t, client, ":irc.example.net 376 ")
+
+	upstream.send(":oper!o@example.net KILL alice :Spamming", ":irc.example.net NOTICE alice :Still here")
+	testClientExpect(t, client, ":oper!o@example.net KILL alice ")
+	testClientExpect(t, client, ":irc.example.net NOTICE alice ")
+	if client.IsShuttingDown() {
+		t.Error("the client was closed with on_kill = pass")
+	}
+}
+
+func TestKillOfOtherNickIgnored(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	gateway := newTestGateway(t, "[clients]\non_kill = disconnect\n"+upstream.config(""))
+
+	client := newTestClient(t, gateway)
+	testClientSend(client, "NICK alice", "USER alice 0 * :Alice")
+	upstream.register("alice")
+	testClientExpect(t, client, ":irc.example.net 376 ")
+
+	// After a nick change the old nick is someone else's
+	testClientSend(client, "NICK alice2")
+	upstream.expect("NICK alice2")
+	upstream.send(":alice!a@example.net NICK alice2")
+	testClientExpect(t, client, ":alice!a@example.net NICK alice2")
+
+	upstream.send(":oper!o@example.net KILL alice :Not you", ":irc.example.net NOTICE alice2 :Still here")
+	testClientExpect(t, client, ":irc.example.net NOTICE alice2 ")
+	if client.IsShuttingDown() {
+		t.Error("the client was closed by a KILL of its old nick")
+	}
+}
+
+func TestForcedNickDisconnects(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	gateway := newTestGateway(t, "[clients]\non_forced_nick = disconnect\n"+upstream.config(""))
+
+	client := newTestClient(t, gateway)
+	testClientSend(client, "NICK alice", "USER alice 0 * :Alice")
+	upstream.register("alice")
+	testClientExpect(t, client, ":irc.example.net 376 ")
+
+	upstream.send(":alice!a@example.net NICK Guest123")
+	testClientExpect(t, client, ":alice!a@example.net NICK Guest123")
+	if reason := testClientExpectClosed(t, client); reason != "forced_nick" {
+		t.Errorf("close reason = %q, want forced_nick", reason)
+	}
+}
+
+func TestRequestedNicksNotForced(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	gateway := newTestGateway(t, "[clients]\non_forced_nick = disconnect\n"+upstream.config(""))
+
+	client := newTestClient(t, gateway)
+	testClientSend(client, "NICK alice", "USER alice 0 * :Alice")
+	upstream.register("alice")
+	upstream.send(":irc.example.net 005 alice NICKLEN=8 :are supported by this server")
+	testClientExpect(t, client, ":irc.example.net 005 ")
+
+	// Several changes asked for before the upstream answers any, one in use and one truncated
+	testClientSend(client, "NICK alice2", "NICK taken", "NICK alice_the_third")
+	upstream.expect("NICK alice2")
+	upstream.expect("NICK taken")
+	upstream.expect("NICK alice_the_third")
+	upstream.send(
+		":alice!a@example.net NICK alice2",
+		":irc.example.net 433 alice2 taken :Nickname is already in use",
+		":alice2!a@example.net NICK alice_th",
+		":irc.example.net NOTICE alice_th :Still here",
+	)
+	testClientExpect(t, client, ":irc.example.net NOTICE alice_th ")
+	if client.IsShuttingDown() {
+		t.Error("the client was closed after nick changes it asked for")
+	}
+
+	// A refused nick is no longer one that was asked for
+	upstream.send(":alice_th!a@example.net NICK taken")
+	if reason := testClientExpectClosed(t, client); reason != "forced_nick" {
+		t.Errorf("close reason = %q, want forced_nick", reason)
+	}
+}
@@ -0,0 +1,146 @@
+package webircgateway
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+	"golang.org/x/time/rate"
+)
+
+// Dropped lines are counted over this long when deciding if a client is flooding
+const floodDropWindow = 10 * time.Second
+
+// floodControl - Limits how quickly a registered client's lines are passed upstream, as set by the
+// [limits] flood_* options. Lines over the limit are either queued until the limit allows them or
+// dropped. A client with too many lines queued, or dropped within floodDropWindow, is disconnected
+type floodControl struct {
+	limiter   *rate.Limiter
+	action    string
+	maxExcess int
+	queue     []string
+	// timer - Fires when the first queued line may be sent. nil while nothing is queued
+	timer       *time.Timer
+	dropped     int
+	windowStart time.Time
+	flooded     bool
+}
+
+// Ready - Fires when the first queued line may be sent. A nil floodControl, or one without a queue,
+// never fires
+func (f *floodControl) Ready() <-chan time.Time {
+	if f == nil || f.timer == nil {
+		return nil
+	}
+
+	return f.timer.C
+}
+
+// schedule - Reserve the limits next token for the first queued line
+func (f *floodControl) schedule() {
+	f.timer = time.NewTimer(f.limiter.Reserve().Delay())
+}
+
+// floodCheck - If a line from the client may be passed upstream now. Lines over the limit are
+// queued or dropped, disconnecting the client if it keeps flooding
+func (c *Client) floodCheck(line string) bool {
+	if c.flood != nil && c.flood.flooded {
+		return false
+	}
+
+	cfg := c.Gateway.Config
+	// Like the upstream throttle, registration isn't limited
+	if c.State != ClientStateConnected || isFloodExempt(line) {
+		return true
+	}
+
+	if c.flood == nil {
+		if cfg.FloodRate <= 0 {
+			return true
+		}
+		c.flood = &floodControl{
+			limiter:   rate.NewLimiter(rate.Limit(cfg.FloodRate), cfg.FloodBurst),
+			action:    cfg.FloodAction,
+			maxExcess: cfg.FloodMaxExcess,
+		}
+	}
+
+	f := c.flood
+	if f.action == "drop" {
+		if f.limiter.Allow() {
+			return true
+		}
+
+		if time.Since(f.windowStart) > floodDropWindow {
+			f.windowStart = time.Now()
+			f.dropped = 0
+		}
+		f.dropped++
+		c.Log(1, "Dropped line over the flood limit")
+		if f.dropped > f.maxExcess {
+			c.floodDisconnect()
+		}
+		return false
+	}
+
+	// Lines already queued go first so that the order is kept
+	if len(f.queue) == 0 && f.limiter.Allow() {
+		return true
+	}
+
+	f.queue = append(f.queue, line)
+	if len(f.queue) > f.maxExcess {
+		c.floodDisconnect()
+		return false
+	}
+	if f.timer == nil {
+		f.schedule()
+	}
+
+	return false
+}
+
+// floodSendQueued - Pass the first queued line upstream now that its token is available
+func (c *Client) floodSendQueued() {
+	f := c.flood
+	f.timer = nil
+	if f.flooded || len(f.queue) == 0 {
+		return
+	}
+
+	line := f.queue[0]
+	f.queue = f.queue[1:]
+	if len(f.queue) > 0 {
+		f.schedule()
+	}
+
+	c.sendLineFromClient(line)
+}
+
+func (c *Client) floodDisconnect() {
+	f := c.flood
+	f.flooded = true
+	f.queue = nil
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+
+	c.LogEvent(2, "client.flood", "Disconnecting client for sending more than %.4g lines per second", c.Gateway.Config.FloodRate)
+	c.processLineToUpstream("QUIT :Excess flood")
+	c.SendIrcError("Excess flood")
+	c.SendClientSignal("state", "closed", "excess_flood")
+	c.StartShutdown("excess_flood")
+}
+
+// isFloodExempt - Lines that are never limited. Holding back a PONG could get the client timed out
+// by the server
+func isFloodExempt(line string) bool {
+	message, err := irc.ParseLine(line)
+	if err != nil {
+		return false
+	}
+
+	command := strings.ToUpper(message.Command)
+	return command == "PONG" || command == "QUIT"
+}
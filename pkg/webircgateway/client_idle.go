@@ -0,0 +1,103 @@
+package webircgateway
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientIdle - Disconnects clients that send nothing for [clients] idle_disconnect, eg. browsers
+// that crashed without closing their transport, so they don't keep their upstream connection
+// open. With idle_ping_timeout set the client is sent a PING first and is only disconnected if it
+// doesn't answer in time. Only used by the clients line worker
+type clientIdle struct {
+	timer       *time.Timer
+	timeout     time.Duration
+	pingTimeout time.Duration
+	// probe - The token of the PING waiting for an answer, empty if none has been sent
+	probe string
+}
+
+// newClientIdle - nil if idle_disconnect is not set
+func newClientIdle(cfg *Config) *clientIdle {
+	if cfg.ClientIdleTimeout <= 0 {
+		return nil
+	}
+
+	timeout := time.Duration(cfg.ClientIdleTimeout) * time.Second
+	return &clientIdle{
+		timer:       time.NewTimer(timeout),
+		timeout:     timeout,
+		pingTimeout: time.Duration(cfg.ClientIdlePingTimeout) * time.Second,
+	}
+}
+
+// Timeout - Fires once the client has been idle too long or not answered the PING. A nil
+// clientIdle never times out
+func (i *clientIdle) Timeout() <-chan time.Time {
+	if i == nil {
+		return nil
+	}
+
+	return i.timer.C
+}
+
+// stop - The client is closing so its timer isn't needed
+func (i *clientIdle) stop() {
+	if i != nil {
+		i.timer.Stop()
+	}
+}
+
+// active - The client has sent a line. Returns true if it was the answer to the PING, which
+// doesn't need passing upstream
+func (i *clientIdle) active(line string) bool {
+	if i == nil {
+		return false
+	}
+
+	i.reset(i.timeout)
+	if i.probe == "" {
+		return false
+	}
+
+	answer := strings.HasPrefix(strings.ToUpper(line), "PONG ") && strings.Contains(line, i.probe)
+	i.probe = ""
+	return answer
+}
+
+func (i *clientIdle) reset(d time.Duration) {
+	// Drain a timeout that fired but hasn't been read so that it doesn't fire straight away
+	if !i.timer.Stop() {
+		select {
+		case <-i.timer.C:
+		default:
+		}
+	}
+	i.timer.Reset(d)
+}
+
+// clientIdleTimedOut - The client has been idle for idle_disconnect. PING it if configured to, or
+// disconnect it and its upstream
+func (c *Client) clientIdleTimedOut() {
+	// A detached session has no transport to be idle
+	if c.bnc != nil && c.bnc.detached {
+		c.idle.reset(c.idle.timeout)
+		return
+	}
+
+	if c.idle.pingTimeout > 0 && c.idle.probe == "" {
+		c.idle.probe = "webircgateway-idle-" + strconv.FormatInt(time.Now().Unix(), 10)
+		c.Log(1, "Client idle, sending PING %s", c.idle.probe)
+		c.SendClientSignal("data", "PING :"+c.idle.probe)
+		c.idle.reset(c.idle.pingTimeout)
+		return
+	}
+
+	if c.idle.probe != "" {
+		c.LogEvent(2, "client.idle_timeout", "Disconnecting idle client, PING not answered")
+	} else {
+		c.LogEvent(2, "client.idle_timeout", "Disconnecting idle client, nothing received for %d seconds", c.Gateway.Config.ClientIdleTimeout)
+	}
+	c.disconnect("Idle timeout", "idle_timeout")
+}
@@ -0,0 +1,48 @@
+package webircgateway
+
+import (
+	"sort"
+)
+
+// ClientInfo - A point in time summary of a connected client. Safe to keep and read after the
+// client has disconnected.
+type ClientInfo struct {
+	Id             uint64                 `json:"id"`
+	Nick           string                 `json:"nick"`
+	Username       string                 `json:"username"`
+	Upstream       string                 `json:"upstream"`
+	State          string                 `json:"state"`
+	RemoteAddr     string                 `json:"remote_addr"`
+	RemoteHostname string                 `json:"remote_hostname"`
+	TLSVersion     string                 `json:"tls_version"`
+	TLSCipher      string                 `json:"tls_cipher"`
+	Stats          TransportStatsSnapshot `json:"stats"`
+	// The client this summary was taken from, for use by status hooks
+	client *Client
+}
+
+// SnapshotClients - Summaries of all connected clients ordered by client ID
+func (s *Gateway) SnapshotClients() []ClientInfo {
+	clients := make([]ClientInfo, 0, s.Clients.Count())
+	for _, c := range s.Clients.Snapshot() {
+		clients = append(clients, ClientInfo{
+			Id:             c.Id,
+			Nick:           c.IrcState.Nick,
+			Username:       c.IrcState.Username,
+			Upstream:       upstreamAddrKey(*c.UpstreamConfig),
+			State:          c.State,
+			RemoteAddr:     c.RemoteAddr,
+			RemoteHostname: c.RemoteHostname,
+			TLSVersion:     c.TLSVersion,
+			TLSCipher:      c.TLSCipher,
+			Stats:          c.Stats.Snapshot(),
+			client:         c,
+		})
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Id < clients[j].Id
+	})
+
+	return clients
+}
@@ -0,0 +1,222 @@
+package webircgateway
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// clientRegistryShards - A power of two so that a clients shard is the low bits of its ID
+const clientRegistryShards = 32
+
+// ClientRegistry - The connected clients by ID. Split into shards that are locked on their own so
+// that clients connecting and disconnecting only wait on others in the same shard, and iterating
+// only holds one shard at a time while copying it. Clients are also indexed by their upstream host
+// once connecting upstream
+type ClientRegistry struct {
+	shards [clientRegistryShards]clientRegistryShard
+	count  int64
+	// byUpstreamHost - Client IDs under each host
+	byUpstreamHost clientIndex
+}
+
+type clientRegistryShard struct {
+	mu      sync.RWMutex
+	clients map[uint64]*registeredClient
+}
+
+type registeredClient struct {
+	client *Client
+	// upstreamHost - The key the client is indexed under, so it can be removed from the index even
+	// after it has changed on the client
+	upstreamHost string
+}
+
+func NewClientRegistry() *ClientRegistry {
+	r := &ClientRegistry{}
+	for i := range r.shards {
+		r.shards[i].clients = make(map[uint64]*registeredClient)
+	}
+	r.byUpstreamHost.init()
+	return r
+}
+
+func (r *ClientRegistry) shard(id uint64) *clientRegistryShard {
+	return &r.shards[id&(clientRegistryShards-1)]
+}
+
+func (r *ClientRegistry) Add(c *Client) {
+	shard := r.shard(c.Id)
+	shard.mu.Lock()
+	shard.clients[c.Id] = &registeredClient{client: c}
+	shard.mu.Unlock()
+
+	atomic.AddInt64(&r.count, 1)
+}
+
+func (r *ClientRegistry) Remove(c *Client) {
+	shard := r.shard(c.Id)
+	shard.mu.Lock()
+	entry, ok := shard.clients[c.Id]
+	delete(shard.clients, c.Id)
+	shard.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	atomic.AddInt64(&r.count, -1)
+	r.byUpstreamHost.remove(entry.upstreamHost, c.Id)
+}
+
+func (r *ClientRegistry) Get(id uint64) (*Client, bool) {
+	shard := r.shard(id)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	entry, ok := shard.clients[id]
+	if !ok {
+		return nil, false
+	}
+	return entry.client, true
+}
+
+func (r *ClientRegistry) Count() int {
+	return int(atomic.LoadInt64(&r.count))
+}
+
+// Snapshot - The connected clients, in no particular order
+func (r *ClientRegistry) Snapshot() []*Client {
+	clients := make([]*Client, 0, r.Count())
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mu.RLock()
+		for _, entry := range shard.clients {
+			clients = append(clients, entry.client)
+		}
+		shard.mu.RUnlock()
+	}
+
+	return clients
+}
+
+// Iterate - Call fn for each connected client until it returns false. fn is called on a
+// snapshot so it may add or remove clients
+func (r *ClientRegistry) Iterate(fn func(*Client) bool) {
+	for _, c := range r.Snapshot() {
+		if !fn(c) {
+			return
+		}
+	}
+}
+
+// ByUpstreamHost - The clients connected or connecting to an upstream on host, case insensitive
+func (r *ClientRegistry) ByUpstreamHost(host string) []*Client {
+	return r.clients(r.byUpstreamHost.ids(strings.ToLower(host)))
+}
+
+func (r *ClientRegistry) clients(ids []uint64) []*Client {
+	clients := make([]*Client, 0, len(ids))
+	for _, id := range ids {
+		if c, ok := r.Get(id); ok {
+			clients = append(clients, c)
+		}
+	}
+
+	return clients
+}
+
+// indexUpstreamHost - Index the client under the host of its UpstreamConfig
+func (r *ClientRegistry) indexUpstreamHost(c *Client) {
+	r.reindex(c, &r.byUpstreamHost, strings.ToLower(c.UpstreamConfig.Hostname), func(entry *registeredClient) *string {
+		return &entry.upstreamHost
+	})
+}
+
+// reindex - Move the client in index from the key kept in the field given by key to newKey
+func (r *ClientRegistry) reindex(c *Client, index *clientIndex, newKey string, key func(*registeredClient) *string) {
+	shard := r.shard(c.Id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry, ok := shard.clients[c.Id]
+	if !ok {
+		return
+	}
+	oldKey := key(entry)
+	if *oldKey == newKey {
+		return
+	}
+
+	// Updated while the shard is held so a Remove at the same time can't leave the client indexed
+	index.remove(*oldKey, c.Id)
+	index.add(newKey, c.Id)
+	*oldKey = newKey
+}
+
+// clientIndex - Client IDs by a key, sharded by the hash of the key
+type clientIndex struct {
+	shards [clientRegistryShards]clientIndexShard
+}
+
+type clientIndexShard struct {
+	mu   sync.RWMutex
+	keys map[string]map[uint64]struct{}
+}
+
+func (i *clientIndex) init() {
+	for n := range i.shards {
+		i.shards[n].keys = make(map[string]map[uint64]struct{})
+	}
+}
+
+func (i *clientIndex) shard(key string) *clientIndexShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &i.shards[h.Sum32()&(clientRegistryShards-1)]
+}
+
+func (i *clientIndex) add(key string, id uint64) {
+	if key == "" {
+		return
+	}
+
+	shard := i.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	ids, ok := shard.keys[key]
+	if !ok {
+		ids = make(map[uint64]struct{})
+		shard.keys[key] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+func (i *clientIndex) remove(key string, id uint64) {
+	if key == "" {
+		return
+	}
+
+	shard := i.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	ids := shard.keys[key]
+	delete(ids, id)
+	if len(ids) == 0 {
+		delete(shard.keys, key)
+	}
+}
+
+func (i *clientIndex) ids(key string) []uint64 {
+	shard := i.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	ids := make([]uint64, 0, len(shard.keys[key]))
+	for id := range shard.keys[key] {
+		ids = append(ids, id)
+	}
+	return ids
+}
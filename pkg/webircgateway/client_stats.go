@@ -0,0 +1,110 @@
+package webircgateway
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+// TransportStats - Byte counters for data passing over a clients transport. Raw counts are the
+// IRC data itself while wire counts are the bytes after compression. Wire counts are only
+// tracked while the transport is compressing
+type TransportStats struct {
+	BytesSent     uint64
+	BytesRecv     uint64
+	WireBytesSent uint64
+	WireBytesRecv uint64
+	compressed    int32
+}
+
+// TransportStatsSnapshot - A point in time copy of TransportStats. In JSON the wire counts are null
+// when they weren't measured, which is for every transport other than a compressed websocket
+type TransportStatsSnapshot struct {
+	BytesSent     uint64 `json:"bytes_sent"`
+	BytesRecv     uint64 `json:"bytes_recv"`
+	WireBytesSent uint64 `json:"wire_bytes_sent"`
+	WireBytesRecv uint64 `json:"wire_bytes_recv"`
+	Compressed    bool   `json:"compressed"`
+}
+
+// SetCompressed - Mark that the transport is compressing data for this client
+func (s *TransportStats) SetCompressed(compressed bool) {
+	val := int32(0)
+	if compressed {
+		val = 1
+	}
+	atomic.StoreInt32(&s.compressed, val)
+}
+
+// IsCompressed - True if the transport is compressing data for this client
+func (s *TransportStats) IsCompressed() bool {
+	return atomic.LoadInt32(&s.compressed) == 1
+}
+
+// RecordSent - Record data sent to the client. wire is ignored for uncompressed transports
+func (s *TransportStats) RecordSent(raw int, wire int) {
+	atomic.AddUint64(&s.BytesSent, uint64(raw))
+	if s.IsCompressed() {
+		atomic.AddUint64(&s.WireBytesSent, uint64(wire))
+	}
+}
+
+// RecordRecv - Record data received from the client. wire is ignored for uncompressed transports
+func (s *TransportStats) RecordRecv(raw int, wire int) {
+	atomic.AddUint64(&s.BytesRecv, uint64(raw))
+	if s.IsCompressed() {
+		atomic.AddUint64(&s.WireBytesRecv, uint64(wire))
+	}
+}
+
+// Snapshot - Copy the current counters
+func (s *TransportStats) Snapshot() TransportStatsSnapshot {
+	return TransportStatsSnapshot{
+		BytesSent:     atomic.LoadUint64(&s.BytesSent),
+		BytesRecv:     atomic.LoadUint64(&s.BytesRecv),
+		WireBytesSent: atomic.LoadUint64(&s.WireBytesSent),
+		WireBytesRecv: atomic.LoadUint64(&s.WireBytesRecv),
+		Compressed:    s.IsCompressed(),
+	}
+}
+
+// MarshalJSON - The snapshot with null wire counts if they weren't measured
+func (s TransportStatsSnapshot) MarshalJSON() ([]byte, error) {
+	type snapshotJSON struct {
+		BytesSent     uint64  `json:"bytes_sent"`
+		BytesRecv     uint64  `json:"bytes_recv"`
+		WireBytesSent *uint64 `json:"wire_bytes_sent"`
+		WireBytesRecv *uint64 `json:"wire_bytes_recv"`
+		Compressed    bool    `json:"compressed"`
+	}
+
+	out := snapshotJSON{
+		BytesSent:  s.BytesSent,
+		BytesRecv:  s.BytesRecv,
+		Compressed: s.Compressed,
+	}
+	if s.Compressed {
+		out.WireBytesSent = &s.WireBytesSent
+		out.WireBytesRecv = &s.WireBytesRecv
+	}
+
+	return json.Marshal(out)
+}
+
+// BytesSaved - The number of bytes compression has saved, in both directions
+func (s TransportStatsSnapshot) BytesSaved() int64 {
+	if !s.Compressed {
+		return 0
+	}
+
+	return int64(s.BytesSent+s.BytesRecv) - int64(s.WireBytesSent+s.WireBytesRecv)
+}
+
+// Ratio - Wire bytes as a fraction of raw bytes. 1 when nothing has been compressed
+func (s TransportStatsSnapshot) Ratio() float64 {
+	raw := s.BytesSent + s.BytesRecv
+	if !s.Compressed || raw == 0 {
+		return 1
+	}
+
+	return float64(s.WireBytesSent+s.WireBytesRecv) / float64(raw)
+}
@@ -0,0 +1,20 @@
+package webircgateway
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTransportStatsJSON(t *testing.T) {
+	stats := &TransportStats{}
+	stats.RecordSent(100, 100)
+	if out, _ := json.Marshal(stats.Snapshot()); string(out) != `{"bytes_sent":100,"bytes_recv":0,"wire_bytes_sent":null,"wire_bytes_recv":null,"compressed":false}` {
+		t.Errorf("uncompressed stats = %s", out)
+	}
+
+	stats.SetCompressed(true)
+	stats.RecordSent(100, 40)
+	if out, _ := json.Marshal(stats.Snapshot()); string(out) != `{"bytes_sent":200,"bytes_recv":0,"wire_bytes_sent":40,"wire_bytes_recv":0,"compressed":true}` {
+		t.Errorf("compressed stats = %s", out)
+	}
+}
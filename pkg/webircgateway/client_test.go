@@ -0,0 +1,88 @@
+package webircgateway
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// byteWriter - Writes one byte at a time, giving other writers the chance to interleave with it
+type byteWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *byteWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		w.mu.Lock()
+		w.buf.WriteByte(b)
+		w.mu.Unlock()
+		runtime.Gosched()
+	}
+	return len(p), nil
+}
+
+func (w *byteWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func TestSendUpstreamConcurrent(t *testing.T) {
+	gateway := newTestGateway(t, "")
+	client := newTestClient(t, gateway)
+
+	writer := &byteWriter{}
+	client.startUpstreamWriter(writer)
+
+	const senders = 20
+	const linesEach = 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(sender int) {
+			defer wg.Done()
+			for j := 0; j < linesEach; j++ {
+				client.SendUpstream(fmt.Sprintf("PRIVMSG #test :sender=%d line=%d %s", sender, j, strings.Repeat("x", sender+1)))
+			}
+		}(i)
+	}
+	wg.Wait()
+	client.stopUpstreamWriter()
+
+	written := writer.String()
+	if !strings.HasSuffix(written, "\r\n") {
+		t.Fatalf("the last line was not written whole: %q", written[len(written)-20:])
+	}
+
+	next := make([]int, senders)
+	lines := strings.Split(strings.TrimSuffix(written, "\r\n"), "\r\n")
+	for _, line := range lines {
+		var sender, lineNum int
+		var padding string
+		_, err := fmt.Sscanf(line, "PRIVMSG #test :sender=%d line=%d %s", &sender, &lineNum, &padding)
+		if err != nil || sender < 0 || sender >= senders || padding != strings.Repeat("x", sender+1) {
+			t.Fatalf("corrupted line %q", line)
+		}
+		if lineNum != next[sender] {
+			t.Fatalf("sender %d line %d was written out of order, expected line %d", sender, lineNum, next[sender])
+		}
+		next[sender]++
+	}
+
+	if len(lines) != senders*linesEach {
+		t.Errorf("%d lines were written, want %d", len(lines), senders*linesEach)
+	}
+}
+
+func TestSendUpstreamBeforeConnected(t *testing.T) {
+	gateway := newTestGateway(t, "")
+	client := newTestClient(t, gateway)
+
+	// Dropped rather than blocking or panicking
+	client.SendUpstream("PING :early")
+}
@@ -1,13 +1,17 @@
 package webircgateway
 
 import (
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/gobwas/glob"
 	"gopkg.in/ini.v1"
@@ -27,6 +31,105 @@ type ConfigUpstream struct {
 	ServerPassword       string
 	GatewayName          string
 	Proxy                *ConfigProxy
+	// RequiredForReady - The gateway only reports as ready while this upstream is reachable
+	RequiredForReady bool
+	// AutoJoin - Channels the gateway joins on behalf of every client once registered
+	AutoJoin []ConfigChannel
+	// ClientUsername / ClientRealname - Override the username and realname sent to this upstream
+	ClientUsername string
+	ClientRealname string
+	// Retries - Extra connection attempts made before giving up on this upstream
+	Retries int
+	// TLSTimeout - Seconds the TLS handshake may take once connected. Timeout is for the TCP dial
+	TLSTimeout int
+	// RegistrationTimeout - Seconds the upstream has to send RPL_WELCOME once connected before the
+	// connection is abandoned and the next failover host or a reconnect is tried. 0 = no limit
+	RegistrationTimeout int
+	// Fallback - A standby upstream to connect to if this one can't be reached
+	Fallback     *ConfigUpstream
+	fallbackName string
+	// isFallback - Only used as a fallback for other upstreams, never chosen directly
+	isFallback bool
+	// The config section name, eg. upstream.1
+	sectionName string
+	// PreconnectPoolSize - Idle connections kept open to this upstream, ready for new clients
+	PreconnectPoolSize int
+	// PreconnectMaxIdle - Seconds a preconnected connection may stay idle before being replaced
+	PreconnectMaxIdle int
+	// CapAllow / CapDeny - Capabilities clients may or may not see and request from this upstream
+	CapAllow []string
+	CapDeny  []string
+	// CapForce - Capabilities requested from this upstream for clients that negotiate any, whether
+	// they request them or not. eg. server-time for clients that don't but rely on it
+	CapForce []string
+	// ISupportSet / ISupportRemove - ISUPPORT (005) tokens to add or replace, and to hide from clients
+	ISupportSet    []string
+	ISupportRemove []string
+	// Weight - New clients are spread across upstreams in proportion to their weight. 0 = drained,
+	// no new clients are sent to the upstream
+	Weight int
+	// Public - List this upstream on /webirc/networks, with its display name and description
+	Public      bool
+	DisplayName string
+	Description string
+	// Origins - Clients with a matching Origin header are locked to the upstreams with matching
+	// origins. Upstreams with origins set are only used by those clients
+	Origins []glob.Glob
+	// ProxyProtocol - Start connections with a PROXY protocol v2 header giving the clients address,
+	// for IRCds that read it instead of or as well as WEBIRC
+	ProxyProtocol bool
+	// WebircFallbacks - Other WEBIRC passwords to try if the upstream rejects WebircPassword
+	WebircFallbacks []string
+	// ClientCertFile / ClientKeyFile - A certificate presented to the upstream over TLS
+	ClientCertFile string
+	ClientKeyFile  string
+	// TLSVerify - Check the upstream certificate against TLSRootCAs, or the system CAs if nil.
+	// TLSServerName - The name sent as SNI and verified, instead of Hostname
+	TLSVerify     bool
+	TLSRootCAs    *x509.CertPool
+	TLSServerName string
+	// TLSPins - The upstream must present one of these certificates, verified or not
+	TLSPins []upstreamTLSPin
+	// Socks5Address - Connect through this SOCKS5 proxy, host:port. Socks5Username and
+	// Socks5Password are optional
+	Socks5Address  string
+	Socks5Username string
+	Socks5Password string
+	// Onion - The hostname is a Tor .onion address, connected to through TorSocksAddress
+	Onion bool
+	// FailoverHosts - Other hosts of the network tried in order when Hostname can't be reached or
+	// closes the connection during registration
+	FailoverHosts []ConfigUpstreamHost
+	// FailoverAttempts - The most failover hosts tried for each client. 0 = all of them
+	FailoverAttempts int
+	// Balance - How clients are spread across Hostname and FailoverHosts: failover, round_robin or
+	// weighted. The other hosts are still tried after the chosen one
+	Balance string
+	// HostWeight - The share of clients given to Hostname when weighted
+	HostWeight int
+	// EjectAfter - Consecutive failures of a host before it is taken out of use. 0 = never.
+	// EjectTime - Seconds between probes of an ejected host to see if it has recovered
+	EjectAfter int
+	EjectTime  int
+	// ReconnectAttempts - Times to reconnect a registered client after the upstream drops it,
+	// instead of closing the client. 0 = never.
+	// ReconnectDelay / ReconnectMaxDelay - Seconds before the first attempt, doubling each
+	// attempt up to the max
+	ReconnectAttempts int
+	ReconnectDelay    int
+	ReconnectMaxDelay int
+}
+
+// ConfigUpstreamHost - One of the hosts of an upstream, host:port
+type ConfigUpstreamHost struct {
+	Address string
+	Weight  int
+}
+
+// ConfigChannel - A channel name and its optional key
+type ConfigChannel struct {
+	Name string
+	Key  string
 }
 
 // ConfigServer - A web server config
@@ -38,6 +141,31 @@ type ConfigServer struct {
 	CertFile            string
 	KeyFile             string
 	LetsEncryptCacheDir string
+	// AcceptProxyProtocol - Read a PROXY protocol header from connections made by trusted reverse proxies
+	AcceptProxyProtocol bool
+	// ProxyProtocolTrusted - Sources that send a PROXY protocol header. Empty = ReverseProxies
+	ProxyProtocolTrusted []net.IPNet
+	// ClientCerts - Ask TLS clients for a certificate so that its fingerprint can be sent in WEBIRC
+	ClientCerts bool
+	// MaxClients - Refuse connections on this listener once it has this many clients. 0 = unlimited
+	MaxClients int
+	// The config section name, eg. server.1
+	sectionName string
+	// TcpProbe - Check the first line sent to a tcp: server looks like IRC. "", "loose" or "strict"
+	TcpProbe        string
+	TcpProbeTimeout int
+	// ReusePort - Bind with SO_REUSEPORT so that other processes may listen on the same address
+	ReusePort bool
+	// Listeners - The number of sockets to accept connections on when ReusePort is set
+	Listeners int
+	// WebsocketPingInterval - Seconds between pings to websocket clients. 0 = no pings
+	WebsocketPingInterval int
+	// WebsocketPongTimeout - Seconds a websocket client has to answer a ping before it is closed.
+	// 0 = never closed for not answering
+	WebsocketPongTimeout int
+	// WebsocketIdleTimeout - Seconds a websocket client may send nothing before it is closed.
+	// Pongs don't count, 0 = never closed for being idle
+	WebsocketIdleTimeout int
 }
 
 type ConfigProxy struct {
@@ -51,7 +179,10 @@ type ConfigProxy struct {
 
 // Config - Config options for the running app
 type Config struct {
-	gateway               *Gateway
+	gateway *Gateway
+	// mu - Held by Load() while it replaces the config, for the things reading it from outside
+	// of the goroutine that reloads it
+	mu                    sync.RWMutex
 	ConfigFile            string
 	LogLevel              int
 	Gateway               bool
@@ -79,12 +210,309 @@ type Config struct {
 	Secret                string
 	Plugins               []string
 	DnsblServers          []string
-	// DnsblAction - "deny" = deny the connection. "verify" = require verification
+	// DnsblAction - "deny" = deny the connection. "verify" = require verification. "tag" = add
+	// the listing DNSBLs to the WEBIRC tags. "log" = only log the listing
 	DnsblAction string
+	// DnsblServerActions - Actions of the DNSBLs given their own instead of DnsblAction
+	DnsblServerActions map[string]string
+	// DnsblTimeout - Seconds each DNSBL query may take
+	DnsblTimeout int
+	// DnsblCacheTTL / DnsblNegativeCacheTTL - Seconds listed and unlisted results are cached for
+	DnsblCacheTTL         int
+	DnsblNegativeCacheTTL int
+	DnsblCacheSize        int
+	// DnsNameservers - host:port of the nameservers upstream hostnames and client rDNS are looked
+	// up with instead of those in /etc/resolv.conf. Empty = the systems
+	DnsNameservers []string
+	// DnsTimeout - Seconds each lookup may take. 0 = no limit
+	DnsTimeout int
+	// DnsSearch / DnsNdots - Domains names with fewer than DnsNdots dots are tried in first, as
+	// with search and ndots in resolv.conf. Only used once DnsNameservers or DnsSearch is set,
+	// until then the systems search domains are used
+	DnsSearch []string
+	DnsNdots  int
+	// IPAccessAllow / IPAccessDeny - Ranges that may or may not connect, along with those in
+	// IPAccessFile. IPAccessDefault - "allow" or "deny" addresses in neither
+	IPAccessAllow   []net.IPNet
+	IPAccessDeny    []net.IPNet
+	IPAccessFile    string
+	IPAccessDefault string
+	// GeoIPDatabase / GeoIPASNDatabase - MaxMind country (or city) and ASN databases
+	GeoIPDatabase    string
+	GeoIPASNDatabase string
+	// GeoIPWebircTags - Add the clients country and ASN to the WEBIRC tags
+	GeoIPWebircTags bool
+	// GeoIPAllowCountries / GeoIPDenyCountries / GeoIPAllowASNs / GeoIPDenyASNs - When an allow
+	// list is set, only clients on it may connect. Clients on a deny list may not
+	GeoIPAllowCountries []string
+	GeoIPDenyCountries  []string
+	GeoIPAllowASNs      []string
+	GeoIPDenyASNs       []string
+	// ReputationURL - A service that clients addresses are POSTed to before they connect, answering
+	// whether they should be allowed
+	ReputationURL  string
+	ReputationAuth string
+	// ReputationHeaders - Request headers included with the address
+	ReputationHeaders []string
+	// ReputationTimeout - Seconds to wait for an answer
+	ReputationTimeout int
+	// ReputationRejectScore - Clients with a score of at least this are refused. 0 = scores are ignored
+	ReputationRejectScore float64
+	// ReputationCacheTTL - Seconds an answer is kept for the address
+	ReputationCacheTTL int
+	// ReputationFailOpen - Allow clients when the service can't be reached or gives a bad answer
+	ReputationFailOpen bool
+	// RejectionLogFile - Log refused and disconnected connections to this file for fail2ban and
+	// similar tools. Empty = disabled
+	RejectionLogFile     string
+	RejectionLogMaxSize  int64
+	RejectionLogMaxFiles int
+	// TokenAuth - Require transport connections to carry a token signed with TokenSecret by the
+	// website. TokenBindIP - the token must have been issued for the clients address
+	TokenAuth       bool
+	TokenSecret     string
+	TokenQueryParam string
+	TokenBindIP     bool
+	// TokenMaxTTL - Seconds into the future a token may expire. 0 = no limit
+	TokenMaxTTL int
+	// ReadinessInterval - Seconds between reachability probes of upstreams required for readiness
+	ReadinessInterval int
+	// ReadinessRise / ReadinessFall - Consecutive probe results needed before changing state
+	ReadinessRise int
+	ReadinessFall int
+	// MaxClients - Refuse new clients once this many are connected. 0 = unlimited
+	MaxClients int
+	// MaxMemory - Refuse new clients once the process is using roughly this many MB. 0 = unlimited
+	MaxMemory uint64
+	// UpstreamAffinity - What clients are keyed by to send them back to the same upstream. "ip",
+	// "account", "token" or ""
+	UpstreamAffinity string
+	// UpstreamAffinityClaim - The auth claim holding a clients account, for the "account" key
+	UpstreamAffinityClaim string
+	// UpstreamAffinityParam - The query parameter clients send their reconnect token in, for the
+	// "token" key
+	UpstreamAffinityParam string
+	// UpstreamAffinityTTL - Seconds an upstream affinity is remembered for
+	UpstreamAffinityTTL int
+	// RelayRegistrationErrors - Send the client a readable notice when the upstream rejects it
+	// before registration
+	RelayRegistrationErrors bool
+	// KillAction / ForcedNickAction - "disconnect" or "pass" when the IRCd kills the client or
+	// forces a nick change on it
+	KillAction       string
+	ForcedNickAction string
+	// ForcedDisconnectMessage - Sent to the client when disconnected by KillAction / ForcedNickAction
+	ForcedDisconnectMessage string
+	// ClientIdleTimeout - Seconds a client may send nothing before it is disconnected. 0 = never
+	ClientIdleTimeout int
+	// ClientIdlePingTimeout - Seconds an idle client has to answer a PING before it is
+	// disconnected. 0 = disconnected without a PING
+	ClientIdlePingTimeout int
+	// UpstreamTransformers / ClientTransformers - Names of the line transformers applied, in order,
+	// to lines heading to the IRCd / client
+	UpstreamTransformers []string
+	ClientTransformers   []string
+	// WebircTLSInfo - Send the TLS version and cipher of the clients connection as WEBIRC tags
+	WebircTLSInfo bool
+	// QuitOnCloseReason / QuitOnAbnormalClose - QUIT message templates used instead of
+	// SendQuitOnClientClose when a websocket client closes cleanly with a reason, or abnormally
+	QuitOnCloseReason   string
+	QuitOnAbnormalClose string
+	// DebugCaptureSampleRate - Capture the full traffic of 1 in every N new clients. 0 = disabled
+	DebugCaptureSampleRate int
+	DebugCaptureFilterIPs  []net.IPNet
+	DebugCaptureFilterNick glob.Glob
+	DebugCaptureFile       string
+	// DebugCaptureMaxSize - MB the capture file may grow to before being rotated
+	DebugCaptureMaxSize  int64
+	DebugCaptureMaxFiles int
+	// NotFoundPage / NotFoundRedirect - Response to requests that don't match any route. A
+	// redirect takes priority over the page
+	NotFoundPage     string
+	NotFoundRedirect string
+	// RetryAfter - Seconds that clients refused for being over capacity are told to wait
+	RetryAfter int
+	// ProxyHeader - The header that ReverseProxies give the client address in, eg. X-Real-IP
+	ProxyHeader string
+	// ProxyHops - The number of proxies adding to ProxyHeader, so the client address is this many
+	// entries from the right. 0 = the rightmost address that isn't one of ReverseProxies
+	ProxyHops int
+	// SaslEnabled - Log clients in to their account with SASL PLAIN using credentials from
+	// SaslSource: claims (SaslAccount / SaslPassword templates), basic_auth or headers
+	SaslEnabled        bool
+	SaslSource         string
+	SaslAccount        string
+	SaslPassword       string
+	SaslAccountHeader  string
+	SaslPasswordHeader string
+	// SaslTimeout - Seconds to wait for the upstream to finish before registering without it
+	SaslTimeout int
+	// SaslRetries - Times a rejected login is tried again
+	SaslRetries int
+	// SaslOnFailure - continue registering without an account, or disconnect
+	SaslOnFailure string
+	// TorSocksAddress - The Tor SOCKS port that .onion upstreams are connected through
+	TorSocksAddress string
+	// BncEnabled - Keep the upstream connection of a registered client open when its transport
+	// closes, for a later connection with the same BncIdentityClaim to attach to
+	BncEnabled       bool
+	BncIdentityClaim string
+	// BncTimeout - Seconds a session is kept with nothing attached
+	BncTimeout int
+	// BncBuffer / BncBufferMaxAge - Lines kept for the client while nothing is attached, and the
+	// seconds they are kept for. 0 = no age limit
+	BncBuffer       int
+	BncBufferMaxAge int
+	BncAwayMessage  string
+	BncQuitMessage  string
+	// WebsocketSubprotocols - Subprotocols the websocket transport may select from those a client
+	// requests. binary.ircv3.net clients are sent binary messages, others text
+	WebsocketSubprotocols []string
+	// WebsocketBinary - Send binary messages with the raw bytes of lines to websocket clients that
+	// requested no subprotocol
+	WebsocketBinary bool
+	// WebsocketBatchSize - Bytes of queued lines sent to a websocket client as one message. 0 = a
+	// message per line
+	WebsocketBatchSize int
+	// WebsocketBatchInterval - Milliseconds a batch waits for more lines once the queue has backed up
+	WebsocketBatchInterval int
+	// WebsocketCompression - Negotiate permessage-deflate with websocket, sockjs and kiwiirc
+	// clients that offer it
+	WebsocketCompression bool
+	// WebsocketCompressionLevel - The flate level of the websocket transport, 1 (fastest) to 9
+	WebsocketCompressionLevel int
+	// QuicAlpn - The ALPN protocols native clients of the quic transport connect with
+	QuicAlpn []string
+	// QuicAllow0RTT - Accept lines sent in 0-RTT by QUIC clients resuming a previous session
+	QuicAllow0RTT bool
+	// ConnectRate / ConnectBurst - New connections accepted from each IP address per minute, and
+	// how many may be made at once. 0 = unlimited
+	ConnectRate  int
+	ConnectBurst int
+	// ConnectIPv6Prefix - IPv6 addresses within a prefix of this length share a rate limit
+	ConnectIPv6Prefix int
+	// MaxClientsPerIP - Refuse new clients from an IP address once it has this many. 0 = unlimited
+	MaxClientsPerIP int
+	// MaxClientsIPv6Prefix - IPv6 addresses within a prefix of this length share MaxClientsPerIP
+	MaxClientsIPv6Prefix int
+	// MaxClientsPerIPExempt - IP ranges that MaxClientsPerIP doesn't apply to, eg. shared NATs
+	MaxClientsPerIPExempt []net.IPNet
+	// FloodRate / FloodBurst - Lines per second a registered client may send upstream, and how many
+	// may be sent at once. 0 = unlimited
+	FloodRate  float64
+	FloodBurst int
+	// FloodAction - queue or drop lines over the flood limit
+	FloodAction string
+	// FloodMaxExcess - Lines queued, or dropped within 10 seconds, before the client is disconnected
+	FloodMaxExcess int
+	// KiwiircMaxChannels - Channels, each with its own upstream connection, that one kiwiirc
+	// connection may have open at once. 0 = unlimited
+	KiwiircMaxChannels int
+	// MaxLineLength - Bytes a websocket, sockjs or kiwiirc client may send in one message.
+	// 0 = unlimited
+	MaxLineLength int
+	// Overrides - Options set from the command line, keyed by their environment variable name
+	// without the WEBIRCGATEWAY_ prefix. Applied on every load after the config file
+	Overrides map[string]string
+	// LetsEncryptMaxCerts / LetsEncryptMaxIdleDays - Limits on the letsencrypt certificate cache.
+	// Certificates over the limit or not requested for the idle days are evicted. 0 = no limit
+	LetsEncryptMaxCerts    int
+	LetsEncryptMaxIdleDays int
+	// CtcpAnswer - CTCP query types answered by the gateway instead of the client
+	CtcpAnswer       []string
+	CtcpVersionReply string
+	// CtcpRateLimit - CTCP queries per minute passed on to each client. 0 = unlimited
+	CtcpRateLimit int
+	// ClientWriteTimeout - Seconds a write to a clients transport may block before the client is
+	// disconnected for being too slow. 0 = no timeout
+	ClientWriteTimeout int
+	// IdentdAddr / IdentdPort - Where the identd server listens. An empty address = all addresses
+	IdentdAddr string
+	IdentdPort int
+	IdentdIPv4 bool
+	IdentdIPv6 bool
+	// LogFormat - "text" or "json" lines including the client and upstream of each message
+	LogFormat string
+	// LogStdout - Print log messages to stdout. May be disabled when logging elsewhere instead
+	LogStdout      bool
+	SyslogEnabled  bool
+	SyslogNetwork  string
+	SyslogAddress  string
+	SyslogFacility string
+	SyslogTag      string
+	// LogFile - Also write log messages to this file. Empty = disabled
+	LogFile string
+	// LogFileMaxSize / LogFileMaxAge - MB and hours before the log file is rotated. 0 = no limit
+	LogFileMaxSize  int64
+	LogFileMaxAge   int
+	LogFileMaxFiles int
+	// Tracing - Export spans of each clients lifecycle to an OpenTelemetry collector over OTLP/HTTP
+	TracingEnabled     bool
+	TracingEndpoint    string
+	TracingServiceName string
+	// TracingSampleRate - The fraction of clients to trace, 0-1
+	TracingSampleRate float64
+	// AdminToken - The bearer token for the /webirc/admin/ API. Empty = API disabled
+	AdminToken string
+	// ControlSocket - The path of a unix socket accepting commands from webircgatewayctl. Empty = disabled
+	ControlSocket string
+	// ShutdownTimeout - Seconds to wait for clients to disconnect when shutting down before they
+	// are disconnected
+	ShutdownTimeout int
+	ShutdownMessage string
+	// ConfigFormat - The format of ConfigFile, "ini", "yaml" or "toml". Detected from the file extension
+	// when empty. Included files are always detected from their extension
+	ConfigFormat string
+	// ConfigAuth - Sent as the Authorization header when ConfigFile is a http(s) URL
+	ConfigAuth string
+	// ConfigRefresh - Seconds between checking a http(s) config for changes. 0 = disabled
+	ConfigRefresh int
+	remote        *RemoteConfig
+	// JwtAuth - Require transport connections to carry a JWT signed by JwtSecret, JwtPublicKey
+	// or a key from JwtJwksURL
+	JwtAuth       bool
+	JwtSecret     string
+	JwtPublicKey  interface{}
+	JwtJwksURL    string
+	JwtAudience   string
+	JwtIssuer     string
+	JwtQueryParam string
+	// OidcAuth - Require browsers to log in at the OpenID Connect provider OidcIssuer before
+	// transport connections are accepted
+	OidcAuth         bool
+	OidcIssuer       string
+	OidcClientID     string
+	OidcClientSecret string
+	OidcRedirectURL  string
+	OidcScopes       string
+	// OidcSessionTTL - Seconds a login is valid for
+	OidcSessionTTL int
+	// LdapAuth - Require transport connections to send a username and password that can bind to
+	// the LDAP server LdapURL
+	LdapAuth               bool
+	LdapURL                string
+	LdapStartTLS           bool
+	LdapTLSVerify          bool
+	LdapRootCAs            *x509.CertPool
+	LdapBindDN             string
+	LdapSearchBase         string
+	LdapSearchFilter       string
+	LdapSearchBindDN       string
+	LdapSearchBindPassword string
+	LdapAttributes         []string
+	LdapPoolSize           int
+	LdapTimeout            int
+	// CaptchaProvider - "recaptcha", "hcaptcha" or "turnstile", used for the default ReCaptchaURL
+	CaptchaProvider string
+	// VerifyHandshake - Verify a captcha response sent with the transport handshake, refusing
+	// connections without one when verification is required
+	VerifyHandshake bool
+	// VerifyExempt - IP ranges that never need to pass a captcha
+	VerifyExempt []net.IPNet
 }
 
 func NewConfig(gateway *Gateway) *Config {
-	return &Config{gateway: gateway}
+	return &Config{gateway: gateway, remote: NewRemoteConfig()}
 }
 
 // ConfigResolvePath - If relative, resolve a path to it's full absolute path relative to the config file
@@ -94,6 +522,12 @@ func (c *Config) ResolvePath(path string) string {
 		return path
 	}
 
+	// Remote configs have no directory of their own so use the working directory
+	if isRemoteConfig(c.ConfigFile) {
+		resolved, _ := filepath.Abs(path)
+		return resolved
+	}
+
 	resolved := filepath.Dir(c.ConfigFile)
 	resolved = filepath.Clean(resolved + "/" + path)
 	return resolved
@@ -101,7 +535,7 @@ func (c *Config) ResolvePath(path string) string {
 
 func (c *Config) SetConfigFile(configFile string) {
 	// Config paths starting with $ is executed rather than treated as a path
-	if strings.HasPrefix(configFile, "$ ") {
+	if strings.HasPrefix(configFile, "$ ") || isRemoteConfig(configFile) {
 		c.ConfigFile = configFile
 	} else {
 		c.ConfigFile, _ = filepath.Abs(configFile)
@@ -113,25 +547,74 @@ func (c *Config) CurrentConfigFile() string {
 	return c.ConfigFile
 }
 
-func (c *Config) Load() error {
+// loadIniFile - Read the config file and its includes, expanding environment variable references
+func (c *Config) loadIniFile() (*ini.File, error) {
 	var configSrc interface{}
+	var err error
 
 	if strings.HasPrefix(c.ConfigFile, "$ ") {
 		cmdRawOut, err := exec.Command("sh", "-c", c.ConfigFile[2:]).Output()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		configSrc = cmdRawOut
+	} else if isRemoteConfig(c.ConfigFile) {
+		body, _, err := c.remote.Fetch(c.ConfigFile, c.ConfigAuth)
+		if err != nil {
+			return nil, err
+		}
+
+		configSrc = body
 	} else {
 		configSrc = c.ConfigFile
 	}
 
-	cfg, err := ini.LoadSources(ini.LoadOptions{AllowBooleanKeys: true}, configSrc)
+	format := strings.ToLower(c.ConfigFormat)
+	if format == "" && isRemoteConfig(c.ConfigFile) {
+		format = configFileFormat(remoteConfigPath(c.ConfigFile))
+	} else if format == "" {
+		format = configFileFormat(c.ConfigFile)
+	}
+	if format != "ini" && format != "yaml" && format != "toml" {
+		return nil, fmt.Errorf("Unknown config format '%s', must be ini, yaml or toml", c.ConfigFormat)
+	}
+
+	// Included config files are merged in after the main config so that they may override it
+	var sources []interface{}
+	if src, isFile := configSrc.(string); isFile {
+		// Included paths are absolute so the main config must be too for including itself to be
+		// caught as circular
+		absSrc, absErr := filepath.Abs(src)
+		if absErr != nil {
+			return nil, absErr
+		}
+		sources, err = c.resolveIncludes(src, format, filepath.Dir(src), []string{absSrc})
+	} else {
+		sources, err = c.resolveIncludes(configSrc, format, ".", []string{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := ini.LoadSources(ini.LoadOptions{AllowBooleanKeys: true}, sources[0], sources[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	c.expandEnvRefs(cfg)
+
+	return cfg, nil
+}
+
+func (c *Config) Load() error {
+	cfg, err := c.loadIniFile()
 	if err != nil {
 		return err
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	// Clear the existing config
 	c.Gateway = false
 	c.GatewayWebircPassword = make(map[string]string)
@@ -149,21 +632,184 @@ func (c *Config) Load() error {
 	c.RequiresVerification = false
 	c.Secret = ""
 	c.SendQuitOnClientClose = ""
+	c.RelayRegistrationErrors = true
 	c.ClientRealname = ""
 	c.ClientUsername = ""
 	c.ClientHostname = ""
+	c.KillAction = "pass"
+	c.ForcedNickAction = "pass"
+	c.ForcedDisconnectMessage = "Disconnected by the IRC network: %r"
+	c.ClientIdleTimeout = 0
+	c.ClientIdlePingTimeout = 0
+	c.UpstreamTransformers = []string{}
+	c.ClientTransformers = []string{}
+	c.WebircTLSInfo = false
+	c.QuitOnCloseReason = ""
+	c.QuitOnAbnormalClose = ""
 	c.DnsblServers = []string{}
 	c.DnsblAction = ""
+	c.DnsblServerActions = make(map[string]string)
+	c.DnsblTimeout = 5
+	c.DnsblCacheTTL = 3600
+	c.DnsblNegativeCacheTTL = 300
+	c.DnsblCacheSize = 10000
+	c.DnsNameservers = []string{}
+	c.DnsTimeout = 5
+	c.DnsSearch = []string{}
+	c.DnsNdots = 1
+	c.IPAccessAllow = []net.IPNet{}
+	c.IPAccessDeny = []net.IPNet{}
+	c.IPAccessFile = ""
+	c.IPAccessDefault = "allow"
+	c.GeoIPDatabase = ""
+	c.GeoIPASNDatabase = ""
+	c.GeoIPWebircTags = false
+	c.GeoIPAllowCountries = []string{}
+	c.GeoIPDenyCountries = []string{}
+	c.GeoIPAllowASNs = []string{}
+	c.GeoIPDenyASNs = []string{}
+	c.ReputationURL = ""
+	c.ReputationAuth = ""
+	c.ReputationHeaders = []string{"User-Agent", "Origin", "Accept-Language"}
+	c.ReputationTimeout = 2
+	c.ReputationRejectScore = 0
+	c.ReputationCacheTTL = 300
+	c.ReputationFailOpen = true
+	c.RejectionLogFile = ""
+	c.RejectionLogMaxSize = 100
+	c.RejectionLogMaxFiles = 7
+	c.TokenAuth = false
+	c.TokenSecret = ""
+	c.TokenQueryParam = "conn_token"
+	c.TokenBindIP = true
+	c.TokenMaxTTL = 300
+	c.ReadinessInterval = 10
+	c.ReadinessRise = 2
+	c.ReadinessFall = 3
+	c.MaxClients = 0
+	c.MaxMemory = 0
+	c.UpstreamAffinity = ""
+	c.UpstreamAffinityClaim = "sub"
+	c.UpstreamAffinityParam = "affinity"
+	c.UpstreamAffinityTTL = 3600
+	c.DebugCaptureSampleRate = 0
+	c.DebugCaptureFilterIPs = []net.IPNet{}
+	c.DebugCaptureFilterNick = nil
+	c.DebugCaptureFile = ""
+	c.DebugCaptureMaxSize = 10
+	c.DebugCaptureMaxFiles = 5
+	c.NotFoundPage = ""
+	c.NotFoundRedirect = ""
+	c.RetryAfter = 30
+	c.ProxyHeader = "X-Forwarded-For"
+	c.ProxyHops = 0
+	c.SaslEnabled = false
+	c.SaslSource = "claims"
+	c.SaslAccount = "%{sub}"
+	c.SaslPassword = ""
+	c.SaslAccountHeader = "X-Sasl-Account"
+	c.SaslPasswordHeader = "X-Sasl-Password"
+	c.SaslTimeout = 15
+	c.SaslRetries = 0
+	c.SaslOnFailure = "continue"
+	c.TorSocksAddress = "127.0.0.1:9050"
+	c.BncEnabled = false
+	c.BncIdentityClaim = "sub"
+	c.BncTimeout = 3600
+	c.BncBuffer = 200
+	c.BncBufferMaxAge = 0
+	c.BncAwayMessage = "Detached"
+	c.BncQuitMessage = "Session expired"
+	c.WebsocketSubprotocols = []string{"text.ircv3.net", "binary.ircv3.net"}
+	c.WebsocketBinary = false
+	c.WebsocketBatchSize = 0
+	c.WebsocketBatchInterval = 0
+	c.WebsocketCompression = false
+	c.WebsocketCompressionLevel = 1
+	c.QuicAlpn = []string{"irc"}
+	c.QuicAllow0RTT = false
+	c.ConnectRate = 0
+	c.ConnectBurst = 10
+	c.ConnectIPv6Prefix = 64
+	c.MaxClientsPerIP = 0
+	c.MaxClientsIPv6Prefix = 64
+	c.FloodRate = 0
+	c.FloodBurst = 10
+	c.FloodAction = "queue"
+	c.FloodMaxExcess = 50
+	c.KiwiircMaxChannels = 0
+	c.MaxLineLength = 16384
+	c.LetsEncryptMaxCerts = 0
+	c.LetsEncryptMaxIdleDays = 0
+	c.CtcpAnswer = []string{}
+	c.CtcpVersionReply = ""
+	c.CtcpRateLimit = 0
+	c.ClientWriteTimeout = 0
+	c.LogStdout = true
+	c.SyslogEnabled = false
+	c.LogFile = ""
+	c.TracingEnabled = false
+	c.TracingEndpoint = ""
+	c.AdminToken = ""
+	c.ControlSocket = ""
+	c.ConfigRefresh = 60
+	c.JwtAuth = false
+	c.OidcAuth = false
+	c.OidcIssuer = ""
+	c.OidcClientID = ""
+	c.OidcClientSecret = ""
+	c.OidcRedirectURL = ""
+	c.OidcScopes = "openid profile"
+	c.OidcSessionTTL = 86400
+	c.LdapAuth = false
+	c.LdapURL = ""
+	c.LdapStartTLS = false
+	c.LdapTLSVerify = true
+	c.LdapRootCAs = nil
+	c.LdapBindDN = ""
+	c.LdapSearchBase = ""
+	c.LdapSearchFilter = "(uid=%u)"
+	c.LdapSearchBindDN = ""
+	c.LdapSearchBindPassword = ""
+	c.LdapAttributes = []string{}
+	c.LdapPoolSize = 4
+	c.LdapTimeout = 10
+	c.CaptchaProvider = "recaptcha"
+	c.VerifyHandshake = false
+	c.VerifyExempt = []net.IPNet{}
+	c.MaxClientsPerIPExempt = []net.IPNet{}
+	c.JwtSecret = ""
+	c.JwtPublicKey = nil
+	c.JwtJwksURL = ""
+	c.JwtAudience = ""
+	c.JwtIssuer = ""
+	c.JwtQueryParam = "token"
 
 	for _, section := range cfg.Sections() {
 		if strings.Index(section.Name(), "DEFAULT") == 0 {
 			c.LogLevel = section.Key("logLevel").MustInt(3)
+			c.LogFormat = strings.ToLower(section.Key("log_format").MustString("text"))
+			c.LogStdout = section.Key("log_stdout").MustBool(true)
 			if c.LogLevel < 1 || c.LogLevel > 3 {
 				c.gateway.Log(3, "Config option logLevel must be between 1-3. Setting default value of 3.")
 				c.LogLevel = 3
 			}
 
 			c.Identd = section.Key("identd").MustBool(false)
+			c.IdentdAddr = section.Key("identd_addr").MustString("")
+			c.IdentdPort = section.Key("identd_port").MustInt(113)
+			c.IdentdIPv4 = section.Key("identd_ipv4").MustBool(true)
+			c.IdentdIPv6 = section.Key("identd_ipv6").MustBool(true)
+
+			c.ConfigRefresh = section.Key("config_refresh").MustInt(60)
+
+			c.ShutdownTimeout = section.Key("shutdown_timeout").MustInt(30)
+			c.ShutdownMessage = section.Key("shutdown_message").MustString("This server is restarting, please reconnect")
+
+			controlSocket := section.Key("control_socket").MustString("")
+			if controlSocket != "" {
+				c.ControlSocket = c.ResolvePath(controlSocket)
+			}
 
 			c.GatewayName = section.Key("gateway_name").MustString("")
 			if strings.Contains(c.GatewayName, " ") {
@@ -173,26 +819,191 @@ func (c *Config) Load() error {
 
 			c.Secret = section.Key("secret").MustString("")
 			c.SendQuitOnClientClose = section.Key("send_quit_on_client_close").MustString("Connection closed")
+			c.QuitOnCloseReason = section.Key("quit_on_close_reason").MustString("Client closed: %r")
+			c.QuitOnAbnormalClose = section.Key("quit_on_abnormal_close").MustString("Connection lost")
+			c.RelayRegistrationErrors = section.Key("relay_registration_errors").MustBool(true)
+			c.WebircTLSInfo = section.Key("webirc_tls_info").MustBool(false)
+			c.ClientWriteTimeout = section.Key("write_timeout").MustInt(60)
 		}
 
 		if section.Name() == "verify" {
-			captchaSecret := section.Key("recaptcha_secret").MustString("")
-			captchaKey := section.Key("recaptcha_key").MustString("")
+			// The recaptcha_ options are older names of secret_key, site_key and verify_url
+			captchaSecret := confKeyAsString(section.Key("secret_key"), section.Key("recaptcha_secret").MustString(""))
+			captchaKey := section.Key("site_key").MustString(section.Key("recaptcha_key").MustString(""))
 			if captchaSecret != "" && captchaKey != "" {
 				c.RequiresVerification = section.Key("required").MustBool(false)
 				c.ReCaptchaSecret = captchaSecret
+				c.ReCaptchaKey = captchaKey
+			}
+			c.CaptchaProvider = strings.ToLower(section.Key("provider").MustString("recaptcha"))
+			c.ReCaptchaURL = section.Key("verify_url").MustString(section.Key("recaptcha_url").MustString(captchaVerifyURL(c.CaptchaProvider)))
+			c.VerifyHandshake = section.Key("handshake").MustBool(false)
+			if captchaVerifyURL(c.CaptchaProvider) == "" {
+				c.gateway.Log(3, "Config section verify has an unknown provider '%s'", c.CaptchaProvider)
+			}
+		}
+
+		if section.Name() == "verify.exempt" {
+			for _, cidrRange := range section.KeyStrings() {
+				_, validRange, cidrErr := net.ParseCIDR(cidrRange)
+				if cidrErr != nil {
+					c.gateway.Log(3, "Config section verify.exempt has invalid entry, "+cidrRange)
+					continue
+				}
+				c.VerifyExempt = append(c.VerifyExempt, *validRange)
+			}
+		}
+
+		if section.Name() == "limits.ip_exempt" {
+			for _, cidrRange := range section.KeyStrings() {
+				_, validRange, cidrErr := net.ParseCIDR(cidrRange)
+				if cidrErr != nil {
+					c.gateway.Log(3, "Config section limits.ip_exempt has invalid entry, "+cidrRange)
+					continue
+				}
+				c.MaxClientsPerIPExempt = append(c.MaxClientsPerIPExempt, *validRange)
 			}
-			c.ReCaptchaURL = section.Key("recaptcha_url").MustString("https://www.google.com/recaptcha/api/siteverify")
 		}
 
 		if section.Name() == "dnsbl" {
 			c.DnsblAction = section.Key("action").MustString("")
+			c.DnsblTimeout = section.Key("timeout").MustInt(5)
+			c.DnsblCacheTTL = section.Key("cache_ttl").MustInt(3600)
+			c.DnsblNegativeCacheTTL = section.Key("negative_cache_ttl").MustInt(300)
+			c.DnsblCacheSize = section.Key("cache_size").MustInt(10000)
+		}
+
+		if section.Name() == "dns" {
+			for _, entry := range section.Key("nameservers").Strings(",") {
+				nameserver, ok := parseNameserver(entry)
+				if !ok {
+					c.gateway.Log(3, "Config section dns has an invalid nameserver, %s", entry)
+					continue
+				}
+				c.DnsNameservers = append(c.DnsNameservers, nameserver)
+			}
+			c.DnsTimeout = section.Key("timeout").MustInt(5)
+			for _, domain := range section.Key("search").Strings(",") {
+				if domain = strings.Trim(strings.ToLower(domain), "."); domain != "" {
+					c.DnsSearch = append(c.DnsSearch, domain)
+				}
+			}
+			c.DnsNdots = section.Key("ndots").MustInt(1)
 		}
 
 		if section.Name() == "dnsbl.servers" {
 			for _, addr := range section.KeyStrings() {
 				c.DnsblServers = append(c.DnsblServers, addr)
+
+				// Servers listed without a value use the [dnsbl] action
+				action := section.Key(addr).String()
+				if action == "true" {
+					continue
+				}
+				if !isDnsblAction(action) {
+					c.gateway.Log(3, "Config section dnsbl.servers has an invalid action for %s, using the [dnsbl] action", addr)
+					continue
+				}
+				c.DnsblServerActions[addr] = action
+			}
+		}
+
+		if section.Name() == "ip_access" {
+			c.IPAccessFile = section.Key("file").MustString("")
+			if c.IPAccessFile != "" {
+				c.IPAccessFile = c.ResolvePath(c.IPAccessFile)
+			}
+			c.IPAccessDefault = section.Key("default").In("allow", []string{"allow", "deny"})
+		}
+
+		if section.Name() == "ip_access.allow" || section.Name() == "ip_access.deny" {
+			for _, val := range section.KeyStrings() {
+				ipRange, err := parseIPRange(val)
+				if err != nil {
+					c.gateway.Log(3, "Config section %s has invalid entry, %s", section.Name(), val)
+					continue
+				}
+				if section.Name() == "ip_access.allow" {
+					c.IPAccessAllow = append(c.IPAccessAllow, *ipRange)
+				} else {
+					c.IPAccessDeny = append(c.IPAccessDeny, *ipRange)
+				}
+			}
+		}
+
+		if section.Name() == "geoip" {
+			c.GeoIPDatabase = section.Key("database").MustString("")
+			if c.GeoIPDatabase != "" {
+				c.GeoIPDatabase = c.ResolvePath(c.GeoIPDatabase)
+			}
+			c.GeoIPASNDatabase = section.Key("asn_database").MustString("")
+			if c.GeoIPASNDatabase != "" {
+				c.GeoIPASNDatabase = c.ResolvePath(c.GeoIPASNDatabase)
+			}
+			c.GeoIPWebircTags = section.Key("webirc_tags").MustBool(false)
+			c.GeoIPAllowCountries = splitGeoIPList(section.Key("allow_countries").MustString(""), "")
+			c.GeoIPDenyCountries = splitGeoIPList(section.Key("deny_countries").MustString(""), "")
+			c.GeoIPAllowASNs = splitGeoIPList(section.Key("allow_asns").MustString(""), "AS")
+			c.GeoIPDenyASNs = splitGeoIPList(section.Key("deny_asns").MustString(""), "AS")
+		}
+
+		if section.Name() == "reputation" {
+			c.ReputationURL = section.Key("url").MustString("")
+			c.ReputationAuth = confKeyAsString(section.Key("authorization"), "")
+			c.ReputationHeaders = []string{}
+			for _, name := range strings.Split(section.Key("headers").MustString("User-Agent, Origin, Accept-Language"), ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					c.ReputationHeaders = append(c.ReputationHeaders, name)
+				}
+			}
+			c.ReputationTimeout = section.Key("timeout").MustInt(2)
+			c.ReputationRejectScore = section.Key("reject_score").MustFloat64(0)
+			c.ReputationCacheTTL = section.Key("cache_ttl").MustInt(300)
+			c.ReputationFailOpen = section.Key("fail_open").MustBool(true)
+		}
+
+		if section.Name() == "readiness" {
+			c.ReadinessInterval = section.Key("interval").MustInt(10)
+			c.ReadinessRise = section.Key("rise").MustInt(2)
+			c.ReadinessFall = section.Key("fall").MustInt(3)
+		}
+
+		if section.Name() == "limits" {
+			c.MaxClients = section.Key("max_clients").MustInt(0)
+			c.MaxMemory = section.Key("max_memory").MustUint64(0)
+			c.RetryAfter = section.Key("retry_after").MustInt(30)
+			c.ConnectRate = section.Key("connect_rate").MustInt(0)
+			c.ConnectBurst = section.Key("connect_burst").MustInt(10)
+			c.ConnectIPv6Prefix = section.Key("connect_ipv6_prefix").MustInt(64)
+			if c.ConnectBurst < 1 {
+				c.ConnectBurst = 1
+			}
+			if c.ConnectIPv6Prefix < 1 || c.ConnectIPv6Prefix > 128 {
+				c.gateway.Log(3, "Config section limits connect_ipv6_prefix must be between 1 and 128, using 64")
+				c.ConnectIPv6Prefix = 64
+			}
+			c.MaxClientsPerIP = section.Key("max_clients_per_ip").MustInt(0)
+			c.MaxClientsIPv6Prefix = section.Key("max_clients_ipv6_prefix").MustInt(64)
+			if c.MaxClientsIPv6Prefix < 1 || c.MaxClientsIPv6Prefix > 128 {
+				c.gateway.Log(3, "Config section limits max_clients_ipv6_prefix must be between 1 and 128, using 64")
+				c.MaxClientsIPv6Prefix = 64
 			}
+			c.FloodRate = section.Key("flood_rate").MustFloat64(0)
+			c.FloodBurst = section.Key("flood_burst").MustInt(10)
+			c.FloodAction = section.Key("flood_action").In("queue", []string{"queue", "drop"})
+			c.FloodMaxExcess = section.Key("flood_max_excess").MustInt(50)
+			if c.FloodBurst < 1 {
+				c.FloodBurst = 1
+			}
+			c.KiwiircMaxChannels = section.Key("kiwiirc_max_channels").MustInt(0)
+			c.MaxLineLength = section.Key("max_line_length").MustInt(16384)
+		}
+
+		if section.Name() == "upstream_affinity" {
+			c.UpstreamAffinity = section.Key("key").In("", []string{"", "ip", "account", "token"})
+			c.UpstreamAffinityClaim = section.Key("claim").MustString("sub")
+			c.UpstreamAffinityParam = section.Key("token_param").MustString("affinity")
+			c.UpstreamAffinityTTL = section.Key("ttl").MustInt(3600)
 		}
 
 		if section.Name() == "gateway" {
@@ -211,6 +1022,15 @@ func (c *Config) Load() error {
 			c.ClientUsername = section.Key("username").MustString("")
 			c.ClientRealname = section.Key("realname").MustString("")
 			c.ClientHostname = section.Key("hostname").MustString("")
+			c.KillAction = section.Key("on_kill").In("pass", []string{"pass", "disconnect"})
+			c.ForcedNickAction = section.Key("on_forced_nick").In("pass", []string{"pass", "disconnect"})
+			c.ForcedDisconnectMessage = section.Key("forced_disconnect_message").MustString("Disconnected by the IRC network: %r")
+			c.ClientIdleTimeout = section.Key("idle_disconnect").MustInt(0)
+			c.ClientIdlePingTimeout = section.Key("idle_ping_timeout").MustInt(0)
+			if c.ClientIdlePingTimeout > 0 && c.ClientIdleTimeout <= 0 {
+				c.gateway.Log(3, "Config section clients idle_ping_timeout is set without idle_disconnect, it is not used")
+				c.ClientIdlePingTimeout = 0
+			}
 		}
 
 		if strings.Index(section.Name(), "fileserving") == 0 {
@@ -219,6 +1039,205 @@ func (c *Config) Load() error {
 			}
 		}
 
+		if section.Name() == "ctcp" {
+			for _, ctcpType := range section.Key("answer").Strings(",") {
+				c.CtcpAnswer = append(c.CtcpAnswer, strings.ToUpper(ctcpType))
+			}
+			c.CtcpVersionReply = section.Key("version").MustString("webircgateway " + Version)
+			c.CtcpRateLimit = section.Key("rate_limit").MustInt(0)
+		}
+
+		if section.Name() == "log_file" {
+			logFile := section.Key("path").MustString("")
+			if logFile != "" {
+				c.LogFile = c.ResolvePath(logFile)
+			}
+			c.LogFileMaxSize = section.Key("max_size").MustInt64(100)
+			c.LogFileMaxAge = section.Key("max_age").MustInt(0)
+			c.LogFileMaxFiles = section.Key("max_files").MustInt(7)
+		}
+
+		if section.Name() == "auth_token" {
+			c.TokenAuth = section.Key("enabled").MustBool(false)
+			c.TokenSecret = confKeyAsString(section.Key("secret"), "")
+			c.TokenQueryParam = section.Key("query_param").MustString("conn_token")
+			c.TokenBindIP = section.Key("bind_ip").MustBool(true)
+			c.TokenMaxTTL = section.Key("max_ttl").MustInt(300)
+			if c.TokenAuth && c.TokenSecret == "" {
+				c.gateway.Log(3, "Config section auth_token has no secret, all connections will be refused")
+			}
+		}
+
+		if section.Name() == "proxy_headers" {
+			c.ProxyHeader = section.Key("header").MustString("X-Forwarded-For")
+			c.ProxyHops = section.Key("hops").MustInt(0)
+		}
+
+		if section.Name() == "tor" {
+			c.TorSocksAddress = section.Key("socks").MustString("127.0.0.1:9050")
+		}
+
+		if section.Name() == "sasl" {
+			c.SaslEnabled = section.Key("enabled").MustBool(false)
+			c.SaslSource = strings.ToLower(section.Key("source").MustString("claims"))
+			c.SaslAccount = section.Key("account").MustString("%{sub}")
+			c.SaslPassword = confKeyAsString(section.Key("password"), "")
+			c.SaslAccountHeader = section.Key("account_header").MustString("X-Sasl-Account")
+			c.SaslPasswordHeader = section.Key("password_header").MustString("X-Sasl-Password")
+			c.SaslTimeout = section.Key("timeout").MustInt(15)
+			c.SaslRetries = section.Key("retries").MustInt(0)
+			c.SaslOnFailure = strings.ToLower(section.Key("on_failure").MustString("continue"))
+
+			if c.SaslSource != "claims" && c.SaslSource != "basic_auth" && c.SaslSource != "headers" {
+				c.gateway.Log(3, "Config section sasl has an unknown source '%s', SASL is disabled", c.SaslSource)
+				c.SaslEnabled = false
+			}
+		}
+
+		if section.Name() == "bnc" {
+			c.BncEnabled = section.Key("enabled").MustBool(false)
+			c.BncIdentityClaim = section.Key("identity_claim").MustString("sub")
+			c.BncTimeout = section.Key("timeout").MustInt(3600)
+			if c.BncTimeout < 1 {
+				c.BncTimeout = 1
+			}
+			c.BncBuffer = section.Key("buffer").MustInt(200)
+			c.BncBufferMaxAge = section.Key("buffer_max_age").MustInt(0)
+			c.BncAwayMessage = section.Key("away_message").MustString("Detached")
+			c.BncQuitMessage = section.Key("quit_message").MustString("Session expired")
+		}
+
+		if section.Name() == "websocket" {
+			c.WebsocketSubprotocols = []string{}
+			for _, protocol := range strings.Split(section.Key("subprotocols").MustString("text.ircv3.net, binary.ircv3.net"), ",") {
+				if protocol = strings.TrimSpace(protocol); protocol != "" {
+					c.WebsocketSubprotocols = append(c.WebsocketSubprotocols, protocol)
+				}
+			}
+			c.WebsocketBinary = section.Key("binary").MustBool(false)
+			c.WebsocketBatchSize = section.Key("batch_size").MustInt(0)
+			c.WebsocketBatchInterval = section.Key("batch_interval").MustInt(0)
+		}
+
+		if section.Name() == "compression" {
+			c.WebsocketCompression = section.Key("enabled").MustBool(false)
+			c.WebsocketCompressionLevel = section.Key("level").MustInt(1)
+		}
+
+		if section.Name() == "quic" {
+			c.QuicAlpn = []string{}
+			for _, protocol := range strings.Split(section.Key("alpn").MustString("irc"), ",") {
+				if protocol = strings.TrimSpace(protocol); protocol != "" {
+					c.QuicAlpn = append(c.QuicAlpn, protocol)
+				}
+			}
+			c.QuicAllow0RTT = section.Key("allow_0rtt").MustBool(false)
+		}
+
+		if section.Name() == "rejection_log" {
+			rejectionLog := section.Key("path").MustString("")
+			if rejectionLog != "" {
+				c.RejectionLogFile = c.ResolvePath(rejectionLog)
+			}
+			c.RejectionLogMaxSize = section.Key("max_size").MustInt64(100)
+			c.RejectionLogMaxFiles = section.Key("max_files").MustInt(7)
+		}
+
+		if section.Name() == "syslog" {
+			c.SyslogEnabled = section.Key("enabled").MustBool(false)
+			c.SyslogNetwork = strings.ToLower(section.Key("network").MustString(""))
+			c.SyslogAddress = section.Key("address").MustString("")
+			c.SyslogFacility = strings.ToLower(section.Key("facility").MustString("daemon"))
+			c.SyslogTag = section.Key("tag").MustString("webircgateway")
+		}
+
+		if section.Name() == "admin" {
+			c.AdminToken = section.Key("token").MustString("")
+		}
+
+		if section.Name() == "auth_jwt" {
+			c.JwtAuth = section.Key("enabled").MustBool(false)
+			c.JwtSecret = confKeyAsString(section.Key("secret"), "")
+			c.JwtJwksURL = section.Key("jwks_url").MustString("")
+			c.JwtAudience = section.Key("audience").MustString("")
+			c.JwtIssuer = section.Key("issuer").MustString("")
+			c.JwtQueryParam = section.Key("query_param").MustString("token")
+
+			publicKeyFile := section.Key("public_key").MustString("")
+			if publicKeyFile != "" {
+				c.JwtPublicKey = c.loadJwtPublicKey(c.ResolvePath(publicKeyFile))
+			}
+
+			if c.JwtAuth && c.JwtSecret == "" && c.JwtPublicKey == nil && c.JwtJwksURL == "" {
+				c.gateway.Log(3, "Config section auth_jwt needs a secret, public_key or jwks_url. All connections will be refused")
+			}
+		}
+
+		if section.Name() == "auth_oidc" {
+			c.OidcAuth = section.Key("enabled").MustBool(false)
+			c.OidcIssuer = section.Key("issuer").MustString("")
+			c.OidcClientID = section.Key("client_id").MustString("")
+			c.OidcClientSecret = confKeyAsString(section.Key("client_secret"), "")
+			c.OidcRedirectURL = section.Key("redirect_url").MustString("")
+			c.OidcScopes = section.Key("scopes").MustString("openid profile")
+			c.OidcSessionTTL = section.Key("session_ttl").MustInt(86400)
+
+			if c.OidcAuth && (c.OidcIssuer == "" || c.OidcClientID == "") {
+				c.gateway.Log(3, "Config section auth_oidc needs an issuer and client_id. Logins will fail")
+			}
+		}
+
+		if section.Name() == "auth_ldap" {
+			c.LdapAuth = section.Key("enabled").MustBool(false)
+			c.LdapURL = section.Key("url").MustString("")
+			c.LdapStartTLS = section.Key("start_tls").MustBool(false)
+			c.LdapTLSVerify = section.Key("tls_verify").MustBool(true)
+			c.LdapBindDN = section.Key("bind_dn").MustString("")
+			c.LdapSearchBase = section.Key("search_base").MustString("")
+			c.LdapSearchFilter = section.Key("search_filter").MustString("(uid=%u)")
+			c.LdapSearchBindDN = section.Key("search_bind_dn").MustString("")
+			c.LdapSearchBindPassword = confKeyAsString(section.Key("search_bind_password"), "")
+			c.LdapAttributes = section.Key("attributes").Strings(",")
+			c.LdapPoolSize = section.Key("pool_size").MustInt(4)
+			c.LdapTimeout = section.Key("timeout").MustInt(10)
+
+			caFile := section.Key("ca_file").MustString("")
+			if caFile != "" {
+				c.LdapRootCAs = c.loadLdapCA(c.ResolvePath(caFile))
+			}
+
+			if c.LdapAuth && c.LdapURL == "" {
+				c.gateway.Log(3, "Config section auth_ldap needs a url. All connections will be refused")
+			}
+			if c.LdapAuth && c.LdapBindDN == "" && c.LdapSearchBase == "" {
+				c.gateway.Log(3, "Config section auth_ldap needs a bind_dn or search_base. All connections will be refused")
+			}
+		}
+
+		if section.Name() == "tracing" {
+			c.TracingEnabled = section.Key("enabled").MustBool(false)
+			c.TracingEndpoint = section.Key("endpoint").MustString("http://localhost:4318")
+			c.TracingServiceName = section.Key("service_name").MustString("webircgateway")
+			c.TracingSampleRate = section.Key("sample_rate").MustFloat64(1)
+			if c.TracingSampleRate < 0 || c.TracingSampleRate > 1 {
+				c.gateway.Log(3, "Config option tracing sample_rate must be between 0-1. Setting default value of 1.")
+				c.TracingSampleRate = 1
+			}
+		}
+
+		if section.Name() == "letsencrypt" {
+			c.LetsEncryptMaxCerts = section.Key("max_certs").MustInt(0)
+			c.LetsEncryptMaxIdleDays = section.Key("max_idle_days").MustInt(0)
+		}
+
+		if strings.Index(section.Name(), "not_found") == 0 {
+			notFoundPage := section.Key("page").MustString("")
+			if notFoundPage != "" {
+				c.NotFoundPage = c.ResolvePath(notFoundPage)
+			}
+			c.NotFoundRedirect = section.Key("redirect").MustString("")
+		}
+
 		if strings.Index(section.Name(), "server.") == 0 {
 			server := ConfigServer{}
 			server.LocalAddr = confKeyAsString(section.Key("bind"), "127.0.0.1")
@@ -233,6 +1252,36 @@ func (c *Config) Load() error {
 			server.CertFile = confKeyAsString(section.Key("cert"), "")
 			server.KeyFile = confKeyAsString(section.Key("key"), "")
 			server.LetsEncryptCacheDir = confKeyAsString(section.Key("letsencrypt_cache"), "")
+			server.AcceptProxyProtocol = confKeyAsBool(section.Key("proxy_protocol"), false)
+			server.ClientCerts = confKeyAsBool(section.Key("client_certs"), false)
+			for _, trusted := range section.Key("proxy_protocol_trusted").Strings(",") {
+				trustedRange, err := parseIPRange(trusted)
+				if err != nil {
+					c.gateway.Log(3, "Config section %s has invalid proxy_protocol_trusted entry, %s", section.Name(), trusted)
+					continue
+				}
+				server.ProxyProtocolTrusted = append(server.ProxyProtocolTrusted, *trustedRange)
+			}
+			server.MaxClients = confKeyAsInt(section.Key("max_clients"), 0)
+			server.sectionName = section.Name()
+			server.TcpProbe = strings.ToLower(confKeyAsString(section.Key("probe"), ""))
+			if server.TcpProbe != "" && server.TcpProbe != "loose" && server.TcpProbe != "strict" {
+				c.gateway.Log(3, "Config option probe must be loose or strict. Disabling it for %s", section.Name())
+				server.TcpProbe = ""
+			}
+			server.TcpProbeTimeout = confKeyAsInt(section.Key("probe_timeout"), 10)
+			server.ReusePort = confKeyAsBool(section.Key("reuse_port"), false)
+			server.Listeners = confKeyAsInt(section.Key("listeners"), 1)
+			if server.Listeners < 1 {
+				server.Listeners = 1
+			}
+			if server.Listeners > 1 && !server.ReusePort {
+				c.gateway.Log(3, "Config option listeners requires reuse_port. Using a single listener for %s", section.Name())
+				server.Listeners = 1
+			}
+			server.WebsocketPingInterval = confKeyAsInt(section.Key("ping_interval"), 0)
+			server.WebsocketPongTimeout = confKeyAsInt(section.Key("pong_timeout"), 0)
+			server.WebsocketIdleTimeout = confKeyAsInt(section.Key("idle_timeout"), 0)
 
 			if strings.HasSuffix(server.LetsEncryptCacheDir, ".cache") {
 				return errors.New("Syntax has changed. Please update letsencrypt_cache to a directory path (eg ./cache)")
@@ -262,9 +1311,95 @@ func (c *Config) Load() error {
 				upstream.TLS = section.Key("tls").MustBool(false)
 			}
 
-			upstream.Timeout = section.Key("timeout").MustInt(10)
+			upstream.Timeout = section.Key("dial_timeout").MustInt(section.Key("timeout").MustInt(10))
+			upstream.TLSTimeout = section.Key("tls_timeout").MustInt(upstream.Timeout)
+			upstream.RegistrationTimeout = section.Key("registration_timeout").MustInt(0)
 			upstream.Throttle = section.Key("throttle").MustInt(2)
 			upstream.WebircPassword = section.Key("webirc").MustString("")
+			upstream.WebircFallbacks = section.Key("webirc_fallback").Strings(",")
+			if clientCert := section.Key("client_cert").MustString(""); clientCert != "" {
+				upstream.ClientCertFile = c.ResolvePath(clientCert)
+				// The key may be in the same file as the certificate
+				upstream.ClientKeyFile = c.ResolvePath(section.Key("client_key").MustString(clientCert))
+			}
+			if caFile := section.Key("tls_ca_file").MustString(""); caFile != "" {
+				upstream.TLSRootCAs = c.loadUpstreamCA(section.Name(), c.ResolvePath(caFile))
+			}
+			// An internal CA is only of use if certificates are verified against it
+			upstream.TLSVerify = section.Key("tls_verify").MustBool(upstream.TLSRootCAs != nil)
+			upstream.TLSServerName = section.Key("tls_server_name").MustString("")
+			for _, pin := range section.Key("tls_pin").Strings(",") {
+				tlsPin, err := parseUpstreamTLSPin(pin)
+				if err != nil {
+					c.gateway.Log(3, "Config section %s has an %s, %s", section.Name(), err.Error(), pin)
+					continue
+				}
+				upstream.TLSPins = append(upstream.TLSPins, tlsPin)
+			}
+			if upstream.TLS && !upstream.TLSVerify && len(upstream.TLSPins) == 0 {
+				c.gateway.Log(2, "Config section %s does not verify the upstream TLS certificate. Set tls_verify or tls_pin to do so", section.Name())
+			}
+			upstream.Socks5Address = section.Key("socks5").MustString("")
+			upstream.Socks5Username = confKeyAsString(section.Key("socks5_username"), "")
+			upstream.Socks5Password = confKeyAsString(section.Key("socks5_password"), "")
+			if upstream.Socks5Address != "" && upstream.Network == "unix" {
+				c.gateway.Log(3, "Config section %s connects to a unix socket, socks5 is not used", section.Name())
+			}
+			if _, _, err := net.SplitHostPort(upstream.Socks5Address); upstream.Socks5Address != "" && err != nil {
+				c.gateway.Log(3, "Config section %s has an invalid socks5 address, %s", section.Name(), upstream.Socks5Address)
+				upstream.Socks5Address = ""
+			}
+			// failover_hosts = "host:port weight, host". The port and weight are optional
+			for _, entry := range section.Key("failover_hosts").Strings(",") {
+				if upstream.Network == "unix" {
+					c.gateway.Log(3, "Config section %s connects to a unix socket, failover_hosts is not used", section.Name())
+					break
+				}
+				parts := strings.Fields(entry)
+				if len(parts) == 0 {
+					c.gateway.Log(3, "Config section %s has an empty failover host", section.Name())
+					continue
+				}
+				host := ConfigUpstreamHost{Address: parts[0], Weight: 1}
+				// The port defaults to that of the upstream
+				if _, _, err := net.SplitHostPort(host.Address); err != nil {
+					host.Address = net.JoinHostPort(host.Address, strconv.Itoa(upstream.Port))
+				}
+				if _, portStr, err := net.SplitHostPort(host.Address); err != nil || portStr == "" {
+					c.gateway.Log(3, "Config section %s has an invalid failover host, %s", section.Name(), entry)
+					continue
+				}
+				if len(parts) > 1 {
+					weight, err := strconv.Atoi(parts[1])
+					if err != nil || weight < 0 {
+						c.gateway.Log(3, "Config section %s has an invalid failover host weight, %s", section.Name(), entry)
+						continue
+					}
+					host.Weight = weight
+				}
+				upstream.FailoverHosts = append(upstream.FailoverHosts, host)
+			}
+			upstream.FailoverAttempts = section.Key("failover_attempts").MustInt(0)
+			upstream.Balance = strings.ToLower(section.Key("balance").MustString("failover"))
+			if upstream.Balance != "failover" && upstream.Balance != "round_robin" && upstream.Balance != "weighted" {
+				c.gateway.Log(3, "Config section %s has an unknown balance '%s', using failover", section.Name(), upstream.Balance)
+				upstream.Balance = "failover"
+			}
+			upstream.HostWeight = section.Key("host_weight").MustInt(1)
+			upstream.EjectAfter = section.Key("eject_after").MustInt(0)
+			upstream.EjectTime = section.Key("eject_time").MustInt(30)
+			if upstream.EjectTime < 1 {
+				upstream.EjectTime = 1
+			}
+			upstream.ReconnectAttempts = section.Key("reconnect_attempts").MustInt(0)
+			upstream.ReconnectDelay = section.Key("reconnect_delay").MustInt(2)
+			if upstream.ReconnectDelay < 1 {
+				upstream.ReconnectDelay = 1
+			}
+			upstream.ReconnectMaxDelay = section.Key("reconnect_max_delay").MustInt(60)
+			if upstream.ReconnectMaxDelay < upstream.ReconnectDelay {
+				upstream.ReconnectMaxDelay = upstream.ReconnectDelay
+			}
 			upstream.ServerPassword = section.Key("serverpassword").MustString("")
 
 			upstream.GatewayName = section.Key("gateway_name").MustString("")
@@ -274,6 +1409,62 @@ func (c *Config) Load() error {
 			}
 
 			upstream.NetworkCommonAddress = section.Key("network_common_address").MustString("")
+			upstream.RequiredForReady = section.Key("readiness").MustBool(false)
+			upstream.ClientUsername = section.Key("username").MustString("")
+			upstream.ClientRealname = section.Key("realname").MustString("")
+			upstream.Retries = section.Key("retries").MustInt(0)
+			upstream.fallbackName = section.Key("fallback").MustString("")
+			upstream.sectionName = section.Name()
+			upstream.PreconnectPoolSize = section.Key("preconnect_pool").MustInt(0)
+			upstream.PreconnectMaxIdle = section.Key("preconnect_max_idle").MustInt(20)
+			upstream.ProxyProtocol = section.Key("proxy_protocol").MustBool(false)
+			for _, capability := range section.Key("cap_allow").Strings(",") {
+				upstream.CapAllow = append(upstream.CapAllow, strings.ToLower(capability))
+			}
+			for _, capability := range section.Key("cap_deny").Strings(",") {
+				upstream.CapDeny = append(upstream.CapDeny, strings.ToLower(capability))
+			}
+			for _, capability := range section.Key("cap_force").Strings(",") {
+				upstream.CapForce = append(upstream.CapForce, strings.ToLower(capability))
+			}
+			upstream.ISupportSet = section.Key("isupport_set").Strings(",")
+			upstream.Weight = section.Key("weight").MustInt(1)
+			upstream.Public = section.Key("public").MustBool(false)
+			upstream.DisplayName = section.Key("display_name").MustString(section.Name())
+			upstream.Description = section.Key("description").MustString("")
+			for _, origin := range section.Key("origins").Strings(",") {
+				match, err := glob.Compile(strings.ToLower(origin))
+				if err != nil {
+					c.gateway.Log(3, "Config section %s has invalid origin match, %s", section.Name(), origin)
+					continue
+				}
+				upstream.Origins = append(upstream.Origins, match)
+			}
+			if upstream.Weight < 0 {
+				c.gateway.Log(3, "Config section %s has a negative weight, using 0", section.Name())
+				upstream.Weight = 0
+			}
+			for _, token := range section.Key("isupport_remove").Strings(",") {
+				upstream.ISupportRemove = append(upstream.ISupportRemove, isupportTokenName(token))
+			}
+
+			// autojoin = "channel, keyedchannel key". The # is optional as it starts a comment in the
+			// config file unless the value is wrapped in `backticks`
+			for _, entry := range section.Key("autojoin").Strings(",") {
+				parts := strings.Fields(entry)
+				if len(parts) == 0 {
+					c.gateway.Log(3, "Config section %s has an empty autojoin channel", section.Name())
+					continue
+				}
+				channel := ConfigChannel{Name: parts[0]}
+				if !strings.ContainsAny(channel.Name[:1], "#&+!") {
+					channel.Name = "#" + channel.Name
+				}
+				if len(parts) > 1 {
+					channel.Key = parts[1]
+				}
+				upstream.AutoJoin = append(upstream.AutoJoin, channel)
+			}
 
 			c.Upstreams = append(c.Upstreams, upstream)
 		}
@@ -285,6 +1476,18 @@ func (c *Config) Load() error {
 			}
 		}
 
+		if section.Name() == "transformers.upstream" {
+			for _, name := range section.KeyStrings() {
+				c.UpstreamTransformers = append(c.UpstreamTransformers, strings.Trim(name, "\n"))
+			}
+		}
+
+		if section.Name() == "transformers.client" {
+			for _, name := range section.KeyStrings() {
+				c.ClientTransformers = append(c.ClientTransformers, strings.Trim(name, "\n"))
+			}
+		}
+
 		if strings.Index(section.Name(), "plugins") == 0 {
 			for _, plugin := range section.KeyStrings() {
 				c.Plugins = append(c.Plugins, strings.Trim(plugin, "\n"))
@@ -313,6 +1516,32 @@ func (c *Config) Load() error {
 			}
 		}
 
+		if strings.Index(section.Name(), "debug_capture") == 0 {
+			c.DebugCaptureSampleRate = section.Key("sample_rate").MustInt(0)
+			c.DebugCaptureFile = c.ResolvePath(section.Key("file").MustString("debug_capture.log"))
+			c.DebugCaptureMaxSize = section.Key("max_size").MustInt64(10)
+			c.DebugCaptureMaxFiles = section.Key("max_files").MustInt(5)
+
+			for _, cidrRange := range section.Key("filter_ips").Strings(",") {
+				_, validRange, cidrErr := net.ParseCIDR(cidrRange)
+				if cidrErr != nil {
+					c.gateway.Log(3, "Config section debug_capture has invalid filter_ips entry, "+cidrRange)
+					continue
+				}
+				c.DebugCaptureFilterIPs = append(c.DebugCaptureFilterIPs, *validRange)
+			}
+
+			filterNick := section.Key("filter_nick").MustString("")
+			if filterNick != "" {
+				match, err := glob.Compile(strings.ToLower(filterNick))
+				if err != nil {
+					c.gateway.Log(3, "Config section debug_capture has invalid filter_nick, "+filterNick)
+				} else {
+					c.DebugCaptureFilterNick = match
+				}
+			}
+		}
+
 		if strings.Index(section.Name(), "reverse_proxies") == 0 {
 			for _, cidrRange := range section.KeyStrings() {
 				_, validRange, cidrErr := net.ParseCIDR(cidrRange)
@@ -325,9 +1554,176 @@ func (c *Config) Load() error {
 		}
 	}
 
+	// Overrides first so that the copies of upstreams used as fallbacks have them too
+	c.applyOverrides()
+	c.resolveUpstreamFallbacks()
+	c.routeOnionUpstreams()
+
 	return nil
 }
 
+// upstreams - A copy of the upstreams, for reading while the config may be reloaded
+func (c *Config) upstreams() []ConfigUpstream {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	upstreams := make([]ConfigUpstream, len(c.Upstreams))
+	copy(upstreams, c.Upstreams)
+	return upstreams
+}
+
+// configRefresh - ConfigRefresh, for reading while the config may be reloaded
+func (c *Config) configRefresh() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.ConfigRefresh
+}
+
+// servers - A copy of the servers, for reading while the config may be reloaded
+func (c *Config) servers() []ConfigServer {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	servers := make([]ConfigServer, len(c.Servers))
+	copy(servers, c.Servers)
+	return servers
+}
+
+// resolveUpstreamFallbacks - Link upstreams to the fallback upstreams they name. Upstreams used as
+// a fallback are removed from normal upstream selection
+func (c *Config) resolveUpstreamFallbacks() {
+	for i := range c.Upstreams {
+		name := c.Upstreams[i].fallbackName
+		if name == "" {
+			continue
+		}
+
+		for j := range c.Upstreams {
+			if c.Upstreams[j].sectionName == name && i != j {
+				c.Upstreams[j].isFallback = true
+				fallback := c.Upstreams[j]
+				// A fallback does not have its own fallback
+				fallback.Fallback = nil
+				c.Upstreams[i].Fallback = &fallback
+			}
+		}
+
+		if c.Upstreams[i].Fallback == nil {
+			c.gateway.Log(3, "Config section %s has an unknown fallback, %s", c.Upstreams[i].sectionName, name)
+		}
+	}
+}
+
+// resolveIncludes - Walk the include directives of a config source, returning all sources in the
+// order they should be merged. includeStack holds the files currently being included so that
+// circular includes can be detected.
+func (c *Config) resolveIncludes(src interface{}, format string, baseDir string, includeStack []string) ([]interface{}, error) {
+	if format == "yaml" || format == "toml" {
+		var data []byte
+		var err error
+		if path, isFile := src.(string); isFile {
+			data, err = ioutil.ReadFile(path)
+		} else {
+			data = src.([]byte)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if format == "yaml" {
+			src, err = yamlToIni(data)
+		} else {
+			src, err = tomlToIni(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg, err := ini.LoadSources(ini.LoadOptions{AllowBooleanKeys: true}, src)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := []interface{}{src}
+
+	for _, include := range cfg.Section("").Key("include").Strings(",") {
+		pattern := c.expandEnv(include)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+
+		includePaths, err := configIncludePaths(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Config include %s: %s", pattern, err.Error())
+		}
+
+		for _, includePath := range includePaths {
+			for _, stackPath := range includeStack {
+				if stackPath == includePath {
+					return nil, fmt.Errorf("Circular config include of %s", includePath)
+				}
+			}
+
+			// Copy the stack so that sibling includes do not see each others paths
+			nextStack := append(append([]string{}, includeStack...), includePath)
+			includeSources, err := c.resolveIncludes(includePath, configFileFormat(includePath), filepath.Dir(includePath), nextStack)
+			if err != nil {
+				return nil, fmt.Errorf("Config include %s: %s", includePath, err.Error())
+			}
+
+			sources = append(sources, includeSources...)
+		}
+	}
+
+	return sources, nil
+}
+
+// configIncludePaths - The absolute paths of the files an include refers to. A pattern such as
+// conf.d/*.conf includes each matching file in name order, and matching nothing is not an error
+func configIncludePaths(pattern string) ([]string, error) {
+	if !strings.ContainsAny(pattern, "*?[") {
+		path, err := filepath.Abs(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return []string{path}, nil
+	}
+
+	// Glob returns the matches sorted by name
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, match := range matches {
+		if info, err := os.Stat(match); err != nil || info.IsDir() {
+			continue
+		}
+		path, err := filepath.Abs(match)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
+
+// configFileFormat - The format of a config file from its extension, "yaml", "toml" or "ini"
+func configFileFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+
+	return "ini"
+}
+
 func confKeyAsString(key *ini.Key, def string) string {
 	val := def
 
@@ -0,0 +1,319 @@
+package webircgateway
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// configSectionKeys - The options each config section accepts, used to find unknown options when
+// checking the config. Sections listing names, such as [transports], accept any key and are nil.
+// Numbered sections such as [server.1] are listed by their prefix, "server."
+var configSectionKeys = map[string][]string{
+	"DEFAULT": {
+		"include", "logLevel", "log_format", "log_stdout", "identd", "identd_addr", "identd_port",
+		"identd_ipv4", "identd_ipv6", "shutdown_timeout", "shutdown_message", "control_socket",
+		"gateway_name", "secret", "send_quit_on_client_close", "quit_on_close_reason",
+		"quit_on_abnormal_close", "relay_registration_errors", "webirc_tls_info", "write_timeout",
+		"config_refresh",
+	},
+	"verify": {
+		"recaptcha_secret", "recaptcha_key", "required", "recaptcha_url", "provider", "handshake",
+		"secret_key", "site_key", "verify_url",
+	},
+	"verify.exempt":   nil,
+	"dns":             {"nameservers", "timeout", "search", "ndots"},
+	"dnsbl":           {"action", "timeout", "cache_ttl", "negative_cache_ttl", "cache_size"},
+	"dnsbl.servers":   nil,
+	"ip_access":       {"file", "default"},
+	"ip_access.allow": nil,
+	"ip_access.deny":  nil,
+	"geoip": {
+		"database", "asn_database", "webirc_tags", "allow_countries", "deny_countries", "allow_asns",
+		"deny_asns",
+	},
+	"rejection_log": {"path", "max_size", "max_files"},
+	"auth_token":    {"enabled", "secret", "query_param", "bind_ip", "max_ttl"},
+	"proxy_headers": {"header", "hops"},
+	"tor":           {"socks"},
+	"sasl": {
+		"enabled", "source", "account", "password", "account_header", "password_header", "timeout",
+		"retries", "on_failure",
+	},
+	"bnc": {
+		"enabled", "identity_claim", "timeout", "buffer", "buffer_max_age", "away_message",
+		"quit_message",
+	},
+	"quic":        {"alpn", "allow_0rtt"},
+	"compression": {"enabled", "level"},
+	"websocket":   {"subprotocols", "binary", "batch_size", "batch_interval"},
+	"reputation": {
+		"url", "authorization", "headers", "timeout", "reject_score", "cache_ttl", "fail_open",
+	},
+	"readiness": {"interval", "rise", "fall"},
+	"limits": {
+		"max_clients", "max_memory", "retry_after", "connect_rate", "connect_burst",
+		"connect_ipv6_prefix", "flood_rate", "flood_burst", "flood_action", "flood_max_excess",
+		"kiwiirc_max_channels", "max_clients_per_ip", "max_clients_ipv6_prefix", "max_line_length",
+	},
+	"limits.ip_exempt":  nil,
+	"upstream_affinity": {"key", "claim", "token_param", "ttl"},
+	"gateway":           {"enabled", "timeout", "throttle"},
+	"gateway.webirc":    nil,
+	"gateway.whitelist": nil,
+	"clients": {
+		"username", "realname", "hostname", "on_kill", "on_forced_nick", "forced_disconnect_message",
+		"idle_disconnect", "idle_ping_timeout",
+	},
+	"fileserving": {"enabled", "webroot"},
+	"ctcp":        {"answer", "version", "rate_limit"},
+	"log_file":    {"path", "max_size", "max_age", "max_files"},
+	"syslog":      {"enabled", "network", "address", "facility", "tag"},
+	"admin":       {"token"},
+	"auth_jwt":    {"enabled", "secret", "public_key", "jwks_url", "audience", "issuer", "query_param"},
+	"auth_oidc": {
+		"enabled", "issuer", "client_id", "client_secret", "redirect_url", "scopes", "session_ttl",
+	},
+	"auth_ldap": {
+		"enabled", "url", "start_tls", "tls_verify", "ca_file", "bind_dn", "search_base", "search_filter",
+		"search_bind_dn", "search_bind_password", "attributes", "pool_size", "timeout",
+	},
+	"tracing":     {"enabled", "endpoint", "service_name", "sample_rate"},
+	"letsencrypt": {"max_certs", "max_idle_days"},
+	"not_found":   {"page", "redirect"},
+	"server.": {
+		"bind", "bind_mode", "port", "tls", "cert", "key", "letsencrypt_cache", "proxy_protocol",
+		"proxy_protocol_trusted", "client_certs",
+		"max_clients", "probe", "probe_timeout", "reuse_port", "listeners", "ping_interval",
+		"pong_timeout", "idle_timeout",
+	},
+	"proxy": {"bind", "port"},
+	"upstream.": {
+		"hostname", "port", "tls", "timeout", "dial_timeout", "tls_timeout", "registration_timeout",
+		"throttle", "webirc", "serverpassword", "gateway_name", "network_common_address", "readiness",
+		"username", "realname", "retries", "fallback", "preconnect_pool", "preconnect_max_idle",
+		"cap_allow", "cap_deny", "cap_force", "isupport_set", "isupport_remove", "weight", "public",
+		"display_name", "description", "autojoin", "origins", "proxy_protocol", "webirc_fallback",
+		"client_cert", "client_key", "tls_verify", "tls_ca_file", "tls_pin", "tls_server_name",
+		"socks5", "socks5_username", "socks5_password", "failover_hosts", "failover_attempts",
+		"balance", "host_weight", "eject_after", "eject_time", "reconnect_attempts", "reconnect_delay",
+		"reconnect_max_delay",
+	},
+	"engines":               nil,
+	"transports":            nil,
+	"transformers.upstream": nil,
+	"transformers.client":   nil,
+	"plugins":               nil,
+	"allowed_origins":       nil,
+	"debug_capture":         {"sample_rate", "file", "max_size", "max_files", "filter_ips", "filter_nick"},
+	"reverse_proxies":       nil,
+}
+
+var configNumberedSection = regexp.MustCompile(`^(server|upstream)\.[^.]+$`)
+
+// CheckConfig - Load the config file and check it for problems without starting anything,
+// returning a description of each. This includes the warnings logged while loading it, such as
+// invalid CIDR ranges
+func (s *Gateway) CheckConfig() []string {
+	s.checkingConfig = true
+	s.configProblems = []string{}
+	defer func() {
+		s.checkingConfig = false
+		s.configProblems = nil
+	}()
+
+	if err := s.Config.Load(); err != nil {
+		return []string{err.Error()}
+	}
+
+	s.checkConfigKeys()
+	s.checkConfigServers()
+	s.checkConfigTransports()
+
+	if len(s.Config.upstreams()) == 0 && !s.Config.Gateway {
+		s.configProblem("No [upstream.*] sections are configured and [gateway] is not enabled, clients have nowhere to connect")
+	}
+
+	for _, plugin := range s.Config.Plugins {
+		if _, err := os.Stat(s.Config.ResolvePath(plugin)); err != nil {
+			s.configProblem("Plugin %s: %s", plugin, err.Error())
+		}
+	}
+
+	// Some warnings, eg. unset environment variables, are found by both loading and checking keys
+	problems := []string{}
+	seen := map[string]bool{}
+	for _, problem := range s.configProblems {
+		if !seen[problem] {
+			problems = append(problems, problem)
+			seen[problem] = true
+		}
+	}
+
+	return problems
+}
+
+func (s *Gateway) configProblem(format string, args ...interface{}) {
+	s.configProblems = append(s.configProblems, fmt.Sprintf(format, args...))
+}
+
+// checkConfigKeys - Find sections and options that aren't used, eg. misspelt
+func (s *Gateway) checkConfigKeys() {
+	cfg, err := s.Config.loadIniFile()
+	if err != nil {
+		s.configProblem(err.Error())
+		return
+	}
+
+	for _, section := range cfg.Sections() {
+		name := section.Name()
+		lookup := name
+		if configNumberedSection.MatchString(name) {
+			lookup = name[:strings.Index(name, ".")+1]
+		}
+
+		known, exists := configSectionKeys[lookup]
+		if !exists {
+			s.configProblem("Unknown config section [%s]", name)
+			continue
+		}
+		if known == nil {
+			continue
+		}
+
+		for _, key := range section.KeyStrings() {
+			if !configKeyKnown(known, key) {
+				if name == "DEFAULT" {
+					s.configProblem("Unknown config option %s", key)
+				} else {
+					s.configProblem("Unknown config option %s in [%s]", key, name)
+				}
+			}
+		}
+	}
+}
+
+func configKeyKnown(known []string, key string) bool {
+	for _, k := range known {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkConfigServers - Check TLS certificates can be loaded and that servers don't listen on the
+// same address
+func (s *Gateway) checkConfigServers() {
+	if s.Function == "gateway" && len(s.Config.Servers) == 0 {
+		s.configProblem("No [server.*] sections are configured")
+	}
+
+	for i, conf := range s.Config.Servers {
+		name := serverDisplayName(conf)
+
+		if conf.TLS && conf.LetsEncryptCacheDir == "" {
+			if conf.CertFile == "" || conf.KeyFile == "" {
+				s.configProblem("Server %s: 'cert' and 'key' options must be set for TLS servers", name)
+			} else {
+				tlsCert := s.Config.ResolvePath(conf.CertFile)
+				tlsKey := s.Config.ResolvePath(conf.KeyFile)
+				if _, err := tls.LoadX509KeyPair(tlsCert, tlsKey); err != nil {
+					s.configProblem("Server %s: certificate error: %s", name, err.Error())
+				}
+			}
+		}
+
+		if conf.WebsocketPongTimeout > 0 && conf.WebsocketPingInterval <= 0 {
+			s.configProblem("Server %s: pong_timeout requires ping_interval to be set", name)
+		}
+
+		for _, other := range s.Config.Servers[:i] {
+			if serversConflict(conf, other) {
+				s.configProblem("Server %s listens on the same address as %s", name, serverDisplayName(other))
+			}
+		}
+	}
+}
+
+// serversConflict - If two servers would both bind the same address. Servers may share an address
+// when both have reuse_port set
+func serversConflict(a ConfigServer, b ConfigServer) bool {
+	isUnix := func(conf ConfigServer) bool {
+		return strings.HasPrefix(strings.ToLower(conf.LocalAddr), "unix:")
+	}
+	if isUnix(a) || isUnix(b) || isInheritedListener(a) || isInheritedListener(b) {
+		return strings.EqualFold(a.LocalAddr, b.LocalAddr)
+	}
+
+	if a.Port != b.Port || (a.ReusePort && b.ReusePort) {
+		return false
+	}
+
+	// Binding all addresses conflicts with binding any single address on the same port
+	host := func(conf ConfigServer) string {
+		h := conf.LocalAddr
+		if strings.HasPrefix(strings.ToLower(h), "tcp:") {
+			h = h[4:]
+		} else if strings.HasPrefix(strings.ToLower(h), "grpc:") {
+			h = h[5:]
+		}
+		h = strings.Trim(h, "[]")
+		if h == "0.0.0.0" || h == "::" {
+			h = ""
+		}
+		return h
+	}
+
+	return host(a) == "" || host(b) == "" || host(a) == host(b)
+}
+
+func (s *Gateway) checkConfigTransports() {
+	if s.Function != "gateway" {
+		return
+	}
+
+	if len(s.Config.ServerTransports) == 0 {
+		s.configProblem("No [transports] are configured")
+	}
+	for _, transport := range s.Config.ServerTransports {
+		if !stringInSlice(transport, []string{"kiwiirc", "websocket", "sockjs", "sse", "polling", "socketio", "webtransport", "quic"}) {
+			s.configProblem("Invalid transport '%s', must be kiwiirc, websocket, sockjs, sse, polling, socketio, webtransport or quic", transport)
+		}
+	}
+
+	for _, transport := range []string{"webtransport", "quic"} {
+		if !stringInSlice(transport, s.Config.ServerTransports) {
+			continue
+		}
+		hasTLS := false
+		for _, server := range s.Config.Servers {
+			hasTLS = hasTLS || server.TLS
+		}
+		if !hasTLS {
+			s.configProblem("The %s transport is only served on TLS servers, none are configured", transport)
+		}
+	}
+
+	if s.Config.WebsocketCompression && (s.Config.WebsocketCompressionLevel < 1 || s.Config.WebsocketCompressionLevel > 9) {
+		s.configProblem("[compression] level must be from 1 to 9")
+	}
+
+	if s.Config.WebsocketBatchInterval > 0 && s.Config.WebsocketBatchSize <= 0 {
+		s.configProblem("[websocket] batch_interval requires batch_size to be set")
+	}
+
+	if stringInSlice("quic", s.Config.ServerTransports) {
+		if len(s.Config.QuicAlpn) == 0 {
+			s.configProblem("[quic] alpn must list at least one protocol")
+		}
+		for _, protocol := range s.Config.QuicAlpn {
+			if protocol == "h3" {
+				s.configProblem("[quic] alpn can't include h3, it is used by the webtransport transport")
+			}
+		}
+	}
+}
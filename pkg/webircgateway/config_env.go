@@ -0,0 +1,190 @@
+package webircgateway
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// Prefix of the environment variables that override config options
+const configEnvPrefix = "WEBIRCGATEWAY_"
+
+// configEnvRef - A ${NAME} reference to an environment variable within a config value
+var configEnvRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// configOverride - A config option that may be set from the environment or a command line flag.
+// Secrets may also be read from a file named by the NAME_FILE environment variable.
+type configOverride struct {
+	Name   string
+	Secret bool
+	Apply  func(c *Config, val string) error
+}
+
+var configOverrides = []configOverride{
+	{Name: "LOG_LEVEL", Apply: func(c *Config, val string) error {
+		level, err := strconv.Atoi(val)
+		if err != nil || level < 1 || level > 3 {
+			return errors.New("must be 1, 2 or 3")
+		}
+		c.LogLevel = level
+		return nil
+	}},
+	// host:port of the first [server.*] section
+	{Name: "BIND", Apply: func(c *Config, val string) error {
+		host, port, err := splitOverrideHostPort(val)
+		if err != nil {
+			return err
+		}
+		if len(c.Servers) == 0 {
+			c.Servers = append(c.Servers, ConfigServer{})
+		}
+		c.Servers[0].LocalAddr = host
+		c.Servers[0].Port = port
+		return nil
+	}},
+	// host:port of the first [upstream.*] section
+	{Name: "UPSTREAM", Apply: func(c *Config, val string) error {
+		host, port, err := splitOverrideHostPort(val)
+		if err != nil {
+			return err
+		}
+		if len(c.Upstreams) == 0 {
+			c.Upstreams = append(c.Upstreams, ConfigUpstream{Network: "tcp", Timeout: 10, Throttle: 2, Weight: 1})
+		}
+		c.Upstreams[0].Hostname = host
+		c.Upstreams[0].Port = port
+		return nil
+	}},
+	{Name: "UPSTREAM_TLS", Apply: func(c *Config, val string) error {
+		tls, err := strconv.ParseBool(val)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		for i := range c.Upstreams {
+			c.Upstreams[i].TLS = tls
+		}
+		return nil
+	}},
+	// Applies to all upstreams
+	{Name: "WEBIRC_PASSWORD", Secret: true, Apply: func(c *Config, val string) error {
+		for i := range c.Upstreams {
+			c.Upstreams[i].WebircPassword = val
+		}
+		return nil
+	}},
+	{Name: "SERVER_PASSWORD", Secret: true, Apply: func(c *Config, val string) error {
+		for i := range c.Upstreams {
+			c.Upstreams[i].ServerPassword = val
+		}
+		return nil
+	}},
+	{Name: "SECRET", Secret: true, Apply: func(c *Config, val string) error {
+		c.Secret = val
+		return nil
+	}},
+	{Name: "RECAPTCHA_SECRET", Secret: true, Apply: func(c *Config, val string) error {
+		c.ReCaptchaSecret = val
+		return nil
+	}},
+}
+
+func splitOverrideHostPort(val string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(val)
+	if err != nil {
+		return "", 0, errors.New("must be in the form host:port")
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, errors.New("invalid port")
+	}
+	return host, port, nil
+}
+
+// applyOverrides - Overlay options set by command line flags or environment variables onto the
+// loaded config file. Flags take priority over the environment.
+func (c *Config) applyOverrides() {
+	for _, override := range configOverrides {
+		val, source, found := c.lookupOverride(override)
+		if !found {
+			continue
+		}
+
+		err := override.Apply(c, val)
+		if err != nil {
+			c.gateway.Log(3, "Config override %s ignored: %s", source, err.Error())
+			continue
+		}
+
+		c.gateway.Log(2, "Config option %s overridden by %s", override.Name, source)
+	}
+}
+
+func (c *Config) lookupOverride(override configOverride) (val string, source string, found bool) {
+	if val, found = c.Overrides[override.Name]; found {
+		return val, "command line flag", true
+	}
+
+	envName := configEnvPrefix + override.Name
+	if val, found = os.LookupEnv(envName); found {
+		return val, envName, true
+	}
+
+	// Secrets may be read from a file so that they stay out of the environment, eg. docker secrets
+	if override.Secret {
+		if path, exists := os.LookupEnv(envName + "_FILE"); exists {
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				c.gateway.Log(3, "Config override %s_FILE could not be read: %s", envName, err.Error())
+				return "", "", false
+			}
+			return strings.TrimRight(string(contents), "\r\n"), envName + "_FILE", true
+		}
+	}
+
+	return "", "", false
+}
+
+// expandEnvRefs - Replace ${NAME} references in the config values with the environment variable
+// NAME. Keys listed in sections such as [allowed_origins] or [gateway.webirc] are expanded too
+func (c *Config) expandEnvRefs(cfg *ini.File) {
+	for _, section := range cfg.Sections() {
+		keys := section.Keys()
+		renamed := false
+		for _, key := range keys {
+			key.SetValue(c.expandEnv(key.Value()))
+			if configEnvRef.MatchString(key.Name()) {
+				renamed = true
+			}
+		}
+
+		if !renamed {
+			continue
+		}
+
+		// Keys can't be renamed so add them all again to keep their order
+		for _, key := range keys {
+			section.DeleteKey(key.Name())
+		}
+		for _, key := range keys {
+			section.NewKey(c.expandEnv(key.Name()), key.Value())
+		}
+	}
+}
+
+// expandEnv - Replace ${NAME} references in a string. Unset variables are replaced with nothing
+func (c *Config) expandEnv(val string) string {
+	return configEnvRef.ReplaceAllStringFunc(val, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		envVal, exists := os.LookupEnv(name)
+		if !exists {
+			c.gateway.Log(3, "Config references the environment variable %s which is not set", name)
+		}
+		return envVal
+	})
+}
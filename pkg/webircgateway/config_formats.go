@@ -0,0 +1,126 @@
+package webircgateway
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// configItem - A named value read from a YAML or TOML config, kept in the order it was given. The
+// value is a scalar, a []configItem for a map, or a []interface{} for a list
+type configItem struct {
+	Key   string
+	Value interface{}
+}
+
+// configItemsToIni - Convert a YAML or TOML config to the ini format so that it is loaded with the
+// same options and defaults. Sections map to the ini format as follows, shown as YAML:
+//
+//	logLevel: 3                  top level values are set in the default section
+//	gateway: {enabled: true}     [gateway]
+//	server: [{port: 80}, ...]    [server.1], [server.2], ..
+//	transports: [websocket]      [transports] listing each value as a key
+//	gateway.webirc: {...}        [gateway.webirc], as is a map nested in another section
+func configItemsToIni(items []configItem) ([]byte, error) {
+	cfg := ini.Empty()
+	for _, item := range items {
+		// A list of files in the ini format is given comma separated
+		if item.Key == "include" {
+			if list, isList := item.Value.([]interface{}); isList {
+				cfg.Section("").NewKey(item.Key, configJoinList(list))
+				continue
+			}
+		}
+
+		if err := addIniValue(cfg, "", item.Key, item.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := cfg.WriteTo(buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// addIniValue - Add a value to the ini section named sectionName, or as a section of its own if it
+// is a map or list
+func addIniValue(cfg *ini.File, sectionName string, name string, value interface{}) error {
+	// Sections nested in sections, eg. gateway.webirc
+	childName := name
+	if sectionName != "" {
+		childName = sectionName + "." + name
+	}
+
+	switch v := value.(type) {
+	case []configItem:
+		section, err := cfg.NewSection(childName)
+		if err != nil {
+			return err
+		}
+		for _, item := range v {
+			if err := addIniValue(cfg, section.Name(), item.Key, item.Value); err != nil {
+				return err
+			}
+		}
+
+	case []interface{}:
+		if configListOfMaps(v) {
+			for i, item := range v {
+				if err := addIniValue(cfg, "", fmt.Sprintf("%s.%d", childName, i+1), item); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		section, err := cfg.NewSection(childName)
+		if err != nil {
+			return err
+		}
+		for _, item := range v {
+			if _, err := section.NewBooleanKey(configScalar(item)); err != nil {
+				return fmt.Errorf("Config section %s: %s", childName, err.Error())
+			}
+		}
+
+	default:
+		if _, err := cfg.Section(sectionName).NewKey(name, configScalar(v)); err != nil {
+			return fmt.Errorf("Config option %s: %s", name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// configListOfMaps - If every item in a non-empty list is a map
+func configListOfMaps(list []interface{}) bool {
+	for _, item := range list {
+		if _, isMap := item.([]configItem); !isMap {
+			return false
+		}
+	}
+
+	return len(list) > 0
+}
+
+func configJoinList(list []interface{}) string {
+	values := []string{}
+	for _, item := range list {
+		values = append(values, configScalar(item))
+	}
+
+	return strings.Join(values, ",")
+}
+
+func configScalar(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,147 @@
+package webircgateway
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long fetching a remote config may take
+const remoteConfigTimeout = time.Second * 30
+
+// isRemoteConfig - If the config file is a http(s) URL
+func isRemoteConfig(configFile string) bool {
+	lower := strings.ToLower(configFile)
+	return strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "http://")
+}
+
+// remoteConfigPath - The path of a remote config URL, used to detect its format
+func remoteConfigPath(configFile string) string {
+	u, err := url.Parse(configFile)
+	if err != nil {
+		return configFile
+	}
+
+	return u.Path
+}
+
+// RemoteConfig - A config file fetched from a http(s) URL. Its ETag and Last-Modified headers are
+// kept so that it is only downloaded again once it has changed
+type RemoteConfig struct {
+	mu           sync.Mutex
+	client       *http.Client
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+func NewRemoteConfig() *RemoteConfig {
+	return &RemoteConfig{client: &http.Client{Timeout: remoteConfigTimeout}}
+}
+
+// Fetch - Get the config from configURL, sending auth as the Authorization header if set. changed
+// is false if the config is the same as when last fetched
+func (r *RemoteConfig) Fetch(configURL string, auth string) (body []byte, changed bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	req, err := http.NewRequest("GET", configURL, nil)
+	if err != nil {
+		return nil, false, redactURLError(err)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	if r.body != nil {
+		if r.etag != "" {
+			req.Header.Set("If-None-Match", r.etag)
+		}
+		if r.lastModified != "" {
+			req.Header.Set("If-Modified-Since", r.lastModified)
+		}
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, false, redactURLError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && r.body != nil {
+		return r.body, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("Fetching config %s: %s", redactURL(configURL), resp.Status)
+	}
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Servers that don't support conditional requests send the config every time
+	changed = r.body == nil || !bytes.Equal(body, r.body)
+	r.body = body
+	r.etag = resp.Header.Get("ETag")
+	r.lastModified = resp.Header.Get("Last-Modified")
+
+	return body, changed, nil
+}
+
+// redactURL - A URL without any password or query string, which may hold a token
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.User = nil
+	u.RawQuery = ""
+
+	return u.String()
+}
+
+// redactURLError - err with the URL it includes redacted, as the http client's errors include the
+// URL requested
+func redactURLError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return &url.Error{Op: urlErr.Op, URL: redactURL(urlErr.URL), Err: urlErr.Err}
+	}
+
+	return err
+}
+
+// watchRemoteConfig - Fetch a remote config every config_refresh seconds, reloading when it changes
+func (s *Gateway) watchRemoteConfig() {
+	if !isRemoteConfig(s.Config.ConfigFile) {
+		return
+	}
+
+	for !s.IsClosing() {
+		interval := s.Config.configRefresh()
+		if interval <= 0 {
+			// Check again later in case a reload enables it
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(time.Second * time.Duration(interval))
+
+		_, changed, err := s.Config.remote.Fetch(s.Config.ConfigFile, s.Config.ConfigAuth)
+		if err != nil {
+			s.Log(3, "Error checking the remote config for changes: %s", err.Error())
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		s.Log(2, "Remote config has changed, reloading")
+		if err := s.Reload(); err != nil {
+			s.Log(3, "Config file error: %s", err.Error())
+		}
+	}
+}
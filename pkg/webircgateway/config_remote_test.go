@@ -0,0 +1,28 @@
+package webircgateway
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRemoteConfigErrorRedacted(t *testing.T) {
+	// Nothing listening, so the request fails with the URL in the error
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	_, _, err = NewRemoteConfig().Fetch("http://user:hunter2@"+addr+"/config.conf?token=hunter2", "")
+	if err == nil {
+		t.Fatal("the fetch did not fail")
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("the error includes the token: %s", err.Error())
+	}
+	if !strings.Contains(err.Error(), addr+"/config.conf") {
+		t.Errorf("the error doesn't say which URL failed: %s", err.Error())
+	}
+}
@@ -0,0 +1,48 @@
+package webircgateway
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigEnvWithinValue(t *testing.T) {
+	t.Setenv("WEBIRCGATEWAY_TEST_TOKEN", "abc123")
+
+	gateway := newTestGateway(t, "[reputation]\nurl = \"https://abuse.example.com/check\"\nauthorization = \"Bearer ${WEBIRCGATEWAY_TEST_TOKEN}\"\n")
+	if got := gateway.Config.ReputationAuth; got != "Bearer abc123" {
+		t.Errorf("authorization = %q, want %q", got, "Bearer abc123")
+	}
+}
+
+func TestConfigSelfIncludeRelative(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.conf"), []byte("include = main.conf\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	gateway := NewGateway("gateway")
+	go func() {
+		for range gateway.LogOutput {
+		}
+	}()
+	// Set directly rather than with SetConfigFile, which would make it absolute
+	gateway.Config.ConfigFile = "main.conf"
+
+	// Caught before main.conf is loaded a second time
+	err = gateway.Config.Load()
+	if err == nil || !strings.HasPrefix(err.Error(), "Circular config include") {
+		t.Errorf("Load() = %v, want a circular include error", err)
+	}
+}
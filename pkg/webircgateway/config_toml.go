@@ -0,0 +1,80 @@
+package webircgateway
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// tomlToIni - Convert a TOML config to the ini format. Tables map to sections the same way as maps
+// in a YAML config, eg. [[server]] tables become [server.1], [server.2], ..
+func tomlToIni(data []byte) ([]byte, error) {
+	doc := map[string]interface{}{}
+	md, err := toml.Decode(string(data), &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return configItemsToIni(tomlValue(doc, nil, md.Keys()).([]configItem))
+}
+
+// tomlValue - Convert the tables in a TOML value to configItems. Decoding to a map loses the order
+// of the keys so it is taken from the keys listed in the metadata, in the order they were given
+func tomlValue(value interface{}, path []string, keys []toml.Key) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		items := []configItem{}
+		for _, name := range tomlOrderedKeys(v, path, keys) {
+			childPath := append(append([]string{}, path...), name)
+			items = append(items, configItem{Key: name, Value: tomlValue(v[name], childPath, keys)})
+		}
+		return items
+
+	case []map[string]interface{}:
+		list := []interface{}{}
+		for _, table := range v {
+			list = append(list, tomlValue(table, path, keys))
+		}
+		return list
+
+	case []interface{}:
+		list := []interface{}{}
+		for _, item := range v {
+			list = append(list, tomlValue(item, path, keys))
+		}
+		return list
+	}
+
+	return value
+}
+
+// tomlOrderedKeys - The keys of the table at path in the order they were given. Tables in an array
+// share the same path so their keys are ordered by the first table using each key
+func tomlOrderedKeys(table map[string]interface{}, path []string, keys []toml.Key) []string {
+	ordered := []string{}
+	seen := map[string]bool{}
+	prefix := strings.Join(path, "\x00")
+
+	for _, key := range keys {
+		if len(key) != len(path)+1 || strings.Join(key[:len(path)], "\x00") != prefix {
+			continue
+		}
+		name := key[len(path)]
+		if _, exists := table[name]; exists && !seen[name] {
+			ordered = append(ordered, name)
+			seen[name] = true
+		}
+	}
+
+	// Shouldn't happen, but keep any keys missing from the metadata
+	missing := []string{}
+	for name := range table {
+		if !seen[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+
+	return append(ordered, missing...)
+}
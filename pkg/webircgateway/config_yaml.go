@@ -0,0 +1,38 @@
+package webircgateway
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// yamlToIni - Convert a YAML config to the ini format
+func yamlToIni(data []byte) ([]byte, error) {
+	doc := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	return configItemsToIni(yamlValue(doc).([]configItem))
+}
+
+// yamlValue - Convert the maps in a YAML value to configItems, keeping their order
+func yamlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		items := []configItem{}
+		for _, item := range v {
+			items = append(items, configItem{Key: fmt.Sprint(item.Key), Value: yamlValue(item.Value)})
+		}
+		return items
+
+	case []interface{}:
+		list := []interface{}{}
+		for _, item := range v {
+			list = append(list, yamlValue(item))
+		}
+		return list
+	}
+
+	return value
+}
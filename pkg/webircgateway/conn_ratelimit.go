@@ -0,0 +1,121 @@
+package webircgateway
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ConnRateLimiter - Limits how quickly new connections are accepted from each IP address with a
+// token bucket per address. IPv6 addresses are grouped by their prefix since a single host is
+// usually given a whole /64
+type ConnRateLimiter struct {
+	gateway *Gateway
+	mu      sync.Mutex
+	buckets map[string]*connBucket
+	// settings - The rate and burst the buckets were created with, so that a reload changing them
+	// starts afresh
+	settings  string
+	lastPrune time.Time
+}
+
+type connBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func NewConnRateLimiter(gateway *Gateway) *ConnRateLimiter {
+	return &ConnRateLimiter{
+		gateway: gateway,
+		buckets: make(map[string]*connBucket),
+	}
+}
+
+// Allow - If a new connection from ip may be accepted. Always true when connect_rate is not set
+func (l *ConnRateLimiter) Allow(ip net.IP) bool {
+	cfg := l.gateway.Config
+	if cfg.ConnectRate <= 0 || ip == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	settings := strconv.Itoa(cfg.ConnectRate) + "/" + strconv.Itoa(cfg.ConnectBurst) + "/" + strconv.Itoa(cfg.ConnectIPv6Prefix)
+	if settings != l.settings {
+		l.buckets = make(map[string]*connBucket)
+		l.settings = settings
+	}
+	l.pruneLocked()
+
+	key := connRateKey(ip, cfg.ConnectIPv6Prefix)
+	bucket, exists := l.buckets[key]
+	if !exists {
+		perSecond := rate.Limit(float64(cfg.ConnectRate) / 60)
+		bucket = &connBucket{limiter: rate.NewLimiter(perSecond, cfg.ConnectBurst)}
+		l.buckets[key] = bucket
+	}
+	bucket.lastSeen = time.Now()
+
+	if !bucket.limiter.Allow() {
+		l.gateway.LogEvent(2, "client.rate_limited", "Connection from %s refused, connecting too quickly", ip.String())
+		l.gateway.logRejection(ip.String(), "rate_limited")
+		return false
+	}
+
+	return true
+}
+
+// pruneLocked - Forget addresses that haven't connected for long enough that their bucket would
+// be full again. l.mu must be held
+func (l *ConnRateLimiter) pruneLocked() {
+	if time.Since(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = time.Now()
+
+	cfg := l.gateway.Config
+	refill := time.Duration(math.Ceil(float64(cfg.ConnectBurst)*60/float64(cfg.ConnectRate))) * time.Second
+	for key, bucket := range l.buckets {
+		if time.Since(bucket.lastSeen) > refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RetryAfter - Seconds until another connection would be accepted from an address that has used
+// its burst
+func (l *ConnRateLimiter) RetryAfter() int {
+	cfg := l.gateway.Config
+	if cfg.ConnectRate <= 0 {
+		return 0
+	}
+
+	return int(math.Ceil(60 / float64(cfg.ConnectRate)))
+}
+
+// RejectHandshake - Respond with a 429 and Retry-After if the request's address is connecting too
+// quickly. Returns true if the request has been rejected
+func (l *ConnRateLimiter) RejectHandshake(w http.ResponseWriter, req *http.Request) bool {
+	if l.Allow(l.gateway.GetRemoteAddressFromRequest(req)) {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(l.RetryAfter()))
+	http.Error(w, "Too many connections, please try again later", http.StatusTooManyRequests)
+	return true
+}
+
+// connRateKey - The bucket an address belongs to. IPv4 addresses each have their own
+func connRateKey(ip net.IP, ipv6Prefix int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	return ip.Mask(net.CIDRMask(ipv6Prefix, 128)).String() + "/" + strconv.Itoa(ipv6Prefix)
+}
@@ -0,0 +1,239 @@
+package webircgateway
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ControlSocket - A unix socket that operators can send commands to, eg. with webircgatewayctl.
+// Each connection sends a single command line and is answered with "OK" or "ERR <reason>"
+// followed by any output, after which the connection is closed
+type ControlSocket struct {
+	gateway  *Gateway
+	mu       sync.Mutex
+	listener net.Listener
+	path     string
+}
+
+func NewControlSocket(gateway *Gateway) *ControlSocket {
+	return &ControlSocket{gateway: gateway}
+}
+
+// Run - Listen on the configured socket path, if any
+func (c *ControlSocket) Run() {
+	path := c.gateway.Config.ControlSocket
+	if path == "" {
+		return
+	}
+
+	// A socket left behind by a process that didn't exit cleanly would stop us listening
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		c.gateway.Log(3, "Control socket %s is in use by another process", path)
+		return
+	}
+	os.Remove(path)
+
+	l, err := listenPrivateUnix(path)
+	if err != nil {
+		c.gateway.Log(3, "Failed to listen on control socket %s: %s", path, err.Error())
+		return
+	}
+
+	c.mu.Lock()
+	c.listener = l
+	c.path = path
+	c.mu.Unlock()
+
+	c.gateway.Log(2, "Control socket listening on %s", path)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			c.mu.Lock()
+			closed := c.listener == nil
+			c.mu.Unlock()
+			if !closed {
+				c.gateway.Log(3, "Control socket error accepting: %s", err.Error())
+			}
+			return
+		}
+
+		go c.handleConn(conn)
+	}
+}
+
+// Close - Stop listening and remove the socket file
+func (c *ControlSocket) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.listener != nil {
+		c.listener.Close()
+		c.listener = nil
+		os.Remove(c.path)
+	}
+}
+
+// listenPrivateUnix - Listen on a unix socket that only our user may connect to. The socket gives
+// full control over the gateway, so it is created in a directory only we can enter and made
+// private before being moved to path
+func listenPrivateUnix(path string) (*net.UnixListener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".ctl")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// Closing the listener would only remove tmpPath
+	l.SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmpPath, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (c *ControlSocket) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+
+	out, err := c.runCommand(strings.Fields(line))
+	if err != nil {
+		fmt.Fprintf(conn, "ERR %s\n", err.Error())
+		return
+	}
+
+	conn.Write([]byte("OK\n" + out))
+}
+
+func (c *ControlSocket) runCommand(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("No command given")
+	}
+
+	gateway := c.gateway
+	switch strings.ToLower(args[0]) {
+	case "reload":
+		gateway.Log(2, "Reloading config file from the control socket")
+		if err := gateway.Reload(); err != nil {
+			return "", err
+		}
+		return "", nil
+
+	case "status":
+		return c.status(), nil
+
+	case "kick":
+		if len(args) < 2 {
+			return "", errors.New("Usage: kick <client id|nick!user@host> [reason]")
+		}
+
+		reason := strings.Join(args[2:], " ")
+		if reason == "" {
+			reason = "Disconnected by the gateway administrator"
+		}
+
+		clients := []*Client{}
+		if id, err := strconv.ParseUint(args[1], 10, 64); err == nil {
+			if client, ok := gateway.Clients.Get(id); ok {
+				clients = append(clients, client)
+			}
+		} else {
+			matched, err := gateway.clientsMatchingMask(args[1])
+			if err != nil {
+				return "", fmt.Errorf("Invalid mask: %s", err.Error())
+			}
+			for _, info := range matched {
+				clients = append(clients, info.client)
+			}
+		}
+
+		for _, client := range clients {
+			client.Disconnect(reason)
+		}
+		return fmt.Sprintf("Kicked %d clients\n", len(clients)), nil
+
+	case "loglevel":
+		if len(args) < 2 {
+			return fmt.Sprintf("%d\n", gateway.Config.LogLevel), nil
+		}
+
+		level, err := strconv.Atoi(args[1])
+		if err != nil || level < 1 || level > 3 {
+			return "", errors.New("Log level must be between 1-3")
+		}
+		// Until the config is next reloaded
+		gateway.Config.LogLevel = level
+		gateway.Log(2, "Log level set to %d from the control socket", level)
+		return "", nil
+	}
+
+	return "", fmt.Errorf("Unknown command %s. Commands: reload, status, kick, loglevel", args[0])
+}
+
+func (c *ControlSocket) status() string {
+	clients := c.gateway.SnapshotClients()
+
+	byState := map[string]int{}
+	byUpstream := map[string]int{}
+	byListener := map[string]int{}
+	for _, client := range clients {
+		byState[client.State]++
+		if client.client.UpstreamConfig.Hostname != "" {
+			byUpstream[client.Upstream]++
+		}
+		if client.client.Listener != "" {
+			byListener[client.client.Listener]++
+		}
+	}
+
+	out := fmt.Sprintf("version %s\n", Version)
+	out += fmt.Sprintf("clients %d\n", len(clients))
+	out += formatStatusCounts("state", byState)
+	out += formatStatusCounts("upstream", byUpstream)
+	out += formatStatusCounts("listener", byListener)
+
+	return out
+}
+
+// formatStatusCounts - "<prefix> <name> <count>" lines, sorted by name
+func formatStatusCounts(prefix string, counts map[string]int) string {
+	names := []string{}
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := ""
+	for _, name := range names {
+		out += fmt.Sprintf("%s %s %d\n", prefix, name, counts[name])
+	}
+
+	return out
+}
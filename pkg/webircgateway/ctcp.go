@@ -0,0 +1,71 @@
+package webircgateway
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+	"golang.org/x/time/rate"
+)
+
+// handleCtcpFromUpstream - Answer or rate limit CTCP queries sent to the client. Returns true if
+// the message has been dealt with and should not be passed on to the client
+func (c *Client) handleCtcpFromUpstream(message *irc.Message) bool {
+	if strings.ToUpper(message.Command) != "PRIVMSG" {
+		return false
+	}
+
+	ctcpType, params, isCtcp := parseCtcp(message)
+	if !isCtcp || ctcpType == "ACTION" {
+		return false
+	}
+
+	cfg := c.Gateway.Config
+
+	if cfg.CtcpRateLimit > 0 {
+		if c.ctcpLimiter == nil {
+			perSecond := rate.Limit(float64(cfg.CtcpRateLimit) / 60)
+			c.ctcpLimiter = rate.NewLimiter(perSecond, cfg.CtcpRateLimit)
+		}
+		if !c.ctcpLimiter.Allow() {
+			c.Log(1, "Dropping CTCP %s from %s, rate limit reached", ctcpType, message.Prefix.Nick)
+			return true
+		}
+	}
+
+	answered := false
+	for _, answerType := range cfg.CtcpAnswer {
+		if answerType == ctcpType {
+			answered = true
+			break
+		}
+	}
+	if !answered || message.Prefix.Nick == "" {
+		return false
+	}
+
+	reply := ""
+	switch ctcpType {
+	case "VERSION":
+		reply = cfg.CtcpVersionReply
+	case "PING":
+		reply = params
+	case "TIME":
+		reply = time.Now().Format(time.RFC1123)
+	case "CLIENTINFO":
+		reply = "ACTION " + strings.Join(cfg.CtcpAnswer, " ")
+	default:
+		// Nothing we know how to answer, let the client deal with it
+		return false
+	}
+
+	notice := irc.NewMessage()
+	notice.Command = "NOTICE"
+	notice.Params = []string{message.Prefix.Nick, "\x01" + strings.TrimSpace(ctcpType+" "+reply) + "\x01"}
+	line := notice.ToLine()
+
+	c.Log(1, "Answering CTCP %s from %s", ctcpType, message.Prefix.Nick)
+	c.TrafficLog(true, false, line)
+	c.SendUpstream(line)
+	return true
+}
@@ -0,0 +1,155 @@
+package webircgateway
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+const (
+	debugCaptureOff = iota
+	debugCaptureOn
+	// Waiting for the clients first NICK before deciding if it matches the nick filter
+	debugCapturePending
+)
+
+// Lines kept while waiting for a pending clients NICK
+const debugCapturePendingMax = 50
+
+// DebugCapture - Writes the full traffic of a sample of clients to a rotating file
+type DebugCapture struct {
+	gateway *Gateway
+	mu      sync.Mutex
+	file    rotatingFile
+	// Number of clients that passed the filters, used to pick one in every SampleRate
+	seen uint64
+}
+
+func NewDebugCapture(gateway *Gateway) *DebugCapture {
+	return &DebugCapture{gateway: gateway}
+}
+
+// Select - Decide if a newly accepted client should be captured. This is done once per client so
+// that a whole session is either captured or not.
+func (d *DebugCapture) Select(client *Client) {
+	cfg := d.gateway.Config
+	if cfg.DebugCaptureSampleRate < 1 {
+		return
+	}
+
+	if len(cfg.DebugCaptureFilterIPs) > 0 {
+		ip := net.ParseIP(client.RemoteAddr)
+		matched := false
+		for _, cidrRange := range cfg.DebugCaptureFilterIPs {
+			if ip != nil && cidrRange.Contains(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.seen++
+	if (d.seen-1)%uint64(cfg.DebugCaptureSampleRate) != 0 {
+		return
+	}
+
+	if cfg.DebugCaptureFilterNick != nil {
+		atomic.StoreInt32(&client.debugCapture, debugCapturePending)
+	} else {
+		atomic.StoreInt32(&client.debugCapture, debugCaptureOn)
+		client.Log(2, "Capturing traffic to %s", cfg.DebugCaptureFile)
+	}
+}
+
+// Record - Write a line of traffic if the client has been selected for capturing
+func (d *DebugCapture) Record(client *Client, label string, line string) {
+	// Most clients are never captured, so don't make all of them wait on the capture lock
+	if atomic.LoadInt32(&client.debugCapture) == debugCaptureOff {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if atomic.LoadInt32(&client.debugCapture) == debugCaptureOff {
+		return
+	}
+
+	entry := fmt.Sprintf("%s client:%d %s (%s) %s\n",
+		time.Now().Format(time.RFC3339Nano),
+		client.Id,
+		client.RemoteAddr,
+		label,
+		strings.TrimRight(line, "\r\n"),
+	)
+
+	if atomic.LoadInt32(&client.debugCapture) == debugCapturePending {
+		if !d.checkPendingNick(client, label, line) {
+			client.debugCapturePending = append(client.debugCapturePending, entry)
+			if len(client.debugCapturePending) > debugCapturePendingMax {
+				client.debugCapturePending = client.debugCapturePending[1:]
+			}
+			return
+		}
+
+		if atomic.LoadInt32(&client.debugCapture) == debugCaptureOff {
+			return
+		}
+
+		client.Log(2, "Capturing traffic to %s", d.gateway.Config.DebugCaptureFile)
+		for _, pendingEntry := range client.debugCapturePending {
+			d.write(pendingEntry)
+		}
+		client.debugCapturePending = nil
+	}
+
+	d.write(entry)
+}
+
+// checkPendingNick - Returns true once the client has sent its NICK, having switched the client
+// to being captured or not depending on the nick filter
+func (d *DebugCapture) checkPendingNick(client *Client, label string, line string) bool {
+	if label != "Client->" {
+		return false
+	}
+
+	message, err := irc.ParseLine(line)
+	if err != nil || strings.ToUpper(message.Command) != "NICK" {
+		return false
+	}
+
+	if d.gateway.Config.DebugCaptureFilterNick.Match(strings.ToLower(message.GetParam(0, ""))) {
+		atomic.StoreInt32(&client.debugCapture, debugCaptureOn)
+	} else {
+		atomic.StoreInt32(&client.debugCapture, debugCaptureOff)
+		client.debugCapturePending = nil
+	}
+
+	return true
+}
+
+func (d *DebugCapture) write(entry string) {
+	cfg := d.gateway.Config
+	err := d.file.Write(cfg.DebugCaptureFile, entry, cfg.DebugCaptureMaxSize*1024*1024, 0, cfg.DebugCaptureMaxFiles)
+	if err != nil {
+		d.gateway.Log(3, "Error writing debug capture file: %s", err.Error())
+	}
+}
+
+// Reopen - Close the capture file so that it is opened again on the next write
+func (d *DebugCapture) Reopen() {
+	d.mu.Lock()
+	d.file.Close()
+	d.mu.Unlock()
+}
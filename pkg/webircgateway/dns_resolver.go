@@ -0,0 +1,228 @@
+package webircgateway
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DNSResolver - Looks up upstream hostnames and client rDNS with the [dns] nameservers, timeout
+// and search domains so that the gateway doesn't depend on the systems resolver, which is often
+// broken or slow in containers. Uses the system resolver for anything not configured
+type DNSResolver struct {
+	gateway *Gateway
+	// custom - Sends every query to the [dns] nameservers in turn, so that a retry goes to the next
+	custom *net.Resolver
+	next   uint32
+	// hosts - Only answers from /etc/hosts, which absolute names aren't looked up in
+	hosts *net.Resolver
+
+	// mu - Guards the [dns] config copied in by Load(), so that lookups never see it half loaded
+	mu          sync.RWMutex
+	nameservers []string
+	timeout     int
+	search      []string
+	ndots       int
+}
+
+var errHostsOnly = errors.New("only looking in the hosts file")
+var errNoNameservers = errors.New("no [dns] nameservers are configured")
+
+func NewDNSResolver(gateway *Gateway) *DNSResolver {
+	r := &DNSResolver{gateway: gateway}
+	r.custom = &net.Resolver{
+		PreferGo: true,
+		Dial:     r.dialNameserver,
+	}
+	r.hosts = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return nil, errHostsOnly
+		},
+	}
+	return r
+}
+
+// Load - Copy the [dns] config, once it has been loaded
+func (r *DNSResolver) Load() {
+	cfg := r.gateway.Config
+	cfg.mu.RLock()
+	nameservers := append([]string{}, cfg.DnsNameservers...)
+	search := append([]string{}, cfg.DnsSearch...)
+	timeout, ndots := cfg.DnsTimeout, cfg.DnsNdots
+	cfg.mu.RUnlock()
+
+	r.mu.Lock()
+	r.nameservers = nameservers
+	r.timeout = timeout
+	r.search = search
+	r.ndots = ndots
+	r.mu.Unlock()
+}
+
+// parseNameserver - host:port of a nameserver given as an IP with an optional port
+func parseNameserver(entry string) (string, bool) {
+	entry = strings.TrimSpace(entry)
+	if ip := net.ParseIP(strings.Trim(entry, "[]")); ip != nil {
+		return net.JoinHostPort(ip.String(), "53"), true
+	}
+
+	host, port, err := net.SplitHostPort(entry)
+	if err != nil || net.ParseIP(host) == nil || port == "" {
+		return "", false
+	}
+	return net.JoinHostPort(host, port), true
+}
+
+func (r *DNSResolver) dialNameserver(ctx context.Context, network string, _ string) (net.Conn, error) {
+	r.mu.RLock()
+	nameservers := r.nameservers
+	r.mu.RUnlock()
+	if len(nameservers) == 0 {
+		return nil, errNoNameservers
+	}
+	n := atomic.AddUint32(&r.next, 1)
+
+	dialer := net.Dialer{}
+	return dialer.DialContext(ctx, network, nameservers[int(n%uint32(len(nameservers)))])
+}
+
+func (r *DNSResolver) resolver() *net.Resolver {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.nameservers) == 0 {
+		return net.DefaultResolver
+	}
+
+	return r.custom
+}
+
+// ownSearch - If names are searched in the [dns] search domains rather than the systems
+func (r *DNSResolver) ownSearch() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.nameservers) > 0 || len(r.search) > 0
+}
+
+func (r *DNSResolver) context() (context.Context, context.CancelFunc) {
+	timeout := r.lookupTimeout()
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+}
+
+func (r *DNSResolver) lookupTimeout() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.timeout
+}
+
+// searchNames - The names looked up in turn for host. Absolute names, ending in a . so that the
+// systems search domains aren't added to them too
+func (r *DNSResolver) searchNames(host string) []string {
+	if !r.ownSearch() || strings.HasSuffix(host, ".") {
+		return []string{host}
+	}
+
+	r.mu.RLock()
+	search, ndots := r.search, r.ndots
+	r.mu.RUnlock()
+
+	names := []string{}
+	enoughDots := strings.Count(host, ".") >= ndots
+	if enoughDots {
+		names = append(names, host+".")
+	}
+	for _, domain := range search {
+		names = append(names, host+"."+domain+".")
+	}
+	if !enoughDots {
+		names = append(names, host+".")
+	}
+
+	return names
+}
+
+// LookupIP - The addresses of host, from /etc/hosts or trying each search domain until one has any
+func (r *DNSResolver) LookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	ctx, cancel := r.context()
+	defer cancel()
+
+	if r.ownSearch() {
+		if addrs, err := r.hosts.LookupIPAddr(ctx, strings.TrimSuffix(host, ".")); err == nil {
+			return ipAddrsToIPs(addrs), nil
+		}
+	}
+
+	var err error
+	for _, name := range r.searchNames(host) {
+		var addrs []net.IPAddr
+		addrs, err = r.resolver().LookupIPAddr(ctx, name)
+		if err == nil {
+			return ipAddrsToIPs(addrs), nil
+		}
+	}
+
+	return nil, err
+}
+
+func ipAddrsToIPs(addrs []net.IPAddr) []net.IP {
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips
+}
+
+// LookupAddr - The rDNS hostnames of addr
+func (r *DNSResolver) LookupAddr(addr string) ([]string, error) {
+	ctx, cancel := r.context()
+	defer cancel()
+
+	return r.resolver().LookupAddr(ctx, addr)
+}
+
+// Dial - Connect to addr with dialer, looking up its host with LookupIP and trying each of its
+// addresses until one connects. The dialers timeout covers all of them
+func (r *DNSResolver) Dial(dialer *net.Dialer, network string, addr string) (net.Conn, error) {
+	// Left to the dialer when there is nothing to do differently
+	if !r.ownSearch() && r.lookupTimeout() <= 0 {
+		return dialer.Dial(network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialer.Dial(network, addr)
+	}
+
+	ips, err := r.LookupIP(host)
+	if err != nil {
+		// As net.Dialer would return it, so it is reported the same way
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	d := *dialer
+	if d.Timeout > 0 {
+		d.Deadline = time.Now().Add(d.Timeout)
+	}
+
+	var conn net.Conn
+	for _, ip := range ips {
+		conn, err = d.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
@@ -0,0 +1,53 @@
+package webircgateway
+
+import (
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/dnsbl"
+)
+
+// isDnsblAction - If action is something that can be done to a client listed on a DNSBL
+func isDnsblAction(action string) bool {
+	switch action {
+	case "deny", "verify", "tag", "log":
+		return true
+	}
+
+	return false
+}
+
+// dnsblServerAction - The action taken on clients listed on a DNSBL server, its own if it was
+// given one in [dnsbl.servers]
+func (c *Config) dnsblServerAction(server string) string {
+	if action, exists := c.DnsblServerActions[server]; exists {
+		return action
+	}
+
+	return c.DnsblAction
+}
+
+// usesDnsblVerify - If clients listed on any DNSBL are asked for a captcha
+func (c *Config) usesDnsblVerify() bool {
+	for _, server := range c.DnsblServers {
+		if c.dnsblServerAction(server) == "verify" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dnsblLookup - Query the DNSBL servers for an address, answering from the cache where possible
+func (s *Gateway) dnsblLookup(servers []string, addr string) dnsbl.ResultList {
+	cfg := s.Config
+	s.dnsblCache.SetOptions(
+		time.Duration(cfg.DnsblCacheTTL)*time.Second,
+		time.Duration(cfg.DnsblNegativeCacheTTL)*time.Second,
+		cfg.DnsblCacheSize,
+	)
+
+	return dnsbl.LookupWithOptions(servers, addr, dnsbl.Options{
+		Timeout: time.Duration(cfg.DnsblTimeout) * time.Second,
+		Cache:   s.dnsblCache,
+	})
+}
@@ -1,21 +1,24 @@
 package webircgateway
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"errors"
 
+	"github.com/kiwiirc/webircgateway/pkg/dnsbl"
 	"github.com/kiwiirc/webircgateway/pkg/identd"
 	"github.com/kiwiirc/webircgateway/pkg/proxy"
-	cmap "github.com/orcaman/concurrent-map"
+	"github.com/kiwiirc/webircgateway/pkg/proxyprotocol"
 )
 
 var (
@@ -25,15 +28,64 @@ var (
 type Gateway struct {
 	Config      *Config
 	HttpRouter  *http.ServeMux
-	LogOutput   chan string
+	LogOutput   chan LogEntry
 	messageTags *MessageTagManager
 	identdServ  identd.Server
-	Clients     cmap.ConcurrentMap
+	Clients     *ClientRegistry
 	Acme        *LEManager
 	Function    string
-	httpSrvs    []*http.Server
-	httpSrvsMu  sync.Mutex
-	closeWg     sync.WaitGroup
+	// upstreamProbe checks upstreams that the gateway requires before reporting as ready
+	upstreamProbe *UpstreamProbe
+	admission     *AdmissionControl
+	// upstreamAffinity remembers which upstream each client was last sent to
+	upstreamAffinity *UpstreamAffinity
+	debugCapture     *DebugCapture
+	upstreamPool     *UpstreamPool
+	listenerLimits   *ListenerLimits
+	ipLimits         *IPLimits
+	syslog           *SyslogSink
+	logFile          *LogFile
+	tracer           *Tracer
+	controlSocket    *ControlSocket
+	jwtAuth          *JwtAuth
+	oidcAuth         *OidcAuth
+	ldapAuth         *LdapAuth
+	tokenAuth        *TokenAuth
+	connRateLimit    *ConnRateLimiter
+	dnsblCache       *dnsbl.Cache
+	dnsResolver      *DNSResolver
+	ipAccess         *IPAccess
+	geoIP            *GeoIP
+	reputation       *Reputation
+	rejectionLog     *RejectionLog
+	webircPasswords  *WebircPasswords
+	upstreamCerts    *UpstreamCerts
+	upstreamHosts    *UpstreamHosts
+	bncSessions      *BncSessions
+	httpSrvs         []*http.Server
+	// quicSrvs - The QUIC servers on the UDP ports of the TLS servers. Guarded by httpSrvsMu
+	quicSrvs []*quicServer
+	// listeners - Listeners not served by one of httpSrvs, eg. TCP. Guarded by httpSrvsMu
+	listeners []net.Listener
+	// handoffListeners - Listeners that are passed to the new process when upgrading, keyed by
+	// address. upgradeListeners are those passed to this process, until taken by their server.
+	// Both are guarded by httpSrvsMu
+	handoffListeners map[string]net.Listener
+	upgradeListeners map[string]net.Listener
+	// certStores - The certificates of the TLS servers, read again on Reload(). Guarded by httpSrvsMu
+	certStores []*CertStore
+	// servers - The [server.*] blocks being listened on. Guarded by httpSrvsMu
+	servers    []*runningServer
+	httpSrvsMu sync.Mutex
+	closeWg    sync.WaitGroup
+	closeLock  sync.Mutex
+	closing    bool
+	// drainEnd - Closed to stop waiting for clients to disconnect while shutting down
+	drainEnd     chan struct{}
+	drainEndOnce sync.Once
+	// checkingConfig - Set by CheckConfig() to collect warnings in configProblems instead of logging
+	checkingConfig bool
+	configProblems []string
 }
 
 func NewGateway(function string) *Gateway {
@@ -41,40 +93,67 @@ func NewGateway(function string) *Gateway {
 	s.Function = function
 	s.Config = NewConfig(s)
 	s.HttpRouter = http.NewServeMux()
-	s.LogOutput = make(chan string, 5)
+	s.LogOutput = make(chan LogEntry, 5)
 	s.identdServ = identd.NewIdentdServer()
 	s.messageTags = NewMessageTagManager()
 	// Clients hold a map lookup for all the connected clients
-	s.Clients = cmap.New()
+	s.Clients = NewClientRegistry()
 	s.Acme = NewLetsEncryptManager(s)
+	s.upstreamProbe = NewUpstreamProbe(s)
+	s.admission = NewAdmissionControl(s)
+	s.upstreamAffinity = NewUpstreamAffinity()
+	s.debugCapture = NewDebugCapture(s)
+	s.upstreamPool = NewUpstreamPool(s)
+	s.listenerLimits = NewListenerLimits(s)
+	s.ipLimits = NewIPLimits(s)
+	s.syslog = NewSyslogSink()
+	s.logFile = NewLogFile()
+	s.tracer = NewTracer(s)
+	s.controlSocket = NewControlSocket(s)
+	s.jwtAuth = NewJwtAuth(s)
+	s.oidcAuth = NewOidcAuth(s)
+	s.ldapAuth = NewLdapAuth(s)
+	s.tokenAuth = NewTokenAuth(s)
+	s.connRateLimit = NewConnRateLimiter(s)
+	s.dnsblCache = dnsbl.NewCache()
+	s.dnsResolver = NewDNSResolver(s)
+	s.ipAccess = NewIPAccess(s)
+	s.geoIP = NewGeoIP(s)
+	s.reputation = NewReputation(s)
+	s.rejectionLog = NewRejectionLog()
+	s.webircPasswords = NewWebircPasswords()
+	s.upstreamCerts = NewUpstreamCerts(s)
+	s.upstreamHosts = NewUpstreamHosts(s)
+	s.bncSessions = NewBncSessions(s)
+	s.drainEnd = make(chan struct{})
+	s.handoffListeners = make(map[string]net.Listener)
+	s.upgradeListeners = make(map[string]net.Listener)
 
 	return s
 }
 
-func (s *Gateway) Log(level int, format string, args ...interface{}) {
-	if level < s.Config.LogLevel {
-		return
-	}
-
-	levels := [...]string{"L_DEBUG", "L_INFO", "L_WARN"}
-	line := fmt.Sprintf(levels[level-1]+" "+format, args...)
-
-	select {
-	case s.LogOutput <- line:
-	}
-}
-
 func (s *Gateway) Start() {
+	s.dnsResolver.Load()
 	s.closeWg.Add(1)
+	go s.watchRemoteConfig()
 
 	if s.Function == "gateway" {
-		s.maybeStartStaticFileServer()
+		s.initFallbackRoute()
 		s.initHttpRoutes()
 		s.maybeStartIdentd()
+		s.checkTransformers()
+		s.inheritUpgradeListeners()
+		s.checkInheritedListeners()
+		go s.upstreamProbe.Run()
+		go s.upstreamPool.Run()
+		go s.tracer.Run()
+		go s.controlSocket.Run()
 
 		for _, serverConfig := range s.Config.Servers {
-			go s.startServer(serverConfig)
+			go s.startServer(s.addServer(serverConfig))
 		}
+
+		s.notifyUpgradeReady()
 	}
 
 	if s.Function == "proxy" {
@@ -82,30 +161,61 @@ func (s *Gateway) Start() {
 	}
 }
 
+// Close - Stop accepting new connections and drain the connected clients before closing. Calling
+// Close again while clients are being drained disconnects them straight away
 func (s *Gateway) Close() {
+	s.closeLock.Lock()
+	if s.closing {
+		s.closeLock.Unlock()
+		s.drainEndOnce.Do(func() { close(s.drainEnd) })
+		return
+	}
+	s.closing = true
+	s.closeLock.Unlock()
+
 	hook := HookGatewayClosing{}
 	hook.Dispatch("gateway.closing")
 
 	defer s.closeWg.Done()
 
+	shutdownCtx, cancelShutdown := context.WithCancel(context.Background())
+	s.stopListening(shutdownCtx)
+	s.drainClients()
+	cancelShutdown()
+
+	// Spans of clients closed so far would otherwise be lost
+	s.tracer.Flush()
+	s.controlSocket.Close()
+
 	s.httpSrvsMu.Lock()
 	defer s.httpSrvsMu.Unlock()
 
 	for _, httpSrv := range s.httpSrvs {
 		httpSrv.Close()
 	}
+	for _, quicSrv := range s.quicSrvs {
+		quicSrv.Close()
+	}
 }
 
-func (s *Gateway) WaitClose() {
-	s.closeWg.Wait()
+// Reload - Load the config file again, reopen the log files and read the TLS certificates again.
+// Servers added to or removed from the config are started or stopped
+func (s *Gateway) Reload() error {
+	err := s.Config.Load()
+	s.dnsResolver.Load()
+	s.ReopenLogFiles()
+	s.ReloadCertificates()
+	s.ipAccess.Load()
+	s.geoIP.Load()
+	// A config that failed to load may be missing servers that should keep running
+	if err == nil {
+		s.reloadServers()
+	}
+	return err
 }
 
-func (s *Gateway) maybeStartStaticFileServer() {
-	if s.Config.Webroot != "" {
-		webroot := s.Config.ResolvePath(s.Config.Webroot)
-		s.Log(2, "Serving files from %s", webroot)
-		s.HttpRouter.Handle("/", http.FileServer(http.Dir(webroot)))
-	}
+func (s *Gateway) WaitClose() {
+	s.closeWg.Wait()
 }
 
 func (s *Gateway) initHttpRoutes() error {
@@ -125,6 +235,25 @@ func (s *Gateway) initHttpRoutes() error {
 			t := &TransportSockjs{}
 			t.Init(s)
 			engineConfigured = true
+		case "webtransport":
+			t := &TransportWebtransport{}
+			t.Init(s)
+			engineConfigured = true
+		case "sse":
+			t := &TransportSse{}
+			t.Init(s)
+			engineConfigured = true
+		case "polling":
+			t := &TransportPolling{}
+			t.Init(s)
+			engineConfigured = true
+		case "socketio":
+			t := &TransportSocketio{}
+			t.Init(s)
+			engineConfigured = true
+		case "quic":
+			// Served by the QUIC servers of the TLS servers
+			engineConfigured = true
 		default:
 			s.Log(3, "Invalid server engine: '%s'", transport)
 		}
@@ -137,37 +266,105 @@ func (s *Gateway) initHttpRoutes() error {
 
 	// Add some general server info about this webircgateway instance
 	s.HttpRouter.HandleFunc("/webirc/info", func(w http.ResponseWriter, r *http.Request) {
-		out, _ := json.Marshal(map[string]interface{}{
+		info := map[string]interface{}{
 			"name":    "webircgateway",
 			"version": Version,
-		})
+		}
+		// Clients need the site key to show the captcha widget
+		if s.Config.RequiresVerification || s.Config.usesDnsblVerify() {
+			info["captcha"] = map[string]interface{}{
+				"provider": s.Config.CaptchaProvider,
+				"site_key": s.Config.ReCaptchaKey,
+			}
+		}
+		out, _ := json.Marshal(info)
 
 		w.Write(out)
 	})
 
+	// The networks clients may offer in a network picker. Only upstreams marked public are listed,
+	// and never with their hostname or passwords
+	s.HttpRouter.HandleFunc("/webirc/networks", func(w http.ResponseWriter, r *http.Request) {
+		type network struct {
+			Name        string `json:"name"`
+			DisplayName string `json:"display_name"`
+			TLS         bool   `json:"tls"`
+			Description string `json:"description"`
+		}
+
+		// Pages are only shown the networks their clients may connect to
+		origin := strings.ToLower(r.Header.Get("Origin"))
+		originLocked := s.isOriginLocked(origin)
+
+		networks := []network{}
+		for _, upstream := range s.Config.upstreams() {
+			if !upstream.Public || upstream.isFallback || !upstreamUsableFromOrigin(upstream, origin, originLocked) {
+				continue
+			}
+
+			networks = append(networks, network{
+				Name:        upstream.sectionName,
+				DisplayName: upstream.DisplayName,
+				TLS:         upstream.TLS,
+				Description: upstream.Description,
+			})
+		}
+
+		out, _ := json.Marshal(networks)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	})
+
+	// Orchestrators may use this to only route traffic here while the required upstreams are reachable
+	s.HttpRouter.HandleFunc("/webirc/_ready", func(w http.ResponseWriter, r *http.Request) {
+		if !isPrivateIP(s.GetRemoteAddressFromRequest(r)) {
+			w.WriteHeader(403)
+			return
+		}
+
+		if !s.upstreamProbe.IsReady() {
+			w.WriteHeader(503)
+			w.Write([]byte("not ready\n"))
+			return
+		}
+
+		w.Write([]byte("ready\n"))
+	})
+
 	s.HttpRouter.HandleFunc("/webirc/_status", func(w http.ResponseWriter, r *http.Request) {
 		if !isPrivateIP(s.GetRemoteAddressFromRequest(r)) {
 			w.WriteHeader(403)
 			return
 		}
 
+		clients := s.SnapshotClients()
+
+		// The [limits] max_clients cap alongside the current count, 0 = unlimited
+		w.Header().Set("X-Clients", strconv.Itoa(s.Clients.Count()))
+		w.Header().Set("X-Max-Clients", strconv.Itoa(s.Config.MaxClients))
+
+		if r.URL.Query().Get("format") == "json" {
+			out, _ := json.Marshal(clients)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(out)
+			return
+		}
+
 		out := ""
-		for item := range s.Clients.Iter() {
-			c := item.Val.(*Client)
+		for _, c := range clients {
 			line := fmt.Sprintf(
-				"%s:%d %s %s!%s %s %s",
-				c.UpstreamConfig.Hostname,
-				c.UpstreamConfig.Port,
+				"%s %s %s!%s %s %s",
+				c.Upstream,
 				c.State,
-				c.IrcState.Nick,
-				c.IrcState.Username,
+				c.Nick,
+				c.Username,
 				c.RemoteAddr,
 				c.RemoteHostname,
 			)
 
 			// Allow plugins to add their own status data
 			hook := HookStatus{}
-			hook.Client = c
+			hook.Client = c.client
 			hook.Line = line
 			hook.Dispatch("status.client")
 			if !hook.Halt {
@@ -179,27 +376,148 @@ func (s *Gateway) initHttpRoutes() error {
 		w.Write([]byte(out))
 	})
 
+	// Compression stats for all clients plus the top clients by bytes saved. ?top=N
+	s.HttpRouter.HandleFunc("/webirc/_status/compression", func(w http.ResponseWriter, r *http.Request) {
+		if !isPrivateIP(s.GetRemoteAddressFromRequest(r)) {
+			w.WriteHeader(403)
+			return
+		}
+
+		topN, err := strconv.Atoi(r.URL.Query().Get("top"))
+		if err != nil || topN < 1 {
+			topN = 10
+		}
+
+		type clientCompression struct {
+			ID         uint64                 `json:"id"`
+			Nick       string                 `json:"nick"`
+			Stats      TransportStatsSnapshot `json:"stats"`
+			BytesSaved int64                  `json:"bytes_saved"`
+			Ratio      float64                `json:"ratio"`
+		}
+
+		total := TransportStatsSnapshot{}
+		clients := []clientCompression{}
+		for _, c := range s.SnapshotClients() {
+			stats := c.Stats
+			if !stats.Compressed {
+				continue
+			}
+
+			total.Compressed = true
+			total.BytesSent += stats.BytesSent
+			total.BytesRecv += stats.BytesRecv
+			total.WireBytesSent += stats.WireBytesSent
+			total.WireBytesRecv += stats.WireBytesRecv
+
+			clients = append(clients, clientCompression{
+				ID:         c.Id,
+				Nick:       c.Nick,
+				Stats:      stats,
+				BytesSaved: stats.BytesSaved(),
+				Ratio:      stats.Ratio(),
+			})
+		}
+
+		sort.Slice(clients, func(i, j int) bool {
+			return clients[i].BytesSaved > clients[j].BytesSaved
+		})
+		if len(clients) > topN {
+			clients = clients[:topN]
+		}
+
+		// Only compressed websocket clients are measured, others are N/A rather than uncompressed
+		status := map[string]interface{}{
+			"total":       total,
+			"bytes_saved": nil,
+			"ratio":       nil,
+			"top":         clients,
+		}
+		if total.Compressed {
+			status["bytes_saved"] = total.BytesSaved()
+			status["ratio"] = total.Ratio()
+		}
+		out, _ := json.Marshal(status)
+		w.Write(out)
+	})
+
+	// Number of hostnames with a cached letsencrypt certificate
+	s.HttpRouter.HandleFunc("/webirc/_status/letsencrypt", func(w http.ResponseWriter, r *http.Request) {
+		if !isPrivateIP(s.GetRemoteAddressFromRequest(r)) {
+			w.WriteHeader(403)
+			return
+		}
+
+		out, _ := json.Marshal(map[string]interface{}{
+			"cached_certs":  s.Acme.CacheSize(),
+			"max_certs":     s.Config.LetsEncryptMaxCerts,
+			"max_idle_days": s.Config.LetsEncryptMaxIdleDays,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	})
+
+	s.initAdminRoutes()
+	s.initOidcRoutes()
+
 	return nil
 }
 
 func (s *Gateway) maybeStartIdentd() {
-	if s.Config.Identd {
-		err := s.identdServ.Run()
-		if err != nil {
-			s.Log(3, "Error starting identd server: %s", err.Error())
-		} else {
-			s.Log(2, "Identd server started")
-		}
+	if !s.Config.Identd {
+		return
+	}
+
+	network := "tcp"
+	if !s.Config.IdentdIPv4 && !s.Config.IdentdIPv6 {
+		s.Log(3, "Identd server not started, identd_ipv4 and identd_ipv6 are both disabled")
+		return
+	} else if !s.Config.IdentdIPv6 {
+		network = "tcp4"
+	} else if !s.Config.IdentdIPv4 {
+		network = "tcp6"
+	}
+	addr := net.JoinHostPort(s.Config.IdentdAddr, strconv.Itoa(s.Config.IdentdPort))
+
+	err := s.identdServ.Listen(network, addr)
+	if err == nil {
+		s.Log(2, "Identd server started on %s", addr)
+		return
 	}
+
+	// IRCds may reject clients without an ident reply so keep trying, eg. while another process
+	// releases the port
+	s.Log(3, "Error starting identd server on %s: %s. Retrying every 30 seconds", addr, err.Error())
+	go func() {
+		for {
+			time.Sleep(time.Second * 30)
+			err := s.identdServ.Listen(network, addr)
+			if err == nil {
+				s.Log(2, "Identd server started on %s", addr)
+				return
+			}
+			s.Log(1, "Error starting identd server on %s: %s", addr, err.Error())
+		}
+	}()
 }
 
-func (s *Gateway) startServer(conf ConfigServer) {
-	addr := fmt.Sprintf("%s:%d", conf.LocalAddr, conf.Port)
+func (s *Gateway) startServer(server *runningServer) {
+	conf := server.conf
+	addr := serverListenAddr(conf)
 
 	if strings.HasPrefix(strings.ToLower(conf.LocalAddr), "tcp:") {
 		t := &TransportTcp{}
 		t.Init(s)
-		t.Start(conf.LocalAddr[4:] + ":" + strconv.Itoa(conf.Port))
+		t.AcceptProxyProtocol = conf.AcceptProxyProtocol
+		t.Server = conf
+		t.running = server
+		t.Start(addr)
+	} else if strings.HasPrefix(strings.ToLower(conf.LocalAddr), "grpc:") {
+		t := &TransportGrpc{}
+		t.Init(s)
+		t.Server = conf
+		t.running = server
+		t.Start(addr)
 	} else if conf.TLS && conf.LetsEncryptCacheDir == "" {
 		if conf.CertFile == "" || conf.KeyFile == "" {
 			s.Log(3, "'cert' and 'key' options must be set for TLS servers")
@@ -210,38 +528,55 @@ func (s *Gateway) startServer(conf ConfigServer) {
 		tlsKey := s.Config.ResolvePath(conf.KeyFile)
 
 		s.Log(2, "Listening with TLS on %s", addr)
-		keyPair, keyPairErr := tls.LoadX509KeyPair(tlsCert, tlsKey)
-		if keyPairErr != nil {
-			s.Log(3, "Failed to listen with TLS, certificate error: %s", keyPairErr.Error())
+		certStore := NewCertStore(s, tlsCert, tlsKey)
+		if certErr := certStore.Load(); certErr != nil {
+			s.Log(3, "Failed to listen with TLS, certificate error: %s", certErr.Error())
 			return
 		}
 		srv := &http.Server{
 			Addr: addr,
 			TLSConfig: &tls.Config{
-				Certificates: []tls.Certificate{keyPair},
+				GetCertificate: certStore.GetCertificate,
+				ClientAuth:     serverClientAuth(conf),
 			},
-			Handler: s.HttpRouter,
+			Handler:     s.HttpRouter,
+			BaseContext: listenerBaseContext(conf),
 		}
 		s.httpSrvsMu.Lock()
 		s.httpSrvs = append(s.httpSrvs, srv)
+		s.certStores = append(s.certStores, certStore)
 		s.httpSrvsMu.Unlock()
 
 		// Don't use HTTP2 since it doesn't support websockets
 		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 
-		err := srv.ListenAndServeTLS("", "")
-		if err != nil && err != http.ErrServerClosed {
+		listeners, err := s.listen(conf, addr)
+		if err != nil {
+			s.Log(3, "Failed to listen with TLS: %s", err.Error())
+			return
+		}
+		if !server.track(listeners, srv, certStore) {
+			return
+		}
+		go s.maybeStartQuic(server, addr, srv.TLSConfig)
+
+		err = serveListeners(listeners, func(listener net.Listener) error {
+			return srv.ServeTLS(s.maybeLimitListener(s.maybeWrapProxyProtocol(listener, conf), conf), "", "")
+		})
+		if err != nil && err != http.ErrServerClosed && !server.isStopped() {
 			s.Log(3, "Failed to listen with TLS: %s", err.Error())
 		}
 	} else if conf.TLS && conf.LetsEncryptCacheDir != "" {
 		s.Log(2, "Listening with letsencrypt TLS on %s", addr)
-		leManager := s.Acme.Get(conf.LetsEncryptCacheDir)
+		s.Acme.Get(conf.LetsEncryptCacheDir)
 		srv := &http.Server{
 			Addr: addr,
 			TLSConfig: &tls.Config{
-				GetCertificate: leManager.GetCertificate,
+				GetCertificate: s.Acme.GetCertificate,
+				ClientAuth:     serverClientAuth(conf),
 			},
-			Handler: s.HttpRouter,
+			Handler:     s.HttpRouter,
+			BaseContext: listenerBaseContext(conf),
 		}
 		s.httpSrvsMu.Lock()
 		s.httpSrvs = append(s.httpSrvs, srv)
@@ -250,32 +585,91 @@ func (s *Gateway) startServer(conf ConfigServer) {
 		// Don't use HTTP2 since it doesn't support websockets
 		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 
-		err := srv.ListenAndServeTLS("", "")
-		if err != nil && err != http.ErrServerClosed {
+		listeners, err := s.listen(conf, addr)
+		if err != nil {
+			s.Log(3, "Listening with letsencrypt failed: %s", err.Error())
+			return
+		}
+		if !server.track(listeners, srv, nil) {
+			return
+		}
+		go s.maybeStartQuic(server, addr, srv.TLSConfig)
+
+		err = serveListeners(listeners, func(listener net.Listener) error {
+			return srv.ServeTLS(s.maybeLimitListener(s.maybeWrapProxyProtocol(listener, conf), conf), "", "")
+		})
+		if err != nil && err != http.ErrServerClosed && !server.isStopped() {
 			s.Log(3, "Listening with letsencrypt failed: %s", err.Error())
 		}
 	} else if strings.HasPrefix(strings.ToLower(conf.LocalAddr), "unix:") {
 		socketFile := conf.LocalAddr[5:]
 		s.Log(2, "Listening on %s", socketFile)
-		os.Remove(socketFile)
-		server, serverErr := net.Listen("unix", socketFile)
+		listener, serverErr := s.listenUnix(conf, socketFile)
 		if serverErr != nil {
 			s.Log(3, serverErr.Error())
 			return
 		}
-		os.Chmod(socketFile, conf.BindMode)
-		http.Serve(server, s.HttpRouter)
+		srv := &http.Server{Handler: s.HttpRouter, BaseContext: listenerBaseContext(conf)}
+
+		s.httpSrvsMu.Lock()
+		s.httpSrvs = append(s.httpSrvs, srv)
+		s.httpSrvsMu.Unlock()
+
+		if !server.track([]net.Listener{listener}, srv, nil) {
+			return
+		}
+		srv.Serve(s.maybeLimitListener(listener, conf))
 	} else {
 		s.Log(2, "Listening on %s", addr)
-		srv := &http.Server{Addr: addr, Handler: s.HttpRouter}
+		srv := &http.Server{Addr: addr, Handler: s.HttpRouter, BaseContext: listenerBaseContext(conf)}
 
 		s.httpSrvsMu.Lock()
 		s.httpSrvs = append(s.httpSrvs, srv)
 		s.httpSrvsMu.Unlock()
 
-		err := srv.ListenAndServe()
-		if err != nil && err != http.ErrServerClosed {
+		listeners, err := s.listen(conf, addr)
+		if err != nil {
 			s.Log(3, err.Error())
+			return
 		}
+		if !server.track(listeners, srv, nil) {
+			return
+		}
+
+		err = serveListeners(listeners, func(listener net.Listener) error {
+			return srv.Serve(s.maybeLimitListener(s.maybeWrapProxyProtocol(listener, conf), conf))
+		})
+		if err != nil && err != http.ErrServerClosed && !server.isStopped() {
+			s.Log(3, err.Error())
+		}
+	}
+}
+
+// serverClientAuth - Whether a TLS server asks clients for a certificate. Certificates are not
+// verified, only their fingerprint is passed on to the IRCd
+func serverClientAuth(conf ConfigServer) tls.ClientAuthType {
+	if conf.ClientCerts {
+		return tls.RequestClientCert
+	}
+
+	return tls.NoClientCert
+}
+
+// maybeWrapProxyProtocol - If enabled for the server, connections from trusted reverse proxies
+// must start with a PROXY protocol header which then provides the real client address
+func (s *Gateway) maybeWrapProxyProtocol(listener net.Listener, conf ConfigServer) net.Listener {
+	if !conf.AcceptProxyProtocol {
+		return listener
+	}
+
+	return &proxyprotocol.Listener{
+		Listener: listener,
+		Timeout:  time.Second * 5,
+		Trusted: func(ip net.IP) bool {
+			if len(conf.ProxyProtocolTrusted) > 0 {
+				return ipInRanges(ip, conf.ProxyProtocolTrusted)
+			}
+			return s.isReverseProxy(ip)
+		},
 	}
 }
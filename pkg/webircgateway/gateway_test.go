@@ -0,0 +1,227 @@
+package webircgateway
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// How long tests wait for a line before failing
+const testTimeout = time.Second * 5
+
+// newTestGateway - A gateway loaded from config, with its log output discarded
+func newTestGateway(t *testing.T, config string) *Gateway {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "webircgateway-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	configFile := filepath.Join(dir, "config.conf")
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := NewGateway("gateway")
+	go func() {
+		for range gateway.LogOutput {
+		}
+	}()
+
+	gateway.Config.SetConfigFile(configFile)
+	if err := gateway.Config.Load(); err != nil {
+		t.Fatal(err)
+	}
+	gateway.dnsResolver.Load()
+
+	return gateway
+}
+
+// fakeUpstream - An IRC server that tests read the lines sent to and write lines back over
+type fakeUpstream struct {
+	t        *testing.T
+	listener net.Listener
+	conns    chan net.Conn
+	conn     net.Conn
+	lines    chan string
+}
+
+func newFakeUpstream(t *testing.T) *fakeUpstream {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &fakeUpstream{
+		t:        t,
+		listener: listener,
+		conns:    make(chan net.Conn, 10),
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(u.conns)
+				return
+			}
+			u.conns <- conn
+		}
+	}()
+
+	return u
+}
+
+// config - An [upstream] section connecting to this server
+func (u *fakeUpstream) config(extra string) string {
+	_, port, _ := net.SplitHostPort(u.listener.Addr().String())
+	return fmt.Sprintf("[upstream.1]\nhostname = \"127.0.0.1\"\nport = %s\ntimeout = 5\n%s\n", port, extra)
+}
+
+// accept - Wait for the gateway to connect
+func (u *fakeUpstream) accept() {
+	u.t.Helper()
+
+	select {
+	case conn := <-u.conns:
+		u.t.Cleanup(func() { conn.Close() })
+		u.conn = conn
+		u.lines = make(chan string, 100)
+		go func(lines chan string) {
+			reader := bufio.NewReader(conn)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					close(lines)
+					return
+				}
+				lines <- strings.TrimRight(line, "\r\n")
+			}
+		}(u.lines)
+	case <-time.After(testTimeout):
+		u.t.Fatal("the gateway did not connect to the upstream")
+	}
+}
+
+// send - Write lines to the gateway
+func (u *fakeUpstream) send(lines ...string) {
+	u.t.Helper()
+
+	for _, line := range lines {
+		if _, err := u.conn.Write([]byte(line + "\r\n")); err != nil {
+			u.t.Fatal(err)
+		}
+	}
+}
+
+// expect - Read lines sent by the gateway until one starts with prefix
+func (u *fakeUpstream) expect(prefix string) string {
+	u.t.Helper()
+
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case line, ok := <-u.lines:
+			if !ok {
+				u.t.Fatalf("the upstream connection closed while waiting for %q", prefix)
+			}
+			if strings.HasPrefix(line, prefix) {
+				return line
+			}
+		case <-timeout:
+			u.t.Fatalf("the upstream did not receive %q", prefix)
+		}
+	}
+}
+
+// register - Accept the gateway and complete registration for nick
+func (u *fakeUpstream) register(nick string) {
+	u.t.Helper()
+
+	u.accept()
+	u.expect("USER ")
+	u.send(
+		":irc.example.net 001 "+nick+" :Welcome",
+		":irc.example.net 376 "+nick+" :End of MOTD",
+	)
+}
+
+// newTestClient - A client connected to the gateway as if by a transport
+func newTestClient(t *testing.T, gateway *Gateway) *Client {
+	t.Helper()
+
+	client := gateway.NewClient()
+	client.RemoteAddr = "127.0.0.1"
+	client.RemoteHostname = "localhost"
+	client.Ready()
+
+	t.Cleanup(func() {
+		client.StartShutdown("test_ended")
+		// Let the client finish closing, as a transport would
+		go func() {
+			for range client.Signals {
+			}
+		}()
+	})
+
+	return client
+}
+
+// testClientSend - Send lines from the client
+func testClientSend(client *Client, lines ...string) {
+	for _, line := range lines {
+		client.Recv <- line
+	}
+}
+
+// testClientExpect - Read signals sent to the client until a data line starting with prefix
+func testClientExpect(t *testing.T, client *Client, prefix string) string {
+	t.Helper()
+
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case signal, ok := <-client.Signals:
+			if !ok {
+				t.Fatalf("the client closed while waiting for %q", prefix)
+			}
+			if signal[0] == "data" && strings.HasPrefix(signal[1], prefix) {
+				return signal[1]
+			}
+		case <-timeout:
+			t.Fatalf("the client did not receive %q", prefix)
+		}
+	}
+}
+
+// testClientExpectClosed - Read signals sent to the client until it is closed, returning the close
+// reason given to the transport
+func testClientExpectClosed(t *testing.T, client *Client) string {
+	t.Helper()
+
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case signal, ok := <-client.Signals:
+			if !ok {
+				t.Fatal("the client signals closed without a closed state")
+			}
+			if signal[0] == "state" && signal[1] == "closed" {
+				return signal[2]
+			}
+		case <-timeout:
+			t.Fatal("the client was not closed")
+		}
+	}
+}
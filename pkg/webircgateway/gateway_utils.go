@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"time"
 )
 
 func (s *Gateway) NewClient() *Client {
@@ -53,19 +54,148 @@ func (s *Gateway) isIrcAddressAllowed(addr string) bool {
 	return foundMatch
 }
 
-func (s *Gateway) findUpstream() (ConfigUpstream, error) {
+func (s *Gateway) findUpstream(client *Client) (ConfigUpstream, error) {
 	var ret ConfigUpstream
 
-	if len(s.Config.Upstreams) == 0 {
+	upstreams := s.Config.upstreams()
+	if len(upstreams) == 0 {
 		return ret, errors.New("No upstreams available")
 	}
 
-	randIdx := rand.Intn(len(s.Config.Upstreams))
-	ret = s.Config.Upstreams[randIdx]
+	originLocked := s.isOriginLocked(client.Origin)
+	affinityKey := client.AffinityKey
+	if affinityKey == "" {
+		affinityKey = s.clientAffinityKey(client)
+	}
+	if affinityKey != "" {
+		affinityKey += " " + affinityGroup(client.Origin, originLocked)
+	}
+	affinityTTL := time.Second * time.Duration(s.Config.UpstreamAffinityTTL)
+
+	// Send the client back to the upstream it used last if it is still configured and healthy
+	if affinityKey != "" {
+		if lastUpstream, exists := s.upstreamAffinity.Get(affinityKey); exists {
+			for _, upstream := range upstreams {
+				if upstreamAddrKey(upstream) != lastUpstream || !upstreamUsableFromOrigin(upstream, client.Origin, originLocked) {
+					continue
+				}
+
+				if s.upstreamProbe.IsUnhealthy(upstream) {
+					client.Log(1, "Upstream affinity: %s is unhealthy, selecting another upstream", lastUpstream)
+					break
+				}
+				if upstream.Weight == 0 {
+					client.Log(1, "Upstream affinity: %s is drained, selecting another upstream", lastUpstream)
+					break
+				}
+
+				client.Log(1, "Upstream affinity: using previous upstream %s", lastUpstream)
+				s.upstreamAffinity.Set(affinityKey, lastUpstream, affinityTTL)
+				return upstream, nil
+			}
+		}
+	}
+
+	// Upstreams that are only fallbacks for others are never picked directly, and drained
+	// upstreams with a weight of 0 take no new clients
+	candidates := []ConfigUpstream{}
+	totalWeight := 0
+	for _, upstream := range upstreams {
+		if !upstream.isFallback && upstream.Weight > 0 && upstreamUsableFromOrigin(upstream, client.Origin, originLocked) {
+			candidates = append(candidates, upstream)
+			totalWeight += upstream.Weight
+		}
+	}
+	if len(candidates) == 0 {
+		return ret, errors.New("No upstreams available")
+	}
+
+	// Weighted random selection. Each upstream covers a range of the total weight as wide as its
+	// own weight, so the chance of picking it is its weight / the total weight
+	pick := rand.Intn(totalWeight)
+	for _, upstream := range candidates {
+		pick -= upstream.Weight
+		if pick < 0 {
+			ret = upstream
+			break
+		}
+	}
+
+	if affinityKey != "" {
+		client.Log(1, "Upstream affinity: assigning upstream %s", upstreamAddrKey(ret))
+		s.upstreamAffinity.Set(affinityKey, upstreamAddrKey(ret), affinityTTL)
+	}
 
 	return ret, nil
 }
 
+// clientAffinityKey - What the client is identified by for upstream affinity. Empty if affinity is
+// disabled or the client has nothing to be identified by
+func (s *Gateway) clientAffinityKey(client *Client) string {
+	switch s.Config.UpstreamAffinity {
+	case "ip":
+		return client.RemoteAddr
+	case "account":
+		// Only clients with verified claims have them, so nobody can take another accounts upstream
+		if account := makeClaimReplacements("%{"+s.Config.UpstreamAffinityClaim+"}", client); account != "" {
+			return "account:" + account
+		}
+	case "token":
+		if client.affinityToken != "" {
+			return "token:" + client.affinityToken
+		}
+	}
+
+	return ""
+}
+
+// affinityGroup - Which group of upstreams a client from origin picks from: those locked to its
+// origin, or the upstreams open to any origin. Clients of different sites behind the same address
+// then have an upstream remembered for each site
+func affinityGroup(origin string, originLocked bool) string {
+	if originLocked {
+		return "origin:" + origin
+	}
+
+	return "any"
+}
+
+// isOriginLocked - If an upstream has origins matching origin, so that clients from it may only use
+// those upstreams
+func (s *Gateway) isOriginLocked(origin string) bool {
+	for _, upstream := range s.Config.upstreams() {
+		if upstreamMatchesOrigin(upstream, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// upstreamUsableFromOrigin - If a client from origin may use an upstream. originLocked is the
+// result of isOriginLocked for the origin
+func upstreamUsableFromOrigin(upstream ConfigUpstream, origin string, originLocked bool) bool {
+	if originLocked {
+		return upstreamMatchesOrigin(upstream, origin)
+	}
+
+	return len(upstream.Origins) == 0
+}
+
+func upstreamMatchesOrigin(upstream ConfigUpstream, origin string) bool {
+	if origin == "" {
+		return false
+	}
+
+	for _, match := range upstream.Origins {
+		if match.Match(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (s *Gateway) findWebircPassword(ircHost string) string {
 	pass, exists := s.Config.GatewayWebircPassword[strings.ToLower(ircHost)]
 	if !exists {
@@ -85,52 +215,114 @@ func (s *Gateway) GetRemoteAddressFromRequest(req *http.Request) net.IP {
 
 	remoteIP := net.ParseIP(remoteAddr)
 
-	isInRange := false
-	for _, cidrRange := range s.Config.ReverseProxies {
-		if cidrRange.Contains(remoteIP) {
-			isInRange = true
-			break
+	// If the remoteIP is not in a whitelisted reverse proxy range, don't trust
+	// the headers and use the remoteIP as the users IP
+	if !s.isReverseProxy(remoteIP) {
+		return remoteIP
+	}
+
+	// Each proxy appends the address it was connected from, so the chain is read from the right.
+	// Anything left of the proxies we trust may have been made up by the client
+	chain := []net.IP{}
+	for _, headerVal := range req.Header[http.CanonicalHeaderKey(s.Config.ProxyHeader)] {
+		for _, ipStr := range strings.Split(headerVal, ",") {
+			ip := net.ParseIP(strings.Trim(ipStr, " "))
+			if ip == nil {
+				// A broken entry means nothing to the left of it can be trusted
+				chain = []net.IP{}
+				continue
+			}
+			chain = append(chain, ip)
 		}
 	}
 
-	// If the remoteIP is not in a whitelisted reverse proxy range, don't trust
-	// the headers and use the remoteIP as the users IP
-	if !isInRange {
+	if len(chain) == 0 {
 		return remoteIP
 	}
 
-	headerVal := req.Header.Get("x-forwarded-for")
-	ips := strings.Split(headerVal, ",")
-	ipStr := strings.Trim(ips[0], " ")
-	if ipStr != "" {
-		ip := net.ParseIP(ipStr)
-		if ip != nil {
-			remoteIP = ip
+	if s.Config.ProxyHops > 0 {
+		if len(chain) < s.Config.ProxyHops {
+			return chain[0]
 		}
+		return chain[len(chain)-s.Config.ProxyHops]
 	}
 
-	return remoteIP
+	for i := len(chain) - 1; i > 0; i-- {
+		if !s.isReverseProxy(chain[i]) {
+			return chain[i]
+		}
+	}
+
+	return chain[0]
+}
+
+// lookupClientHostname - The clients verified reverse DNS hostname, or its address if it has none.
+// Not looked up when only .onion upstreams are configured, as they are never sent hostnames
+func (s *Gateway) lookupClientHostname(remoteAddr string) string {
+	if s.Config.onionUpstreamsOnly() {
+		return remoteAddr
+	}
+
+	clientHostnames, err := s.dnsResolver.LookupAddr(remoteAddr)
+	if err != nil || len(clientHostnames) == 0 {
+		return remoteAddr
+	}
+
+	// FQDNs include a . at the end. Strip it out
+	potentialHostname := strings.Trim(clientHostnames[0], ".")
+
+	// Must check that the resolved hostname also resolves back to the users IP
+	addr, err := s.dnsResolver.LookupIP(potentialHostname)
+	if err == nil && len(addr) == 1 && addr[0].String() == remoteAddr {
+		return potentialHostname
+	}
 
+	return remoteAddr
+}
+
+// isReverseProxy - If ip is in one of the [reverse_proxies] ranges
+func (s *Gateway) isReverseProxy(ip net.IP) bool {
+	for _, cidrRange := range s.Config.ReverseProxies {
+		if cidrRange.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// localPortFromRequest - The port the client connected to, as given by a reverse proxy in the
+// X-Forwarded-Port header if there is one
+func (s *Gateway) localPortFromRequest(req *http.Request) string {
+	remoteAddr, _, _ := net.SplitHostPort(req.RemoteAddr)
+	if s.isReverseProxy(net.ParseIP(remoteAddr)) {
+		if port := strings.TrimSpace(req.Header.Get("X-Forwarded-Port")); port != "" {
+			return port
+		}
+	}
+
+	localAddr, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if localAddr == nil {
+		return ""
+	}
+	_, port, _ := net.SplitHostPort(localAddr.String())
+	return port
 }
 
 func (s *Gateway) isRequestSecure(req *http.Request) bool {
 	remoteAddr, _, _ := net.SplitHostPort(req.RemoteAddr)
 	remoteIP := net.ParseIP(remoteAddr)
+	isInRange := s.isReverseProxy(remoteIP)
 
-	isInRange := false
-	for _, cidrRange := range s.Config.ReverseProxies {
-		if cidrRange.Contains(remoteIP) {
-			isInRange = true
-			break
-		}
+	// Connections made over TLS to us directly are secure whoever made them
+	if req.TLS != nil {
+		return true
 	}
 
 	// If the remoteIP is not in a whitelisted reverse proxy range, don't trust
-	// the headers and check the request directly
-	if !isInRange && req.TLS == nil {
+	// the headers
+	if !isInRange {
 		return false
-	} else if !isInRange {
-		return true
 	}
 
 	headerVal := strings.ToLower(req.Header.Get("x-forwarded-proto"))
@@ -140,3 +332,9 @@ func (s *Gateway) isRequestSecure(req *http.Request) bool {
 
 	return false
 }
+
+// lineTooLong - If a message from a client is over [limits] max_line_length
+func (s *Gateway) lineTooLong(message string) bool {
+	maxLength := s.Config.MaxLineLength
+	return maxLength > 0 && len(message) > maxLength
+}
@@ -0,0 +1,195 @@
+package webircgateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const weightedUpstreams = `
+[upstream.small]
+hostname = "irc1.example.net"
+port = 6667
+weight = %s
+
+[upstream.big]
+hostname = "irc2.example.net"
+port = 6667
+weight = %s
+
+[upstream.drained]
+hostname = "irc3.example.net"
+port = 6667
+weight = 0
+`
+
+// upstreamDistribution - The share of picks each upstream hostname got
+func upstreamDistribution(t *testing.T, gateway *Gateway, client *Client, picks int) map[string]float64 {
+	t.Helper()
+
+	counts := map[string]int{}
+	for i := 0; i < picks; i++ {
+		upstream, err := gateway.findUpstream(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[upstream.Hostname]++
+	}
+
+	shares := map[string]float64{}
+	for hostname, count := range counts {
+		shares[hostname] = float64(count) / float64(picks)
+	}
+	return shares
+}
+
+func checkShare(t *testing.T, shares map[string]float64, hostname string, want float64) {
+	t.Helper()
+
+	if got := shares[hostname]; math.Abs(got-want) > 0.02 {
+		t.Errorf("%s got %.3f of clients, want %.3f", hostname, got, want)
+	}
+}
+
+func TestWeightedUpstreamDistribution(t *testing.T) {
+	gateway := newTestGateway(t, fmt.Sprintf(weightedUpstreams, "1", "3"))
+	client := newTestClient(t, gateway)
+
+	shares := upstreamDistribution(t, gateway, client, 20000)
+	checkShare(t, shares, "irc1.example.net", 0.25)
+	checkShare(t, shares, "irc2.example.net", 0.75)
+	if shares["irc3.example.net"] != 0 {
+		t.Errorf("the drained upstream got %.3f of clients", shares["irc3.example.net"])
+	}
+
+	// Weights take effect once the config is reloaded
+	err := ioutil.WriteFile(gateway.Config.ConfigFile, []byte(fmt.Sprintf(weightedUpstreams, "2", "2")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.Config.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	shares = upstreamDistribution(t, gateway, client, 20000)
+	checkShare(t, shares, "irc1.example.net", 0.5)
+	checkShare(t, shares, "irc2.example.net", 0.5)
+}
+
+func TestWeightedUpstreamAllDrained(t *testing.T) {
+	gateway := newTestGateway(t, fmt.Sprintf(weightedUpstreams, "0", "0"))
+	client := newTestClient(t, gateway)
+
+	if upstream, err := gateway.findUpstream(client); err == nil {
+		t.Errorf("picked %s while every upstream is drained", upstream.Hostname)
+	}
+}
+
+const affinityUpstreams = `
+[upstream_affinity]
+key = ip
+
+[upstream.open1]
+hostname = "irc1.example.net"
+port = 6667
+
+[upstream.open2]
+hostname = "irc2.example.net"
+port = 6667
+
+[upstream.site]
+hostname = "irc3.example.net"
+port = 6667
+origins = "https://site.example.com"
+`
+
+func TestUpstreamAffinityPerGroup(t *testing.T) {
+	gateway := newTestGateway(t, affinityUpstreams)
+
+	siteClient := newTestClient(t, gateway)
+	siteClient.SetOrigin("https://site.example.com")
+	upstream, err := gateway.findUpstream(siteClient)
+	if err != nil || upstream.Hostname != "irc3.example.net" {
+		t.Fatalf("the site client got %s, %v", upstream.Hostname, err)
+	}
+
+	// A client from the same address without the site's origin picks from the open upstreams, and
+	// keeps that pick without disturbing the site client's
+	client := newTestClient(t, gateway)
+	first, err := gateway.findUpstream(client)
+	if err != nil || first.Hostname == "irc3.example.net" {
+		t.Fatalf("the client got %s, %v", first.Hostname, err)
+	}
+	for i := 0; i < 20; i++ {
+		if upstream, _ := gateway.findUpstream(client); upstream.Hostname != first.Hostname {
+			t.Fatalf("the client moved from %s to %s", first.Hostname, upstream.Hostname)
+		}
+	}
+
+	if last, _ := gateway.upstreamAffinity.Get("127.0.0.1 origin:https://site.example.com"); last != "irc3.example.net:6667" {
+		t.Errorf("the site client's upstream is remembered as %q", last)
+	}
+}
+
+// affinityPicks - The upstreams picked for clients made by newClient, which should all be the same
+func affinityPicks(t *testing.T, gateway *Gateway, newClient func() *Client) map[string]bool {
+	t.Helper()
+
+	picks := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		upstream, err := gateway.findUpstream(newClient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[upstream.Hostname] = true
+	}
+
+	return picks
+}
+
+func TestUpstreamAffinityByAccount(t *testing.T) {
+	gateway := newTestGateway(t, strings.Replace(affinityUpstreams, "key = ip", "key = account", 1))
+
+	// The same account from different addresses keeps its upstream
+	n := 0
+	picks := affinityPicks(t, gateway, func() *Client {
+		n++
+		client := newTestClient(t, gateway)
+		client.RemoteAddr = fmt.Sprintf("192.0.2.%d", n)
+		client.AuthClaims = map[string]interface{}{"sub": "alice"}
+		return client
+	})
+	if len(picks) != 1 {
+		t.Errorf("the account was sent to %d upstreams", len(picks))
+	}
+
+	// Clients without an account aren't remembered, even from the same address
+	for i := 0; i < 20; i++ {
+		gateway.findUpstream(newTestClient(t, gateway))
+	}
+	if _, exists := gateway.upstreamAffinity.Get("127.0.0.1 any"); exists {
+		t.Error("a client without an account was remembered by its address")
+	}
+}
+
+func TestUpstreamAffinityByToken(t *testing.T) {
+	gateway := newTestGateway(t, strings.Replace(affinityUpstreams, "key = ip", "key = token", 1))
+
+	picks := affinityPicks(t, gateway, func() *Client {
+		client := newTestClient(t, gateway)
+		client.SetAffinityToken(httptest.NewRequest("GET", "/webirc/websocket/?affinity=tab1", nil))
+		return client
+	})
+	if len(picks) != 1 {
+		t.Errorf("the token was sent to %d upstreams", len(picks))
+	}
+
+	client := newTestClient(t, gateway)
+	client.SetAffinityToken(httptest.NewRequest("GET", "/webirc/websocket/?affinity="+strings.Repeat("a", 200), nil))
+	if key := gateway.clientAffinityKey(client); key != "" {
+		t.Errorf("an overlong token was kept as %q", key)
+	}
+}
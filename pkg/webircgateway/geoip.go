@@ -0,0 +1,201 @@
+package webircgateway
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP - Looks up the country and ASN of client addresses in MaxMind GeoLite2 / GeoIP2
+// databases. The databases are opened again when the config is reloaded so that updated copies
+// are used without a restart
+type GeoIP struct {
+	gateway     *Gateway
+	mu          sync.RWMutex
+	countryFile string
+	asnFile     string
+	country     *maxminddb.Reader
+	asn         *maxminddb.Reader
+}
+
+// GeoIPResult - What is known about an address. Fields are empty or 0 when not known
+type GeoIPResult struct {
+	// Country - ISO 3166-1 alpha-2 country code, eg. GB
+	Country string
+	ASN     uint
+	ASOrg   string
+}
+
+type geoIPCountryRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type geoIPASNRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+func NewGeoIP(gateway *Gateway) *GeoIP {
+	return &GeoIP{gateway: gateway}
+}
+
+// Lookup - The country and ASN of an address, from whichever databases are configured
+func (g *GeoIP) Lookup(ip net.IP) GeoIPResult {
+	result := GeoIPResult{}
+	if ip == nil {
+		return result
+	}
+
+	// The readers are safe to use concurrently so lookups only wait for the databases to be opened
+	g.mu.RLock()
+	if g.changed() {
+		g.mu.RUnlock()
+		g.mu.Lock()
+		if g.changed() {
+			g.load()
+		}
+		g.mu.Unlock()
+		g.mu.RLock()
+	}
+	defer g.mu.RUnlock()
+
+	if g.country != nil {
+		record := geoIPCountryRecord{}
+		if err := g.country.Lookup(ip, &record); err != nil {
+			g.gateway.Log(2, "GeoIP country lookup of %s failed: %s", ip.String(), err.Error())
+		}
+		result.Country = record.Country.IsoCode
+	}
+
+	if g.asn != nil {
+		record := geoIPASNRecord{}
+		if err := g.asn.Lookup(ip, &record); err != nil {
+			g.gateway.Log(2, "GeoIP ASN lookup of %s failed: %s", ip.String(), err.Error())
+		}
+		result.ASN = record.Number
+		result.ASOrg = record.Organization
+	}
+
+	return result
+}
+
+// Load - Open the databases again
+func (g *GeoIP) Load() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.load()
+}
+
+// changed - If the configured databases aren't the ones open. g.mu must be held
+func (g *GeoIP) changed() bool {
+	cfg := g.gateway.Config
+	return cfg.GeoIPDatabase != g.countryFile || cfg.GeoIPASNDatabase != g.asnFile
+}
+
+// load - g.mu must be held for writing
+func (g *GeoIP) load() {
+	cfg := g.gateway.Config
+	g.country = g.open(g.country, g.countryFile, cfg.GeoIPDatabase)
+	g.countryFile = cfg.GeoIPDatabase
+	g.asn = g.open(g.asn, g.asnFile, cfg.GeoIPASNDatabase)
+	g.asnFile = cfg.GeoIPASNDatabase
+}
+
+// open - A reader for file, replacing current. current is kept if file is unchanged and can't be
+// opened
+func (g *GeoIP) open(current *maxminddb.Reader, currentFile string, file string) *maxminddb.Reader {
+	if file == "" {
+		if current != nil {
+			current.Close()
+		}
+		return nil
+	}
+
+	reader, err := maxminddb.Open(file)
+	if err != nil {
+		g.gateway.Log(3, "Error opening GeoIP database %s: %s", file, err.Error())
+		if file == currentFile {
+			return current
+		}
+		if current != nil {
+			current.Close()
+		}
+		return nil
+	}
+
+	if current != nil {
+		current.Close()
+	}
+	g.gateway.Log(2, "Loaded GeoIP database %s (%s)", file, reader.Metadata.DatabaseType)
+	return reader
+}
+
+// Allowed - If the [geoip] country and ASN rules allow an address. Addresses with an unknown
+// country or ASN are only allowed when there is no allow list for them
+func (r GeoIPResult) Allowed(cfg *Config) bool {
+	if r.Country != "" && stringInSlice(r.Country, cfg.GeoIPDenyCountries) {
+		return false
+	}
+	if len(cfg.GeoIPAllowCountries) > 0 && !stringInSlice(r.Country, cfg.GeoIPAllowCountries) {
+		return false
+	}
+
+	asn := strconv.FormatUint(uint64(r.ASN), 10)
+	if r.ASN != 0 && stringInSlice(asn, cfg.GeoIPDenyASNs) {
+		return false
+	}
+	if len(cfg.GeoIPAllowASNs) > 0 && (r.ASN == 0 || !stringInSlice(asn, cfg.GeoIPAllowASNs)) {
+		return false
+	}
+
+	return true
+}
+
+// checkGeoIP - Look up the clients country and ASN, tagging the WEBIRC line with them if
+// configured. Returns false if the [geoip] rules don't allow the client to connect
+func (c *Client) checkGeoIP() bool {
+	cfg := c.Gateway.Config
+	if cfg.GeoIPDatabase == "" && cfg.GeoIPASNDatabase == "" {
+		return true
+	}
+
+	geo := c.Gateway.geoIP.Lookup(net.ParseIP(c.RemoteAddr))
+	c.Country = geo.Country
+	c.ASN = geo.ASN
+	c.ASOrg = geo.ASOrg
+
+	if cfg.GeoIPWebircTags {
+		if geo.Country != "" {
+			c.Tags["country"] = geo.Country
+		}
+		if geo.ASN != 0 {
+			c.Tags["asn"] = strconv.FormatUint(uint64(geo.ASN), 10)
+		}
+	}
+
+	if !geo.Allowed(cfg) {
+		c.LogEvent(2, "client.geoip_denied", "Connection from %s refused, country %s ASN %d", c.RemoteAddr, geo.Country, geo.ASN)
+		return false
+	}
+
+	return true
+}
+
+// splitGeoIPList - A comma separated list of countries or ASNs, uppercased with any prefix
+// removed so that gb and AS15169 match
+func splitGeoIPList(val string, prefix string) []string {
+	list := []string{}
+	for _, item := range strings.Split(val, ",") {
+		item = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(item)), prefix)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
@@ -1,6 +1,11 @@
 package webircgateway
 
-import "github.com/kiwiirc/webircgateway/pkg/irc"
+import (
+	"crypto/tls"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+	"github.com/kiwiirc/webircgateway/pkg/recaptcha"
+)
 
 var hooksRegistered map[string][]interface{}
 
@@ -53,6 +58,50 @@ func (h *HookIrcConnectionPre) Dispatch(eventType string) {
 	}
 }
 
+/**
+ * HookIrcWebirc
+ * Dispatched just before the WEBIRC line is sent to the IRCd
+ *   * Tags may be modified to change the flags sent with it, eg. Tags["account"] = "bob"
+ * Types: irc.webirc
+ */
+type HookIrcWebirc struct {
+	Hook
+	Client         *Client
+	UpstreamConfig *ConfigUpstream
+	Tags           map[string]string
+}
+
+func (h *HookIrcWebirc) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookIrcWebirc)); ok {
+			f(h)
+		}
+	}
+}
+
+/**
+ * HookIrcClientCertificate
+ * Dispatched before the TLS handshake with the IRCd
+ *   * Certificate may be set to present a certificate for this client, eg. one generated for
+ *     its account. It starts as the upstreams client_cert, if any
+ *   * The preconnect pool is not used for TLS upstreams while this hook has callbacks
+ * Types: irc.client_certificate
+ */
+type HookIrcClientCertificate struct {
+	Hook
+	Client         *Client
+	UpstreamConfig *ConfigUpstream
+	Certificate    *tls.Certificate
+}
+
+func (h *HookIrcClientCertificate) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookIrcClientCertificate)); ok {
+			f(h)
+		}
+	}
+}
+
 /**
  * HookIrcLine
  * Dispatched when either:
@@ -77,6 +126,98 @@ func (h *HookIrcLine) Dispatch(eventType string) {
 	}
 }
 
+/**
+ * HookMessageToClient
+ * Dispatched for each line from the IRCd just before it is sent to the client, after the
+ * gateway has made its own changes. Only this client is affected.
+ *   * Line may be modified
+ *   * Setting Halt drops the line
+ *   * Lines added to Inject are sent to the client after Line, in order
+ * Types: irc.line.client
+ */
+type HookMessageToClient struct {
+	Hook
+	Client *Client
+	Line   string
+	Inject []string
+}
+
+func (h *HookMessageToClient) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookMessageToClient)); ok {
+			f(h)
+		}
+	}
+}
+
+/**
+ * HookIrcCommand
+ * Dispatched for each command from the client, before the gateway handles it or it is sent to
+ * the IRCd. Allows plugins to add commands answered entirely by the gateway.
+ *   * Use Client.Reply() to send the client a response
+ *   * Setting Halt claims the command so that it is not handled any further
+ * Types: irc.command
+ */
+type HookIrcCommand struct {
+	Hook
+	Client  *Client
+	Line    string
+	Message *irc.Message
+}
+
+func (h *HookIrcCommand) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookIrcCommand)); ok {
+			f(h)
+		}
+	}
+}
+
+/**
+ * HookIrcForcedChange
+ * Dispatched when the IRCd KILLs the client or changes its nick without the client asking.
+ *   * Kind is either "kill" or "nick"
+ *   * Disconnect may be changed to override the configured action
+ *   * Reason may be changed to alter the message the client sees if disconnected
+ * Types: irc.forced
+ */
+type HookIrcForcedChange struct {
+	Hook
+	Client     *Client
+	Kind       string
+	Reason     string
+	Disconnect bool
+}
+
+func (h *HookIrcForcedChange) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookIrcForcedChange)); ok {
+			f(h)
+		}
+	}
+}
+
+/**
+ * HookIrcAutoJoin
+ * Dispatched once the client has registered, before joining the upstreams autojoin channels
+ *   * Setting Halt stops the gateway joining any channels for this client
+ *   * Channels may be modified to change which channels are joined
+ * Types: irc.autojoin
+ */
+type HookIrcAutoJoin struct {
+	Hook
+	Client   *Client
+	Channels []ConfigChannel
+}
+
+func (h *HookIrcAutoJoin) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookIrcAutoJoin)); ok {
+			f(h)
+		}
+	}
+}
+
 /**
  * HookClientState
  * Dispatched after a client connects or disconnects
@@ -134,6 +275,31 @@ func (h *HookStatus) Dispatch(eventType string) {
 	}
 }
 
+/**
+ * HookCaptchaVerify
+ * Dispatched after a captcha response has been verified with the provider
+ *   * Client is nil when the response was sent with a websocket handshake, before the client exists
+ *   * Result holds the provider's response, eg. the hostname or action the captcha was solved for
+ *   * Verified may be changed to accept or reject the response
+ * Types: captcha.verify
+ */
+type HookCaptchaVerify struct {
+	Hook
+	Client     *Client
+	RemoteAddr string
+	Provider   string
+	Result     recaptcha.Result
+	Verified   bool
+}
+
+func (h *HookCaptchaVerify) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookCaptchaVerify)); ok {
+			f(h)
+		}
+	}
+}
+
 /**
  * HookGatewayClosing
  * Dispatched when the gateway has been told to shutdown
@@ -0,0 +1,100 @@
+package webircgateway
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// initFallbackRoute - Handle every request that doesn't match another route, serving static
+// files if enabled and otherwise responding as configured in [not_found]
+func (s *Gateway) initFallbackRoute() {
+	var fileServer http.Handler
+	var webroot noListingFileSystem
+
+	if s.Config.Webroot != "" {
+		webrootPath := s.Config.ResolvePath(s.Config.Webroot)
+		s.Log(2, "Serving files from %s", webrootPath)
+		webroot = noListingFileSystem{http.Dir(webrootPath)}
+		fileServer = http.FileServer(webroot)
+	}
+
+	s.HttpRouter.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if fileServer != nil && !strings.HasPrefix(r.URL.Path, "/webirc/") {
+			if f, err := webroot.Open(path.Clean("/" + r.URL.Path)); err == nil {
+				f.Close()
+				if !s.oidcAuth.RequireLogin(w, r) {
+					return
+				}
+				fileServer.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		s.serveNotFound(w, r)
+	})
+}
+
+func (s *Gateway) serveNotFound(w http.ResponseWriter, r *http.Request) {
+	// Embedders talking to the gateway API expect JSON, never a HTML page
+	if strings.HasPrefix(r.URL.Path, "/webirc/") {
+		out, _ := json.Marshal(map[string]interface{}{
+			"error": "not_found",
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(404)
+		w.Write(out)
+		return
+	}
+
+	if s.Config.NotFoundRedirect != "" {
+		http.Redirect(w, r, s.Config.NotFoundRedirect, http.StatusFound)
+		return
+	}
+
+	if s.Config.NotFoundPage != "" {
+		page, err := ioutil.ReadFile(s.Config.NotFoundPage)
+		if err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(404)
+			w.Write(page)
+			return
+		}
+		s.Log(3, "Error reading not_found page: %s", err.Error())
+	}
+
+	http.NotFound(w, r)
+}
+
+// noListingFileSystem - A http.FileSystem that refuses to open directories without an
+// index.html so that directory listings are never served
+type noListingFileSystem struct {
+	fs http.FileSystem
+}
+
+func (nfs noListingFileSystem) Open(name string) (http.File, error) {
+	f, err := nfs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if stat.IsDir() {
+		index, err := nfs.fs.Open(strings.TrimSuffix(name, "/") + "/index.html")
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+
+	return f, nil
+}
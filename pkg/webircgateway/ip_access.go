@@ -0,0 +1,174 @@
+package webircgateway
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the ip_access file is checked for changes
+const ipAccessCheckInterval = time.Second * 10
+
+// IPAccess - Decides which addresses may connect from the [ip_access.allow] and [ip_access.deny]
+// ranges, along with those in the [ip_access] file. The file is read again when it changes or the
+// config is reloaded so that bans can be added without a restart
+type IPAccess struct {
+	gateway   *Gateway
+	mu        sync.Mutex
+	file      string
+	modTime   time.Time
+	lastCheck time.Time
+	allow     []net.IPNet
+	deny      []net.IPNet
+}
+
+func NewIPAccess(gateway *Gateway) *IPAccess {
+	return &IPAccess{gateway: gateway}
+}
+
+// Allowed - If an address may connect. Allowed ranges take priority over denied ranges, and
+// addresses in neither are allowed unless the [ip_access] default is deny
+func (a *IPAccess) Allowed(ip net.IP) bool {
+	cfg := a.gateway.Config
+	if ip == nil {
+		return true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.checkFile()
+
+	if ipInRanges(ip, cfg.IPAccessAllow) || ipInRanges(ip, a.allow) {
+		return true
+	}
+	if ipInRanges(ip, cfg.IPAccessDeny) || ipInRanges(ip, a.deny) {
+		return false
+	}
+
+	return cfg.IPAccessDefault != "deny"
+}
+
+// Load - Read the ip_access file again
+func (a *IPAccess) Load() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.load()
+}
+
+// checkFile - Load the file if it has changed since last checked. a.mu must be held
+func (a *IPAccess) checkFile() {
+	file := a.gateway.Config.IPAccessFile
+	if file == a.file && time.Since(a.lastCheck) < ipAccessCheckInterval {
+		return
+	}
+	a.lastCheck = time.Now()
+
+	if file != a.file || !fileModTime(file).Equal(a.modTime) {
+		a.load()
+	}
+}
+
+// load - a.mu must be held
+func (a *IPAccess) load() {
+	file := a.gateway.Config.IPAccessFile
+	a.file = file
+	a.lastCheck = time.Now()
+
+	if file == "" {
+		a.allow = nil
+		a.deny = nil
+		a.modTime = time.Time{}
+		return
+	}
+
+	modTime := fileModTime(file)
+	allow, deny, err := readIPAccessFile(file)
+	if err != nil {
+		a.gateway.Log(3, "Error reading ip_access file %s, using the previous entries: %s", file, err.Error())
+		return
+	}
+
+	a.allow = allow
+	a.deny = deny
+	a.modTime = modTime
+	a.gateway.Log(2, "Loaded %d allowed and %d denied ranges from %s", len(allow), len(deny), file)
+}
+
+// readIPAccessFile - Ranges from a file with one per line, as "allow <range>" or "deny <range>". A
+// range on its own is denied. Blank lines and those starting with # are ignored
+func readIPAccessFile(file string) (allow []net.IPNet, deny []net.IPNet, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		action := "deny"
+		if len(fields) == 2 {
+			action = strings.ToLower(fields[0])
+			fields = fields[1:]
+		}
+		ipRange, rangeErr := parseIPRange(fields[0])
+		if len(fields) != 1 || rangeErr != nil || (action != "allow" && action != "deny") {
+			return nil, nil, fmt.Errorf("invalid entry on line %d: %s", lineNum, line)
+		}
+
+		if action == "allow" {
+			allow = append(allow, *ipRange)
+		} else {
+			deny = append(deny, *ipRange)
+		}
+	}
+
+	return allow, deny, scanner.Err()
+}
+
+// parseIPRange - A CIDR range, or a single IPv4 or IPv6 address
+func parseIPRange(val string) (*net.IPNet, error) {
+	if !strings.Contains(val, "/") {
+		ip := net.ParseIP(val)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %s", val)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, ipRange, err := net.ParseCIDR(val)
+	return ipRange, err
+}
+
+func ipInRanges(ip net.IP, ranges []net.IPNet) bool {
+	for _, ipRange := range ranges {
+		if ipRange.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func fileModTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
@@ -0,0 +1,102 @@
+package webircgateway
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// IPLimits - Counts the clients connected from each IP address so that [limits]
+// max_clients_per_ip stops a single machine taking up the gateway. IPv6 addresses are grouped by
+// their prefix as with the connection rate limit, and addresses in [limits.ip_exempt], eg. known
+// shared NATs, aren't limited
+type IPLimits struct {
+	gateway *Gateway
+	mu      sync.Mutex
+	clients map[string]int
+}
+
+func NewIPLimits(gateway *Gateway) *IPLimits {
+	return &IPLimits{
+		gateway: gateway,
+		clients: make(map[string]int),
+	}
+}
+
+// key - The address group ip is counted in. Empty if it isn't limited
+func (l *IPLimits) key(ip net.IP) string {
+	cfg := l.gateway.Config
+	if cfg.MaxClientsPerIP <= 0 || ip == nil {
+		return ""
+	}
+
+	for _, cidrRange := range cfg.MaxClientsPerIPExempt {
+		if cidrRange.Contains(ip) {
+			return ""
+		}
+	}
+
+	return connRateKey(ip, cfg.MaxClientsIPv6Prefix)
+}
+
+// Add - Count the client against its address. Returns false, without counting it, if its address
+// already has max_clients_per_ip clients
+func (l *IPLimits) Add(c *Client) bool {
+	key := l.key(net.ParseIP(c.RemoteAddr))
+	if key == "" {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c.ipLimitKey != "" {
+		return true
+	}
+	if l.clients[key] >= l.gateway.Config.MaxClientsPerIP {
+		return false
+	}
+	l.clients[key]++
+	c.ipLimitKey = key
+	return true
+}
+
+func (l *IPLimits) Remove(c *Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c.ipLimitKey == "" {
+		return
+	}
+	l.clients[c.ipLimitKey]--
+	if l.clients[c.ipLimitKey] <= 0 {
+		delete(l.clients, c.ipLimitKey)
+	}
+	c.ipLimitKey = ""
+}
+
+// Full - If ip already has max_clients_per_ip clients
+func (l *IPLimits) Full(ip net.IP) bool {
+	key := l.key(ip)
+	if key == "" {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.clients[key] >= l.gateway.Config.MaxClientsPerIP
+}
+
+// RejectHandshake - Respond with a 429 if the request's address already has max_clients_per_ip
+// clients, before starting another. Returns true if the request has been rejected
+func (l *IPLimits) RejectHandshake(w http.ResponseWriter, req *http.Request) bool {
+	ip := l.gateway.GetRemoteAddressFromRequest(req)
+	if !l.Full(ip) {
+		return false
+	}
+
+	l.gateway.LogEvent(2, "client.ip_limited", "Connection from %s refused, too many clients from the address", ip.String())
+	l.gateway.logRejection(ip.String(), "ip_limited")
+	http.Error(w, "Too many connections from your address", http.StatusTooManyRequests)
+	return true
+}
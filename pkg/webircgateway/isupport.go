@@ -0,0 +1,69 @@
+package webircgateway
+
+import (
+	"strings"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// isupportTokenName - The uppercased name of an ISUPPORT token, without its value or the - prefix
+// used to negate it
+func isupportTokenName(token string) string {
+	name := strings.TrimPrefix(token, "-")
+	if pos := strings.Index(name, "="); pos > -1 {
+		name = name[:pos]
+	}
+
+	return strings.ToUpper(name)
+}
+
+// rewriteISupport - Apply the upstreams isupport_set and isupport_remove options to a 005 line.
+// Tokens being set are removed wherever the upstream sends them and are added to the first 005
+// line instead, so that each is only sent once however many lines the upstream uses. Returns
+// false if no tokens are left and the line should be dropped
+func (c *Client) rewriteISupport(m *irc.Message) bool {
+	upstream := c.UpstreamConfig
+	if len(m.Params) < 2 {
+		return true
+	}
+
+	// :server 005 nick TOKEN TOKEN=value :are supported by this server
+	tokensEnd := len(m.Params)
+	trailer := ""
+	if strings.Contains(m.Params[tokensEnd-1], " ") {
+		tokensEnd--
+		trailer = m.Params[tokensEnd]
+	}
+
+	replaced := make(map[string]bool)
+	for _, name := range upstream.ISupportRemove {
+		replaced[name] = true
+	}
+	for _, token := range upstream.ISupportSet {
+		replaced[isupportTokenName(token)] = true
+	}
+
+	tokens := []string{}
+	for _, token := range m.Params[1:tokensEnd] {
+		if !replaced[isupportTokenName(token)] {
+			tokens = append(tokens, token)
+		}
+	}
+
+	if !c.isupportSet {
+		c.isupportSet = true
+		tokens = append(tokens, upstream.ISupportSet...)
+	}
+
+	if len(tokens) == 0 {
+		return false
+	}
+
+	params := append([]string{m.Params[0]}, tokens...)
+	if trailer != "" {
+		params = append(params, trailer)
+	}
+	m.Params = params
+
+	return true
+}
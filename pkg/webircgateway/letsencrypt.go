@@ -2,22 +2,44 @@ package webircgateway
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
+// Certificates requested within this time are never evicted
+const leCertInUse = time.Minute * 10
+
 type LEManager struct {
 	// ensure only one instance of the manager and handler is running
 	// while allowing multiple listeners to use it
 	Mutex   sync.Mutex
 	Manager *autocert.Manager
 	gateway *Gateway
+	// The cache directory and the last time each cached hostname had a certificate requested
+	cacheDir string
+	lastUsed map[string]time.Time
+	// Stops the ACME client of the current manager once it has been replaced
+	retired *int32
+	// 1 while an eviction started by going over max_certs is running
+	evicting int32
 }
 
 func NewLetsEncryptManager(gateway *Gateway) *LEManager {
-	return &LEManager{gateway: gateway}
+	return &LEManager{
+		gateway:  gateway,
+		lastUsed: make(map[string]time.Time),
+	}
 }
 
 func (le *LEManager) Get(certCacheDir string) *autocert.Manager {
@@ -26,16 +48,188 @@ func (le *LEManager) Get(certCacheDir string) *autocert.Manager {
 
 	// Create it if it doesn't already exist
 	if le.Manager == nil {
-		le.Manager = &autocert.Manager{
-			Prompt: autocert.AcceptTOS,
-			Cache:  autocert.DirCache(strings.TrimRight(certCacheDir, "/")),
-			HostPolicy: func(ctx context.Context, host string) error {
-				le.gateway.Log(2, "Automatically requesting a HTTPS certificate for %s", host)
-				return nil
-			},
-		}
-		le.gateway.HttpRouter.Handle("/.well-known/", le.Manager.HTTPHandler(nil))
+		le.cacheDir = strings.TrimRight(certCacheDir, "/")
+		le.loadCachedHosts()
+		le.Manager = le.newManager()
+		le.gateway.HttpRouter.HandleFunc("/.well-known/", func(w http.ResponseWriter, r *http.Request) {
+			le.Mutex.Lock()
+			manager := le.Manager
+			le.Mutex.Unlock()
+			manager.HTTPHandler(nil).ServeHTTP(w, r)
+		})
+		go le.evictLoop()
 	}
 
 	return le.Manager
 }
+
+func (le *LEManager) newManager() *autocert.Manager {
+	retired := int32(0)
+	le.retired = &retired
+
+	return &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  leCache{DirCache: autocert.DirCache(le.cacheDir), le: le},
+		HostPolicy: func(ctx context.Context, host string) error {
+			le.gateway.Log(2, "Automatically requesting a HTTPS certificate for %s", host)
+			return nil
+		},
+		// autocert keeps renewing every certificate it has loaded. Once a manager has been
+		// replaced its client refuses to make requests so that evicted certificates stop renewing
+		Client: &acme.Client{
+			DirectoryURL: autocert.DefaultACMEDirectory,
+			HTTPClient:   &http.Client{Transport: leRetirableTransport{retired: &retired}},
+		},
+	}
+}
+
+// GetCertificate - Used as the tls.Config GetCertificate so that certificates are served from
+// the current manager, and so that the time each hostname was last requested is known
+func (le *LEManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	le.Mutex.Lock()
+	manager := le.Manager
+	le.Mutex.Unlock()
+
+	cert, err := manager.GetCertificate(hello)
+	if err == nil {
+		le.touch(hello.ServerName)
+	}
+
+	return cert, err
+}
+
+// CacheSize - The number of hostnames with a cached certificate
+func (le *LEManager) CacheSize() int {
+	le.Mutex.Lock()
+	defer le.Mutex.Unlock()
+	return len(le.lastUsed)
+}
+
+func (le *LEManager) touch(host string) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return
+	}
+
+	le.Mutex.Lock()
+	le.lastUsed[host] = time.Now()
+	overLimit := le.gateway.Config.LetsEncryptMaxCerts > 0 && len(le.lastUsed) > le.gateway.Config.LetsEncryptMaxCerts
+	le.Mutex.Unlock()
+
+	// Every handshake while over the limit would start another
+	if overLimit && atomic.CompareAndSwapInt32(&le.evicting, 0, 1) {
+		go func() {
+			le.evict()
+			atomic.StoreInt32(&le.evicting, 0)
+		}()
+	}
+}
+
+// loadCachedHosts - Find hostnames that already have certificates in the cache directory. Their
+// last use is unknown so assume it was when the certificate was last written
+func (le *LEManager) loadCachedHosts() {
+	files, err := ioutil.ReadDir(le.cacheDir)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		host := leCertHost(file.Name())
+		if host == "" || file.IsDir() {
+			continue
+		}
+		if file.ModTime().After(le.lastUsed[host]) {
+			le.lastUsed[host] = file.ModTime()
+		}
+	}
+}
+
+func (le *LEManager) evictLoop() {
+	for {
+		time.Sleep(time.Hour)
+		le.evict()
+	}
+}
+
+// evict - Remove certificates for hostnames that have not been requested for too long, then the
+// least recently requested while there are too many. The manager is replaced afterwards so that
+// it forgets the evicted certificates. If one is needed again it is requested again.
+func (le *LEManager) evict() {
+	le.Mutex.Lock()
+	defer le.Mutex.Unlock()
+
+	maxCerts := le.gateway.Config.LetsEncryptMaxCerts
+	maxIdle := time.Duration(le.gateway.Config.LetsEncryptMaxIdleDays) * time.Hour * 24
+	now := time.Now()
+
+	hosts := make([]string, 0, len(le.lastUsed))
+	for host := range le.lastUsed {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return le.lastUsed[hosts[i]].Before(le.lastUsed[hosts[j]])
+	})
+
+	evicted := 0
+	for _, host := range hosts {
+		idle := now.Sub(le.lastUsed[host])
+		tooOld := maxIdle > 0 && idle > maxIdle
+		tooMany := maxCerts > 0 && len(le.lastUsed) > maxCerts
+		if idle < leCertInUse || (!tooOld && !tooMany) {
+			continue
+		}
+
+		le.gateway.Log(2, "Evicting the HTTPS certificate for %s, last requested %s ago", host, idle.Round(time.Second))
+		cache := autocert.DirCache(le.cacheDir)
+		cache.Delete(context.Background(), host)
+		cache.Delete(context.Background(), host+"+rsa")
+		delete(le.lastUsed, host)
+		evicted++
+	}
+
+	if evicted > 0 && le.Manager != nil {
+		atomic.StoreInt32(le.retired, 1)
+		le.Manager = le.newManager()
+	}
+}
+
+// leCertHost - The hostname of a certificate cache key, or an empty string if the key is not for
+// a certificate (account keys and challenge tokens)
+func leCertHost(key string) string {
+	if strings.HasPrefix(key, "acme_account") || strings.HasSuffix(key, "+token") || strings.HasSuffix(key, "+http-01") {
+		return ""
+	}
+
+	return strings.TrimSuffix(filepath.Base(key), "+rsa")
+}
+
+// leCache - The certificate cache directory, keeping track of which hostnames have certificates
+type leCache struct {
+	autocert.DirCache
+	le *LEManager
+}
+
+func (c leCache) Put(ctx context.Context, key string, data []byte) error {
+	err := c.DirCache.Put(ctx, key, data)
+	if host := leCertHost(key); err == nil && host != "" {
+		c.le.Mutex.Lock()
+		if _, exists := c.le.lastUsed[host]; !exists {
+			c.le.lastUsed[host] = time.Now()
+		}
+		c.le.Mutex.Unlock()
+	}
+
+	return err
+}
+
+type leRetirableTransport struct {
+	retired *int32
+}
+
+func (t leRetirableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadInt32(t.retired) == 1 {
+		return nil, errors.New("letsencrypt manager has been replaced")
+	}
+
+	return http.DefaultTransport.RoundTrip(req)
+}
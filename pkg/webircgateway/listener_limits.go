@@ -0,0 +1,121 @@
+package webircgateway
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+type listenerContextKey struct{}
+
+// ListenerLimits - Counts the clients connected through each listener so that servers with
+// max_clients set can refuse new connections once full
+type ListenerLimits struct {
+	gateway *Gateway
+	mu      sync.Mutex
+	clients map[string]int
+	full    map[string]bool
+}
+
+func NewListenerLimits(gateway *Gateway) *ListenerLimits {
+	return &ListenerLimits{
+		gateway: gateway,
+		clients: make(map[string]int),
+		full:    make(map[string]bool),
+	}
+}
+
+func (l *ListenerLimits) Add(listener string) {
+	l.mu.Lock()
+	l.clients[listener]++
+	l.mu.Unlock()
+}
+
+func (l *ListenerLimits) Remove(listener string) {
+	l.mu.Lock()
+	l.clients[listener]--
+	if l.clients[listener] <= 0 {
+		delete(l.clients, listener)
+	}
+	l.mu.Unlock()
+}
+
+func (l *ListenerLimits) Count(listener string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.clients[listener]
+}
+
+// allow - If the listener may accept another connection. Logs when the listener becomes full and
+// when it starts accepting again
+func (l *ListenerLimits) allow(conf ConfigServer) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := l.clients[conf.sectionName]
+	allowed := count < conf.MaxClients
+
+	if !allowed && !l.full[conf.sectionName] {
+		l.full[conf.sectionName] = true
+		l.gateway.Log(3, "Listener %s is full with %d clients. Refusing new connections on it", conf.sectionName, count)
+	} else if allowed && l.full[conf.sectionName] {
+		delete(l.full, conf.sectionName)
+		l.gateway.Log(2, "Listener %s is accepting new connections again", conf.sectionName)
+	}
+
+	return allowed
+}
+
+// maybeLimitListener - If the server has max_clients set, refuse connections as they are accepted
+// while it has that many clients. Other listeners are not affected
+func (s *Gateway) maybeLimitListener(listener net.Listener, conf ConfigServer) net.Listener {
+	if conf.MaxClients <= 0 {
+		return listener
+	}
+
+	return &limitedListener{Listener: listener, gateway: s, conf: conf}
+}
+
+type limitedListener struct {
+	net.Listener
+	gateway *Gateway
+	conf    ConfigServer
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.gateway.listenerLimits.allow(l.conf) {
+			return conn, err
+		}
+
+		l.gateway.Log(1, "Listener %s refused a connection from %s, max_clients reached", l.conf.sectionName, conn.RemoteAddr().String())
+		conn.Close()
+	}
+}
+
+// listenerBaseContext - Used as a http.Server BaseContext so that clients created by its
+// requests know which listener they connected through
+func listenerBaseContext(conf ConfigServer) func(net.Listener) context.Context {
+	return func(net.Listener) context.Context {
+		return context.WithValue(context.Background(), listenerContextKey{}, conf.sectionName)
+	}
+}
+
+// listenerFromRequest - The name of the listener a HTTP request was received on
+func listenerFromRequest(req *http.Request) string {
+	listener, _ := req.Context().Value(listenerContextKey{}).(string)
+	return listener
+}
+
+// listenerConfig - The config of the [server.*] block a listener was started for
+func (s *Gateway) listenerConfig(listener string) (ConfigServer, bool) {
+	for _, conf := range s.Config.servers() {
+		if conf.sectionName == listener {
+			return conf, true
+		}
+	}
+
+	return ConfigServer{}, false
+}
@@ -0,0 +1,218 @@
+package webircgateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemd passes sockets starting at file descriptor 3
+const systemdListenFdsStart = 3
+
+// listen - Open the listeners for a server, or take them over from the process that upgraded to
+// this one. There is one unless the server has reuse_port and listeners set. They are kept so
+// that they can be passed on to the next process when upgrading
+func (s *Gateway) listen(conf ConfigServer, addr string) ([]net.Listener, error) {
+	listeners := []net.Listener{}
+	for i := 0; i < conf.Listeners || i == 0; i++ {
+		// Each listener sharing the address is passed on separately when upgrading
+		key := addr
+		if i > 0 {
+			key = fmt.Sprintf("%s#%d", addr, i+1)
+		}
+
+		listener := s.takeUpgradeListener(key)
+		if listener == nil {
+			var err error
+			listener, err = openListener(conf, addr)
+			if err != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+				return nil, err
+			}
+		}
+
+		s.httpSrvsMu.Lock()
+		s.handoffListeners[key] = listener
+		s.httpSrvsMu.Unlock()
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+// listenUnix - Create the socket file of a unix: server, or take its listener over from the
+// process that upgraded to this one. Kept so that it can be passed on when upgrading
+func (s *Gateway) listenUnix(conf ConfigServer, socketFile string) (net.Listener, error) {
+	key := serverListenAddr(conf)
+	listener := s.takeUpgradeListener(key)
+	if listener == nil {
+		os.Remove(socketFile)
+		var err error
+		listener, err = net.Listen("unix", socketFile)
+		if err != nil {
+			return nil, err
+		}
+		os.Chmod(socketFile, conf.BindMode)
+	}
+
+	s.httpSrvsMu.Lock()
+	s.handoffListeners[key] = listener
+	s.httpSrvsMu.Unlock()
+
+	return listener, nil
+}
+
+// serveListeners - Call serve for each listener of a server, returning the error of the first to
+// stop
+func serveListeners(listeners []net.Listener, serve func(net.Listener) error) error {
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- serve(listener)
+		}(listener)
+	}
+
+	return <-errs
+}
+
+// takeUpgradeListener - The listener for addr passed from the process that upgraded to this
+// one, if any. Each is only given out once
+func (s *Gateway) takeUpgradeListener(addr string) net.Listener {
+	s.httpSrvsMu.Lock()
+	defer s.httpSrvsMu.Unlock()
+
+	listener := s.upgradeListeners[addr]
+	delete(s.upgradeListeners, addr)
+	return listener
+}
+
+// serverListenAddr - The address a server listens on, also used to match its listener up when
+// upgrading
+func serverListenAddr(conf ConfigServer) string {
+	if isInheritedListener(conf) {
+		return conf.LocalAddr
+	}
+	if strings.HasPrefix(strings.ToLower(conf.LocalAddr), "tcp:") {
+		return conf.LocalAddr[4:] + ":" + strconv.Itoa(conf.Port)
+	}
+	if strings.HasPrefix(strings.ToLower(conf.LocalAddr), "grpc:") {
+		return conf.LocalAddr[5:] + ":" + strconv.Itoa(conf.Port)
+	}
+
+	return fmt.Sprintf("%s:%d", conf.LocalAddr, conf.Port)
+}
+
+// openListener - Bind the address for a server. The bind address may be "fd:N" or "systemd:name"
+// to use a socket passed in by systemd socket activation instead of binding a port ourselves
+func openListener(conf ConfigServer, addr string) (net.Listener, error) {
+	bind := conf.LocalAddr
+
+	if strings.HasPrefix(strings.ToLower(bind), "fd:") {
+		fd, err := strconv.Atoi(bind[3:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid file descriptor '%s'", bind)
+		}
+		return listenOnFd(fd, bind)
+	}
+
+	if strings.HasPrefix(strings.ToLower(bind), "systemd:") {
+		fds, err := systemdListenFds()
+		if err != nil {
+			return nil, err
+		}
+		fd, exists := fds[bind[8:]]
+		if !exists {
+			return nil, fmt.Errorf("No socket named '%s' was passed from systemd", bind[8:])
+		}
+		return listenOnFd(fd, bind)
+	}
+
+	if conf.ReusePort {
+		listenConfig := net.ListenConfig{Control: setReusePort}
+		return listenConfig.Listen(context.Background(), "tcp", addr)
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// isInheritedListener - True if the server uses a socket passed in from systemd
+func isInheritedListener(conf ConfigServer) bool {
+	bind := strings.ToLower(conf.LocalAddr)
+	return strings.HasPrefix(bind, "fd:") || strings.HasPrefix(bind, "systemd:")
+}
+
+// checkInheritedListeners - Make sure that every fd:N or systemd:name server has a matching socket
+func (s *Gateway) checkInheritedListeners() {
+	for _, conf := range s.Config.Servers {
+		if !isInheritedListener(conf) {
+			continue
+		}
+
+		// Taken over from the previous process, which may have had it from systemd
+		s.httpSrvsMu.Lock()
+		_, upgraded := s.upgradeListeners[conf.LocalAddr]
+		s.httpSrvsMu.Unlock()
+		if upgraded {
+			continue
+		}
+
+		fds, err := systemdListenFds()
+		if err != nil {
+			s.Log(3, "Server %s: %s", conf.LocalAddr, err.Error())
+			continue
+		}
+
+		if strings.HasPrefix(strings.ToLower(conf.LocalAddr), "systemd:") {
+			if _, exists := fds[conf.LocalAddr[8:]]; !exists {
+				s.Log(3, "Server %s: systemd did not pass a socket with this name", conf.LocalAddr)
+			}
+			continue
+		}
+
+		if _, exists := fds[conf.LocalAddr[3:]]; !exists {
+			s.Log(3, "Server %s: systemd did not pass this file descriptor (LISTEN_FDS=%s)", conf.LocalAddr, os.Getenv("LISTEN_FDS"))
+		}
+	}
+}
+
+// systemdListenFds - The sockets passed in by systemd, keyed by both name and fd number
+func systemdListenFds() (map[string]int, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("No sockets were passed from systemd (LISTEN_PID)")
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("No sockets were passed from systemd (LISTEN_FDS)")
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	fds := make(map[string]int)
+	for i := 0; i < count; i++ {
+		fd := systemdListenFdsStart + i
+		fds[strconv.Itoa(fd)] = fd
+		if i < len(names) && names[i] != "" {
+			fds[names[i]] = fd
+		}
+	}
+
+	return fds, nil
+}
+
+func listenOnFd(fd int, name string) (net.Listener, error) {
+	file := os.NewFile(uintptr(fd), name)
+	if file == nil {
+		return nil, fmt.Errorf("Invalid file descriptor %d", fd)
+	}
+	// FileListener duplicates the file descriptor so the original can be closed
+	defer file.Close()
+
+	return net.FileListener(file)
+}
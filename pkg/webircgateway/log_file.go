@@ -0,0 +1,51 @@
+package webircgateway
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogFile - Writes log entries to the file set in [log_file], rotating it by size and age
+type LogFile struct {
+	mu   sync.Mutex
+	file rotatingFile
+	// Set after a failed write so that the error is only reported once
+	failed bool
+}
+
+func NewLogFile() *LogFile {
+	return &LogFile{}
+}
+
+// Write - Append an entry to the log file if enabled. Errors are written to stderr as logging
+// them would send them straight back here
+func (l *LogFile) Write(cfg *Config, entry LogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cfg.LogFile == "" {
+		l.file.Close()
+		return
+	}
+
+	line := entry.Time.Format("2006/01/02 15:04:05.000000") + " " + entry.String() + "\n"
+	if cfg.LogFormat == "json" {
+		line = string(entry.JSON()) + "\n"
+	}
+
+	maxAge := time.Hour * time.Duration(cfg.LogFileMaxAge)
+	err := l.file.Write(cfg.LogFile, line, cfg.LogFileMaxSize*1024*1024, maxAge, cfg.LogFileMaxFiles)
+	if err != nil && !l.failed {
+		fmt.Fprintf(os.Stderr, "Error writing log file: %s\n", err.Error())
+	}
+	l.failed = err != nil
+}
+
+// Reopen - Close the log file so that it is opened again on the next write
+func (l *LogFile) Reopen() {
+	l.mu.Lock()
+	l.file.Close()
+	l.mu.Unlock()
+}
@@ -0,0 +1,118 @@
+package webircgateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var logLevelNames = [...]string{"debug", "info", "warn"}
+
+// LogEntry - A single log message along with the context it was logged in. Fields that don't apply
+// to the message are left empty
+type LogEntry struct {
+	Time     time.Time
+	Level    int
+	ClientID uint64
+	// Upstream - The address of the upstream the client is using, if connected
+	Upstream string
+	// Event - A fixed name for notable events so that they can be found without matching the
+	// message text, eg. client.connected
+	Event   string
+	Message string
+}
+
+// String - The entry in the plain text log format. The time is left to the output
+func (e LogEntry) String() string {
+	return "L_" + strings.ToUpper(logLevelNames[e.Level-1]) + " " + e.Text()
+}
+
+// Text - The message and the client it is for, without the level
+func (e LogEntry) Text() string {
+	if e.ClientID > 0 {
+		return fmt.Sprintf("client:%d %s", e.ClientID, e.Message)
+	}
+
+	return e.Message
+}
+
+// JSON - The entry as a single line of JSON
+func (e LogEntry) JSON() []byte {
+	out, _ := json.Marshal(struct {
+		Time     string `json:"time"`
+		Level    string `json:"level"`
+		ClientID uint64 `json:"client_id,omitempty"`
+		Upstream string `json:"upstream,omitempty"`
+		Event    string `json:"event,omitempty"`
+		Message  string `json:"message"`
+	}{
+		Time:     e.Time.UTC().Format(time.RFC3339Nano),
+		Level:    logLevelNames[e.Level-1],
+		ClientID: e.ClientID,
+		Upstream: e.Upstream,
+		Event:    e.Event,
+		Message:  e.Message,
+	})
+
+	return out
+}
+
+// ReopenLogFiles - Reopen the log file and debug capture file, eg. after logrotate has moved them
+func (s *Gateway) ReopenLogFiles() {
+	s.logFile.Reopen()
+	s.rejectionLog.Reopen()
+	s.debugCapture.Reopen()
+}
+
+func (s *Gateway) Log(level int, format string, args ...interface{}) {
+	s.logEntry(LogEntry{Level: level, Message: fmt.Sprintf(format, args...)})
+}
+
+// LogEvent - Log a notable event, named so that it can be found in structured logs
+func (s *Gateway) LogEvent(level int, event string, format string, args ...interface{}) {
+	s.logEntry(LogEntry{Level: level, Event: event, Message: fmt.Sprintf(format, args...)})
+}
+
+func (s *Gateway) logEntry(entry LogEntry) {
+	// Warnings are reported as problems instead while checking the config
+	if s.checkingConfig {
+		if entry.Level >= 3 {
+			s.configProblems = append(s.configProblems, entry.Message)
+		}
+		return
+	}
+
+	if entry.Level < s.Config.LogLevel {
+		return
+	}
+
+	entry.Time = time.Now()
+	s.syslog.Write(s.Config, entry)
+	s.logFile.Write(s.Config, entry)
+	s.LogOutput <- entry
+}
+
+// Log - Log a line of text with context of this client
+func (c *Client) Log(level int, format string, args ...interface{}) {
+	c.LogEvent(level, "", format, args...)
+}
+
+// LogEvent - Log a notable event for this client, named so that it can be found in structured logs
+func (c *Client) LogEvent(level int, event string, format string, args ...interface{}) {
+	if level < c.Gateway.Config.LogLevel {
+		return
+	}
+
+	entry := LogEntry{
+		Level:    level,
+		ClientID: c.Id,
+		Event:    event,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	if c.UpstreamConfig != nil && c.UpstreamConfig.Hostname != "" {
+		entry.Upstream = upstreamAddrKey(*c.UpstreamConfig)
+	}
+
+	c.Gateway.logEntry(entry)
+}
@@ -0,0 +1,136 @@
+package webircgateway
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// quicServer - Listens on the UDP port of a TLS server for the transports served over QUIC,
+// handing each connection to the transport for the protocol it negotiated with ALPN
+type quicServer struct {
+	gateway   *Gateway
+	conf      ConfigServer
+	transport *quic.Transport
+	listener  *quic.EarlyListener
+	// webtransport - Serves connections that negotiated h3, if the webtransport transport is enabled
+	webtransport *webtransport.Server
+	// irc - Serves connections that negotiated one of the [quic] alpn protocols, if the quic
+	// transport is enabled
+	irc *TransportQuic
+	// sessions - Open sessions, which keep the UDP socket open after the server has been stopped
+	sessions int
+	stopped  bool
+	mu       sync.Mutex
+}
+
+// maybeStartQuic - Serve the transports that are served over QUIC on the same port as a TLS
+// server, if any of them are enabled
+func (s *Gateway) maybeStartQuic(server *runningServer, addr string, tlsConfig *tls.Config) {
+	q := &quicServer{gateway: s, conf: server.conf}
+
+	tlsConf := tlsConfig.Clone()
+	tlsConf.NextProtos = []string{}
+	if stringInSlice("webtransport", s.Config.ServerTransports) {
+		q.webtransport = s.newWebtransportServer(q)
+		tlsConf.NextProtos = append(tlsConf.NextProtos, http3.NextProtoH3)
+	}
+	if stringInSlice("quic", s.Config.ServerTransports) {
+		q.irc = &TransportQuic{}
+		q.irc.Init(s)
+		tlsConf.NextProtos = append(tlsConf.NextProtos, s.Config.QuicAlpn...)
+	}
+	if len(tlsConf.NextProtos) == 0 {
+		return
+	}
+
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		s.Log(3, "Failed to listen for QUIC: %s", err.Error())
+		return
+	}
+
+	q.transport = &quic.Transport{Conn: udpConn}
+	q.listener, err = q.transport.ListenEarly(tlsConf, &quic.Config{
+		EnableDatagrams: q.webtransport != nil,
+		Allow0RTT:       s.Config.QuicAllow0RTT,
+	})
+	if err != nil {
+		s.Log(3, "Failed to listen for QUIC: %s", err.Error())
+		udpConn.Close()
+		return
+	}
+
+	if !server.trackQuic(q) {
+		return
+	}
+	s.httpSrvsMu.Lock()
+	s.quicSrvs = append(s.quicSrvs, q)
+	s.httpSrvsMu.Unlock()
+
+	s.Log(2, "Listening for QUIC (%s) on udp %s", strings.Join(tlsConf.NextProtos, ", "), addr)
+	for {
+		conn, err := q.listener.Accept(context.Background())
+		if err != nil {
+			break
+		}
+
+		if conn.ConnectionState().TLS.NegotiatedProtocol == http3.NextProtoH3 {
+			go q.webtransport.ServeQUICConn(conn)
+			continue
+		}
+
+		q.sessionStarted()
+		go func() {
+			defer q.sessionEnded()
+			q.irc.handleConn(conn, q)
+		}()
+	}
+}
+
+// Stop - Stop accepting new connections. The UDP socket is closed once the open sessions end
+func (q *quicServer) Stop() {
+	q.listener.Close()
+
+	q.mu.Lock()
+	q.stopped = true
+	idle := q.sessions == 0
+	q.mu.Unlock()
+
+	if idle {
+		q.Close()
+	}
+}
+
+// Close - Close the server and all of its connections
+func (q *quicServer) Close() {
+	q.listener.Close()
+	if q.webtransport != nil {
+		q.webtransport.Close()
+	}
+	q.transport.Close()
+}
+
+func (q *quicServer) sessionStarted() {
+	q.mu.Lock()
+	q.sessions++
+	q.mu.Unlock()
+}
+
+func (q *quicServer) sessionEnded() {
+	q.mu.Lock()
+	q.sessions--
+	idle := q.stopped && q.sessions == 0
+	q.mu.Unlock()
+
+	// Closing waits for the handlers, including the one this may be called from
+	if idle {
+		go q.Close()
+	}
+}
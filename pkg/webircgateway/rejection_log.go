@@ -0,0 +1,75 @@
+package webircgateway
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client close reasons that are logged as rejections, and the reason they are logged with
+var clientRejectionReasons = map[string]string{
+	"ip_denied":           "ip_denied",
+	"geoip_denied":        "geoip_denied",
+	"reputation_rejected": "reputation_rejected",
+	"dnsbl":               "dnsbl_listed",
+	"unverifed":           "captcha_failed",
+	"excess_flood":        "excess_flood",
+	"forced_kill":         "killed",
+	"admin_disconnect":    "admin_disconnect",
+}
+
+// RejectionLog - Writes a line to the [rejection_log] file for every connection that is refused
+// or disconnected for breaking a rule. The format is kept the same between versions so that tools
+// such as fail2ban and crowdsec can match it, eg:
+//
+//	2006-01-02T15:04:05Z webircgateway rejected ip=192.0.2.1 reason=rate_limited
+type RejectionLog struct {
+	mu   sync.Mutex
+	file rotatingFile
+	// Set after a failed write so that the error is only reported once
+	failed bool
+}
+
+func NewRejectionLog() *RejectionLog {
+	return &RejectionLog{}
+}
+
+// Write - Append a rejection to the file if enabled
+func (l *RejectionLog) Write(cfg *Config, ip string, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cfg.RejectionLogFile == "" {
+		l.file.Close()
+		return
+	}
+
+	line := fmt.Sprintf("%s webircgateway rejected ip=%s reason=%s\n", time.Now().UTC().Format(time.RFC3339), ip, reason)
+	err := l.file.Write(cfg.RejectionLogFile, line, cfg.RejectionLogMaxSize*1024*1024, 0, cfg.RejectionLogMaxFiles)
+	if err != nil && !l.failed {
+		fmt.Fprintf(os.Stderr, "Error writing rejection log file: %s\n", err.Error())
+	}
+	l.failed = err != nil
+}
+
+// Reopen - Close the file so that it is opened again on the next write
+func (l *RejectionLog) Reopen() {
+	l.mu.Lock()
+	l.file.Close()
+	l.mu.Unlock()
+}
+
+// logRejection - Record a connection from ip being refused or disconnected, in the rejection log
+// and as a client.rejected event. reason is a fixed name such as rate_limited
+func (s *Gateway) logRejection(ip string, reason string) {
+	if ip == "" {
+		return
+	}
+	// Keep the line parseable whatever the address looks like
+	ip = strings.Replace(ip, " ", "", -1)
+
+	s.LogEvent(2, "client.rejected", "Rejected connection from %s: %s", ip, reason)
+	s.rejectionLog.Write(s.Config, ip, reason)
+}
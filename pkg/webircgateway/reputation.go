@@ -0,0 +1,143 @@
+package webircgateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Reputation - Asks an external HTTP service whether a client should be allowed to connect. The
+// client's address and some of its request headers are POSTed as JSON, and the service answers
+// with a verdict and/or a score. Answers are cached per address
+type Reputation struct {
+	gateway *Gateway
+	mu      sync.Mutex
+	cache   map[string]*reputationEntry
+}
+
+type reputationEntry struct {
+	allowed bool
+	reason  string
+	expires time.Time
+}
+
+type reputationRequest struct {
+	IP      string            `json:"ip"`
+	Headers map[string]string `json:"headers"`
+}
+
+// reputationVerdict - The service's answer. Verdict is accept or reject, otherwise Score is
+// compared against the configured reject_score
+type reputationVerdict struct {
+	Verdict string   `json:"verdict"`
+	Score   *float64 `json:"score"`
+	Reason  string   `json:"reason"`
+}
+
+func NewReputation(gateway *Gateway) *Reputation {
+	return &Reputation{
+		gateway: gateway,
+		cache:   make(map[string]*reputationEntry),
+	}
+}
+
+// Check - If a client connecting from ip may connect, and why not. headers are the client's HTTP
+// request headers, nil for TCP clients
+func (r *Reputation) Check(ip string, headers http.Header) (bool, string) {
+	cfg := r.gateway.Config
+	if cfg.ReputationURL == "" {
+		return true, ""
+	}
+
+	r.mu.Lock()
+	entry, exists := r.cache[ip]
+	r.mu.Unlock()
+	if exists && time.Now().Before(entry.expires) {
+		return entry.allowed, entry.reason
+	}
+
+	allowed, reason, err := r.query(ip, headers)
+	if err != nil {
+		r.gateway.Log(3, "Reputation lookup of %s failed: %s", ip, err.Error())
+		if cfg.ReputationFailOpen {
+			return true, ""
+		}
+		return false, "reputation service unavailable"
+	}
+
+	if cfg.ReputationCacheTTL > 0 {
+		r.mu.Lock()
+		for key, entry := range r.cache {
+			if time.Now().After(entry.expires) {
+				delete(r.cache, key)
+			}
+		}
+		r.cache[ip] = &reputationEntry{
+			allowed: allowed,
+			reason:  reason,
+			expires: time.Now().Add(time.Second * time.Duration(cfg.ReputationCacheTTL)),
+		}
+		r.mu.Unlock()
+	}
+
+	return allowed, reason
+}
+
+func (r *Reputation) query(ip string, headers http.Header) (bool, string, error) {
+	cfg := r.gateway.Config
+
+	body := reputationRequest{IP: ip, Headers: make(map[string]string)}
+	for _, name := range cfg.ReputationHeaders {
+		if val := headers.Get(name); val != "" {
+			body.Headers[name] = val
+		}
+	}
+	bodyJSON, _ := json.Marshal(body)
+
+	req, err := http.NewRequest("POST", cfg.ReputationURL, bytes.NewReader(bodyJSON))
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.ReputationAuth != "" {
+		req.Header.Set("Authorization", cfg.ReputationAuth)
+	}
+
+	httpClient := &http.Client{Timeout: time.Second * time.Duration(cfg.ReputationTimeout)}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, "", fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+
+	verdict := reputationVerdict{}
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return false, "", fmt.Errorf("invalid response: %s", err.Error())
+	}
+
+	switch verdict.Verdict {
+	case "accept":
+		return true, "", nil
+	case "reject":
+		return false, verdict.Reason, nil
+	}
+
+	if verdict.Score == nil {
+		return false, "", fmt.Errorf("response has no verdict or score")
+	}
+	if cfg.ReputationRejectScore > 0 && *verdict.Score >= cfg.ReputationRejectScore {
+		if verdict.Reason == "" {
+			verdict.Reason = fmt.Sprintf("score %g", *verdict.Score)
+		}
+		return false, verdict.Reason, nil
+	}
+
+	return true, "", nil
+}
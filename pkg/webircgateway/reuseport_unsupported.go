@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package webircgateway
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setReusePort(network string, address string, conn syscall.RawConn) error {
+	return errors.New("reuse_port is not supported on this platform")
+}
@@ -0,0 +1,73 @@
+package webircgateway
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// rotatingFile - A file that is appended to until it reaches a size or age, when it is moved to
+// path.1, path.1 to path.2 and so on, removing the oldest. Not safe for concurrent use
+type rotatingFile struct {
+	file   *os.File
+	path   string
+	size   int64
+	opened time.Time
+}
+
+// Write - Append to the file at path, opening it first if needed. A change of path opens the new
+// file. maxSize is in bytes. A maxSize or maxAge of 0 disables that limit
+func (r *rotatingFile) Write(path string, entry string, maxSize int64, maxAge time.Duration, maxFiles int) error {
+	if r.file != nil && r.path != path {
+		r.Close()
+	}
+
+	if r.file == nil {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		r.file = file
+		r.path = path
+		r.size = 0
+		r.opened = time.Now()
+		if info, err := file.Stat(); err == nil {
+			r.size = info.Size()
+		}
+	}
+
+	n, err := r.file.WriteString(entry)
+	r.size += int64(n)
+
+	if (maxSize > 0 && r.size >= maxSize) || (maxAge > 0 && time.Since(r.opened) >= maxAge) {
+		r.rotate(maxFiles)
+	}
+
+	return err
+}
+
+// Close - Close the file. It is opened again on the next write, eg. after being moved by logrotate
+func (r *rotatingFile) Close() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+func (r *rotatingFile) rotate(maxFiles int) {
+	r.Close()
+
+	if maxFiles < 1 {
+		os.Remove(r.path)
+		return
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", r.path, maxFiles))
+	for i := maxFiles - 1; i >= 1; i-- {
+		os.Rename(
+			fmt.Sprintf("%s.%d", r.path, i),
+			fmt.Sprintf("%s.%d", r.path, i+1),
+		)
+	}
+	os.Rename(r.path, r.path+".1")
+}
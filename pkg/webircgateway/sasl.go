@@ -0,0 +1,267 @@
+package webircgateway
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// AUTHENTICATE payloads are sent in chunks of this many bytes
+const saslChunkSize = 400
+
+// saslSession - The gateway logging a client in to its account with SASL PLAIN on the clients
+// behalf. The clients own CAP END and AUTHENTICATE lines are held until it has finished so that
+// registration doesn't complete first
+type saslSession struct {
+	// state - requested, authenticating or done
+	state    string
+	account  string
+	password string
+	attempts int
+	timer    *time.Timer
+	held     []string
+	// clientCap - The client is negotiating capabilities itself and will send its own CAP END
+	clientCap bool
+	// aborted - AUTHENTICATE * was sent after timing out, so the 906 reply is expected
+	aborted bool
+}
+
+// Timeout - Fires if the upstream takes too long to answer. A nil session never times out
+func (s *saslSession) Timeout() <-chan time.Time {
+	if s == nil || s.timer == nil {
+		return nil
+	}
+
+	return s.timer.C
+}
+
+// SetRequestCredentials - Keep the credentials of the clients HTTP request that [sasl] is
+// configured to use
+func (c *Client) SetRequestCredentials(req *http.Request) {
+	cfg := c.Gateway.Config
+	if !cfg.SaslEnabled {
+		return
+	}
+
+	switch cfg.SaslSource {
+	case "basic_auth":
+		c.saslAccount, c.saslPassword, _ = req.BasicAuth()
+	case "headers":
+		// Only a reverse proxy may set the headers, otherwise anybody could use any account
+		remoteAddr, _, _ := net.SplitHostPort(req.RemoteAddr)
+		if !c.Gateway.isReverseProxy(net.ParseIP(remoteAddr)) {
+			return
+		}
+		c.saslAccount = req.Header.Get(cfg.SaslAccountHeader)
+		c.saslPassword = req.Header.Get(cfg.SaslPasswordHeader)
+	}
+}
+
+// saslCredentials - The account and password to log the client in with, empty if it has none
+func (c *Client) saslCredentials() (string, string) {
+	cfg := c.Gateway.Config
+	if cfg.SaslSource == "basic_auth" || cfg.SaslSource == "headers" {
+		return stripLineBreaks(c.saslAccount), stripLineBreaks(c.saslPassword)
+	}
+
+	return makeClaimReplacements(cfg.SaslAccount, c), makeClaimReplacements(cfg.SaslPassword, c)
+}
+
+// maybeStartSasl - Start logging the client in if [sasl] is enabled and it has credentials. Sent
+// before any of the clients own lines so that registration waits for it
+func (c *Client) maybeStartSasl() {
+	// Connecting again after a rejected WEBIRC password starts over
+	if c.sasl != nil && c.sasl.timer != nil {
+		c.sasl.timer.Stop()
+	}
+	c.sasl = nil
+	if !c.Gateway.Config.SaslEnabled {
+		return
+	}
+
+	account, password := c.saslCredentials()
+	if account == "" || password == "" {
+		c.Log(1, "No SASL credentials for this client")
+		return
+	}
+
+	c.sasl = &saslSession{
+		state:    "requested",
+		account:  account,
+		password: password,
+		timer:    time.NewTimer(time.Second * time.Duration(c.Gateway.Config.SaslTimeout)),
+	}
+	c.Log(1, "Logging in to account %s with SASL", account)
+	c.SendUpstream("CAP REQ :sasl")
+}
+
+// holdForSasl - Keep a line from the client until logging in has finished. Returns true if held
+func (c *Client) holdForSasl(line string) bool {
+	s := c.sasl
+	if s == nil || s.state == "done" {
+		return false
+	}
+
+	message, err := irc.ParseLine(line)
+	if err != nil {
+		return false
+	}
+
+	command := strings.ToUpper(message.Command)
+	if command == "CAP" {
+		s.clientCap = true
+	}
+
+	if command == "AUTHENTICATE" || (command == "CAP" && strings.ToUpper(message.GetParam(0, "")) == "END") {
+		s.held = append(s.held, line)
+		return true
+	}
+
+	return false
+}
+
+// handleSaslFromUpstream - Follow the SASL exchange with the upstream. Returns true if the line
+// was part of it and should not be passed on to the client
+func (c *Client) handleSaslFromUpstream(m *irc.Message) bool {
+	s := c.sasl
+	if s == nil {
+		return false
+	}
+
+	if s.state == "done" {
+		// The reply to aborting after a timeout
+		if s.aborted && m.Command == "906" {
+			s.aborted = false
+			return true
+		}
+		return false
+	}
+
+	switch m.Command {
+	case "CAP":
+		subcommand := strings.ToUpper(m.GetParam(1, ""))
+		caps := strings.TrimSpace(m.GetParam(2, ""))
+		if s.state != "requested" || caps != "sasl" || (subcommand != "ACK" && subcommand != "NAK") {
+			return false
+		}
+		if subcommand == "NAK" {
+			c.finishSasl(false, "the server does not support SASL")
+			return true
+		}
+		s.state = "authenticating"
+		c.SendUpstream("AUTHENTICATE PLAIN")
+		return true
+
+	case "421":
+		// An IRCd without CAP support
+		if s.state == "requested" && strings.EqualFold(m.GetParam(1, ""), "CAP") {
+			c.finishSasl(false, "the server does not support SASL")
+			return true
+		}
+
+	case "AUTHENTICATE":
+		if s.state == "authenticating" && m.GetParam(0, "") == "+" {
+			c.sendSaslPlain()
+			return true
+		}
+
+	case "903", "907":
+		c.finishSasl(true, "")
+		return true
+
+	case "902", "904", "905":
+		if s.attempts < c.Gateway.Config.SaslRetries {
+			s.attempts++
+			c.Log(2, "SASL login to %s failed, trying again: %s", s.account, m.GetParam(1, ""))
+			c.SendUpstream("AUTHENTICATE PLAIN")
+			return true
+		}
+		c.finishSasl(false, m.GetParam(1, "authentication failed"))
+		return true
+
+	case "906":
+		c.finishSasl(false, "authentication aborted")
+		return true
+
+	case "908":
+		// The mechanisms the server supports, followed by a 904
+		return true
+	}
+
+	return false
+}
+
+// sendSaslPlain - Send the account and password, split into chunks as AUTHENTICATE requires
+func (c *Client) sendSaslPlain() {
+	s := c.sasl
+	payload := base64.StdEncoding.EncodeToString([]byte(s.account + "\x00" + s.account + "\x00" + s.password))
+
+	for len(payload) >= saslChunkSize {
+		c.SendUpstream("AUTHENTICATE " + payload[:saslChunkSize])
+		payload = payload[saslChunkSize:]
+	}
+
+	// A payload that fills the last chunk exactly is ended with an empty one
+	if payload == "" {
+		payload = "+"
+	}
+	c.SendUpstream("AUTHENTICATE " + payload)
+}
+
+// saslTimedOut - The upstream didn't answer in time. Registration carries on without logging in
+func (c *Client) saslTimedOut() {
+	s := c.sasl
+	s.timer = nil
+	if s.state == "done" {
+		return
+	}
+
+	if s.state == "authenticating" {
+		s.aborted = true
+		c.SendUpstream("AUTHENTICATE *")
+	}
+	c.finishSasl(false, "timed out")
+}
+
+// finishSasl - Let registration continue once logging in has succeeded or failed
+func (c *Client) finishSasl(success bool, reason string) {
+	s := c.sasl
+	s.state = "done"
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	if success {
+		c.LogEvent(2, "client.sasl", "Logged in to account %s with SASL", s.account)
+	} else {
+		c.LogEvent(2, "client.sasl_failed", "SASL login to account %s failed: %s", s.account, reason)
+
+		if c.Gateway.Config.SaslOnFailure == "disconnect" {
+			c.SendIrcError("Could not log in to your account: " + reason)
+			c.SendClientSignal("state", "closed", "err_sasl")
+			c.StartShutdown("sasl_failed")
+			return
+		}
+
+		notice := irc.NewMessage()
+		notice.Command = "NOTICE"
+		notice.Params = []string{"*", "Could not log in to your account: " + reason}
+		c.SendClientSignal("data", notice.ToLine())
+	}
+
+	held := s.held
+	s.held = nil
+	for _, line := range held {
+		c.processLineToUpstream(line)
+	}
+
+	// The client won't end the negotiation the gateway started
+	if !s.clientCap {
+		c.SendUpstream("CAP END")
+	}
+}
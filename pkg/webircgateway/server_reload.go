@@ -0,0 +1,211 @@
+package webircgateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// runningServer - A [server.*] block that is being listened on, kept so that it can be stopped
+// if it is removed or changed when the config is reloaded
+type runningServer struct {
+	conf      ConfigServer
+	mu        sync.Mutex
+	stopped   bool
+	listeners []net.Listener
+	httpSrv   *http.Server
+	certStore *CertStore
+	// quic - Set if transports are served over QUIC on the servers UDP port
+	quic *quicServer
+}
+
+// track - Keep the listeners of the server so they are closed when it is stopped. Returns false,
+// closing them, if the server was stopped before it started listening
+func (r *runningServer) track(listeners []net.Listener, httpSrv *http.Server, certStore *CertStore) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return false
+	}
+
+	r.listeners = append(r.listeners, listeners...)
+	r.httpSrv = httpSrv
+	r.certStore = certStore
+	return true
+}
+
+// trackQuic - Keep the QUIC server so it is stopped along with the server. Returns false, closing
+// it, if the server was stopped before it started listening
+func (r *runningServer) trackQuic(q *quicServer) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		q.Close()
+		return false
+	}
+
+	r.quic = q
+	return true
+}
+
+// isStopped - If the server was removed from the config, so errors from its listeners closing
+// can be ignored
+func (r *runningServer) isStopped() bool {
+	if r == nil {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stopped
+}
+
+// addServer - Keep track of a server about to be started
+func (s *Gateway) addServer(conf ConfigServer) *runningServer {
+	server := &runningServer{conf: conf}
+
+	s.httpSrvsMu.Lock()
+	s.servers = append(s.servers, server)
+	s.httpSrvsMu.Unlock()
+
+	return server
+}
+
+// reloadServers - Stop the servers no longer in the config and start those that are new. A
+// server block that changed is stopped and started again. Clients already connected through a
+// stopped server stay connected
+func (s *Gateway) reloadServers() {
+	if s.Function != "gateway" || s.IsClosing() {
+		return
+	}
+
+	s.httpSrvsMu.Lock()
+	running := append([]*runningServer{}, s.servers...)
+	s.httpSrvsMu.Unlock()
+
+	added := append([]ConfigServer{}, s.Config.Servers...)
+	removed := []*runningServer{}
+	for _, server := range running {
+		unchanged := false
+		for i, conf := range added {
+			if reflect.DeepEqual(conf, server.conf) {
+				added = append(added[:i], added[i+1:]...)
+				unchanged = true
+				break
+			}
+		}
+		if !unchanged {
+			removed = append(removed, server)
+		}
+	}
+
+	// Stopped first so that a changed server can bind its address again
+	for _, server := range removed {
+		s.stopServer(server)
+	}
+
+	for _, conf := range added {
+		s.Log(2, "Starting server %s", serverDisplayName(conf))
+		go s.startServer(s.addServer(conf))
+	}
+}
+
+// stopServer - Stop accepting connections on a server. HTTP requests already being handled are
+// given until shutdown_timeout to complete
+func (s *Gateway) stopServer(server *runningServer) {
+	s.Log(2, "Stopping server %s", serverDisplayName(server.conf))
+
+	server.mu.Lock()
+	server.stopped = true
+	listeners := server.listeners
+	httpSrv := server.httpSrv
+	certStore := server.certStore
+	quicSrv := server.quic
+	server.mu.Unlock()
+
+	if quicSrv != nil {
+		quicSrv.Stop()
+	}
+
+	closed := map[net.Listener]bool{}
+	for _, l := range listeners {
+		l.Close()
+		closed[l] = true
+	}
+
+	s.httpSrvsMu.Lock()
+	servers := []*runningServer{}
+	for _, r := range s.servers {
+		if r != server {
+			servers = append(servers, r)
+		}
+	}
+	s.servers = servers
+
+	trackedListeners := []net.Listener{}
+	for _, l := range s.listeners {
+		if !closed[l] {
+			trackedListeners = append(trackedListeners, l)
+		}
+	}
+	s.listeners = trackedListeners
+
+	// Closed listeners can't be passed on when upgrading
+	for key, l := range s.handoffListeners {
+		if closed[l] {
+			delete(s.handoffListeners, key)
+		}
+	}
+
+	httpSrvs := []*http.Server{}
+	for _, srv := range s.httpSrvs {
+		if srv != httpSrv {
+			httpSrvs = append(httpSrvs, srv)
+		}
+	}
+	s.httpSrvs = httpSrvs
+
+	certStores := []*CertStore{}
+	for _, store := range s.certStores {
+		if store != certStore {
+			certStores = append(certStores, store)
+		}
+	}
+	s.certStores = certStores
+
+	quicSrvs := []*quicServer{}
+	for _, srv := range s.quicSrvs {
+		if srv != quicSrv {
+			quicSrvs = append(quicSrvs, srv)
+		}
+	}
+	s.quicSrvs = quicSrvs
+	s.httpSrvsMu.Unlock()
+
+	if httpSrv != nil {
+		go func() {
+			timeout := time.Second * time.Duration(s.Config.ShutdownTimeout)
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			httpSrv.Shutdown(ctx)
+		}()
+	}
+}
+
+// serverDisplayName - The config section and address of a server, for logging
+func serverDisplayName(conf ConfigServer) string {
+	if conf.sectionName == "" {
+		return serverListenAddr(conf)
+	}
+
+	return fmt.Sprintf("%s (%s)", conf.sectionName, serverListenAddr(conf))
+}
@@ -0,0 +1,99 @@
+package webircgateway
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// IsClosing - If the gateway has started shutting down and is draining its clients
+func (s *Gateway) IsClosing() bool {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	return s.closing
+}
+
+// trackListener - Keep a listener that isn't served by a http.Server so that it can be closed
+// when shutting down
+func (s *Gateway) trackListener(l net.Listener) {
+	s.httpSrvsMu.Lock()
+	s.listeners = append(s.listeners, l)
+	s.httpSrvsMu.Unlock()
+}
+
+// stopListening - Stop accepting new connections. Requests already being handled by the HTTP
+// servers may continue until ctx is done
+func (s *Gateway) stopListening(ctx context.Context) {
+	s.httpSrvsMu.Lock()
+	defer s.httpSrvsMu.Unlock()
+
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for _, httpSrv := range s.httpSrvs {
+		go httpSrv.Shutdown(ctx)
+	}
+	// Open QUIC connections are left to drain with the other clients
+	for _, quicSrv := range s.quicSrvs {
+		quicSrv.listener.Close()
+	}
+}
+
+// drainClients - Tell the connected clients that the gateway is shutting down and give them until
+// shutdown_timeout to disconnect before disconnecting the rest. Ends early if Close() is called
+// again while waiting
+func (s *Gateway) drainClients() {
+	count := s.Clients.Count()
+	if count == 0 {
+		return
+	}
+
+	timeout := time.Second * time.Duration(s.Config.ShutdownTimeout)
+	message := s.Config.ShutdownMessage
+
+	if timeout > 0 {
+		s.Log(2, "Waiting up to %s for %d clients to disconnect", timeout, count)
+		for _, info := range s.SnapshotClients() {
+			notice := irc.NewMessage()
+			notice.Command = "NOTICE"
+			notice.Params = []string{"*", message}
+			if info.Nick != "" {
+				notice.Params[0] = info.Nick
+			}
+			info.client.SendClientSignal("data", notice.ToLine())
+		}
+
+		deadline := time.After(timeout)
+		ticker := time.NewTicker(time.Millisecond * 100)
+		defer ticker.Stop()
+	waitLoop:
+		for s.Clients.Count() > 0 {
+			select {
+			case <-deadline:
+				break waitLoop
+			case <-s.drainEnd:
+				break waitLoop
+			case <-ticker.C:
+			}
+		}
+	}
+
+	remaining := s.SnapshotClients()
+	if len(remaining) == 0 {
+		s.Log(2, "All clients disconnected")
+		return
+	}
+
+	s.Log(2, "Disconnecting %d remaining clients", len(remaining))
+	for _, info := range remaining {
+		info.client.disconnect(message, "gateway_shutdown")
+	}
+
+	// Give the QUITs a moment to be written upstream before the process exits
+	giveUp := time.Now().Add(time.Second * 2)
+	for s.Clients.Count() > 0 && time.Now().Before(giveUp) {
+		time.Sleep(time.Millisecond * 50)
+	}
+}
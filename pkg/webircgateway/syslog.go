@@ -0,0 +1,222 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package webircgateway
+
+import (
+	"fmt"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// Entries waiting to be sent to syslog. Any more are dropped so that logging never waits on a
+// slow or unreachable syslog server
+const syslogQueueSize = 1000
+
+// How long connecting to syslog may take
+const syslogDialTimeout = time.Second * 5
+
+// SyslogSink - Sends log entries to a local or remote syslog server as configured in [syslog].
+// The connection is remade whenever the config changes. Entries are sent from a goroutine of its
+// own, started by the first Write()
+type SyslogSink struct {
+	startOnce sync.Once
+	queue     chan syslogEntry
+	// Count of entries dropped while the queue was full, reported once it has room again
+	dropped uint64
+	// 1 while syslog is enabled, so that the entry disabling it can be queued to close the writer
+	enabled uint32
+
+	writer *syslog.Writer
+	// The config the writer was connected with
+	dialed string
+	// Set after a failed connection so that the error is only reported once
+	failed     string
+	lastFailed time.Time
+}
+
+// syslogEntry - A log entry with the [syslog] config at the time it was logged
+type syslogEntry struct {
+	enabled  bool
+	network  string
+	address  string
+	facility string
+	tag      string
+	level    int
+	msg      string
+}
+
+func (e syslogEntry) dialConfig() string {
+	return strings.Join([]string{e.network, e.address, e.facility, e.tag}, " ")
+}
+
+func NewSyslogSink() *SyslogSink {
+	return &SyslogSink{
+		queue: make(chan syslogEntry, syslogQueueSize),
+	}
+}
+
+// Write - Queue an entry to be sent to syslog if enabled. Errors are written to stderr as logging
+// them would send them straight back here
+func (s *SyslogSink) Write(cfg *Config, entry LogEntry) {
+	if cfg.SyslogEnabled {
+		atomic.StoreUint32(&s.enabled, 1)
+	} else if atomic.SwapUint32(&s.enabled, 0) == 0 {
+		// Nothing to send and nothing connected to close
+		return
+	}
+	s.startOnce.Do(func() {
+		go s.run()
+	})
+
+	queued := syslogEntry{
+		enabled:  cfg.SyslogEnabled,
+		network:  cfg.SyslogNetwork,
+		address:  cfg.SyslogAddress,
+		facility: cfg.SyslogFacility,
+		tag:      cfg.SyslogTag,
+		level:    entry.Level,
+	}
+	if cfg.SyslogEnabled {
+		queued.msg = entry.Text()
+		if cfg.LogFormat == "json" {
+			queued.msg = string(entry.JSON())
+		}
+	}
+
+	select {
+	case s.queue <- queued:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		if !cfg.SyslogEnabled {
+			// The writer still has to be closed by a later entry
+			atomic.StoreUint32(&s.enabled, 1)
+		}
+	}
+}
+
+func (s *SyslogSink) run() {
+	for entry := range s.queue {
+		if dropped := atomic.SwapUint64(&s.dropped, 0); dropped > 0 {
+			fmt.Fprintf(os.Stderr, "Syslog is not keeping up, dropped %d log entries\n", dropped)
+		}
+		s.send(entry)
+	}
+}
+
+func (s *SyslogSink) send(entry syslogEntry) {
+	if !entry.enabled {
+		s.close()
+		return
+	}
+
+	dialConfig := entry.dialConfig()
+	if s.writer == nil || s.dialed != dialConfig {
+		// Don't hold up every log entry with a connection attempt while syslog is unreachable
+		if s.failed == dialConfig && time.Since(s.lastFailed) < time.Second*30 {
+			return
+		}
+
+		s.close()
+		if !s.dial(entry, dialConfig) {
+			return
+		}
+	}
+
+	var err error
+	switch entry.level {
+	case 1:
+		err = s.writer.Debug(entry.msg)
+	case 2:
+		err = s.writer.Info(entry.msg)
+	default:
+		err = s.writer.Warning(entry.msg)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing to syslog: %s\n", err.Error())
+	}
+}
+
+func (s *SyslogSink) dial(entry syslogEntry, dialConfig string) bool {
+	facility, exists := syslogFacilities[entry.facility]
+	if !exists {
+		fmt.Fprintf(os.Stderr, "Unknown syslog facility %s, using daemon\n", entry.facility)
+		facility = syslog.LOG_DAEMON
+	}
+
+	// An empty network and address connects to the local syslog daemon
+	writer, err := dialSyslog(entry.network, entry.address, facility|syslog.LOG_INFO, entry.tag)
+	if err != nil {
+		if s.failed != dialConfig {
+			fmt.Fprintf(os.Stderr, "Error connecting to syslog: %s\n", err.Error())
+		}
+		s.failed = dialConfig
+		s.lastFailed = time.Now()
+		return false
+	}
+
+	s.writer = writer
+	s.dialed = dialConfig
+	s.failed = ""
+	return true
+}
+
+// dialSyslog - syslog.Dial, giving up after syslogDialTimeout. syslog.Dial can't be cancelled so a
+// connection made after giving up is closed again
+func dialSyslog(network string, address string, priority syslog.Priority, tag string) (*syslog.Writer, error) {
+	type dialResult struct {
+		writer *syslog.Writer
+		err    error
+	}
+	result := make(chan dialResult, 1)
+	go func() {
+		writer, err := syslog.Dial(network, address, priority, tag)
+		result <- dialResult{writer, err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.writer, r.err
+	case <-time.After(syslogDialTimeout):
+		go func() {
+			if r := <-result; r.writer != nil {
+				r.writer.Close()
+			}
+		}()
+		return nil, fmt.Errorf("timed out after %s", syslogDialTimeout)
+	}
+}
+
+func (s *SyslogSink) close() {
+	if s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+}
@@ -0,0 +1,27 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package webircgateway
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// SyslogSink - Syslog is not available on this platform so log entries are never sent
+type SyslogSink struct {
+	warnOnce sync.Once
+}
+
+func NewSyslogSink() *SyslogSink {
+	return &SyslogSink{}
+}
+
+func (s *SyslogSink) Write(cfg *Config, entry LogEntry) {
+	if cfg.SyslogEnabled {
+		s.warnOnce.Do(func() {
+			fmt.Fprintln(os.Stderr, "Syslog is not supported on this platform, [syslog] is ignored")
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package webircgateway
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The most spans held while waiting to be exported. Further spans are dropped if the collector
+// can't keep up
+const tracerMaxPending = 4096
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+	spanStatusError  = 2
+)
+
+// Tracer - Records spans over each clients lifecycle and exports them in batches to an
+// OpenTelemetry collector over OTLP/HTTP. The JSON encoding of OTLP is used so that no SDK is
+// needed
+type Tracer struct {
+	gateway    *Gateway
+	mu         sync.Mutex
+	pending    []*Span
+	dropped    int
+	failing    bool
+	exportLock sync.Mutex
+	httpClient *http.Client
+}
+
+func NewTracer(gateway *Gateway) *Tracer {
+	return &Tracer{
+		gateway:    gateway,
+		httpClient: &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+// Span - A timed operation within a trace. All methods are safe to call on a nil Span, which is
+// what is given when tracing is disabled or the trace was not sampled
+type Span struct {
+	tracer     *Tracer
+	mu         sync.Mutex
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	errMessage string
+}
+
+// StartTrace - Start the root span of a new trace, if tracing is enabled and the trace is sampled
+func (t *Tracer) StartTrace(name string) *Span {
+	cfg := t.gateway.Config
+	if !cfg.TracingEnabled || cfg.TracingEndpoint == "" {
+		return nil
+	}
+
+	span := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       spanKindServer,
+		start:      time.Now(),
+		attributes: make(map[string]string),
+	}
+	rand.Read(span.traceID[:])
+	rand.Read(span.spanID[:])
+
+	// Sampled by trace ID the same way as the OpenTelemetry SDKs TraceIDRatioBased sampler
+	if cfg.TracingSampleRate < 1 {
+		bound := uint64(cfg.TracingSampleRate * (1 << 63))
+		if binary.BigEndian.Uint64(span.traceID[8:])>>1 >= bound {
+			return nil
+		}
+	}
+
+	return span
+}
+
+// StartChild - Start a span within the same trace as this one
+func (s *Span) StartChild(name string) *Span {
+	return s.StartChildAt(name, time.Now())
+}
+
+// StartChildAt - Start a span within the same trace as this one that began at the given time,
+// eg. for work that happened before the parent span was available
+func (s *Span) StartChildAt(name string, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+
+	child := &Span{
+		tracer:     s.tracer,
+		traceID:    s.traceID,
+		parentID:   s.spanID,
+		name:       name,
+		kind:       spanKindInternal,
+		start:      start,
+		attributes: make(map[string]string),
+	}
+	rand.Read(child.spanID[:])
+
+	return child
+}
+
+// SetKind - Mark the span as an outgoing call (client) rather than internal work
+func (s *Span) SetKind(kind int) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.kind = kind
+	s.mu.Unlock()
+}
+
+// SetStart - Move the start of the span earlier, eg. to include a transport handshake that
+// completed before the span was started
+func (s *Span) SetStart(start time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if start.Before(s.start) {
+		s.start = start
+	}
+	s.mu.Unlock()
+}
+
+func (s *Span) SetAttribute(key string, val string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.attributes[key] = val
+	s.mu.Unlock()
+}
+
+// SetError - Mark the span as failed with the given reason
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.errMessage = message
+	s.mu.Unlock()
+}
+
+// End - Complete the span and queue it to be exported. Only the first call has any effect
+func (s *Span) End() {
+	s.EndWithError("")
+}
+
+// EndWithError - Complete the span as failed with the given reason, unless it has already ended
+func (s *Span) EndWithError(message string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = time.Now()
+		if message != "" {
+			s.errMessage = message
+		}
+	}
+	s.mu.Unlock()
+
+	if !ended {
+		s.tracer.queue(s)
+	}
+}
+
+func (t *Tracer) queue(span *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.pending) >= tracerMaxPending {
+		t.dropped++
+		return
+	}
+
+	t.pending = append(t.pending, span)
+}
+
+// Run - Export the queued spans every few seconds
+func (t *Tracer) Run() {
+	for {
+		time.Sleep(time.Second * 5)
+		t.Flush()
+	}
+}
+
+// Flush - Export all queued spans now
+func (t *Tracer) Flush() {
+	t.exportLock.Lock()
+	defer t.exportLock.Unlock()
+
+	t.mu.Lock()
+	spans := t.pending
+	dropped := t.dropped
+	t.pending = nil
+	t.dropped = 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		t.gateway.Log(3, "Tracing dropped %d spans, the collector is not keeping up", dropped)
+	}
+
+	cfg := t.gateway.Config
+	if len(spans) == 0 || cfg.TracingEndpoint == "" {
+		return
+	}
+
+	err := t.export(cfg, spans)
+	if err != nil && !t.failing {
+		t.gateway.Log(3, "Error exporting traces to %s: %s", cfg.TracingEndpoint, err.Error())
+	} else if err == nil && t.failing {
+		t.gateway.Log(2, "Exporting traces to %s again", cfg.TracingEndpoint)
+	}
+	t.failing = err != nil
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	out := []otlpAttribute{}
+	for key, val := range attributes {
+		attr := otlpAttribute{Key: key}
+		attr.Value.StringValue = val
+		out = append(out, attr)
+	}
+
+	return out
+}
+
+func (t *Tracer) export(cfg *Config, spans []*Span) error {
+	out := []otlpSpan{}
+	for _, span := range spans {
+		span.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(span.traceID[:]),
+			SpanID:            hex.EncodeToString(span.spanID[:]),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.attributes),
+		}
+		if span.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(span.parentID[:])
+		}
+		if span.errMessage != "" {
+			o.Status.Code = spanStatusError
+			o.Status.Message = span.errMessage
+		}
+		span.mu.Unlock()
+		out = append(out, o)
+	}
+
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{
+						"service.name":    cfg.TracingServiceName,
+						"service.version": Version,
+					}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "webircgateway"},
+						"spans": out,
+					},
+				},
+			},
+		},
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.httpClient.Post(tracesURL(cfg.TracingEndpoint), "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// tracesURL - The OTLP/HTTP traces URL for a collector endpoint, adding the standard /v1/traces
+// path if only the collectors address was given
+func tracesURL(endpoint string) string {
+	if strings.HasSuffix(endpoint, "/v1/traces") {
+		return endpoint
+	}
+
+	return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+}
+
+// TraceTransport - Record the transport handshake that completed before the client was created,
+// eg. the websocket upgrade, starting the clients trace from when it began
+func (c *Client) TraceTransport(name string, start time.Time) {
+	c.traceSpan.SetStart(start)
+	span := c.traceSpan.StartChildAt(name, start)
+	span.End()
+}
+
+// traceHook - Start a span timing the dispatch of a hook to plugins. Hooks dispatched for every
+// line, such as irc.line, aren't traced so as not to flood the collector
+func (c *Client) traceHook(eventType string) *Span {
+	if c == nil {
+		return nil
+	}
+
+	return c.traceSpan.StartChild("hook." + eventType)
+}
+
+// tracedDialUpstream - dialUpstream, timed with a span for each attempt
+func (c *Client) tracedDialUpstream(upstreamConfig *ConfigUpstream, attempt int) (io.ReadWriteCloser, string, error) {
+	span := c.traceSpan.StartChild("upstream.dial")
+	span.SetKind(spanKindClient)
+	span.SetAttribute("upstream", upstreamAddrKey(*upstreamConfig))
+	span.SetAttribute("attempt", strconv.Itoa(attempt))
+
+	connection, errString, err := c.dialUpstream(upstreamConfig)
+	if err != nil {
+		span.EndWithError(errString + ": " + err.Error())
+	} else {
+		span.End()
+	}
+
+	return connection, errString, err
+}
+
+// endTrace - Complete the clients trace once it has closed
+func (c *Client) endTrace() {
+	if c.traceSpan == nil {
+		return
+	}
+
+	c.registrationSpan.EndWithError("Closed before registering")
+
+	c.traceSpan.SetAttribute("client.remote_addr", c.RemoteAddr)
+	c.traceSpan.SetAttribute("client.listener", c.Listener)
+	if c.UpstreamConfig.Hostname != "" {
+		c.traceSpan.SetAttribute("upstream", upstreamAddrKey(*c.UpstreamConfig))
+	}
+	stats := c.Stats.Snapshot()
+	c.traceSpan.SetAttribute("transport.bytes_sent", strconv.FormatUint(stats.BytesSent, 10))
+	c.traceSpan.SetAttribute("transport.bytes_recv", strconv.FormatUint(stats.BytesRecv, 10))
+	c.traceSpan.End()
+}
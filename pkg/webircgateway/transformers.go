@@ -0,0 +1,170 @@
+package webircgateway
+
+import (
+	"strings"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// LineTransformer - A single stage of the line transformer pipeline. toServer is true for lines
+// heading to the IRCd. Returning drop as true stops the pipeline and discards the line.
+type LineTransformer interface {
+	TransformLine(client *Client, line string, toServer bool) (newLine string, drop bool)
+}
+
+// LineTransformerFunc - Use a plain function as a LineTransformer
+type LineTransformerFunc func(client *Client, line string, toServer bool) (string, bool)
+
+func (f LineTransformerFunc) TransformLine(client *Client, line string, toServer bool) (string, bool) {
+	return f(client, line, toServer)
+}
+
+var transformersRegistered map[string]LineTransformer
+
+func init() {
+	transformersRegistered = make(map[string]LineTransformer)
+
+	RegisterLineTransformer("strip_formatting", LineTransformerFunc(transformStripFormatting))
+	RegisterLineTransformer("block_ctcp", LineTransformerFunc(transformBlockCtcp))
+	RegisterLineTransformer("strip_tags", LineTransformerFunc(transformStripTags))
+}
+
+// RegisterLineTransformer - Make a transformer available to the [transformers.*] config sections.
+// Plugins should register their transformers in their Start() function.
+func RegisterLineTransformer(name string, transformer LineTransformer) {
+	transformersRegistered[name] = transformer
+}
+
+// transformLine - Run a line through the configured pipeline for its direction
+func (c *Client) transformLine(line string, toServer bool) (string, bool) {
+	stages := c.Gateway.Config.ClientTransformers
+	if toServer {
+		stages = c.Gateway.Config.UpstreamTransformers
+	}
+
+	for _, name := range stages {
+		transformer, exists := transformersRegistered[name]
+		if !exists {
+			continue
+		}
+
+		var drop bool
+		line, drop = transformer.TransformLine(c, line, toServer)
+		if drop {
+			return "", true
+		}
+	}
+
+	return line, false
+}
+
+// checkTransformers - Log any configured transformers that have not been registered
+func (s *Gateway) checkTransformers() {
+	for _, name := range append(append([]string{}, s.Config.UpstreamTransformers...), s.Config.ClientTransformers...) {
+		if _, exists := transformersRegistered[name]; !exists {
+			s.Log(3, "Unknown line transformer '%s'", name)
+		}
+	}
+}
+
+// Removes bold, colours, italics, etc from any text
+func transformStripFormatting(client *Client, line string, toServer bool) (string, bool) {
+	if !strings.ContainsAny(line, "\x02\x03\x04\x0f\x11\x16\x1d\x1e\x1f") {
+		return line, false
+	}
+
+	out := strings.Builder{}
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\x02', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+			continue
+		case '\x03':
+			// \x03[fg[,bg]] where colours are 1 or 2 digits
+			fgLen := countDigits(line[i+1:], 2)
+			i += fgLen
+			if fgLen > 0 && i+2 < len(line) && line[i+1] == ',' && countDigits(line[i+2:], 1) == 1 {
+				i += 1 + countDigits(line[i+2:], 2)
+			}
+		case '\x04':
+			// \x04[RRGGBB[,RRGGBB]]
+			fgLen := countHexDigits(line[i+1:], 6)
+			i += fgLen
+			if fgLen == 6 && i+7 < len(line) && line[i+1] == ',' && countHexDigits(line[i+2:], 6) == 6 {
+				i += 7
+			}
+		default:
+			out.WriteByte(line[i])
+		}
+	}
+
+	return out.String(), false
+}
+
+// Drops any CTCP messages other than ACTION (/me)
+func transformBlockCtcp(client *Client, line string, toServer bool) (string, bool) {
+	message, err := irc.ParseLine(line)
+	if err != nil {
+		return line, false
+	}
+
+	ctcpType, _, isCtcp := parseCtcp(message)
+	if isCtcp && ctcpType != "ACTION" {
+		return "", true
+	}
+
+	return line, false
+}
+
+// Removes all message tags
+func transformStripTags(client *Client, line string, toServer bool) (string, bool) {
+	if !strings.HasPrefix(line, "@") {
+		return line, false
+	}
+
+	message, err := irc.ParseLine(line)
+	if err != nil {
+		return line, false
+	}
+
+	message.Tags = make(map[string]string)
+	return message.ToLine(), false
+}
+
+// parseCtcp - If a PRIVMSG or NOTICE is a CTCP message, get its type and parameters
+func parseCtcp(message *irc.Message) (ctcpType string, params string, isCtcp bool) {
+	command := strings.ToUpper(message.Command)
+	if command != "PRIVMSG" && command != "NOTICE" {
+		return "", "", false
+	}
+
+	text := message.GetParam(1, "")
+	if len(text) < 2 || text[0] != '\x01' {
+		return "", "", false
+	}
+
+	// The closing \x01 is optional
+	text = strings.TrimSuffix(text[1:], "\x01")
+	parts := strings.SplitN(text, " ", 2)
+	ctcpType = strings.ToUpper(parts[0])
+	if len(parts) > 1 {
+		params = parts[1]
+	}
+
+	return ctcpType, params, ctcpType != ""
+}
+
+func countDigits(s string, max int) int {
+	n := 0
+	for n < len(s) && n < max && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+func countHexDigits(s string, max int) int {
+	n := 0
+	for n < len(s) && n < max && strings.IndexByte("0123456789abcdefABCDEF", s[n]) > -1 {
+		n++
+	}
+	return n
+}
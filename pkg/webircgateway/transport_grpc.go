@@ -0,0 +1,237 @@
+package webircgateway
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/ircgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// TransportGrpc - IRC over the Connect RPC of the gRPC service in pkg/ircgrpc, for native apps and
+// backends that would rather use generated client code than the kiwiirc framing. Started for
+// [server.*] blocks with a bind of grpc:ADDR. Each message streamed in either direction is one
+// IRC line. Auth is read from the RPC metadata the same as from the headers of HTTP transports,
+// eg. "authorization: Bearer <jwt>"
+type TransportGrpc struct {
+	ircgrpc.UnimplementedGatewayServer
+	gateway *Gateway
+	// Server - The config of the server this transport is listening for
+	Server ConfigServer
+	// running - Set when started for a [server.*] block, which may be stopped when reloading
+	running *runningServer
+}
+
+func (t *TransportGrpc) Init(g *Gateway) {
+	t.gateway = g
+}
+
+func (t *TransportGrpc) Start(lAddr string) {
+	opts := []grpc.ServerOption{}
+	var certStore *CertStore
+
+	if t.Server.TLS {
+		tlsConfig := &tls.Config{
+			ClientAuth: serverClientAuth(t.Server),
+		}
+
+		if t.Server.LetsEncryptCacheDir != "" {
+			t.gateway.Acme.Get(t.Server.LetsEncryptCacheDir)
+			tlsConfig.GetCertificate = t.gateway.Acme.GetCertificate
+		} else {
+			if t.Server.CertFile == "" || t.Server.KeyFile == "" {
+				t.gateway.Log(3, "'cert' and 'key' options must be set for TLS servers")
+				return
+			}
+
+			certStore = NewCertStore(t.gateway, t.gateway.Config.ResolvePath(t.Server.CertFile), t.gateway.Config.ResolvePath(t.Server.KeyFile))
+			if certErr := certStore.Load(); certErr != nil {
+				t.gateway.Log(3, "Failed to listen for gRPC with TLS, certificate error: %s", certErr.Error())
+				return
+			}
+			tlsConfig.GetCertificate = certStore.GetCertificate
+		}
+
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	srv := grpc.NewServer(opts...)
+	ircgrpc.RegisterGatewayServer(srv, t)
+
+	listeners, err := t.gateway.listen(t.Server, lAddr)
+	if err != nil {
+		t.gateway.Log(3, "gRPC error listening: "+err.Error())
+		return
+	}
+	if t.running != nil && !t.running.track(listeners, nil, certStore) {
+		return
+	}
+	if certStore != nil {
+		t.gateway.httpSrvsMu.Lock()
+		t.gateway.certStores = append(t.gateway.certStores, certStore)
+		t.gateway.httpSrvsMu.Unlock()
+	}
+
+	t.gateway.Log(2, "gRPC listening on "+lAddr)
+	serveListeners(listeners, func(l net.Listener) error {
+		// Closing the listener when the application closes or the server is stopped ends Serve
+		t.gateway.trackListener(l)
+		err := srv.Serve(t.gateway.maybeLimitListener(t.gateway.maybeWrapProxyProtocol(l, t.Server), t.Server))
+		if err != nil && !t.gateway.IsClosing() && !t.running.isStopped() {
+			t.gateway.Log(3, "gRPC error serving: "+err.Error())
+		}
+		return nil
+	})
+}
+
+// Connect - One IRC client for as long as the stream is open
+func (t *TransportGrpc) Connect(stream ircgrpc.Gateway_ConnectServer) error {
+	accepted := time.Now()
+
+	// Refused before anything else, as HTTP transports are with a 503
+	if t.gateway.admission.CheckNew() != "" {
+		return status.Error(codes.Unavailable, t.gateway.admission.CloseReason("server_full"))
+	}
+
+	req := grpcRequest(stream)
+	remoteHost, remoteAddrPort, _ := net.SplitHostPort(req.RemoteAddr)
+	if !t.gateway.connRateLimit.Allow(net.ParseIP(remoteHost)) {
+		return status.Error(codes.ResourceExhausted, "Too many connections, please try again later")
+	}
+
+	claims, err := t.gateway.authenticateTransport(req)
+	if err != nil {
+		t.gateway.LogEvent(2, "client.auth_failed", "gRPC connection from %s refused, %s", remoteHost, err.Error())
+		t.gateway.logRejection(remoteHost, "auth_failed")
+		return status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+
+	client := t.gateway.NewClient()
+	client.TraceTransport("grpc.accept", accepted)
+	client.AuthClaims = claims
+	client.SetListener(t.Server.sectionName)
+
+	client.RemoteAddr = remoteHost
+
+	client.RemoteHostname = t.gateway.lookupClientHostname(client.RemoteAddr)
+
+	if req.TLS != nil {
+		client.Tags["secure"] = ""
+		client.SetTLSState(req.TLS)
+	}
+	client.RequestHeaders = req.Header
+	client.SetRequestCredentials(req)
+	client.SetAffinityToken(req)
+
+	client.Tags["remote-port"] = remoteAddrPort
+	client.Tags["local-port"] = strconv.Itoa(t.Server.Port)
+
+	client.LogEvent(2, "client.connected", "New grpc client on %s from %s %s", serverListenAddr(t.Server), client.RemoteAddr, client.RemoteHostname)
+	client.Ready()
+
+	// We wait until the client send queue has been drained
+	var sendDrained sync.WaitGroup
+	sendDrained.Add(1)
+
+	// Read from the stream. Recv returns an error once the RPC has ended
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err == nil {
+				message := strings.TrimRight(msg.Line, "\r\n")
+				client.Stats.RecordRecv(len(message), len(message))
+				client.Log(1, "client->: %s", message)
+				select {
+				case client.Recv <- message:
+				default:
+					client.Log(3, "Recv queue full. Dropping data")
+				}
+
+			} else {
+				client.Log(1, "gRPC stream closed (%s)", err.Error())
+				break
+			}
+		}
+
+		close(client.Recv)
+	}()
+
+	// Once a write has failed the rest are skipped while the client is closing
+	writeFailed := false
+	closeReason := ""
+
+	// Process signals for the client
+	for {
+		signal, ok := <-client.Signals
+		if !ok {
+			sendDrained.Done()
+			break
+		}
+
+		if signal[0] == "data" && !writeFailed {
+			line := strings.Trim(signal[1], "\r\n")
+			client.Log(1, "->grpc: %s", signal[1])
+			client.Stats.RecordSent(len(line), len(line))
+
+			err := stream.Send(&ircgrpc.IrcLine{Line: line})
+			if err != nil {
+				// The RPC has ended so the reader then closes the client
+				writeFailed = true
+				client.transportWriteFailed(err)
+			}
+		}
+
+		if signal[0] == "state" && signal[1] == "closed" {
+			closeReason = t.gateway.admission.CloseReason(signal[2])
+		}
+	}
+
+	sendDrained.Wait()
+
+	// The app is told why the gateway closed the client, eg. server_full
+	if closeReason != "" {
+		return status.Error(codes.Unavailable, closeReason)
+	}
+	return nil
+}
+
+// grpcRequest - The RPC as an HTTP request, so the metadata can be read as headers by the auth
+// shared with the HTTP transports
+func grpcRequest(stream grpc.ServerStream) *http.Request {
+	req := &http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Path: "/"},
+		Header: http.Header{},
+	}
+
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		req.RemoteAddr = p.Addr.String()
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			req.TLS = &tlsInfo.State
+		}
+	}
+
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	for key, vals := range md {
+		// Pseudo headers and those used by gRPC itself aren't wanted
+		if strings.HasPrefix(key, ":") || strings.HasPrefix(key, "grpc-") {
+			continue
+		}
+		for _, val := range vals {
+			req.Header.Add(key, val)
+		}
+	}
+
+	return req
+}
@@ -0,0 +1,176 @@
+package webircgateway
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// httpSession - A client of a transport that receives the lines from the client as POST requests,
+// which are matched to the client by the session ID
+type httpSession struct {
+	id     string
+	client *Client
+	// origin - The origin that started the session, which lines must be POSTed from too
+	origin     string
+	ClosedLock sync.Mutex
+	Closed     bool
+}
+
+func newHttpSession(client *Client, req *http.Request) *httpSession {
+	return &httpSession{
+		id:     randomToken(),
+		client: client,
+		origin: req.Header.Get("Origin"),
+	}
+}
+
+// acceptHttpClient - Check the request that starts a session the same as a websocket handshake
+// and make its client, responding with an error if the client is refused
+func (s *Gateway) acceptHttpClient(w http.ResponseWriter, req *http.Request) (*Client, bool) {
+	claims, verified, ok := s.checkHttpHandshake(w, req)
+	if !ok {
+		return nil, false
+	}
+
+	return s.newHttpClient(req, claims, verified), true
+}
+
+// checkHttpHandshake - The checks made before starting a client, responding with an error if the
+// client is refused. Returns the auth claims and whether a captcha was passed
+func (s *Gateway) checkHttpHandshake(w http.ResponseWriter, req *http.Request) (map[string]interface{}, bool, bool) {
+	if s.admission.RejectHandshake(w) {
+		return nil, false, false
+	}
+	origin := req.Header.Get("Origin")
+	if !s.IsClientOriginAllowed(origin) {
+		s.Log(2, "Origin %#v not allowed. Closing connection", origin)
+		s.logRejection(s.GetRemoteAddressFromRequest(req).String(), "origin_not_allowed")
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return nil, false, false
+	}
+	if s.connRateLimit.RejectHandshake(w, req) {
+		return nil, false, false
+	}
+	if s.ipLimits.RejectHandshake(w, req) {
+		return nil, false, false
+	}
+	claims, rejected := s.rejectUnauthenticated(w, req)
+	if rejected {
+		return nil, false, false
+	}
+	verified, err := s.verifyHandshake(req)
+	if err != nil {
+		remoteAddr := s.GetRemoteAddressFromRequest(req).String()
+		s.LogEvent(2, "client.verify_failed", "Connection from %s refused, %s", remoteAddr, err.Error())
+		s.logRejection(remoteAddr, "captcha_failed")
+		http.Error(w, "Captcha verification failed", http.StatusForbidden)
+		return nil, false, false
+	}
+
+	return claims, verified, true
+}
+
+// newHttpClient - The client for a request that passed checkHttpHandshake
+func (s *Gateway) newHttpClient(req *http.Request, claims map[string]interface{}, verified bool) *Client {
+	client := s.NewClient()
+	client.AuthClaims = claims
+	client.Verified = verified
+
+	client.RemoteAddr = s.GetRemoteAddressFromRequest(req).String()
+
+	client.RemoteHostname = s.lookupClientHostname(client.RemoteAddr)
+
+	if s.isRequestSecure(req) {
+		client.Tags["secure"] = ""
+	}
+	client.SetTLSState(req.TLS)
+	client.SetOrigin(req.Header.Get("Origin"))
+	client.RequestHeaders = req.Header
+	client.SetRequestCredentials(req)
+	client.SetAffinityToken(req)
+	client.SetListener(listenerFromRequest(req))
+
+	// This doesn't make sense to have since the POST requests may come from other ports. Only
+	// the port of the request that started the session is kept
+	_, remoteAddrPort, _ := net.SplitHostPort(req.RemoteAddr)
+	client.Tags["remote-port"] = remoteAddrPort
+	if localPort := s.localPortFromRequest(req); localPort != "" {
+		client.Tags["local-port"] = localPort
+	}
+
+	return client
+}
+
+// postLines - Pass the lines of a POST request on to the client, one or more separated by \n
+func (h *httpSession) postLines(w http.ResponseWriter, req *http.Request) {
+	// Another site knowing the session ID must not be able to send lines for the client
+	if req.Header.Get("Origin") != h.origin {
+		h.client.Gateway.Log(2, "Lines for a client POSTed from origin %#v, which did not start it", req.Header.Get("Origin"))
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	allowCors(w, req)
+	client := h.client
+	scanner := bufio.NewScanner(http.MaxBytesReader(w, req.Body, 64*1024))
+	for scanner.Scan() {
+		message := strings.TrimRight(scanner.Text(), "\r")
+		if message == "" {
+			continue
+		}
+		client.Stats.RecordRecv(len(message), len(message))
+		client.Log(1, "client->: %s", message)
+		if !h.send(message) {
+			http.Error(w, "Session closed", http.StatusGone)
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowCors - Let pages on the allowed origins read the responses, which are requested from
+// another origin when the gateway isn't serving the web client itself
+func allowCors(w http.ResponseWriter, req *http.Request) {
+	if origin := req.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// send - Pass a line on to the client. Returns false if the session has closed
+func (h *httpSession) send(message string) bool {
+	h.ClosedLock.Lock()
+	defer h.ClosedLock.Unlock()
+
+	if h.Closed {
+		return false
+	}
+
+	select {
+	case h.client.Recv <- message:
+	default:
+		h.client.Log(3, "Recv queue full. Dropping data")
+	}
+
+	return true
+}
+
+// close - Close the client as if its connection had closed
+func (h *httpSession) close() {
+	h.ClosedLock.Lock()
+
+	if !h.Closed {
+		h.Closed = true
+		close(h.client.Recv)
+	}
+
+	h.ClosedLock.Unlock()
+}
@@ -18,48 +18,93 @@ type TransportKiwiirc struct {
 
 func (t *TransportKiwiirc) Init(g *Gateway) {
 	t.gateway = g
-	handler := sockjs.NewHandler("/webirc/kiwiirc", sockjs.DefaultOptions, t.sessionHandler)
-	t.gateway.HttpRouter.Handle("/webirc/kiwiirc/", handler)
+	handler := sockjs.NewHandler("/webirc/kiwiirc", g.sockjsOptions(), t.sessionHandler)
+	t.gateway.HttpRouter.Handle("/webirc/kiwiirc/", t.gateway.authSockjsHandler(t.gateway.admission.SockjsHandler(handler)))
 }
 
-func (t *TransportKiwiirc) makeChannel(chanID string, ws sockjs.Session) *TransportKiwiircChannel {
-	client := t.gateway.NewClient()
+// kiwiircConnection - What is checked once for a connection rather than for each of its channels,
+// so that every channel of a connection is a client of the same user
+type kiwiircConnection struct {
+	claims   map[string]interface{}
+	verified bool
+}
+
+// checkConnection - Check the origin, auth and captcha of a new connection, closing it if refused
+func (t *TransportKiwiirc) checkConnection(ws sockjs.Session) (*kiwiircConnection, bool) {
+	remoteAddr := t.gateway.GetRemoteAddressFromRequest(ws.Request()).String()
 
 	originHeader := strings.ToLower(ws.Request().Header.Get("Origin"))
 	if !t.gateway.IsClientOriginAllowed(originHeader) {
-		client.Log(2, "Origin %s not allowed. Closing connection", originHeader)
+		t.gateway.Log(2, "Origin %s not allowed. Closing connection", originHeader)
+		t.gateway.logRejection(remoteAddr, "origin_not_allowed")
 		ws.Close(0, "Origin not allowed")
+		return nil, false
+	}
+
+	// Sessions may be started without the handshakes that were checked by authSockjsHandler
+	claims, err := t.gateway.authenticateTransport(ws.Request())
+	if err != nil {
+		t.gateway.LogEvent(2, "client.auth_failed", "Closing kiwiirc connection from %s, %s", remoteAddr, err.Error())
+		t.gateway.logRejection(remoteAddr, "auth_failed")
+		ws.Close(0, "Unauthorized")
+		return nil, false
+	}
+
+	// Captcha responses can only be verified once so they aren't checked during the handshake.
+	// Checking the connection rather than each channel lets it open more than one
+	verified, err := t.gateway.verifyHandshake(ws.Request())
+	if err != nil {
+		t.gateway.LogEvent(2, "client.verify_failed", "Closing kiwiirc connection from %s, %s", remoteAddr, err.Error())
+		t.gateway.logRejection(remoteAddr, "captcha_failed")
+		ws.Close(0, "Captcha verification failed")
+		return nil, false
+	}
+
+	return &kiwiircConnection{claims: claims, verified: verified}, true
+}
+
+// makeChannel - Start a client for a new channel of a connection. A channel that can't be opened
+// is closed on its own, leaving the others on the connection as they are
+func (t *TransportKiwiirc) makeChannel(chanID string, ws sockjs.Session, conn *kiwiircConnection, open int) *TransportKiwiircChannel {
+	maxChannels := t.gateway.Config.KiwiircMaxChannels
+	if maxChannels > 0 && open >= maxChannels {
+		t.gateway.Log(2, "Kiwiirc connection from %s has too many channels open", t.gateway.GetRemoteAddressFromRequest(ws.Request()).String())
+		ws.Send(fmt.Sprintf(":%s control closed too_many_channels", chanID))
+		return nil
+	}
+
+	if !t.gateway.connRateLimit.Allow(t.gateway.GetRemoteAddressFromRequest(ws.Request())) {
+		ws.Send(fmt.Sprintf(":%s control closed too_many_connections", chanID))
 		return nil
 	}
 
+	client := t.gateway.NewClient()
+	client.AuthClaims = conn.claims
+	client.Verified = conn.verified
+
 	client.RemoteAddr = t.gateway.GetRemoteAddressFromRequest(ws.Request()).String()
 
-	clientHostnames, err := net.LookupAddr(client.RemoteAddr)
-	if err != nil || len(clientHostnames) == 0 {
-		client.RemoteHostname = client.RemoteAddr
-	} else {
-		// FQDNs include a . at the end. Strip it out
-		potentialHostname := strings.Trim(clientHostnames[0], ".")
-
-		// Must check that the resolved hostname also resolves back to the users IP
-		addr, err := net.LookupIP(potentialHostname)
-		if err == nil && len(addr) == 1 && addr[0].String() == client.RemoteAddr {
-			client.RemoteHostname = potentialHostname
-		} else {
-			client.RemoteHostname = client.RemoteAddr
-		}
-	}
+	client.RemoteHostname = t.gateway.lookupClientHostname(client.RemoteAddr)
 
 	if t.gateway.isRequestSecure(ws.Request()) {
 		client.Tags["secure"] = ""
 	}
+	client.SetTLSState(ws.Request().TLS)
+	client.SetOrigin(ws.Request().Header.Get("Origin"))
+	client.RequestHeaders = ws.Request().Header
+	client.SetRequestCredentials(ws.Request())
+	client.SetAffinityToken(ws.Request())
+	client.SetListener(listenerFromRequest(ws.Request()))
 
 	// This doesn't make sense to have since the remote port may change between requests. Only
 	// here for testing purposes for now.
 	_, remoteAddrPort, _ := net.SplitHostPort(ws.Request().RemoteAddr)
 	client.Tags["remote-port"] = remoteAddrPort
+	if localPort := t.gateway.localPortFromRequest(ws.Request()); localPort != "" {
+		client.Tags["local-port"] = localPort
+	}
 
-	client.Log(2, "New kiwiirc channel on %s from %s %s", ws.Request().Host, client.RemoteAddr, client.RemoteHostname)
+	client.LogEvent(2, "client.connected", "New kiwiirc channel on %s from %s %s", ws.Request().Host, client.RemoteAddr, client.RemoteHostname)
 	client.Ready()
 
 	channel := &TransportKiwiircChannel{
@@ -83,38 +128,49 @@ func (t *TransportKiwiirc) sessionHandler(session sockjs.Session) {
 		}
 	}()
 
+	conn, ok := t.checkConnection(session)
+	if !ok {
+		return
+	}
+
 	channels := cmap.New()
 
 	// Read from sockjs
 	go func() {
 		for {
 			msg, err := session.Recv()
+			if err == nil && t.gateway.lineTooLong(msg) {
+				t.gateway.Log(2, "Closing kiwi connection from %s, message too long", t.gateway.GetRemoteAddressFromRequest(session.Request()).String())
+				session.Close(1009, "Message too long")
+				break
+			}
 			if err == nil && len(msg) > 0 {
 				idEnd := strings.Index(msg, " ")
 				if idEnd == -1 {
 					// msg is in the form of ":chanId"
 					chanID := msg[1:]
 
-					c, channelExists := channels.Get(chanID)
-					if channelExists {
-						channel := c.(*TransportKiwiircChannel)
-						channel.close()
+					// Opening a channel that is already open starts it again, its client closes
+					// as if it had its own connection closed
+					if c, channelExists := channels.Pop(chanID); channelExists {
+						c.(*TransportKiwiircChannel).close()
 					}
 
-					if !channelExists {
-						channel := t.makeChannel(chanID, session)
-						if channel == nil {
-							continue
-						}
-						channels.Set(chanID, channel)
-
-						// When the channel closes, remove it from the map again
-						go func() {
-							<-channel.waitForClose
-							channel.Client.Log(2, "Removing channel from connection")
-							channels.Remove(chanID)
-						}()
+					channel := t.makeChannel(chanID, session, conn, channels.Count())
+					if channel == nil {
+						continue
 					}
+					channels.Set(chanID, channel)
+
+					// When the channel closes, remove it from the map again unless it has been
+					// opened again since
+					go func() {
+						<-channel.waitForClose
+						channel.Client.Log(2, "Removing channel from connection")
+						channels.RemoveCb(chanID, func(key string, v interface{}, exists bool) bool {
+							return exists && v == channel
+						})
+					}()
 
 					session.Send(":" + chanID)
 
@@ -136,9 +192,7 @@ func (t *TransportKiwiirc) sessionHandler(session sockjs.Session) {
 		}
 
 		for channel := range channels.Iter() {
-			c := channel.Val.(*TransportKiwiircChannel)
-			c.Closed = true
-			c.Client.StartShutdown("client_closed")
+			channel.Val.(*TransportKiwiircChannel).close()
 		}
 	}()
 }
@@ -159,24 +213,36 @@ func (c *TransportKiwiircChannel) listenForSignals() {
 			break
 		}
 		c.Client.Log(1, "signal:%s %s", signal[0], signal[1])
+
+		// A closed channel may have been opened again, which must not see what is left of this one
+		c.ClosedLock.Lock()
+		closed := c.Closed
+		c.ClosedLock.Unlock()
+		if closed {
+			continue
+		}
+
 		if signal[0] == "state" {
 			if signal[1] == "connected" {
 				c.Conn.Send(fmt.Sprintf(":%s control connected", c.Id))
 			} else if signal[1] == "closed" {
-				c.Conn.Send(fmt.Sprintf(":%s control closed %s", c.Id, signal[2]))
+				c.Conn.Send(fmt.Sprintf(":%s control closed %s", c.Id, c.Client.Gateway.admission.CloseReason(signal[2])))
 			}
 		}
 
 		if signal[0] == "data" {
 			toSend := strings.Trim(signal[1], "\r\n")
+			c.Client.Stats.RecordSent(len(toSend), len(toSend))
 			c.Conn.Send(fmt.Sprintf(":%s %s", c.Id, toSend))
 		}
 	}
 
 	c.ClosedLock.Lock()
 
-	c.Closed = true
-	close(c.Client.Recv)
+	if !c.Closed {
+		c.Closed = true
+		close(c.Client.Recv)
+	}
 	close(c.waitForClose)
 
 	c.ClosedLock.Unlock()
@@ -186,12 +252,22 @@ func (c *TransportKiwiircChannel) handleIncomingLine(line string) {
 	c.ClosedLock.Lock()
 
 	if !c.Closed {
+		c.Client.Stats.RecordRecv(len(line), len(line))
 		c.Client.Recv <- line
 	}
 
 	c.ClosedLock.Unlock()
 }
 
+// close - Close the channel as if it were a connection of its own that closed. The rest of the
+// connection stays open
 func (c *TransportKiwiircChannel) close() {
-	c.Conn.Close(0, "Requested")
+	c.ClosedLock.Lock()
+
+	if !c.Closed {
+		c.Closed = true
+		close(c.Client.Recv)
+	}
+
+	c.ClosedLock.Unlock()
 }
@@ -0,0 +1,250 @@
+package webircgateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// TransportPolling - Long polling, for when neither websockets nor Server-Sent Events make it
+// through a proxy.
+//
+// POST /webirc/polling/ starts the client and responds with {"session": "<id>"}.
+// GET /webirc/polling/<id>?ack=<seq> waits for lines to the client and responds with
+// {"seq": <seq>, "lines": [...]}, the lines after ack and the seq of the last one. Lines are kept
+// until acknowledged by a later poll so that a response lost on the way is sent again. Once the
+// client has closed, "closed" is set to the reason.
+// POST /webirc/polling/<id> sends lines from the client, one or more separated by \n
+type TransportPolling struct {
+	gateway  *Gateway
+	sessions cmap.ConcurrentMap
+}
+
+type pollingSession struct {
+	*httpSession
+	mu sync.Mutex
+	// queue - Lines that have not been acknowledged, the first being number firstSeq
+	queue    []string
+	firstSeq int
+	// closed / closeReason - Set once the client has closed
+	closed      bool
+	closeReason string
+	lastPoll    time.Time
+	// notify - Wakes up a waiting poll when lines are queued or the client closes
+	notify chan struct{}
+}
+
+const (
+	// pollingWait - How long a poll waits for lines, kept below common proxy timeouts
+	pollingWait = time.Second * 25
+	// pollingTimeout - A session that hasn't been polled for this long is closed
+	pollingTimeout = time.Second * 60
+	// pollingMaxQueue - Unacknowledged lines for a client before it is closed as too slow
+	pollingMaxQueue = 1000
+)
+
+func (t *TransportPolling) Init(g *Gateway) {
+	t.gateway = g
+	t.sessions = cmap.New()
+	t.gateway.HttpRouter.HandleFunc("/webirc/polling/", t.httpHandler)
+}
+
+func (t *TransportPolling) httpHandler(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/webirc/polling/")
+
+	if req.Method == http.MethodPost && id == "" {
+		t.startHandler(w, req)
+		return
+	}
+
+	s, exists := t.sessions.Get(id)
+	if id == "" || !exists {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+	session := s.(*pollingSession)
+
+	if req.Method == http.MethodGet {
+		t.pollHandler(w, req, session)
+	} else if req.Method == http.MethodPost {
+		session.postLines(w, req)
+	} else {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (t *TransportPolling) startHandler(w http.ResponseWriter, req *http.Request) {
+	client, ok := t.gateway.acceptHttpClient(w, req)
+	if !ok {
+		return
+	}
+
+	session := &pollingSession{
+		httpSession: newHttpSession(client, req),
+		firstSeq:    1,
+		lastPoll:    time.Now(),
+		notify:      make(chan struct{}, 1),
+	}
+	t.sessions.Set(session.id, session)
+
+	out, _ := json.Marshal(map[string]interface{}{
+		"session": session.id,
+	})
+	allowCors(w, req)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+
+	client.LogEvent(2, "client.connected", "New polling client on %s from %s %s", req.Host, client.RemoteAddr, client.RemoteHostname)
+	client.Ready()
+
+	go t.queueSignals(session)
+}
+
+// queueSignals - Keep the lines to the client for it to poll, and close it if it stops polling
+func (t *TransportPolling) queueSignals(session *pollingSession) {
+	client := session.client
+	idleCheck := time.NewTicker(time.Second * 10)
+	defer idleCheck.Stop()
+
+	// The session is kept once the client has closed until it has been told why, or stops polling
+	defer t.sessions.Remove(session.id)
+
+	signals := client.Signals
+	for {
+		select {
+		case signal, ok := <-signals:
+			if !ok {
+				signals = nil
+				continue
+			}
+
+			if signal[0] == "data" {
+				line := strings.Trim(signal[1], "\r\n")
+				client.Log(1, "->polling: %s", line)
+				client.Stats.RecordSent(len(line), len(line))
+				if !session.queueLine(line) {
+					client.LogEvent(2, "client.slow", "Disconnecting slow client, %d lines have not been acknowledged", pollingMaxQueue)
+					session.close()
+				}
+			}
+
+			if signal[0] == "state" && signal[1] == "closed" {
+				session.setClosed(t.gateway.admission.CloseReason(signal[2]))
+			}
+
+		case <-idleCheck.C:
+			session.mu.Lock()
+			idle := time.Since(session.lastPoll) > pollingTimeout
+			told := session.closed && len(session.queue) == 0 && signals == nil
+			session.mu.Unlock()
+
+			if idle && signals != nil {
+				client.Log(1, "Polling client stopped polling")
+				session.close()
+			} else if idle || told {
+				return
+			}
+		}
+	}
+}
+
+// queueLine - Returns false if too many lines are waiting to be acknowledged
+func (p *pollingSession) queueLine(line string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.queue) >= pollingMaxQueue {
+		return false
+	}
+	p.queue = append(p.queue, line)
+	p.wake()
+	return true
+}
+
+func (p *pollingSession) setClosed(reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.closeReason = reason
+	p.wake()
+}
+
+// wake - Must be called with mu held
+func (p *pollingSession) wake() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (t *TransportPolling) pollHandler(w http.ResponseWriter, req *http.Request, session *pollingSession) {
+	// Only the page that started the session may read its lines
+	if req.Header.Get("Origin") != session.origin {
+		t.gateway.Log(2, "Polling client polled from origin %#v, which did not start it", req.Header.Get("Origin"))
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	ack, _ := strconv.Atoi(req.URL.Query().Get("ack"))
+
+	session.mu.Lock()
+	session.lastPoll = time.Now()
+	session.acknowledge(ack)
+	waiting := len(session.queue) == 0 && !session.closed
+	if waiting {
+		// Lines queued before this poll have already been sent
+		select {
+		case <-session.notify:
+		default:
+		}
+	}
+	session.mu.Unlock()
+
+	if waiting {
+		timer := time.NewTimer(pollingWait)
+		select {
+		case <-session.notify:
+		case <-timer.C:
+		case <-req.Context().Done():
+		}
+		timer.Stop()
+	}
+
+	session.mu.Lock()
+	session.lastPoll = time.Now()
+	lines := append([]string{}, session.queue...)
+	response := map[string]interface{}{
+		"seq":   session.firstSeq + len(session.queue) - 1,
+		"lines": lines,
+	}
+	if session.closed {
+		response["closed"] = session.closeReason
+	}
+	session.mu.Unlock()
+
+	out, _ := json.Marshal(response)
+	allowCors(w, req)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(out)
+}
+
+// acknowledge - Drop the lines the client has received. Must be called with mu held
+func (p *pollingSession) acknowledge(seq int) {
+	drop := seq - p.firstSeq + 1
+	if drop <= 0 {
+		return
+	}
+	if drop > len(p.queue) {
+		drop = len(p.queue)
+	}
+
+	p.queue = p.queue[drop:]
+	p.firstSeq += drop
+}
@@ -0,0 +1,144 @@
+package webircgateway
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// TransportQuic - IRC over a QUIC connection for native clients, served on the UDP port of each
+// TLS server. The client connects with one of the [quic] alpn protocols and opens one
+// bidirectional stream, sending lines over it ending with \n as it would over TCP
+type TransportQuic struct {
+	gateway *Gateway
+}
+
+func (t *TransportQuic) Init(g *Gateway) {
+	t.gateway = g
+}
+
+func (t *TransportQuic) handleConn(conn quic.EarlyConnection, server *quicServer) {
+	accepted := time.Now()
+
+	remoteHost, remoteAddrPort, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !t.gateway.connRateLimit.Allow(net.ParseIP(remoteHost)) {
+		conn.CloseWithError(0, "Too many connections, please try again later")
+		return
+	}
+
+	// There is no HTTP request to take a token or login from
+	if t.gateway.transportAuthEnabled() {
+		t.gateway.LogEvent(2, "client.auth_failed", "QUIC connection from %s refused, an [auth_*] section is enabled", remoteHost)
+		t.gateway.logRejection(remoteHost, "auth_failed")
+		conn.CloseWithError(0, "Authentication is required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(conn.Context(), time.Second*30)
+	stream, err := conn.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		t.gateway.Log(1, "QUIC connection from %s closed before opening a stream: %s", remoteHost, err.Error())
+		conn.CloseWithError(0, "")
+		return
+	}
+
+	// With allow_0rtt the stream may be opened and lines sent in 0-RTT, which could have been
+	// replayed. A replay never completes the handshake, so nothing is read until it has been
+	select {
+	case <-conn.HandshakeComplete():
+	case <-conn.Context().Done():
+		return
+	}
+
+	client := t.gateway.NewClient()
+	client.TraceTransport("quic.accept", accepted)
+	client.SetListener(server.conf.sectionName)
+
+	client.RemoteAddr = remoteHost
+
+	client.RemoteHostname = t.gateway.lookupClientHostname(client.RemoteAddr)
+
+	// QUIC is always over TLS
+	client.Tags["secure"] = ""
+	tlsState := conn.ConnectionState().TLS
+	client.SetTLSState(&tlsState)
+
+	client.Tags["remote-port"] = remoteAddrPort
+	_, localAddrPort, _ := net.SplitHostPort(conn.LocalAddr().String())
+	client.Tags["local-port"] = localAddrPort
+
+	client.LogEvent(2, "client.connected", "New quic client on %s from %s %s", conn.LocalAddr().String(), client.RemoteAddr, client.RemoteHostname)
+	client.Ready()
+
+	// We wait until the client send queue has been drained
+	var sendDrained sync.WaitGroup
+	sendDrained.Add(1)
+
+	// Read from the stream
+	go func() {
+		reader := bufio.NewReader(stream)
+		for {
+			data, err := reader.ReadString('\n')
+			if err == nil {
+				client.Stats.RecordRecv(len(data), len(data))
+				message := strings.TrimRight(data, "\r\n")
+				client.Log(1, "client->: %s", message)
+				select {
+				case client.Recv <- message:
+				default:
+					client.Log(3, "Recv queue full. Dropping data")
+				}
+
+			} else {
+				client.Log(1, "QUIC connection closed (%s)", err.Error())
+				if appErr, ok := err.(*quic.ApplicationError); ok {
+					client.TransportCloseCode = int(appErr.ErrorCode)
+					client.TransportCloseReason = appErr.ErrorMessage
+				}
+				break
+			}
+		}
+
+		close(client.Recv)
+	}()
+
+	// Once a write has failed the rest are skipped while the client is closing
+	writeFailed := false
+
+	// Process signals for the client
+	for {
+		signal, ok := <-client.Signals
+		if !ok {
+			sendDrained.Done()
+			break
+		}
+
+		if signal[0] == "data" && !writeFailed {
+			line := strings.Trim(signal[1], "\r\n")
+			client.Log(1, "->quic: %s", signal[1])
+			client.Stats.RecordSent(len(line)+1, len(line)+1)
+
+			stream.SetWriteDeadline(client.transportWriteDeadline())
+			_, err := writeLine(stream, line, "\n")
+			if err != nil {
+				// Closing the connection ends the reader which then closes the client
+				writeFailed = true
+				client.transportWriteFailed(err)
+				conn.CloseWithError(0, "")
+			}
+		}
+
+		if signal[0] == "state" && signal[1] == "closed" {
+			stream.Close()
+		}
+	}
+
+	sendDrained.Wait()
+	conn.CloseWithError(0, "")
+}
@@ -0,0 +1,496 @@
+package webircgateway
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// TransportSocketio - Socket.IO for web clients that already speak it, served at /webirc/socketio/
+// for Socket.IO v3 and v4 clients (Engine.IO protocol 4), eg. io(url, {path: "/webirc/socketio/"}).
+//
+// On the default namespace the client emits "irc" events with an IRC line each, and lines to the
+// client are emitted as "irc" events. Once the client has closed, a "closed" event with the reason
+// is emitted before disconnecting. Clients may connect over the polling or websocket transports
+// but a polling connection is not upgraded to a websocket
+type TransportSocketio struct {
+	gateway  *Gateway
+	upgrader websocket.Upgrader
+	sessions cmap.ConcurrentMap
+}
+
+const (
+	socketioPingInterval = time.Second * 25
+	socketioPingTimeout  = time.Second * 20
+	// socketioMaxPayload - The most a client may send in one request or websocket message
+	socketioMaxPayload = 64 * 1024
+	// socketioMaxQueue - Packets waiting for a polling client before it is closed as too slow
+	socketioMaxQueue = 1000
+	// socketioSeparator - Separates the packets of a polling request or response
+	socketioSeparator = "\x1e"
+)
+
+var errSocketioQueueFull = errors.New("too many packets waiting to be polled")
+
+type socketioSession struct {
+	*httpSession
+	// ws - Set if the client connected over a websocket, otherwise it is polling
+	ws      *websocket.Conn
+	wsMu    sync.Mutex
+	mu      sync.Mutex
+	pongDue bool
+	// sendMu - Held while sending Socket.IO packets so none are sent before the connect reply
+	sendMu sync.Mutex
+	// connected / pending - Packets for the client are held until it has connected to the namespace
+	connected bool
+	pending   []string
+	// queue / polling / notify - Packets waiting for the next poll, whether a poll is waiting, and
+	// waking it up
+	queue   []string
+	polling bool
+	notify  chan struct{}
+}
+
+func (t *TransportSocketio) Init(g *Gateway) {
+	t.gateway = g
+	t.sessions = cmap.New()
+	// Origins are checked along with the rest of the handshake before upgrading
+	t.upgrader = websocket.Upgrader{
+		CheckOrigin:     func(req *http.Request) bool { return true },
+		WriteBufferPool: websocketWriteBufferPool,
+	}
+	t.gateway.HttpRouter.HandleFunc("/webirc/socketio/", t.httpHandler)
+}
+
+func (t *TransportSocketio) httpHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if query.Get("EIO") != "4" {
+		socketioError(w, 5, "Unsupported protocol version")
+		return
+	}
+
+	transport := query.Get("transport")
+	id := query.Get("sid")
+
+	if transport == "websocket" && id == "" {
+		t.websocketHandler(w, req)
+		return
+	} else if transport == "websocket" {
+		// Polling connections are offered no upgrades
+		socketioError(w, 3, "Bad request")
+		return
+	} else if transport != "polling" {
+		socketioError(w, 0, "Transport unknown")
+		return
+	}
+
+	if id == "" && req.Method == http.MethodGet {
+		t.startPolling(w, req)
+		return
+	}
+
+	s, exists := t.sessions.Get(id)
+	if id == "" || !exists {
+		socketioError(w, 1, "Session ID unknown")
+		return
+	}
+	session := s.(*socketioSession)
+
+	// Only the page that started the session may poll or post to it
+	if req.Header.Get("Origin") != session.origin {
+		t.gateway.Log(2, "Socket.IO client polled from origin %#v, which did not start it", req.Header.Get("Origin"))
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	if req.Method == http.MethodGet {
+		t.pollHandler(w, req, session)
+	} else if req.Method == http.MethodPost {
+		t.postHandler(w, req, session)
+	} else {
+		socketioError(w, 2, "Bad handshake method")
+	}
+}
+
+// socketioError - Respond with an Engine.IO error
+func socketioError(w http.ResponseWriter, code int, message string) {
+	out, _ := json.Marshal(map[string]interface{}{
+		"code":    code,
+		"message": message,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(out)
+}
+
+// openPacket - The Engine.IO open packet starting the session
+func (s *socketioSession) openPacket() string {
+	out, _ := json.Marshal(map[string]interface{}{
+		"sid":          s.id,
+		"upgrades":     []string{},
+		"pingInterval": int(socketioPingInterval / time.Millisecond),
+		"pingTimeout":  int(socketioPingTimeout / time.Millisecond),
+		"maxPayload":   socketioMaxPayload,
+	})
+	return "0" + string(out)
+}
+
+func (t *TransportSocketio) websocketHandler(w http.ResponseWriter, req *http.Request) {
+	claims, verified, ok := t.gateway.checkHttpHandshake(w, req)
+	if !ok {
+		return
+	}
+
+	upgradeStart := time.Now()
+	ws, err := t.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// The upgrader has already responded with an HTTP error
+		t.gateway.Log(1, "Websocket upgrade failed: %s", err.Error())
+		return
+	}
+	ws.SetReadLimit(socketioMaxPayload)
+
+	client := t.gateway.newHttpClient(req, claims, verified)
+	client.TraceTransport("socketio.upgrade", upgradeStart)
+	session := &socketioSession{httpSession: newHttpSession(client, req), ws: ws}
+
+	if err := session.writePacket(session.openPacket()); err != nil {
+		client.Log(1, "Socket.IO connection closed before starting (%s)", err.Error())
+		session.close()
+	}
+
+	client.LogEvent(2, "client.connected", "New socketio client on %s from %s %s", req.Host, client.RemoteAddr, client.RemoteHostname)
+	client.Ready()
+
+	// Read from websocket
+	go func() {
+		for {
+			packet, err := readWebsocketMessage(ws)
+			if err != nil {
+				client.Log(1, "Websocket connection closed (%s)", err.Error())
+
+				// Keep the close code and reason so that they may be used in the QUIT message
+				if closeErr, ok := err.(*websocket.CloseError); ok {
+					client.TransportCloseCode = closeErr.Code
+					client.TransportCloseReason = closeErr.Text
+				} else {
+					client.TransportCloseCode = websocket.CloseAbnormalClosure
+				}
+				break
+			}
+
+			session.handlePacket(packet)
+		}
+
+		session.close()
+	}()
+
+	t.processSignals(session)
+	ws.Close()
+}
+
+func (t *TransportSocketio) startPolling(w http.ResponseWriter, req *http.Request) {
+	client, ok := t.gateway.acceptHttpClient(w, req)
+	if !ok {
+		return
+	}
+
+	session := &socketioSession{
+		httpSession: newHttpSession(client, req),
+		notify:      make(chan struct{}, 1),
+	}
+	t.sessions.Set(session.id, session)
+
+	allowCors(w, req)
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.Write([]byte(session.openPacket()))
+
+	client.LogEvent(2, "client.connected", "New socketio polling client on %s from %s %s", req.Host, client.RemoteAddr, client.RemoteHostname)
+	client.Ready()
+
+	go func() {
+		t.processSignals(session)
+		session.waitPolled()
+		t.sessions.Remove(session.id)
+	}()
+}
+
+func (t *TransportSocketio) pollHandler(w http.ResponseWriter, req *http.Request, session *socketioSession) {
+	session.mu.Lock()
+	if session.polling {
+		session.mu.Unlock()
+		socketioError(w, 3, "Bad request")
+		return
+	}
+	session.polling = true
+	waiting := len(session.queue) == 0
+	if waiting {
+		// Packets queued before this poll have already been sent
+		select {
+		case <-session.notify:
+		default:
+		}
+	}
+	session.mu.Unlock()
+
+	if waiting {
+		// A ping is queued before this runs out, the noop is only sent if the client misses it
+		timer := time.NewTimer(socketioPingInterval + socketioPingTimeout)
+		select {
+		case <-session.notify:
+		case <-timer.C:
+		case <-req.Context().Done():
+		}
+		timer.Stop()
+	}
+
+	session.mu.Lock()
+	packets := session.queue
+	session.queue = nil
+	session.polling = false
+	session.mu.Unlock()
+
+	if len(packets) == 0 {
+		packets = []string{"6"}
+	}
+
+	allowCors(w, req)
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(strings.Join(packets, socketioSeparator)))
+}
+
+func (t *TransportSocketio) postHandler(w http.ResponseWriter, req *http.Request, session *socketioSession) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, socketioMaxPayload))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	for _, packet := range strings.Split(string(body), socketioSeparator) {
+		session.handlePacket(packet)
+	}
+
+	allowCors(w, req)
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.Write([]byte("ok"))
+}
+
+// processSignals - Emit the lines to the client and ping it until the client has closed
+func (t *TransportSocketio) processSignals(session *socketioSession) {
+	client := session.client
+	ping := time.NewTicker(socketioPingInterval)
+	defer ping.Stop()
+
+	// Once a write has failed the rest are skipped while the client is closing
+	writeFailed := false
+	writeErr := func(err error) {
+		if err == nil || writeFailed {
+			return
+		}
+		writeFailed = true
+		if err == errSocketioQueueFull {
+			client.LogEvent(2, "client.slow", "Disconnecting slow client, %d packets have not been polled", socketioMaxQueue)
+		} else {
+			client.transportWriteFailed(err)
+		}
+		session.close()
+		if session.ws != nil {
+			// Closing the connection ends the reader
+			session.ws.Close()
+		}
+	}
+
+	for {
+		var signal ClientSignal
+		var ok bool
+		select {
+		case signal, ok = <-client.Signals:
+		case <-ping.C:
+			session.mu.Lock()
+			timedOut := session.pongDue
+			session.pongDue = true
+			session.mu.Unlock()
+
+			if timedOut {
+				client.Log(1, "Socket.IO client did not answer a ping")
+				session.close()
+			} else if !writeFailed {
+				writeErr(session.writePacket("2"))
+			}
+			continue
+		}
+		if !ok {
+			break
+		}
+
+		if signal[0] == "data" && !writeFailed {
+			line := strings.Trim(signal[1], "\r\n")
+			client.Log(1, "->socketio: %s", line)
+			client.Stats.RecordSent(len(line), len(line))
+			writeErr(session.emit("irc", line))
+		}
+
+		if signal[0] == "state" && signal[1] == "closed" && !writeFailed {
+			writeErr(session.emit("closed", t.gateway.admission.CloseReason(signal[2])))
+			writeErr(session.writeMessage("1"))
+			writeErr(session.writePacket("1"))
+		}
+	}
+}
+
+// waitPolled - Give a polling client the time to poll the last packets after it has closed
+func (s *socketioSession) waitPolled() {
+	deadline := time.Now().Add(socketioPingInterval)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		polled := len(s.queue) == 0
+		s.mu.Unlock()
+		if polled {
+			return
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// writePacket - Send an Engine.IO packet to the client
+func (s *socketioSession) writePacket(packet string) error {
+	if s.ws != nil {
+		s.wsMu.Lock()
+		defer s.wsMu.Unlock()
+		s.ws.SetWriteDeadline(s.client.transportWriteDeadline())
+		return writeWebsocketMessage(s.ws, websocket.TextMessage, packet)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) >= socketioMaxQueue {
+		return errSocketioQueueFull
+	}
+	s.queue = append(s.queue, packet)
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeMessage - Send a Socket.IO packet to the client, held until it has connected
+func (s *socketioSession) writeMessage(packet string) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if !s.connected {
+		if len(s.pending) >= socketioMaxQueue {
+			return errSocketioQueueFull
+		}
+		s.pending = append(s.pending, packet)
+		return nil
+	}
+
+	return s.writePacket("4" + packet)
+}
+
+func (s *socketioSession) emit(event string, arg string) error {
+	out, _ := json.Marshal([]string{event, arg})
+	return s.writeMessage("2" + string(out))
+}
+
+// handlePacket - An Engine.IO packet from the client
+func (s *socketioSession) handlePacket(packet string) {
+	if packet == "" {
+		return
+	}
+
+	switch packet[0] {
+	case '1':
+		s.client.Log(1, "Socket.IO client closed the connection")
+		s.close()
+	case '3':
+		s.mu.Lock()
+		s.pongDue = false
+		s.mu.Unlock()
+	case '4':
+		s.handleMessage(packet[1:])
+	}
+}
+
+// handleMessage - A Socket.IO packet from the client
+func (s *socketioSession) handleMessage(packet string) {
+	if packet == "" {
+		return
+	}
+
+	switch packet[0] {
+	case '0':
+		s.connect(packet[1:])
+	case '1':
+		s.client.Log(1, "Socket.IO client disconnected")
+		s.close()
+	case '2':
+		// An ack ID may come between the type and the event
+		data := strings.TrimLeft(packet[1:], "0123456789")
+		ackID := packet[1 : len(packet)-len(data)]
+
+		args := []interface{}{}
+		if err := json.Unmarshal([]byte(data), &args); err != nil || len(args) == 0 {
+			s.client.Log(1, "Socket.IO client sent an invalid event")
+			return
+		}
+		if event, _ := args[0].(string); event != "irc" {
+			return
+		}
+
+		for _, arg := range args[1:] {
+			lines, _ := arg.(string)
+			for _, message := range strings.Split(lines, "\n") {
+				message = strings.TrimRight(message, "\r")
+				if message == "" {
+					continue
+				}
+				s.client.Stats.RecordRecv(len(message), len(message))
+				s.client.Log(1, "client->: %s", message)
+				if !s.send(message) {
+					return
+				}
+			}
+		}
+
+		if ackID != "" {
+			s.writeMessage("3" + ackID + "[]")
+		}
+	}
+}
+
+// connect - Connect the client to a namespace, only the default one is served
+func (s *socketioSession) connect(payload string) {
+	if strings.HasPrefix(payload, "/") {
+		namespace := strings.SplitN(payload, ",", 2)[0]
+		out, _ := json.Marshal(map[string]string{"message": "Invalid namespace"})
+		s.writePacket("44" + namespace + "," + string(out))
+		return
+	}
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if s.connected {
+		return
+	}
+	s.connected = true
+
+	out, _ := json.Marshal(map[string]string{"sid": randomToken()})
+	s.writePacket("40" + string(out))
+	for _, packet := range s.pending {
+		s.writePacket("4" + packet)
+	}
+	s.pending = nil
+}
@@ -4,6 +4,7 @@ import (
 	"net"
 	"strings"
 
+	"github.com/gorilla/websocket"
 	"github.com/igm/sockjs-go/sockjs"
 )
 
@@ -13,8 +14,8 @@ type TransportSockjs struct {
 
 func (t *TransportSockjs) Init(g *Gateway) {
 	t.gateway = g
-	sockjsHandler := sockjs.NewHandler("/webirc/sockjs", sockjs.DefaultOptions, t.sessionHandler)
-	t.gateway.HttpRouter.Handle("/webirc/sockjs/", sockjsHandler)
+	sockjsHandler := sockjs.NewHandler("/webirc/sockjs", g.sockjsOptions(), t.sessionHandler)
+	t.gateway.HttpRouter.Handle("/webirc/sockjs/", t.gateway.authSockjsHandler(t.gateway.admission.SockjsHandler(sockjsHandler)))
 }
 
 func (t *TransportSockjs) sessionHandler(session sockjs.Session) {
@@ -23,45 +24,71 @@ func (t *TransportSockjs) sessionHandler(session sockjs.Session) {
 	originHeader := strings.ToLower(session.Request().Header.Get("Origin"))
 	if !t.gateway.IsClientOriginAllowed(originHeader) {
 		client.Log(2, "Origin %s not allowed. Closing connection", originHeader)
+		t.gateway.logRejection(t.gateway.GetRemoteAddressFromRequest(session.Request()).String(), "origin_not_allowed")
 		session.Close(0, "Origin not allowed")
 		return
 	}
 
-	client.RemoteAddr = t.gateway.GetRemoteAddressFromRequest(session.Request()).String()
+	if !t.gateway.connRateLimit.Allow(t.gateway.GetRemoteAddressFromRequest(session.Request())) {
+		session.Close(0, "Too many connections")
+		return
+	}
 
-	clientHostnames, err := net.LookupAddr(client.RemoteAddr)
+	// Sessions may be started without the handshakes that were checked by authSockjsHandler
+	claims, err := t.gateway.authenticateTransport(session.Request())
 	if err != nil {
-		client.RemoteHostname = client.RemoteAddr
-	} else {
-		// FQDNs include a . at the end. Strip it out
-		potentialHostname := strings.Trim(clientHostnames[0], ".")
-
-		// Must check that the resolved hostname also resolves back to the users IP
-		addr, err := net.LookupIP(potentialHostname)
-		if err == nil && len(addr) == 1 && addr[0].String() == client.RemoteAddr {
-			client.RemoteHostname = potentialHostname
-		} else {
-			client.RemoteHostname = client.RemoteAddr
-		}
+		client.LogEvent(2, "client.auth_failed", "Closing connection, %s", err.Error())
+		t.gateway.logRejection(t.gateway.GetRemoteAddressFromRequest(session.Request()).String(), "auth_failed")
+		session.Close(0, "Unauthorized")
+		return
+	}
+	client.AuthClaims = claims
+
+	// Captcha responses can only be verified once so they aren't checked during the handshake
+	client.Verified, err = t.gateway.verifyHandshake(session.Request())
+	if err != nil {
+		client.LogEvent(2, "client.verify_failed", "Closing connection, %s", err.Error())
+		t.gateway.logRejection(t.gateway.GetRemoteAddressFromRequest(session.Request()).String(), "captcha_failed")
+		session.Close(0, "Captcha verification failed")
+		return
 	}
 
+	client.RemoteAddr = t.gateway.GetRemoteAddressFromRequest(session.Request()).String()
+
+	client.RemoteHostname = t.gateway.lookupClientHostname(client.RemoteAddr)
+
 	if t.gateway.isRequestSecure(session.Request()) {
 		client.Tags["secure"] = ""
 	}
+	client.SetTLSState(session.Request().TLS)
+	client.SetOrigin(session.Request().Header.Get("Origin"))
+	client.RequestHeaders = session.Request().Header
+	client.SetRequestCredentials(session.Request())
+	client.SetAffinityToken(session.Request())
+	client.SetListener(listenerFromRequest(session.Request()))
 
 	// This doesn't make sense to have since the remote port may change between requests. Only
 	// here for testing purposes for now.
 	_, remoteAddrPort, _ := net.SplitHostPort(session.Request().RemoteAddr)
 	client.Tags["remote-port"] = remoteAddrPort
+	if localPort := t.gateway.localPortFromRequest(session.Request()); localPort != "" {
+		client.Tags["local-port"] = localPort
+	}
 
-	client.Log(2, "New sockjs client on %s from %s %s", session.Request().Host, client.RemoteAddr, client.RemoteHostname)
+	client.LogEvent(2, "client.connected", "New sockjs client on %s from %s %s", session.Request().Host, client.RemoteAddr, client.RemoteHostname)
 	client.Ready()
 
 	// Read from sockjs
 	go func() {
 		for {
 			msg, err := session.Recv()
+			if err == nil && t.gateway.lineTooLong(msg) {
+				client.Log(2, "Closing sockjs client, message too long")
+				session.Close(1009, "Message too long")
+				break
+			}
 			if err == nil && len(msg) > 0 {
+				client.Stats.RecordRecv(len(msg), len(msg))
 				client.Log(1, "client->: %s", msg)
 				select {
 				case client.Recv <- msg:
@@ -90,11 +117,16 @@ func (t *TransportSockjs) sessionHandler(session sockjs.Session) {
 		if signal[0] == "data" {
 			line := strings.Trim(signal[1], "\r\n")
 			client.Log(1, "->ws: %s", line)
+			client.Stats.RecordSent(len(line), len(line))
 			session.Send(line)
 		}
 
 		if signal[0] == "state" && signal[1] == "closed" {
-			session.Close(0, "Closed")
+			if signal[2] == "server_full" {
+				session.Close(websocket.CloseTryAgainLater, t.gateway.admission.CloseReason(signal[2]))
+			} else {
+				session.Close(0, "Closed")
+			}
 		}
 	}
 }
@@ -0,0 +1,143 @@
+package webircgateway
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// TransportSse - Lines to the client are sent as Server-Sent Events over a long running GET
+// request and lines from the client are POSTed, for networks that strip websocket upgrades but
+// allow plain HTTP streaming.
+//
+// GET /webirc/sse/ starts the client. Its first event is "session" with the ID that lines are
+// then POSTed to at /webirc/sse/<id>, one or more per request separated by \n. Each line to the
+// client is a message event, and a "closed" event with the reason ends the stream
+type TransportSse struct {
+	gateway  *Gateway
+	sessions cmap.ConcurrentMap
+}
+
+// sseKeepaliveInterval - Proxies may close streams that have been idle for a while
+const sseKeepaliveInterval = time.Second * 25
+
+func (t *TransportSse) Init(g *Gateway) {
+	t.gateway = g
+	t.sessions = cmap.New()
+	t.gateway.HttpRouter.HandleFunc("/webirc/sse/", t.httpHandler)
+}
+
+func (t *TransportSse) httpHandler(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/webirc/sse/")
+
+	if req.Method == http.MethodGet && id == "" {
+		t.streamHandler(w, req)
+	} else if req.Method == http.MethodPost && id != "" {
+		t.postHandler(w, req, id)
+	} else {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (t *TransportSse) streamHandler(w http.ResponseWriter, req *http.Request) {
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	client, ok := t.gateway.acceptHttpClient(w, req)
+	if !ok {
+		return
+	}
+
+	session := newHttpSession(client, req)
+	t.sessions.Set(session.id, session)
+
+	allowCors(w, req)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	writer := http.NewResponseController(w)
+	writeEvent := func(event string) error {
+		writer.SetWriteDeadline(client.transportWriteDeadline())
+		_, err := w.Write([]byte(event))
+		if err == nil {
+			err = writer.Flush()
+		}
+		return err
+	}
+
+	client.LogEvent(2, "client.connected", "New sse client on %s from %s %s", req.Host, client.RemoteAddr, client.RemoteHostname)
+	if err := writeEvent(fmt.Sprintf("event: session\ndata: %s\n\n", session.id)); err != nil {
+		client.Log(1, "SSE connection closed before starting (%s)", err.Error())
+		session.close()
+	}
+	client.Ready()
+
+	// The client is closed once the stream ends
+	go func() {
+		<-req.Context().Done()
+		client.Log(1, "SSE connection closed")
+		session.close()
+	}()
+	defer t.sessions.Remove(session.id)
+
+	keepalive := time.NewTicker(sseKeepaliveInterval)
+	defer keepalive.Stop()
+
+	// Once a write has failed the rest are skipped while the client is closing
+	writeFailed := false
+
+	// Process signals for the client
+	for {
+		var signal ClientSignal
+		var ok bool
+		select {
+		case signal, ok = <-client.Signals:
+		case <-keepalive.C:
+			if !writeFailed && writeEvent(":\n\n") != nil {
+				writeFailed = true
+				session.close()
+			}
+			continue
+		}
+		if !ok {
+			break
+		}
+
+		if signal[0] == "data" && !writeFailed {
+			line := strings.Trim(signal[1], "\r\n")
+			client.Log(1, "->sse: %s", line)
+			client.Stats.RecordSent(len(line), len(line))
+
+			err := writeEvent("data: " + line + "\n\n")
+			if err != nil {
+				// Closing the session closes the client, which then ends the stream
+				writeFailed = true
+				client.transportWriteFailed(err)
+				session.close()
+			}
+		}
+
+		if signal[0] == "state" && signal[1] == "closed" && !writeFailed {
+			writeEvent("event: closed\ndata: " + t.gateway.admission.CloseReason(signal[2]) + "\n\n")
+			writeFailed = true
+		}
+	}
+}
+
+func (t *TransportSse) postHandler(w http.ResponseWriter, req *http.Request, id string) {
+	s, exists := t.sessions.Get(id)
+	if !exists {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+
+	s.(*httpSession).postLines(w, req)
+}
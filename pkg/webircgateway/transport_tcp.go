@@ -2,13 +2,26 @@ package webircgateway
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
+	"io"
 	"net"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+	"github.com/kiwiirc/webircgateway/pkg/proxyprotocol"
 )
 
 type TransportTcp struct {
 	gateway *Gateway
+	// AcceptProxyProtocol - Read a PROXY protocol header from connections made by trusted reverse proxies
+	AcceptProxyProtocol bool
+	// Server - The config of the server this transport is listening for
+	Server ConfigServer
+	// running - Set when started for a [server.*] block, which may be stopped when reloading
+	running *runningServer
 }
 
 func (t *TransportTcp) Init(g *Gateway) {
@@ -16,19 +29,41 @@ func (t *TransportTcp) Init(g *Gateway) {
 }
 
 func (t *TransportTcp) Start(lAddr string) {
-	l, err := net.Listen("tcp", lAddr)
+	listeners, err := t.gateway.listen(t.Server, lAddr)
 	if err != nil {
 		t.gateway.Log(3, "TCP error listening: "+err.Error())
 		return
 	}
+	if t.running != nil && !t.running.track(listeners, nil, nil) {
+		return
+	}
+
+	t.gateway.Log(2, "TCP listening on "+lAddr)
+	serveListeners(listeners, func(l net.Listener) error {
+		t.acceptLoop(l)
+		return nil
+	})
+}
+
+func (t *TransportTcp) acceptLoop(l net.Listener) {
 	// Close the listener when the application closes.
 	defer l.Close()
-	t.gateway.Log(2, "TCP listening on "+lAddr)
+	t.gateway.trackListener(l)
+
+	if t.AcceptProxyProtocol {
+		server := t.Server
+		server.AcceptProxyProtocol = true
+		l = t.gateway.maybeWrapProxyProtocol(l, server)
+	}
+	l = t.gateway.maybeLimitListener(l, t.Server)
+
 	for {
 		// Listen for an incoming connection.
 		conn, err := l.Accept()
 		if err != nil {
-			t.gateway.Log(3, "TCP error accepting: "+err.Error())
+			if !t.gateway.IsClosing() && !t.running.isStopped() {
+				t.gateway.Log(3, "TCP error accepting: "+err.Error())
+			}
 			break
 		}
 		// Handle connections in a new goroutine.
@@ -37,30 +72,46 @@ func (t *TransportTcp) Start(lAddr string) {
 }
 
 func (t *TransportTcp) handleConn(conn net.Conn) {
-	client := t.gateway.NewClient()
+	accepted := time.Now()
 
-	client.RemoteAddr = conn.RemoteAddr().String()
+	if proxyConn, ok := conn.(*proxyprotocol.Conn); ok && proxyConn.HeaderError() != nil {
+		t.gateway.Log(2, "TCP connection from %s dropped, %s", proxyConn.Conn.RemoteAddr().String(), proxyConn.HeaderError().Error())
+		conn.Close()
+		return
+	}
 
-	clientHostnames, err := net.LookupAddr(client.RemoteAddr)
-	if err != nil {
-		client.RemoteHostname = client.RemoteAddr
-	} else {
-		// FQDNs include a . at the end. Strip it out
-		potentialHostname := strings.Trim(clientHostnames[0], ".")
-
-		// Must check that the resolved hostname also resolves back to the users IP
-		addr, err := net.LookupIP(potentialHostname)
-		if err == nil && len(addr) == 1 && addr[0].String() == client.RemoteAddr {
-			client.RemoteHostname = potentialHostname
-		} else {
-			client.RemoteHostname = client.RemoteAddr
+	remoteHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !t.gateway.connRateLimit.Allow(net.ParseIP(remoteHost)) {
+		conn.Write([]byte("ERROR :Too many connections, please try again later\r\n"))
+		conn.Close()
+		return
+	}
+
+	var connReader io.Reader = conn
+	if t.Server.TcpProbe != "" {
+		var rejectReason string
+		connReader, rejectReason = t.probeConnection(conn)
+		if rejectReason != "" {
+			t.gateway.Log(2, "TCP probe from %s closed, %s", conn.RemoteAddr().String(), rejectReason)
+			conn.Close()
+			return
 		}
 	}
 
+	client := t.gateway.NewClient()
+	client.TraceTransport("tcp.accept", accepted)
+	client.SetListener(t.Server.sectionName)
+
+	client.RemoteAddr, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+
+	client.RemoteHostname = t.gateway.lookupClientHostname(client.RemoteAddr)
+
 	_, remoteAddrPort, _ := net.SplitHostPort(conn.RemoteAddr().String())
 	client.Tags["remote-port"] = remoteAddrPort
+	_, localAddrPort, _ := net.SplitHostPort(conn.LocalAddr().String())
+	client.Tags["local-port"] = localAddrPort
 
-	client.Log(2, "New tcp client on %s from %s %s", conn.LocalAddr().String(), client.RemoteAddr, client.RemoteHostname)
+	client.LogEvent(2, "client.connected", "New tcp client on %s from %s %s", conn.LocalAddr().String(), client.RemoteAddr, client.RemoteHostname)
 	client.Ready()
 
 	// We wait until the client send queue has been drained
@@ -69,10 +120,11 @@ func (t *TransportTcp) handleConn(conn net.Conn) {
 
 	// Read from TCP
 	go func() {
-		reader := bufio.NewReader(conn)
+		reader := bufio.NewReader(connReader)
 		for {
 			data, err := reader.ReadString('\n')
 			if err == nil {
+				client.Stats.RecordRecv(len(data), len(data))
 				message := strings.TrimRight(data, "\r\n")
 				client.Log(1, "client->: %s", message)
 				select {
@@ -92,6 +144,9 @@ func (t *TransportTcp) handleConn(conn net.Conn) {
 		close(client.Recv)
 	}()
 
+	// Once a write has failed the rest are skipped while the client is closing
+	writeFailed := false
+
 	// Process signals for the client
 	for {
 		signal, ok := <-client.Signals
@@ -100,14 +155,65 @@ func (t *TransportTcp) handleConn(conn net.Conn) {
 			break
 		}
 
-		if signal[0] == "data" {
+		if signal[0] == "data" && !writeFailed {
 			//line := strings.Trim(signal[1], "\r\n")
-			line := signal[1] + "\n"
 			client.Log(1, "->tcp: %s", signal[1])
-			conn.Write([]byte(line))
+			client.Stats.RecordSent(len(signal[1])+1, len(signal[1])+1)
+
+			conn.SetWriteDeadline(client.transportWriteDeadline())
+			_, err := writeLine(conn, signal[1], "\n")
+			if err != nil {
+				// Closing the connection ends the reader which then closes the client
+				writeFailed = true
+				client.transportWriteFailed(err)
+				conn.Close()
+			}
 		}
 	}
 
 	sendDrained.Wait()
 	conn.Close()
 }
+
+// tcpProbeCommands - Commands that IRC clients start their connection with
+var tcpProbeCommands = map[string]bool{"CAP": true, "NICK": true, "USER": true, "PASS": true, "WEBIRC": true}
+
+// probeConnection - Check that the first line sent over the connection looks like IRC and not a
+// scanner. Returns the reader to continue reading the connection from, including the first line,
+// or the reason the connection should be closed
+func (t *TransportTcp) probeConnection(conn net.Conn) (io.Reader, string) {
+	timeout := time.Second * time.Duration(t.Server.TcpProbeTimeout)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	data, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, "first line too long"
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil, fmt.Sprintf("nothing sent within %d seconds", t.Server.TcpProbeTimeout)
+	} else if err != nil {
+		return nil, "closed before sending anything"
+	}
+
+	line := strings.TrimRight(string(data), "\r\n")
+	for _, r := range line {
+		if r < 0x20 && r != '\t' {
+			return nil, "binary data sent"
+		}
+	}
+	if strings.Contains(line, " HTTP/") {
+		return nil, "HTTP request sent"
+	}
+
+	message, err := irc.ParseLine(line)
+	if err != nil {
+		return nil, "first line is not IRC"
+	}
+	if t.Server.TcpProbe == "strict" && !tcpProbeCommands[strings.ToUpper(message.Command)] {
+		return nil, "first line is not an IRC registration command"
+	}
+
+	// The first line has been read so it is put back in front of the rest of the connection
+	return io.MultiReader(bytes.NewReader(append([]byte{}, data...)), reader), ""
+}
@@ -1,74 +1,131 @@
 package webircgateway
 
 import (
-	"fmt"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
-	"golang.org/x/net/websocket"
+	"github.com/gorilla/websocket"
 )
 
 type TransportWebsocket struct {
 	gateway  *Gateway
-	wsServer *websocket.Server
+	upgrader websocket.Upgrader
 }
 
 func (t *TransportWebsocket) Init(g *Gateway) {
 	t.gateway = g
-	t.wsServer = &websocket.Server{Handler: t.websocketHandler, Handshake: t.checkOrigin}
-	t.gateway.HttpRouter.Handle("/webirc/websocket/", t.wsServer)
+	t.upgrader = websocket.Upgrader{
+		CheckOrigin:       t.checkOrigin,
+		EnableCompression: g.Config.WebsocketCompression,
+		Subprotocols:      g.Config.WebsocketSubprotocols,
+		WriteBufferPool:   websocketWriteBufferPool,
+	}
+	t.gateway.HttpRouter.HandleFunc("/webirc/websocket/", t.httpHandler)
 }
 
-func (t *TransportWebsocket) checkOrigin(config *websocket.Config, req *http.Request) (err error) {
-	config.Origin, err = websocket.Origin(config, req)
+func (t *TransportWebsocket) checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if !t.gateway.IsClientOriginAllowed(origin) {
+		t.gateway.Log(2, "Origin %#v not allowed. Closing connection", origin)
+		t.gateway.logRejection(t.gateway.GetRemoteAddressFromRequest(req).String(), "origin_not_allowed")
+		return false
+	}
+
+	return true
+}
+
+func (t *TransportWebsocket) httpHandler(w http.ResponseWriter, req *http.Request) {
+	if t.gateway.admission.RejectHandshake(w) {
+		return
+	}
+	if t.gateway.connRateLimit.RejectHandshake(w, req) {
+		return
+	}
+	if t.gateway.ipLimits.RejectHandshake(w, req) {
+		return
+	}
+	claims, rejected := t.gateway.rejectUnauthenticated(w, req)
+	if rejected {
+		return
+	}
+	verified, err := t.gateway.verifyHandshake(req)
+	if err != nil {
+		remoteAddr := t.gateway.GetRemoteAddressFromRequest(req).String()
+		t.gateway.LogEvent(2, "client.verify_failed", "Connection from %s refused, %s", remoteAddr, err.Error())
+		t.gateway.logRejection(remoteAddr, "captcha_failed")
+		http.Error(w, "Captcha verification failed", http.StatusForbidden)
+		return
+	}
 
-	var origin string
-	if config.Origin != nil {
-		origin = config.Origin.String()
-	} else {
-		origin = ""
+	// The size of compressed messages is counted on the connection
+	var counter *wireCounter
+	if t.gateway.Config.WebsocketCompression && offersDeflate(req) {
+		counter = &wireCounter{}
+		w = &countingResponseWriter{ResponseWriter: w, counter: counter}
 	}
 
-	if !t.gateway.IsClientOriginAllowed(origin) {
-		err = fmt.Errorf("Origin %#v not allowed", origin)
-		t.gateway.Log(2, "%s. Closing connection", err)
-		return err
+	upgradeStart := time.Now()
+	ws, err := t.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// The upgrader has already responded with an HTTP error
+		t.gateway.Log(1, "Websocket upgrade failed: %s", err.Error())
+		return
+	}
+	if maxLength := t.gateway.Config.MaxLineLength; maxLength > 0 {
+		ws.SetReadLimit(int64(maxLength))
+	}
+	if counter != nil {
+		ws.SetCompressionLevel(t.gateway.Config.WebsocketCompressionLevel)
 	}
 
-	return err
+	t.websocketHandler(ws, req, upgradeStart, claims, verified, counter)
 }
 
-func (t *TransportWebsocket) websocketHandler(ws *websocket.Conn) {
+func (t *TransportWebsocket) websocketHandler(ws *websocket.Conn, req *http.Request, upgradeStart time.Time, claims map[string]interface{}, verified bool, counter *wireCounter) {
 	client := t.gateway.NewClient()
+	client.TraceTransport("websocket.upgrade", upgradeStart)
+	client.Stats.SetCompressed(counter != nil)
+	client.AuthClaims = claims
+	client.Verified = verified
 
-	client.RemoteAddr = t.gateway.GetRemoteAddressFromRequest(ws.Request()).String()
+	client.RemoteAddr = t.gateway.GetRemoteAddressFromRequest(req).String()
 
-	clientHostnames, err := net.LookupAddr(client.RemoteAddr)
-	if err != nil {
-		client.RemoteHostname = client.RemoteAddr
-	} else {
-		// FQDNs include a . at the end. Strip it out
-		potentialHostname := strings.Trim(clientHostnames[0], ".")
-
-		// Must check that the resolved hostname also resolves back to the users IP
-		addr, err := net.LookupIP(potentialHostname)
-		if err == nil && len(addr) == 1 && addr[0].String() == client.RemoteAddr {
-			client.RemoteHostname = potentialHostname
-		} else {
-			client.RemoteHostname = client.RemoteAddr
-		}
-	}
+	client.RemoteHostname = t.gateway.lookupClientHostname(client.RemoteAddr)
 
-	if t.gateway.isRequestSecure(ws.Request()) {
+	if t.gateway.isRequestSecure(req) {
 		client.Tags["secure"] = ""
 	}
-
-	_, remoteAddrPort, _ := net.SplitHostPort(ws.Request().RemoteAddr)
+	client.SetTLSState(req.TLS)
+	client.SetOrigin(req.Header.Get("Origin"))
+	client.RequestHeaders = req.Header
+	client.SetRequestCredentials(req)
+	client.SetAffinityToken(req)
+	client.SetListener(listenerFromRequest(req))
+
+	_, remoteAddrPort, _ := net.SplitHostPort(req.RemoteAddr)
 	client.Tags["remote-port"] = remoteAddrPort
+	if localPort := t.gateway.localPortFromRequest(req); localPort != "" {
+		client.Tags["local-port"] = localPort
+	}
+
+	// IRCv3 websocket clients choose between text messages, which must be valid UTF-8, and binary
+	// messages carrying the bytes of lines as they are, eg. for networks using legacy encodings
+	messageType := websocket.TextMessage
+	if ws.Subprotocol() == "binary.ircv3.net" || (ws.Subprotocol() == "" && t.gateway.Config.WebsocketBinary) {
+		messageType = websocket.BinaryMessage
+		client.RawBytes = true
+	}
+	validUtf8 := ws.Subprotocol() == "text.ircv3.net"
 
-	client.Log(2, "New websocket client on %s from %s %s", ws.Request().Host, client.RemoteAddr, client.RemoteHostname)
+	conf, _ := t.gateway.listenerConfig(listenerFromRequest(req))
+	keepalive := newWebsocketKeepalive(ws, conf)
+	keepaliveDone := make(chan struct{})
+	go keepalive.run(client, keepaliveDone)
+
+	client.LogEvent(2, "client.connected", "New websocket client on %s from %s %s", req.Host, client.RemoteAddr, client.RemoteHostname)
 	client.Ready()
 
 	// We wait until the client send queue has been drained
@@ -78,10 +135,15 @@ func (t *TransportWebsocket) websocketHandler(ws *websocket.Conn) {
 	// Read from websocket
 	go func() {
 		for {
-			r := make([]byte, 1024)
-			len, err := ws.Read(r)
-			if err == nil && len > 0 {
-				message := string(r[:len])
+			// Approximate, the connection is read ahead of the message through a buffer. Over many
+			// messages the total is close to what was received
+			readFrom := counter.bytesRead()
+			message, err := readWebsocketMessage(ws)
+			if err == nil {
+				keepalive.received()
+			}
+			if err == nil && len(message) > 0 {
+				client.Stats.RecordRecv(len(message), int(counter.bytesRead()-readFrom))
 				client.Log(1, "client->: %s", message)
 				select {
 				case client.Recv <- message:
@@ -92,9 +154,25 @@ func (t *TransportWebsocket) websocketHandler(ws *websocket.Conn) {
 
 			} else if err != nil {
 				client.Log(1, "Websocket connection closed (%s)", err.Error())
+
+				// Keep the close code and reason so that they may be used in the QUIT message
+				if closeErr, ok := err.(*websocket.CloseError); ok {
+					client.TransportCloseCode = closeErr.Code
+					client.TransportCloseReason = closeErr.Text
+				} else {
+					client.TransportCloseCode = websocket.CloseAbnormalClosure
+				}
+
+				// The client is told that it stopped answering pings or sent nothing for too long
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					reason := keepalive.timeoutReason()
+					client.Log(2, "Closing websocket client, %s", reason)
+					closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+					ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+				}
 				break
 
-			} else if len == 0 {
+			} else if len(message) == 0 {
 				client.Log(1, "Got 0 bytes from websocket")
 			}
 		}
@@ -102,21 +180,53 @@ func (t *TransportWebsocket) websocketHandler(ws *websocket.Conn) {
 		close(client.Recv)
 	}()
 
+	// Once a write has failed the rest are skipped while the client is closing
+	writeFailed := false
+
+	// IRCv3 websocket clients expect a single line per message so only others have lines batched
+	batchSize := t.gateway.Config.WebsocketBatchSize
+	if ws.Subprotocol() != "" {
+		batchSize = 0
+	}
+	signals := newWebsocketBatcher(client.Signals, batchSize, time.Millisecond*time.Duration(t.gateway.Config.WebsocketBatchInterval))
+
 	// Process signals for the client
 	for {
-		signal, ok := <-client.Signals
+		signal, ok := signals.next()
 		if !ok {
+			close(keepaliveDone)
 			sendDrained.Done()
 			break
 		}
 
-		if signal[0] == "data" {
+		if signal[0] == "data" && !writeFailed {
 			line := strings.Trim(signal[1], "\r\n")
+			if validUtf8 {
+				line = strings.ToValidUTF8(line, "\uFFFD")
+			}
 			client.Log(1, "->ws: %s", line)
-			ws.Write([]byte(line))
+
+			writtenFrom := counter.bytesWritten()
+			ws.SetWriteDeadline(client.transportWriteDeadline())
+			err := writeWebsocketMessage(ws, messageType, line)
+			client.Stats.RecordSent(len(line), int(counter.bytesWritten()-writtenFrom))
+			if err != nil {
+				// Closing the connection ends the reader which then closes the client
+				writeFailed = true
+				client.transportWriteFailed(err)
+				ws.Close()
+			}
 		}
 
 		if signal[0] == "state" && signal[1] == "closed" {
+			switch signal[2] {
+			case "server_full":
+				closeMsg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, t.gateway.admission.CloseReason(signal[2]))
+				ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+			case "gateway_shutdown":
+				closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, signal[2])
+				ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+			}
 			ws.Close()
 		}
 	}
@@ -0,0 +1,197 @@
+package webircgateway
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// TransportWebtransport - IRC over a WebTransport session, served over HTTP/3 by the QUIC server on
+// the UDP port of each TLS server. The client opens one bidirectional stream and sends lines over
+// it ending with \n, as it would over TCP
+type TransportWebtransport struct {
+	gateway *Gateway
+}
+
+type webtransportContextKey struct{}
+
+func (t *TransportWebtransport) Init(g *Gateway) {
+	t.gateway = g
+	t.gateway.HttpRouter.HandleFunc("/webirc/webtransport/", t.httpHandler)
+}
+
+func (t *TransportWebtransport) httpHandler(w http.ResponseWriter, req *http.Request) {
+	server, _ := req.Context().Value(webtransportContextKey{}).(*quicServer)
+	if server == nil || req.Method != http.MethodConnect {
+		http.Error(w, "WebTransport requires HTTP/3", http.StatusBadRequest)
+		return
+	}
+
+	if t.gateway.admission.RejectHandshake(w) {
+		return
+	}
+	if t.gateway.connRateLimit.RejectHandshake(w, req) {
+		return
+	}
+	claims, rejected := t.gateway.rejectUnauthenticated(w, req)
+	if rejected {
+		return
+	}
+	verified, err := t.gateway.verifyHandshake(req)
+	if err != nil {
+		remoteAddr := t.gateway.GetRemoteAddressFromRequest(req).String()
+		t.gateway.LogEvent(2, "client.verify_failed", "Connection from %s refused, %s", remoteAddr, err.Error())
+		t.gateway.logRejection(remoteAddr, "captcha_failed")
+		http.Error(w, "Captcha verification failed", http.StatusForbidden)
+		return
+	}
+
+	upgradeStart := time.Now()
+	session, err := server.webtransport.Upgrade(w, req)
+	if err != nil {
+		t.gateway.Log(1, "WebTransport upgrade failed: %s", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// The session ends when this returns
+	server.sessionStarted()
+	defer server.sessionEnded()
+
+	ctx, cancel := context.WithTimeout(session.Context(), time.Second*30)
+	stream, err := session.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		t.gateway.Log(1, "WebTransport session closed before opening a stream: %s", err.Error())
+		session.CloseWithError(0, "")
+		return
+	}
+
+	t.sessionHandler(session, stream, req, upgradeStart, claims, verified)
+}
+
+func (t *TransportWebtransport) sessionHandler(session *webtransport.Session, stream webtransport.Stream, req *http.Request, upgradeStart time.Time, claims map[string]interface{}, verified bool) {
+	client := t.gateway.NewClient()
+	client.TraceTransport("webtransport.upgrade", upgradeStart)
+	client.AuthClaims = claims
+	client.Verified = verified
+
+	client.RemoteAddr = t.gateway.GetRemoteAddressFromRequest(req).String()
+
+	client.RemoteHostname = t.gateway.lookupClientHostname(client.RemoteAddr)
+
+	// HTTP/3 is always over TLS
+	client.Tags["secure"] = ""
+	client.SetTLSState(req.TLS)
+	client.SetOrigin(req.Header.Get("Origin"))
+	client.RequestHeaders = req.Header
+	client.SetRequestCredentials(req)
+	client.SetAffinityToken(req)
+	client.SetListener(listenerFromRequest(req))
+
+	_, remoteAddrPort, _ := net.SplitHostPort(req.RemoteAddr)
+	client.Tags["remote-port"] = remoteAddrPort
+	if localPort := t.gateway.localPortFromRequest(req); localPort != "" {
+		client.Tags["local-port"] = localPort
+	}
+
+	client.LogEvent(2, "client.connected", "New webtransport client on %s from %s %s", req.Host, client.RemoteAddr, client.RemoteHostname)
+	client.Ready()
+
+	// We wait until the client send queue has been drained
+	var sendDrained sync.WaitGroup
+	sendDrained.Add(1)
+
+	// Read from the stream
+	go func() {
+		reader := bufio.NewReader(stream)
+		for {
+			data, err := reader.ReadString('\n')
+			if err == nil {
+				client.Stats.RecordRecv(len(data), len(data))
+				message := strings.TrimRight(data, "\r\n")
+				client.Log(1, "client->: %s", message)
+				select {
+				case client.Recv <- message:
+				default:
+					client.Log(3, "Recv queue full. Dropping data")
+				}
+
+			} else {
+				client.Log(1, "WebTransport connection closed (%s)", err.Error())
+				if sessionErr, ok := err.(*webtransport.SessionError); ok {
+					client.TransportCloseCode = int(sessionErr.ErrorCode)
+					client.TransportCloseReason = sessionErr.Message
+				}
+				break
+			}
+		}
+
+		close(client.Recv)
+	}()
+
+	// Once a write has failed the rest are skipped while the client is closing
+	writeFailed := false
+
+	// Process signals for the client
+	for {
+		signal, ok := <-client.Signals
+		if !ok {
+			sendDrained.Done()
+			break
+		}
+
+		if signal[0] == "data" && !writeFailed {
+			line := strings.Trim(signal[1], "\r\n")
+			client.Log(1, "->webtransport: %s", signal[1])
+			client.Stats.RecordSent(len(line)+1, len(line)+1)
+
+			stream.SetWriteDeadline(client.transportWriteDeadline())
+			_, err := writeLine(stream, line, "\n")
+			if err != nil {
+				// Closing the session ends the reader which then closes the client
+				writeFailed = true
+				client.transportWriteFailed(err)
+				session.CloseWithError(0, "")
+			}
+		}
+
+		if signal[0] == "state" && signal[1] == "closed" {
+			stream.Close()
+			session.CloseWithError(0, t.gateway.admission.CloseReason(signal[2]))
+		}
+	}
+
+	sendDrained.Wait()
+	session.CloseWithError(0, "")
+}
+
+// newWebtransportServer - The HTTP/3 server for connections to a QUIC server that negotiated h3
+func (s *Gateway) newWebtransportServer(q *quicServer) *webtransport.Server {
+	return &webtransport.Server{
+		H3: http3.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				ctx := context.WithValue(req.Context(), listenerContextKey{}, q.conf.sectionName)
+				ctx = context.WithValue(ctx, webtransportContextKey{}, q)
+				s.HttpRouter.ServeHTTP(w, req.WithContext(ctx))
+			}),
+		},
+		// Origins are checked against allowed_origins
+		CheckOrigin: func(req *http.Request) bool {
+			origin := req.Header.Get("Origin")
+			if !s.IsClientOriginAllowed(origin) {
+				s.Log(2, "Origin %#v not allowed. Closing connection", origin)
+				s.logRejection(s.GetRemoteAddressFromRequest(req).String(), "origin_not_allowed")
+				return false
+			}
+			return true
+		},
+	}
+}
@@ -0,0 +1,192 @@
+//go:build !windows
+// +build !windows
+
+package webircgateway
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables telling a process started by Upgrade() which of its file descriptors are
+// the listeners it takes over, and which to report back on once it has started
+const (
+	upgradeListenersEnv = "WEBIRCGATEWAY_UPGRADE_LISTENERS"
+	upgradeReadyFdEnv   = "WEBIRCGATEWAY_UPGRADE_READY_FD"
+)
+
+// How long the new process has to start before the upgrade is abandoned
+const upgradeStartTimeout = time.Second * 30
+
+// Upgrade - Start a new gateway process from the current binary and config, passing it the
+// listening sockets so that no connections are refused while it starts. Once it has started this
+// process stops accepting connections and drains its clients as it would when closing, leaving
+// their connections open until they leave or shutdown_timeout passes
+func (s *Gateway) Upgrade() error {
+	if s.IsClosing() {
+		return errors.New("The gateway is already shutting down")
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	s.httpSrvsMu.Lock()
+	addrs := []string{}
+	files := []*os.File{}
+	for addr, listener := range s.handoffListeners {
+		fileListener, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		file, err := fileListener.File()
+		if err != nil {
+			s.httpSrvsMu.Unlock()
+			closeFiles(files)
+			return fmt.Errorf("Error passing on listener %s: %s", addr, err.Error())
+		}
+		addrs = append(addrs, addr)
+		files = append(files, file)
+	}
+	s.httpSrvsMu.Unlock()
+	defer closeFiles(files)
+
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyRead.Close()
+
+	// The passed files start at fd 3, after stdin, stdout and stderr
+	env := []string{}
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, upgradeListenersEnv+"=") && !strings.HasPrefix(v, upgradeReadyFdEnv+"=") {
+			env = append(env, v)
+		}
+	}
+	env = append(env,
+		upgradeListenersEnv+"="+strings.Join(addrs, ","),
+		upgradeReadyFdEnv+"="+strconv.Itoa(3+len(files)),
+	)
+
+	// The new process creates the control socket again at the same path
+	s.controlSocket.Close()
+
+	procFiles := append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...)
+	procFiles = append(procFiles, readyWrite)
+	process, err := os.StartProcess(binary, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: procFiles,
+	})
+	readyWrite.Close()
+	if err != nil {
+		go s.controlSocket.Run()
+		return err
+	}
+
+	s.Log(2, "Started new gateway process %d, waiting for it to be ready", process.Pid)
+
+	// The new process writes to the pipe once started, or it is closed if the process exits
+	ready := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, _ := readyRead.Read(buf)
+		ready <- n > 0
+	}()
+
+	started := false
+	select {
+	case started = <-ready:
+	case <-time.After(upgradeStartTimeout):
+	}
+
+	if !started {
+		pid := process.Pid
+		process.Kill()
+		process.Release()
+		go s.controlSocket.Run()
+		return fmt.Errorf("New gateway process %d failed to start", pid)
+	}
+
+	// Release() clears the pid
+	s.Log(2, "New gateway process %d has started, draining clients from this process", process.Pid)
+	process.Release()
+
+	// The new process listens on the same socket files, so closing ours must not remove them
+	s.httpSrvsMu.Lock()
+	for _, listener := range s.handoffListeners {
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	s.httpSrvsMu.Unlock()
+	go s.Close()
+
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// inheritUpgradeListeners - Take the listeners passed from the process that upgraded to this one.
+// Any that none of the configured servers use are closed
+func (s *Gateway) inheritUpgradeListeners() {
+	addrs := os.Getenv(upgradeListenersEnv)
+	if addrs == "" {
+		return
+	}
+	os.Unsetenv(upgradeListenersEnv)
+
+	inUse := map[string]bool{}
+	for _, conf := range s.Config.Servers {
+		addr := serverListenAddr(conf)
+		inUse[addr] = true
+		for i := 2; i <= conf.Listeners; i++ {
+			inUse[fmt.Sprintf("%s#%d", addr, i)] = true
+		}
+	}
+
+	s.httpSrvsMu.Lock()
+	defer s.httpSrvsMu.Unlock()
+
+	for i, addr := range strings.Split(addrs, ",") {
+		listener, err := listenOnFd(3+i, addr)
+		if err != nil {
+			s.Log(3, "Error taking over listener %s: %s", addr, err.Error())
+			continue
+		}
+
+		if !inUse[addr] {
+			s.Log(2, "Closing listener %s as no server uses it any more", addr)
+			listener.Close()
+			continue
+		}
+
+		s.upgradeListeners[addr] = listener
+	}
+}
+
+// notifyUpgradeReady - Tell the process that upgraded to this one that it has started
+func (s *Gateway) notifyUpgradeReady() {
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyFdEnv))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(upgradeReadyFdEnv)
+
+	pipe := os.NewFile(uintptr(fd), "upgrade-ready")
+	if pipe == nil {
+		return
+	}
+	pipe.Write([]byte{1})
+	pipe.Close()
+}
@@ -0,0 +1,12 @@
+package webircgateway
+
+import "errors"
+
+// Upgrade - Passing listeners to a new process is not supported on Windows
+func (s *Gateway) Upgrade() error {
+	return errors.New("Upgrading is not supported on Windows")
+}
+
+func (s *Gateway) inheritUpgradeListeners() {}
+
+func (s *Gateway) notifyUpgradeReady() {}
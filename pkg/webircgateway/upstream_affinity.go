@@ -0,0 +1,86 @@
+package webircgateway
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Longer reconnect tokens are ignored so that clients can't fill the affinity map with large keys
+const maxAffinityTokenLength = 128
+
+// UpstreamAffinity - Remembers which upstream a client was sent to so that when it reconnects
+// it is sent to the same upstream again
+type UpstreamAffinity struct {
+	mu      sync.Mutex
+	entries map[string]upstreamAffinityEntry
+}
+
+type upstreamAffinityEntry struct {
+	upstream string
+	expires  time.Time
+}
+
+func NewUpstreamAffinity() *UpstreamAffinity {
+	a := &UpstreamAffinity{
+		entries: make(map[string]upstreamAffinityEntry),
+	}
+
+	go a.runGarbageCollectionLoop()
+	return a
+}
+
+// Get - The upstream address last used for this affinity key, if it has not expired
+func (a *UpstreamAffinity) Get(key string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry, exists := a.entries[key]
+	if !exists || entry.expires.Before(time.Now()) {
+		return "", false
+	}
+
+	return entry.upstream, true
+}
+
+// Set - Remember the upstream address for this affinity key for ttl
+func (a *UpstreamAffinity) Set(key string, upstream string, ttl time.Duration) {
+	a.mu.Lock()
+	a.entries[key] = upstreamAffinityEntry{
+		upstream: upstream,
+		expires:  time.Now().Add(ttl),
+	}
+	a.mu.Unlock()
+}
+
+func (a *UpstreamAffinity) runGarbageCollectionLoop() {
+	for {
+		time.Sleep(time.Minute)
+
+		a.mu.Lock()
+		now := time.Now()
+		for key, entry := range a.entries {
+			if entry.expires.Before(now) {
+				delete(a.entries, key)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+// SetAffinityToken - Keep the reconnect token the client sent with its request, if upstream
+// affinity is keyed by them. The page picks the token, eg. one saved in the browser, and sends
+// it again when reconnecting
+func (c *Client) SetAffinityToken(req *http.Request) {
+	cfg := c.Gateway.Config
+	if cfg.UpstreamAffinity != "token" {
+		return
+	}
+
+	token := req.URL.Query().Get(cfg.UpstreamAffinityParam)
+	if len(token) > maxAffinityTokenLength {
+		return
+	}
+
+	c.affinityToken = token
+}
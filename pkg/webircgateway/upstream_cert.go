@@ -0,0 +1,69 @@
+package webircgateway
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// UpstreamCerts - The client certificates presented to upstreams over TLS, eg. for CertFP or SASL
+// EXTERNAL. Like the servers certificates, the files are read again when they change
+type UpstreamCerts struct {
+	gateway *Gateway
+	mu      sync.Mutex
+	stores  map[string]*CertStore
+}
+
+func NewUpstreamCerts(gateway *Gateway) *UpstreamCerts {
+	return &UpstreamCerts{
+		gateway: gateway,
+		stores:  make(map[string]*CertStore),
+	}
+}
+
+// Get - The certificate from a cert and key file
+func (u *UpstreamCerts) Get(certFile string, keyFile string) (*tls.Certificate, error) {
+	key := certFile + "\x00" + keyFile
+
+	u.mu.Lock()
+	store, exists := u.stores[key]
+	if !exists {
+		store = NewCertStore(u.gateway, certFile, keyFile)
+		if err := store.Load(); err != nil {
+			u.mu.Unlock()
+			return nil, err
+		}
+		u.stores[key] = store
+	}
+	u.mu.Unlock()
+
+	return store.GetCertificate(nil)
+}
+
+// Reset - Forget the loaded certificates so that they are read again when next used
+func (u *UpstreamCerts) Reset() {
+	u.mu.Lock()
+	u.stores = make(map[string]*CertStore)
+	u.mu.Unlock()
+}
+
+// upstreamClientCertificate - The certificate to present to an upstream for this client, if any.
+// Plugins may choose a different one for each client
+func (c *Client) upstreamClientCertificate(upstream *ConfigUpstream) (*tls.Certificate, error) {
+	hook := &HookIrcClientCertificate{
+		Client:         c,
+		UpstreamConfig: upstream,
+	}
+
+	if upstream.ClientCertFile != "" {
+		cert, err := c.Gateway.upstreamCerts.Get(upstream.ClientCertFile, upstream.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		hook.Certificate = cert
+	}
+
+	hookSpan := c.traceHook("irc.client_certificate")
+	hook.Dispatch("irc.client_certificate")
+	hookSpan.End()
+	return hook.Certificate, nil
+}
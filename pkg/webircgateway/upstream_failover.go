@@ -0,0 +1,110 @@
+package webircgateway
+
+import (
+	"io"
+	"net"
+	"strconv"
+)
+
+// startFailover - Pick the host of its upstream that the client connects to first, and the
+// failover hosts it may be moved to if that fails
+func (c *Client) startFailover() {
+	// Reconnecting starts again from the upstream as it was chosen rather than the host it was on
+	if c.upstreamBlock == nil {
+		block := *c.UpstreamConfig
+		c.upstreamBlock = &block
+	}
+	upstream := *c.upstreamBlock
+	c.UpstreamConfig = &upstream
+
+	hosts := c.Gateway.upstreamHosts.Order(upstream)
+	c.setUpstreamHost(hosts[0])
+
+	hosts = hosts[1:]
+	if limit := c.UpstreamConfig.FailoverAttempts; limit > 0 && len(hosts) > limit {
+		hosts = hosts[:limit]
+	}
+	c.failoverHosts = hosts
+}
+
+// setUpstreamHost - Point the clients upstream at one of its hosts. A copy so that other clients
+// on the same upstream are not moved too
+func (c *Client) setUpstreamHost(address string) {
+	if address == upstreamAddrKey(*c.UpstreamConfig) {
+		return
+	}
+
+	host, portStr, _ := net.SplitHostPort(address)
+	upstream := *c.UpstreamConfig
+	upstream.Hostname = host
+	upstream.Port, _ = strconv.Atoi(portStr)
+	c.UpstreamConfig = &upstream
+}
+
+// upstreamHostFailed - Count a failed connection against the clients current upstream host
+func (c *Client) upstreamHostFailed() {
+	c.Gateway.upstreamHosts.Failed(*c.UpstreamConfig, upstreamAddrKey(*c.UpstreamConfig))
+}
+
+// nextFailoverHost - Point the clients upstream at the next failover host. Returns false if there
+// are none left to try
+func (c *Client) nextFailoverHost() bool {
+	if len(c.failoverHosts) == 0 || c.IsShuttingDown() {
+		return false
+	}
+
+	failed := upstreamAddrKey(*c.UpstreamConfig)
+	c.setUpstreamHost(c.failoverHosts[0])
+	c.failoverHosts = c.failoverHosts[1:]
+
+	c.LogEvent(3, "upstream.failover", "Upstream %s failed, trying %s", failed, upstreamAddrKey(*c.UpstreamConfig))
+	return true
+}
+
+// dialUpstreamHosts - Connect to the clients upstream, moving on to its failover hosts in turn
+// if it can't be reached
+func (c *Client) dialUpstreamHosts() (io.ReadWriteCloser, string, error) {
+	connection, errString, err := c.dialUpstreamWithRetries(c.UpstreamConfig)
+	for err != nil {
+		c.upstreamHostFailed()
+		if !c.nextFailoverHost() {
+			break
+		}
+		connection, errString, err = c.dialUpstreamWithRetries(c.UpstreamConfig)
+	}
+
+	return connection, errString, err
+}
+
+// reconnectUpstream - Connect the client to its upstream again after the connection closed,
+// replaying what the client sent to register. Returns false if it could not be connected again
+func (c *Client) reconnectUpstream() bool {
+	// The previous connection has been closed and its reader has finished with this
+	c.UpstreamRecv = make(chan string, 50)
+
+	upstream, errString, err := c.dialUpstreamHosts()
+	if err != nil {
+		c.upstreamCloseReason = errString
+		return false
+	}
+
+	c.LogEvent(2, "upstream.connected", "Connected to upstream %s", upstreamAddrKey(*c.UpstreamConfig))
+	c.Gateway.Clients.indexUpstreamHost(c)
+	c.upstreamCloseReason = ""
+	c.registrationSpan = c.traceSpan.StartChild("irc.registration")
+	c.upstream = upstream
+	c.startRegistrationTimeout()
+	c.startUpstreamWriter(upstream)
+	c.readUpstream()
+	c.writeWebircLines()
+	c.maybeSendPass()
+	c.maybeStartSasl()
+
+	lines := c.registrationLines
+	c.registrationLines = nil
+	for _, line := range lines {
+		c.processLineToUpstream(line)
+	}
+
+	return true
+}
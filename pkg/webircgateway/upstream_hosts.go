@@ -0,0 +1,172 @@
+package webircgateway
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UpstreamHosts - Spreads clients across the hosts of upstreams that have failover_hosts, and takes
+// hosts that keep failing out of use until a probe can connect to them again
+type UpstreamHosts struct {
+	gateway *Gateway
+	mu      sync.Mutex
+	// next - The round robin position of each upstream, by section name
+	next map[string]int
+	// health - By host address
+	health map[string]*upstreamHostHealth
+}
+
+type upstreamHostHealth struct {
+	failures int
+	ejected  bool
+}
+
+func NewUpstreamHosts(gateway *Gateway) *UpstreamHosts {
+	return &UpstreamHosts{
+		gateway: gateway,
+		next:    make(map[string]int),
+		health:  make(map[string]*upstreamHostHealth),
+	}
+}
+
+// upstreamHostList - Hostname followed by the failover hosts of an upstream
+func upstreamHostList(upstream ConfigUpstream) []ConfigUpstreamHost {
+	hosts := []ConfigUpstreamHost{{Address: upstreamAddrKey(upstream), Weight: upstream.HostWeight}}
+	return append(hosts, upstream.FailoverHosts...)
+}
+
+// Order - The addresses of an upstreams hosts in the order a client should try them. Ejected hosts
+// are left out unless they all are
+func (u *UpstreamHosts) Order(upstream ConfigUpstream) []string {
+	if len(upstream.FailoverHosts) == 0 {
+		return []string{upstreamAddrKey(upstream)}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	hosts := []ConfigUpstreamHost{}
+	for _, host := range upstreamHostList(upstream) {
+		if health := u.health[host.Address]; health == nil || !health.ejected {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		hosts = upstreamHostList(upstream)
+	}
+
+	first := 0
+	switch upstream.Balance {
+	case "round_robin":
+		first = u.next[upstream.sectionName] % len(hosts)
+		u.next[upstream.sectionName] = first + 1
+
+	case "weighted":
+		totalWeight := 0
+		for _, host := range hosts {
+			totalWeight += host.Weight
+		}
+		// Hosts with a weight of 0 only take clients when others fail
+		if totalWeight > 0 {
+			pick := rand.Intn(totalWeight)
+			for i, host := range hosts {
+				pick -= host.Weight
+				if pick < 0 {
+					first = i
+					break
+				}
+			}
+		}
+	}
+
+	// Continue through the hosts after the chosen one so that failing over is spread out too
+	addresses := []string{}
+	for i := range hosts {
+		addresses = append(addresses, hosts[(first+i)%len(hosts)].Address)
+	}
+
+	return addresses
+}
+
+// Failed - Record a failed connection to one of an upstreams hosts, ejecting it once it has
+// failed EjectAfter times in a row
+func (u *UpstreamHosts) Failed(upstream ConfigUpstream, address string) {
+	if len(upstream.FailoverHosts) == 0 || upstream.EjectAfter <= 0 {
+		return
+	}
+
+	u.mu.Lock()
+	health := u.health[address]
+	if health == nil {
+		health = &upstreamHostHealth{}
+		u.health[address] = health
+	}
+	health.failures++
+	failures := health.failures
+	eject := !health.ejected && failures >= upstream.EjectAfter
+	if eject {
+		health.ejected = true
+	}
+	u.mu.Unlock()
+
+	if eject {
+		u.gateway.Log(3, "Upstream host %s failed %d times in a row, not using it until it recovers", address, failures)
+		u.scheduleProbe(upstream, address)
+	}
+}
+
+// Succeeded - Record a client registering on a host
+func (u *UpstreamHosts) Succeeded(address string) {
+	u.mu.Lock()
+	delete(u.health, address)
+	u.mu.Unlock()
+}
+
+// scheduleProbe - Try connecting to an ejected host after EjectTime, putting it back in use if it
+// works and trying again later if not
+func (u *UpstreamHosts) scheduleProbe(upstream ConfigUpstream, address string) {
+	host, portStr, _ := net.SplitHostPort(address)
+	probeUpstream := upstream
+	probeUpstream.Hostname = host
+	probeUpstream.Port, _ = strconv.Atoi(portStr)
+
+	time.AfterFunc(time.Second*time.Duration(upstream.EjectTime), func() {
+		u.mu.Lock()
+		health := u.health[address]
+		u.mu.Unlock()
+		// A client got through to it in the meantime
+		if health == nil || !health.ejected {
+			return
+		}
+
+		if !u.gateway.hasUpstreamHost(address) {
+			u.Succeeded(address)
+			return
+		}
+
+		if err := dialUpstreamProbe(u.gateway.dnsResolver, probeUpstream); err != nil {
+			u.gateway.Log(1, "Upstream host %s is still failing: %s", address, err.Error())
+			u.scheduleProbe(upstream, address)
+			return
+		}
+
+		u.gateway.Log(2, "Upstream host %s has recovered", address)
+		u.Succeeded(address)
+	})
+}
+
+// hasUpstreamHost - If a host is still in the config, so that it is worth probing
+func (s *Gateway) hasUpstreamHost(address string) bool {
+	for _, upstream := range s.Config.upstreams() {
+		for _, host := range upstreamHostList(upstream) {
+			if host.Address == address {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,203 @@
+package webircgateway
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// UpstreamPool - Keeps connections to upstreams open before any client needs them, so that new
+// clients don't have to wait for a connection to be made. Pooled connections have not sent
+// anything to the upstream so each client still registers itself.
+type UpstreamPool struct {
+	gateway *Gateway
+	mu      sync.Mutex
+	idle    map[string][]*pooledConn
+}
+
+// pooledConn - An idle upstream connection. Anything the upstream sends while idle (eg.
+// NOTICE AUTH lines) is buffered and read first once the connection is in use
+type pooledConn struct {
+	net.Conn
+	buffered bytes.Buffer
+	created  time.Time
+}
+
+func (p *pooledConn) Read(b []byte) (int, error) {
+	if p.buffered.Len() > 0 {
+		return p.buffered.Read(b)
+	}
+
+	return p.Conn.Read(b)
+}
+
+// alive - Check the connection hasn't been closed by the upstream, buffering anything it has sent
+func (p *pooledConn) alive() bool {
+	p.Conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer p.Conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 1024)
+	for {
+		n, err := p.Conn.Read(buf)
+		p.buffered.Write(buf[:n])
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+func NewUpstreamPool(gateway *Gateway) *UpstreamPool {
+	return &UpstreamPool{
+		gateway: gateway,
+		idle:    make(map[string][]*pooledConn),
+	}
+}
+
+// Run - Keep each upstreams pool topped up and discard stale connections forever
+func (p *UpstreamPool) Run() {
+	for {
+		wanted := make(map[string]bool)
+		for _, upstream := range p.gateway.Config.upstreams() {
+			if !poolable(upstream) {
+				continue
+			}
+
+			key := upstreamAddrKey(upstream)
+			wanted[key] = true
+			p.prune(key, time.Second*time.Duration(upstream.PreconnectMaxIdle))
+			p.fill(upstream)
+		}
+
+		// Close connections to upstreams that no longer want a pool, eg. after a config reload
+		p.mu.Lock()
+		for key, conns := range p.idle {
+			if !wanted[key] {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				delete(p.idle, key)
+			}
+		}
+		p.mu.Unlock()
+
+		time.Sleep(time.Second)
+	}
+}
+
+// poolable - Whether connections to the upstream can be made before a client needs one. Not when
+// the connection depends on the client, eg. the PROXY header or a client certificate that the
+// irc.client_certificate hook may choose for each client
+func poolable(upstream ConfigUpstream) bool {
+	if upstream.PreconnectPoolSize < 1 || upstream.Proxy != nil || upstream.ProxyProtocol || upstream.ClientCertFile != "" {
+		return false
+	}
+
+	return !upstream.TLS || len(hooksRegistered["irc.client_certificate"]) == 0
+}
+
+// Take - Get an idle connection to the upstream if one is available
+func (p *UpstreamPool) Take(upstream ConfigUpstream) (net.Conn, bool) {
+	if !poolable(upstream) {
+		return nil, false
+	}
+
+	key := upstreamAddrKey(upstream)
+
+	// Checking a connection reads from it, so they are taken one at a time instead of holding the
+	// pool while checking them
+	for {
+		conn := p.pop(key)
+		if conn == nil {
+			return nil, false
+		}
+		if conn.alive() {
+			return conn, true
+		}
+		conn.Close()
+	}
+}
+
+func (p *UpstreamPool) pop(key string) *pooledConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle[key]) == 0 {
+		return nil
+	}
+	conn := p.idle[key][0]
+	p.idle[key] = p.idle[key][1:]
+	return conn
+}
+
+func (p *UpstreamPool) prune(key string, maxIdle time.Duration) {
+	// Taken out of the pool while being checked so that clients don't wait on the checks, or take
+	// a connection while it is being read from
+	p.mu.Lock()
+	conns := p.idle[key]
+	delete(p.idle, key)
+	p.mu.Unlock()
+
+	keep := []*pooledConn{}
+	for _, conn := range conns {
+		if (maxIdle > 0 && time.Since(conn.created) > maxIdle) || !conn.alive() {
+			conn.Close()
+			continue
+		}
+		keep = append(keep, conn)
+	}
+
+	p.mu.Lock()
+	p.idle[key] = append(keep, p.idle[key]...)
+	p.mu.Unlock()
+}
+
+func (p *UpstreamPool) fill(upstream ConfigUpstream) {
+	key := upstreamAddrKey(upstream)
+
+	p.mu.Lock()
+	missing := upstream.PreconnectPoolSize - len(p.idle[key])
+	p.mu.Unlock()
+
+	for i := 0; i < missing; i++ {
+		conn, err := dialPooledUpstream(p.gateway.dnsResolver, upstream)
+		if err != nil {
+			p.gateway.Log(1, "Error preconnecting to upstream %s: %s", key, err.Error())
+			return
+		}
+
+		p.mu.Lock()
+		p.idle[key] = append(p.idle[key], &pooledConn{Conn: conn, created: time.Now()})
+		p.mu.Unlock()
+	}
+}
+
+func dialPooledUpstream(resolver *DNSResolver, upstream ConfigUpstream) (net.Conn, error) {
+	dialer := net.Dialer{}
+	dialer.Timeout = time.Second * time.Duration(upstream.Timeout)
+
+	conn, err := dialUpstreamConn(resolver, upstream, &dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	if upstream.TLS {
+		if upstream.TLSTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(time.Second * time.Duration(upstream.TLSTimeout)))
+		}
+		tlsConn := tls.Client(conn, upstreamTLSConfig(upstream))
+		err = tlsConn.Handshake()
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	return conn, nil
+}
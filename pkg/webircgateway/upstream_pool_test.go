@@ -0,0 +1,100 @@
+package webircgateway
+
+import (
+	"bufio"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpstreamPoolTake(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	gateway := newTestGateway(t, upstream.config("preconnect_pool = 2"))
+	pool := NewUpstreamPool(gateway)
+	upstreamConfig := gateway.Config.Upstreams[0]
+
+	pool.fill(upstreamConfig)
+	upstream.accept()
+	upstream.conn.Close()
+	upstream.accept()
+	upstream.send("NOTICE * :*** Looking up your hostname")
+
+	// The closed connection is skipped and what the open one was sent while idle is kept for
+	// whoever takes it
+	conn, ok := pool.Take(upstreamConfig)
+	if !ok {
+		t.Fatal("no connection was taken from the pool")
+	}
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "NOTICE * :*** Looking up your hostname\r\n" {
+		t.Errorf("read %q, %v", line, err)
+	}
+
+	if _, ok := pool.Take(upstreamConfig); ok {
+		t.Error("a second connection was taken from the pool")
+	}
+}
+
+func TestUpstreamPoolTakeWhilePruning(t *testing.T) {
+	upstream := newFakeUpstream(t)
+	gateway := newTestGateway(t, upstream.config("preconnect_pool = 5"))
+	pool := NewUpstreamPool(gateway)
+	upstreamConfig := gateway.Config.Upstreams[0]
+
+	pool.fill(upstreamConfig)
+	for i := 0; i < 5; i++ {
+		upstream.accept()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			pool.prune(upstreamAddrKey(upstreamConfig), 0)
+		}
+	}()
+
+	taken := 0
+	timeout := time.After(testTimeout)
+	for taken < 5 {
+		select {
+		case <-timeout:
+			t.Fatalf("only %d connections were taken", taken)
+		default:
+		}
+
+		if conn, ok := pool.Take(upstreamConfig); ok {
+			defer conn.Close()
+			taken++
+		}
+	}
+	wg.Wait()
+
+	if _, ok := pool.Take(upstreamConfig); ok {
+		t.Error("a connection was taken more than once")
+	}
+}
+
+func TestUpstreamPoolClientCertificateHook(t *testing.T) {
+	upstream := ConfigUpstream{PreconnectPoolSize: 2, TLS: true}
+	if !poolable(upstream) {
+		t.Fatal("TLS upstream is not poolable")
+	}
+
+	HookRegister("irc.client_certificate", func(hook *HookIrcClientCertificate) {})
+	t.Cleanup(func() { delete(hooksRegistered, "irc.client_certificate") })
+
+	// The hook may give each client its own certificate, which a preconnected connection has
+	// already done its handshake without
+	if poolable(upstream) {
+		t.Error("TLS upstream is poolable while the irc.client_certificate hook has callbacks")
+	}
+
+	upstream.TLS = false
+	if !poolable(upstream) {
+		t.Error("plaintext upstream is not poolable while the irc.client_certificate hook has callbacks")
+	}
+}
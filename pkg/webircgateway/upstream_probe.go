@@ -0,0 +1,140 @@
+package webircgateway
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UpstreamProbe - Periodically checks that upstreams required for readiness can be reached
+type UpstreamProbe struct {
+	gateway *Gateway
+	mu      sync.Mutex
+	states  map[string]*upstreamProbeState
+}
+
+type upstreamProbeState struct {
+	reachable bool
+	successes int
+	failures  int
+}
+
+func NewUpstreamProbe(gateway *Gateway) *UpstreamProbe {
+	return &UpstreamProbe{
+		gateway: gateway,
+		states:  make(map[string]*upstreamProbeState),
+	}
+}
+
+// Run - Probe the required upstreams forever
+func (p *UpstreamProbe) Run() {
+	for {
+		for _, upstream := range p.gateway.Config.upstreams() {
+			if upstream.RequiredForReady {
+				p.probe(upstream)
+			}
+		}
+
+		interval := p.gateway.Config.ReadinessInterval
+		if interval < 1 {
+			interval = 1
+		}
+		time.Sleep(time.Second * time.Duration(interval))
+	}
+}
+
+// IsReady - True if every upstream required for readiness is currently reachable
+func (p *UpstreamProbe) IsReady() bool {
+	upstreams := p.gateway.Config.upstreams()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, upstream := range upstreams {
+		if !upstream.RequiredForReady {
+			continue
+		}
+
+		state, exists := p.states[upstreamAddrKey(upstream)]
+		if !exists || !state.reachable {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsUnhealthy - True if the upstream has been probed and is currently failing
+func (p *UpstreamProbe) IsUnhealthy(upstream ConfigUpstream) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state, exists := p.states[upstreamAddrKey(upstream)]
+	return exists && !state.reachable && state.failures > 0
+}
+
+func (p *UpstreamProbe) probe(upstream ConfigUpstream) {
+	err := dialUpstreamProbe(p.gateway.dnsResolver, upstream)
+	key := upstreamAddrKey(upstream)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state, exists := p.states[key]
+	if !exists {
+		state = &upstreamProbeState{}
+		p.states[key] = state
+	}
+
+	// Only change state after several results in a row so that a single blip doesn't flap readiness
+	if err == nil {
+		state.failures = 0
+		state.successes++
+		if !state.reachable && state.successes >= p.gateway.Config.ReadinessRise {
+			state.reachable = true
+			p.gateway.Log(2, "Upstream %s is reachable", key)
+		}
+	} else {
+		state.successes = 0
+		state.failures++
+		if state.reachable && state.failures >= p.gateway.Config.ReadinessFall {
+			state.reachable = false
+			p.gateway.Log(3, "Upstream %s is unreachable: %s", key, err.Error())
+		}
+	}
+}
+
+func dialUpstreamProbe(resolver *DNSResolver, upstream ConfigUpstream) error {
+	dialer := net.Dialer{}
+	dialer.Timeout = time.Second * time.Duration(upstream.Timeout)
+
+	var conn net.Conn
+	var err error
+	if upstream.Proxy != nil {
+		conn, err = resolver.Dial(&dialer, "tcp", net.JoinHostPort(upstream.Proxy.Hostname, strconv.Itoa(upstream.Proxy.Port)))
+	} else {
+		conn, err = dialUpstreamConn(resolver, upstream, &dialer)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if upstream.TLS && upstream.Proxy == nil {
+		conn.SetDeadline(time.Now().Add(dialer.Timeout))
+		tlsConn := tls.Client(conn, upstreamTLSConfig(upstream))
+		err = tlsConn.Handshake()
+	}
+
+	return err
+}
+
+func upstreamAddrKey(upstream ConfigUpstream) string {
+	if upstream.Network == "unix" {
+		return "unix:" + upstream.Hostname
+	}
+
+	return net.JoinHostPort(upstream.Hostname, strconv.Itoa(upstream.Port))
+}
@@ -0,0 +1,221 @@
+package webircgateway
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// How many times a reconnecting client may try another nick while its own is still in use
+const reconnectNickAttempts = 5
+
+// upstreamReconnect - A registered client being connected to its upstream again after the upstream
+// dropped it. The client stays connected to the gateway and the new registration is hidden from it
+type upstreamReconnect struct {
+	attempts int
+	// timer - Set while waiting to make the next attempt
+	timer *time.Timer
+	// nick / channels - What the client had before being dropped, restored once registered again
+	nick     string
+	channels []ConfigChannel
+	// nickAttempts - Nicks tried after 433s while registering again
+	nickAttempts int
+}
+
+// Ready - Fires when the next attempt is due. A nil reconnect is never ready
+func (r *upstreamReconnect) Ready() <-chan time.Time {
+	if r == nil || r.timer == nil {
+		return nil
+	}
+
+	return r.timer.C
+}
+
+// reconnectDelay - Exponential backoff from reconnect_delay up to reconnect_max_delay, with a
+// random jitter so that clients dropped together don't all come back at once
+func reconnectDelay(upstream *ConfigUpstream, attempt int) time.Duration {
+	delay := time.Second * time.Duration(upstream.ReconnectDelay)
+	maxDelay := time.Second * time.Duration(upstream.ReconnectMaxDelay)
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	// Somewhere between half and all of the delay
+	half := int64(delay / 2)
+	if half > 0 {
+		delay = time.Duration(half + rand.Int63n(half+1))
+	}
+
+	return delay
+}
+
+// maybeScheduleReconnect - Wait to connect to the upstream again after it closed the connection, if
+// the upstream is configured to. Returns false if the client should be closed instead
+func (c *Client) maybeScheduleReconnect() bool {
+	upstream := c.UpstreamConfig
+	if upstream.ReconnectAttempts <= 0 || c.SeenQuit || c.forcedDisconnect != "" || c.IsShuttingDown() {
+		return false
+	}
+	// Only clients that had registered, or were registering again
+	if c.State != ClientStateConnected && c.reconnect == nil {
+		return false
+	}
+	if len(c.reconnectLines) == 0 {
+		return false
+	}
+
+	if c.reconnect == nil {
+		c.reconnect = &upstreamReconnect{nick: c.IrcState.Nick}
+		for _, name := range c.IrcState.ChannelNames() {
+			c.reconnect.channels = append(c.reconnect.channels, ConfigChannel{
+				Name: name,
+				Key:  c.channelKeys[strings.ToLower(name)],
+			})
+		}
+		c.IrcState.ClearChannels()
+	}
+
+	r := c.reconnect
+	if r.attempts >= upstream.ReconnectAttempts {
+		c.LogEvent(3, "upstream.reconnect_failed", "Gave up reconnecting to upstream %s after %d attempts", upstreamAddrKey(*upstream), r.attempts)
+		return false
+	}
+
+	delay := reconnectDelay(upstream, r.attempts)
+	r.attempts++
+	r.timer = time.NewTimer(delay)
+	c.State = ClientStateConnecting
+	// Nothing more comes from the closed connection. reconnectUpstream makes a new channel
+	c.UpstreamRecv = nil
+
+	c.LogEvent(2, "upstream.reconnecting", "Upstream %s closed the connection, reconnecting in %s (attempt %d)", upstreamAddrKey(*upstream), delay.Round(time.Second).String(), r.attempts)
+	c.sendReconnectNotice(fmt.Sprintf("Lost the connection to the IRC server, reconnecting in %d seconds", int(delay.Round(time.Second).Seconds())))
+	return true
+}
+
+// reconnectNow - Connect to the upstream again and replay the clients registration. Returns false
+// if the client should be closed
+func (c *Client) reconnectNow() bool {
+	r := c.reconnect
+	r.timer = nil
+	if c.SeenQuit || c.IsShuttingDown() {
+		return false
+	}
+
+	c.State = ClientStateRegistering
+	c.startFailover()
+	c.webircPasswords = c.Gateway.webircPasswords.Candidates(*c.UpstreamConfig)
+	if len(c.webircPasswords) > 0 {
+		c.UpstreamConfig.WebircPassword = c.webircPasswords[0]
+	}
+
+	// Register with the nick the client had rather than the one it first asked for
+	c.registrationLines = nil
+	for _, line := range c.reconnectLines {
+		if strings.HasPrefix(strings.ToUpper(line), "NICK ") {
+			line = "NICK " + r.nick
+		}
+		c.registrationLines = append(c.registrationLines, line)
+	}
+
+	if !c.reconnectUpstream() {
+		return c.maybeScheduleReconnect()
+	}
+
+	return true
+}
+
+// handleReconnectFromUpstream - Hide the new registration from the client, which has already seen
+// one. Returns true if the line should not be passed on to the client
+func (c *Client) handleReconnectFromUpstream(m *irc.Message) bool {
+	r := c.reconnect
+	if r == nil || r.timer != nil {
+		return false
+	}
+
+	switch m.Command {
+	case "PING":
+		// Some IRCds need a PONG before registering
+		c.SendUpstream("PONG :" + m.GetParam(0, ""))
+	case "433":
+		// The dropped connection may not have timed out on the network yet
+		r.nickAttempts++
+		if r.nickAttempts > reconnectNickAttempts {
+			c.abandonReconnect("Nickname is already in use")
+			break
+		}
+		c.SendUpstream("NICK " + m.GetParam(1, r.nick) + "_")
+	case "432", "465":
+		// Erroneous nickname or banned, trying again would get the same
+		c.abandonReconnect(m.GetParam(len(m.Params)-1, m.Command))
+	case "ERROR":
+		c.abandonReconnect(m.GetParam(0, "Closing link"))
+	case "376", "422":
+		c.finishReconnect()
+	}
+
+	return true
+}
+
+// abandonReconnect - The upstream refused the new registration. The client is told why and closed
+// once the upstream connection has been
+func (c *Client) abandonReconnect(reason string) {
+	c.reconnect = nil
+
+	c.LogEvent(3, "upstream.reconnect_failed", "Upstream %s refused the reconnection: %s", upstreamAddrKey(*c.UpstreamConfig), reason)
+	c.sendReconnectNotice("Could not reconnect to the IRC server: " + reason)
+	if upstream := c.upstream; upstream != nil {
+		upstream.Close()
+	}
+}
+
+// finishReconnect - Tell the client it is back on the network and restore its nick and channels
+func (c *Client) finishReconnect() {
+	r := c.reconnect
+	c.reconnect = nil
+
+	c.LogEvent(2, "upstream.reconnected", "Reconnected to upstream %s", upstreamAddrKey(*c.UpstreamConfig))
+	c.sendReconnectNotice("Reconnected to the IRC server")
+
+	if !strings.EqualFold(c.IrcState.Nick, r.nick) {
+		nick := irc.NewMessage()
+		nick.Prefix = &irc.Mask{Nick: r.nick}
+		nick.Command = "NICK"
+		nick.Params = []string{c.IrcState.Nick}
+		c.SendClientSignal("data", nick.ToLine())
+	}
+
+	if len(r.channels) > 0 {
+		c.processLineToUpstream(joinLine(r.channels))
+	}
+}
+
+// dropForReconnect - Lines from the client are dropped while waiting to reconnect. A QUIT ends the
+// session instead of waiting. Returns true if the line was dropped
+func (c *Client) dropForReconnect(line string) bool {
+	if c.reconnect == nil || c.reconnect.timer == nil {
+		return false
+	}
+
+	if strings.HasPrefix(strings.ToUpper(line), "QUIT") {
+		c.SeenQuit = true
+		c.reconnect.timer.Stop()
+		c.SendClientSignal("state", "closed")
+		c.StartShutdown("client_quit")
+	}
+
+	return true
+}
+
+func (c *Client) sendReconnectNotice(text string) {
+	notice := irc.NewMessage()
+	notice.Command = "NOTICE"
+	notice.Params = []string{c.IrcState.Nick, text}
+	c.SendClientSignal("data", notice.ToLine())
+}
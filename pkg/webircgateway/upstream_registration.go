@@ -0,0 +1,48 @@
+package webircgateway
+
+import (
+	"time"
+)
+
+// startRegistrationTimeout - Give the upstream just connected to registration_timeout to send
+// RPL_WELCOME. One that accepts the connection but never registers the client would otherwise
+// leave it waiting forever instead of moving on to a failover host or reconnecting
+func (c *Client) startRegistrationTimeout() {
+	c.stopRegistrationTimeout()
+	if c.UpstreamConfig.RegistrationTimeout <= 0 {
+		return
+	}
+
+	c.registrationTimer = time.NewTimer(time.Duration(c.UpstreamConfig.RegistrationTimeout) * time.Second)
+}
+
+func (c *Client) stopRegistrationTimeout() {
+	if c.registrationTimer != nil {
+		c.registrationTimer.Stop()
+		c.registrationTimer = nil
+	}
+}
+
+// registrationTimeout - Fires once the upstream has taken too long to register the client. nil,
+// so never fires, when not registering
+func (c *Client) registrationTimeout() <-chan time.Time {
+	if c.registrationTimer == nil {
+		return nil
+	}
+
+	return c.registrationTimer.C
+}
+
+// upstreamRegistrationTimedOut - Close the upstream connection so that it is handled as an
+// upstream that closed during registration, trying the next failover host or reconnecting
+func (c *Client) upstreamRegistrationTimedOut() {
+	c.registrationTimer = nil
+	upstream := c.upstream
+	if c.State != ClientStateRegistering || upstream == nil {
+		return
+	}
+
+	c.LogEvent(3, "upstream.error", "Upstream %s did not complete registration within %d seconds", upstreamAddrKey(*c.UpstreamConfig), c.UpstreamConfig.RegistrationTimeout)
+	c.registrationSpan.EndWithError("registration timeout")
+	upstream.Close()
+}
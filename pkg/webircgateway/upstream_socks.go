@@ -0,0 +1,90 @@
+package webircgateway
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// dialUpstreamConn - Open the connection to an upstream, through its SOCKS5 proxy if it has one.
+// The hostname is resolved by the proxy so that it works where the gateway has no DNS of its own,
+// otherwise by resolver
+func dialUpstreamConn(resolver *DNSResolver, upstream ConfigUpstream, dialer *net.Dialer) (net.Conn, error) {
+	if upstream.Network == "unix" {
+		return dialer.Dial("unix", upstream.Hostname)
+	}
+
+	addr := net.JoinHostPort(upstream.Hostname, strconv.Itoa(upstream.Port))
+	if upstream.Socks5Address == "" {
+		return resolver.Dial(dialer, "tcp", addr)
+	}
+
+	var auth *proxy.Auth
+	if upstream.Socks5Username != "" {
+		auth = &proxy.Auth{User: upstream.Socks5Username, Password: upstream.Socks5Password}
+	}
+
+	socksDialer, err := proxy.SOCKS5("tcp", upstream.Socks5Address, auth, dialer)
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := socksDialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("socks5 dialer does not support timeouts")
+	}
+
+	// The timeout covers the proxy handshake as well as connecting to the proxy
+	ctx := context.Background()
+	if dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+		defer cancel()
+	}
+
+	return contextDialer.DialContext(ctx, "tcp", addr)
+}
+
+// isOnionHostname - If a hostname is a Tor hidden service
+func isOnionHostname(hostname string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(strings.ToLower(hostname), "."), ".onion")
+}
+
+// routeOnionUpstreams - Connect to .onion upstreams through Tor unless they have their own socks5
+// proxy, which must then be Tor
+func (c *Config) routeOnionUpstreams() {
+	route := func(upstream *ConfigUpstream) {
+		if upstream.Network != "tcp" || !isOnionHostname(upstream.Hostname) {
+			return
+		}
+		upstream.Onion = true
+		if upstream.Socks5Address == "" {
+			upstream.Socks5Address = c.TorSocksAddress
+		}
+	}
+
+	for i := range c.Upstreams {
+		route(&c.Upstreams[i])
+		if c.Upstreams[i].Fallback != nil {
+			route(c.Upstreams[i].Fallback)
+		}
+	}
+}
+
+// onionUpstreamsOnly - If clients can only be connected to .onion upstreams
+func (c *Config) onionUpstreamsOnly() bool {
+	if c.Gateway || len(c.Upstreams) == 0 {
+		return false
+	}
+
+	for _, upstream := range c.Upstreams {
+		if !upstream.Onion {
+			return false
+		}
+	}
+
+	return true
+}
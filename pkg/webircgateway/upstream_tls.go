@@ -0,0 +1,110 @@
+package webircgateway
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// upstreamTLSPin - A certificate the upstream must present. Either the SHA-256 of its public key
+// (SPKI), or the SHA-256 fingerprint of the whole certificate as given by openssl and CertFP
+type upstreamTLSPin struct {
+	spki   bool
+	digest []byte
+}
+
+// parseUpstreamTLSPin - Parse a tls_pin value. sha256/<base64> pins the public key, a hex
+// fingerprint with or without colons pins the certificate
+func parseUpstreamTLSPin(pin string) (upstreamTLSPin, error) {
+	pin = strings.TrimSpace(pin)
+
+	if strings.HasPrefix(strings.ToLower(pin), "sha256/") {
+		digest, err := base64.StdEncoding.DecodeString(pin[7:])
+		if err != nil || len(digest) != sha256.Size {
+			return upstreamTLSPin{}, errors.New("invalid sha256/ public key pin")
+		}
+		return upstreamTLSPin{spki: true, digest: digest}, nil
+	}
+
+	digest, err := hex.DecodeString(strings.Replace(pin, ":", "", -1))
+	if err != nil || len(digest) != sha256.Size {
+		return upstreamTLSPin{}, errors.New("invalid SHA-256 certificate fingerprint")
+	}
+	return upstreamTLSPin{digest: digest}, nil
+}
+
+func (p upstreamTLSPin) matches(cert *x509.Certificate) bool {
+	if p.spki {
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		return bytes.Equal(digest[:], p.digest)
+	}
+
+	digest := sha256.Sum256(cert.Raw)
+	return bytes.Equal(digest[:], p.digest)
+}
+
+// loadUpstreamCA - Read the PEM encoded certificates trusted for an upstream's TLS
+func (c *Config) loadUpstreamCA(sectionName string, path string) *x509.CertPool {
+	pemData, err := ioutil.ReadFile(path)
+	if err != nil {
+		c.gateway.Log(3, "Config section %s tls_ca_file could not be read: %s", sectionName, err.Error())
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		c.gateway.Log(3, "Config section %s tls_ca_file %s has no PEM encoded certificates", sectionName, path)
+		return nil
+	}
+
+	return pool
+}
+
+// upstreamTLSConfig - The TLS config for connecting to an upstream. Without tls_verify any
+// certificate is accepted unless it is pinned
+func upstreamTLSConfig(upstream ConfigUpstream) *tls.Config {
+	serverName := upstream.TLSServerName
+	if serverName == "" {
+		serverName = upstream.Hostname
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: !upstream.TLSVerify,
+		RootCAs:            upstream.TLSRootCAs,
+	}
+
+	if len(upstream.TLSPins) > 0 {
+		pins := upstream.TLSPins
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			// Only the verified chains can be trusted to belong together. Without verification the
+			// upstream has only proven that it holds the key of its own certificate
+			certs := []*x509.Certificate{}
+			if len(state.VerifiedChains) > 0 {
+				for _, chain := range state.VerifiedChains {
+					certs = append(certs, chain...)
+				}
+			} else if len(state.PeerCertificates) > 0 {
+				certs = append(certs, state.PeerCertificates[0])
+			}
+
+			for _, cert := range certs {
+				for _, pin := range pins {
+					if pin.matches(cert) {
+						return nil
+					}
+				}
+			}
+
+			return errors.New("the upstream certificate does not match any tls_pin")
+		}
+	}
+
+	return tlsConfig
+}
@@ -2,6 +2,7 @@ package webircgateway
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"strings"
@@ -43,9 +44,55 @@ func makeClientReplacements(format string, client *Client) string {
 	ret = strings.Replace(ret, "%i", Ipv4ToHex(client.RemoteAddr), -1)
 	ret = strings.Replace(ret, "%h", client.RemoteHostname, -1)
 	ret = strings.Replace(ret, "%n", client.IrcState.Nick, -1)
+	ret = strings.Replace(ret, "%u", client.IrcState.Username, -1)
+	ret = strings.Replace(ret, "%g", client.IrcState.RealName, -1)
+	ret = strings.Replace(ret, "%o", client.OriginHost, -1)
+	ret = makeClaimReplacements(ret, client)
 	return ret
 }
 
+// redactSecret - Hide every occurrence of a secret in a line before it is logged. The whole line is
+// searched rather than a single field so that the secret can't leak if the line's format changes
+func redactSecret(line string, secret string) string {
+	if secret == "" {
+		return line
+	}
+
+	return strings.Replace(line, secret, "<redacted>", -1)
+}
+
+// stripLineBreaks - Remove anything that could end an IRC line early
+func stripLineBreaks(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == 0 {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionSSL30: "SSL3.0",
+	tls.VersionTLS10: "TLS1.0",
+	tls.VersionTLS11: "TLS1.1",
+	tls.VersionTLS12: "TLS1.2",
+	tls.VersionTLS13: "TLS1.3",
+}
+
+// tlsStateNames - Readable names for the TLS version and cipher suite of a connection
+func tlsStateNames(state *tls.ConnectionState) (version string, cipher string) {
+	if state == nil {
+		return "", ""
+	}
+
+	version, exists := tlsVersionNames[state.Version]
+	if !exists {
+		version = fmt.Sprintf("0x%04x", state.Version)
+	}
+
+	return version, tls.CipherSuiteName(state.CipherSuite)
+}
+
 func Ipv4ToHex(ip string) string {
 	var ipParts [4]int
 	fmt.Sscanf(ip, "%d.%d.%d.%d", &ipParts[0], &ipParts[1], &ipParts[2], &ipParts[3])
@@ -94,6 +141,16 @@ func containsOneOf(s string, substrs []string) bool {
 	return false
 }
 
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
 type ThrottledStringChannel struct {
 	in     chan string
 	Input  chan<- string
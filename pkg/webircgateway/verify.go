@@ -0,0 +1,91 @@
+package webircgateway
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/kiwiirc/webircgateway/pkg/recaptcha"
+)
+
+// captchaVerifyURL - The API a provider's captcha responses are verified against. Empty if the
+// provider is unknown
+func captchaVerifyURL(provider string) string {
+	switch provider {
+	case "recaptcha":
+		return "https://www.google.com/recaptcha/api/siteverify"
+	case "hcaptcha":
+		return "https://hcaptcha.com/siteverify"
+	case "turnstile":
+		return "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+	}
+
+	return ""
+}
+
+// isVerifyExempt - If an IP is in one of the [verify.exempt] ranges and never needs to pass a captcha
+func (s *Gateway) isVerifyExempt(ip net.IP) bool {
+	for _, cidrRange := range s.Config.VerifyExempt {
+		if cidrRange.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyHandshake - Verify the captcha response sent with a transport handshake as the captcha
+// query parameter, when [verify] handshake is enabled. Returns true if the client is verified, or
+// an error if verification is required and the response is missing or invalid
+func (s *Gateway) verifyHandshake(req *http.Request) (bool, error) {
+	remoteIP := s.GetRemoteAddressFromRequest(req)
+	if s.isVerifyExempt(remoteIP) {
+		return true, nil
+	}
+
+	if !s.Config.RequiresVerification || !s.Config.VerifyHandshake {
+		return false, nil
+	}
+
+	response := req.URL.Query().Get("captcha")
+	if response == "" {
+		return false, errors.New("no captcha response")
+	}
+
+	if verified, errorCodes := s.verifyCaptcha(nil, remoteIP.String(), response); !verified {
+		return false, fmt.Errorf("invalid captcha response (%s)", strings.Join(errorCodes, ", "))
+	}
+
+	return true, nil
+}
+
+// verifyCaptcha - Verify a captcha response with the provider, letting captcha.verify hooks inspect
+// the result. client is nil when verifying a websocket handshake. Returns if the response was
+// accepted, and the provider's error codes if not
+func (s *Gateway) verifyCaptcha(client *Client, remoteAddr string, response string) (bool, []string) {
+	captcha := recaptcha.R{
+		URL:      s.Config.ReCaptchaURL,
+		Secret:   s.Config.ReCaptchaSecret,
+		RemoteIP: remoteAddr,
+	}
+
+	hook := &HookCaptchaVerify{
+		Client:     client,
+		RemoteAddr: remoteAddr,
+		Provider:   s.Config.CaptchaProvider,
+		Result:     captcha.Verify(response),
+	}
+	hook.Verified = hook.Result.Success
+	hookSpan := client.traceHook("captcha.verify")
+	hook.Dispatch("captcha.verify")
+	hookSpan.End()
+
+	errorCodes := captcha.LastError()
+	if !hook.Verified && len(errorCodes) == 0 {
+		errorCodes = []string{"rejected by hook"}
+	}
+
+	return hook.Verified, errorCodes
+}
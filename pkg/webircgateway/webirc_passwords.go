@@ -0,0 +1,95 @@
+package webircgateway
+
+import (
+	"sync"
+)
+
+// Lines sent upstream during registration that are kept for trying another WEBIRC password or
+// failover host
+const maxRegistrationLines = 100
+
+// WebircPasswords - Remembers which of an upstreams WEBIRC passwords it last accepted, so that
+// while passwords are being rotated new clients try that one first instead of being rejected
+type WebircPasswords struct {
+	mu       sync.Mutex
+	accepted map[string]string
+}
+
+func NewWebircPasswords() *WebircPasswords {
+	return &WebircPasswords{accepted: make(map[string]string)}
+}
+
+// Candidates - The WEBIRC passwords to try for an upstream in order. The last accepted one comes
+// first, followed by webirc and then webirc_fallback
+func (w *WebircPasswords) Candidates(upstream ConfigUpstream) []string {
+	passwords := []string{}
+	if upstream.WebircPassword != "" {
+		passwords = append(passwords, upstream.WebircPassword)
+	}
+	for _, password := range upstream.WebircFallbacks {
+		if password != "" && !stringInSlice(password, passwords) {
+			passwords = append(passwords, password)
+		}
+	}
+
+	if len(passwords) < 2 {
+		return passwords
+	}
+
+	w.mu.Lock()
+	accepted := w.accepted[upstreamAddrKey(upstream)]
+	w.mu.Unlock()
+
+	if !stringInSlice(accepted, passwords) {
+		return passwords
+	}
+
+	ordered := []string{accepted}
+	for _, password := range passwords {
+		if password != accepted {
+			ordered = append(ordered, password)
+		}
+	}
+
+	return ordered
+}
+
+// Accepted - Record that the upstream accepted a WEBIRC password
+func (w *WebircPasswords) Accepted(upstream ConfigUpstream, password string) {
+	if len(upstream.WebircFallbacks) == 0 {
+		return
+	}
+
+	w.mu.Lock()
+	w.accepted[upstreamAddrKey(upstream)] = password
+	w.mu.Unlock()
+}
+
+// retryWebirc - Connect to the upstream again with the next WEBIRC password after it rejected the
+// last one. Returns false if the client could not be connected again
+func (c *Client) retryWebirc() bool {
+	c.webircPasswords = c.webircPasswords[1:]
+	c.UpstreamConfig.WebircPassword = c.webircPasswords[0]
+	c.Log(2, "Connecting to upstream %s again with the next WEBIRC password", upstreamAddrKey(*c.UpstreamConfig))
+
+	return c.reconnectUpstream()
+}
+
+// recordRegistrationLine - Keep a line sent upstream during registration in case another WEBIRC
+// password or failover host needs to be tried, or to reconnect with later
+func (c *Client) recordRegistrationLine(line string) {
+	canReconnect := len(c.webircPasswords) > 1 || len(c.failoverHosts) > 0 || c.UpstreamConfig.ReconnectAttempts > 0
+	if c.State != ClientStateRegistering || !canReconnect {
+		return
+	}
+
+	// Too much to replay, give up on trying another password or host
+	if len(c.registrationLines) >= maxRegistrationLines {
+		c.webircPasswords = c.webircPasswords[:1]
+		c.failoverHosts = nil
+		c.registrationLines = nil
+		return
+	}
+
+	c.registrationLines = append(c.registrationLines, line)
+}
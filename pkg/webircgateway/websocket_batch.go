@@ -0,0 +1,90 @@
+package webircgateway
+
+import (
+	"strings"
+	"time"
+)
+
+// websocketBatcher - Reads the signals of a websocket client, coalescing lines that are queued
+// behind each other into one data signal of \r\n separated lines so they are sent as a single
+// message, eg. during channel floods and netsplits. A line that arrives on an empty queue is
+// passed on as it is
+type websocketBatcher struct {
+	signals <-chan ClientSignal
+	// maxSize - Bytes of lines in a batch, 0 to not batch
+	maxSize int
+	// interval - How long a batch waits for more lines once the queue has backed up
+	interval time.Duration
+	// held - A signal read while batching that belongs after the batch
+	held   *ClientSignal
+	closed bool
+}
+
+func newWebsocketBatcher(signals <-chan ClientSignal, maxSize int, interval time.Duration) *websocketBatcher {
+	return &websocketBatcher{
+		signals:  signals,
+		maxSize:  maxSize,
+		interval: interval,
+	}
+}
+
+// next - The next signal, false once the signals have closed
+func (b *websocketBatcher) next() (ClientSignal, bool) {
+	if b.held != nil {
+		signal := *b.held
+		b.held = nil
+		return signal, true
+	}
+	if b.closed {
+		return ClientSignal{}, false
+	}
+
+	signal, ok := <-b.signals
+	if !ok || signal[0] != "data" || b.maxSize <= 0 {
+		return signal, ok
+	}
+
+	lines := []string{strings.Trim(signal[1], "\r\n")}
+	size := len(lines[0])
+	var timeout *time.Timer
+
+	for size < b.maxSize {
+		var more ClientSignal
+		select {
+		case more, ok = <-b.signals:
+		default:
+			// A lone line isn't held back waiting for others
+			if len(lines) == 1 || b.interval <= 0 {
+				return b.batch(lines), true
+			}
+			if timeout == nil {
+				timeout = time.NewTimer(b.interval)
+				defer timeout.Stop()
+			}
+			select {
+			case more, ok = <-b.signals:
+			case <-timeout.C:
+				return b.batch(lines), true
+			}
+		}
+
+		if !ok {
+			b.closed = true
+			break
+		}
+
+		line := strings.Trim(more[1], "\r\n")
+		if more[0] != "data" || size+2+len(line) > b.maxSize {
+			b.held = &more
+			break
+		}
+		lines = append(lines, line)
+		size += 2 + len(line)
+	}
+
+	return b.batch(lines), true
+}
+
+func (b *websocketBatcher) batch(lines []string) ClientSignal {
+	return ClientSignal{"data", strings.Join(lines, "\r\n")}
+}
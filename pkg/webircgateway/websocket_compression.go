@@ -0,0 +1,105 @@
+package webircgateway
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/igm/sockjs-go/sockjs"
+)
+
+// offersDeflate - If the websocket handshake offers permessage-deflate, which is then negotiated
+// when compression is enabled
+func offersDeflate(req *http.Request) bool {
+	for _, header := range req.Header["Sec-Websocket-Extensions"] {
+		for _, ext := range strings.Split(header, ",") {
+			name := strings.TrimSpace(strings.SplitN(ext, ";", 2)[0])
+			if strings.EqualFold(name, "permessage-deflate") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// sockjsOptions - The sockjs options of the sockjs and kiwiirc transports. Their websockets are
+// compressed with the default level as sockjs doesn't give access to the connections
+func (s *Gateway) sockjsOptions() sockjs.Options {
+	opts := sockjs.DefaultOptions
+	if s.Config.WebsocketCompression {
+		opts.WebsocketUpgrader = &websocket.Upgrader{
+			ReadBufferSize:    sockjs.WebSocketReadBufSize,
+			WriteBufferSize:   sockjs.WebSocketWriteBufSize,
+			EnableCompression: true,
+			WriteBufferPool:   websocketWriteBufferPool,
+			// The transports check origins themselves, as sockjs does without an upgrader
+			CheckOrigin: func(req *http.Request) bool { return true },
+		}
+	}
+
+	return opts
+}
+
+// wireCounter - Counts the bytes read and written on a websocket connection, being the size of
+// the messages after compression. Reads are buffered by the websocket library so the bytes read
+// while reading one message may belong to the next
+type wireCounter struct {
+	net.Conn
+	read    uint64
+	written uint64
+}
+
+func (c *wireCounter) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.read, uint64(n))
+	return n, err
+}
+
+func (c *wireCounter) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+// bytesRead - 0 for a nil counter, when the connection isn't compressed
+func (c *wireCounter) bytesRead() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.read)
+}
+
+func (c *wireCounter) bytesWritten() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.written)
+}
+
+// countingResponseWriter - Hands the websocket upgrader a connection counted by counter when
+// it hijacks the connection
+type countingResponseWriter struct {
+	http.ResponseWriter
+	counter *wireCounter
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The upgrader refuses connections with data already buffered so reads can start afresh
+	w.counter.Conn = conn
+	return w.counter, bufio.NewReadWriter(bufio.NewReader(w.counter), rw.Writer), nil
+}
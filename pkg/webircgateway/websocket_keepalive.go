@@ -0,0 +1,104 @@
+package webircgateway
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocketKeepalive - Pings websocket clients and closes those that stop answering or go idle,
+// as set by the ping_interval, pong_timeout and idle_timeout options of their [server.*] block.
+// Both timeouts are the read deadline of the connection, whichever is sooner
+type websocketKeepalive struct {
+	ws   *websocket.Conn
+	conf ConfigServer
+
+	mu sync.Mutex
+	// idleDeadline / pongDeadline - Zero when not set
+	idleDeadline time.Time
+	pongDeadline time.Time
+}
+
+func newWebsocketKeepalive(ws *websocket.Conn, conf ConfigServer) *websocketKeepalive {
+	k := &websocketKeepalive{ws: ws, conf: conf}
+
+	ws.SetPongHandler(func(string) error {
+		k.mu.Lock()
+		k.pongDeadline = time.Time{}
+		k.updateDeadline()
+		k.mu.Unlock()
+		return nil
+	})
+
+	k.received()
+	return k
+}
+
+// received - The client has sent a message so it isn't idle
+func (k *websocketKeepalive) received() {
+	if k.conf.WebsocketIdleTimeout <= 0 {
+		return
+	}
+
+	k.mu.Lock()
+	k.idleDeadline = time.Now().Add(time.Second * time.Duration(k.conf.WebsocketIdleTimeout))
+	k.updateDeadline()
+	k.mu.Unlock()
+}
+
+// updateDeadline - Must be called with mu held
+func (k *websocketKeepalive) updateDeadline() {
+	deadline := k.idleDeadline
+	if !k.pongDeadline.IsZero() && (deadline.IsZero() || k.pongDeadline.Before(deadline)) {
+		deadline = k.pongDeadline
+	}
+
+	k.ws.SetReadDeadline(deadline)
+}
+
+// run - Ping the client until done is closed
+func (k *websocketKeepalive) run(client *Client, done <-chan struct{}) {
+	if k.conf.WebsocketPingInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second * time.Duration(k.conf.WebsocketPingInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		// An unanswered ping keeps its deadline so that further pings don't extend it
+		if k.conf.WebsocketPongTimeout > 0 {
+			k.mu.Lock()
+			if k.pongDeadline.IsZero() {
+				k.pongDeadline = time.Now().Add(time.Second * time.Duration(k.conf.WebsocketPongTimeout))
+				k.updateDeadline()
+			}
+			k.mu.Unlock()
+		}
+
+		err := k.ws.WriteControl(websocket.PingMessage, nil, client.transportWriteDeadline())
+		if err != nil {
+			// The reader sees the connection fail and closes the client
+			client.Log(1, "Websocket ping failed (%s)", err.Error())
+			return
+		}
+	}
+}
+
+// timeoutReason - Why the read deadline was reached, to tell the client as it is closed
+func (k *websocketKeepalive) timeoutReason() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.pongDeadline.IsZero() && !time.Now().Before(k.pongDeadline) {
+		return "ping timeout"
+	}
+	return "idle timeout"
+}
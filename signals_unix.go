@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals that reopen the log files, eg. from logrotate
+var logReopenSignals = []os.Signal{syscall.SIGUSR1}
+
+// Signals that upgrade to a new process, passing it the listening sockets
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
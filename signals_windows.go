@@ -0,0 +1,9 @@
+package main
+
+import "os"
+
+// SIGUSR1 doesn't exist on windows. Log files are only reopened on SIGHUP
+var logReopenSignals = []os.Signal{}
+
+// Upgrading by passing listeners to a new process isn't supported on windows
+var upgradeSignals = []os.Signal{}